@@ -0,0 +1,95 @@
+package catapult
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// sidecarStem returns the name of the acquisition a sidecar belongs to, which is its name without the longest
+// matching sidecar extension.
+//
+// Parameters:
+// - name: The name of the file.
+//
+// Returns:
+// - string: The name of the acquisition.
+// - bool: True if the name has one of the sidecar extensions of the configuration.
+func (cfg Configuration) sidecarStem(name string) (string, bool) {
+	stem := ""
+	for _, ext := range cfg.SidecarExtensions {
+		if ext == "" || len(name) <= len(ext) || !strings.EqualFold(name[len(name)-len(ext):], ext) {
+			continue
+		}
+		if candidate := name[:len(name)-len(ext)]; stem == "" || len(candidate) < len(stem) {
+			stem = candidate
+		}
+	}
+	return stem, stem != ""
+}
+
+// sidecarPrimary finds the file a sidecar belongs to: the file in the same directory that is not a sidecar itself and
+// whose name, with or without its extension, is the name of the acquisition. With the extension .sld, sample.sld
+// belongs to sample.raw, and with .scan, sample.wiff.scan belongs to sample.wiff.
+//
+// Parameters:
+// - path: The path of the file.
+//
+// Returns:
+// - string: The path of the file the sidecar belongs to.
+// - bool: True if the path is a sidecar of another file.
+func (cfg Configuration) sidecarPrimary(path string) (string, bool) {
+	name := filepath.Base(path)
+	stem, ok := cfg.sidecarStem(name)
+	if !ok {
+		return "", false
+	}
+	entries, err := os.ReadDir(filepath.Dir(path))
+	if err != nil {
+		return "", false
+	}
+	for _, entry := range entries {
+		candidate := entry.Name()
+		if entry.IsDir() || candidate == name {
+			continue
+		}
+		if _, sidecar := cfg.sidecarStem(candidate); sidecar {
+			continue
+		}
+		if candidate == stem || strings.TrimSuffix(candidate, filepath.Ext(candidate)) == stem {
+			return filepath.Join(filepath.Dir(path), candidate), true
+		}
+	}
+	return "", false
+}
+
+// sidecarsOf lists the sidecars that belong to a file, matched like sidecarPrimary.
+//
+// Parameters:
+// - path: The path of the file.
+//
+// Returns:
+// - []string: The paths of the sidecars, sorted by name.
+func (cfg Configuration) sidecarsOf(path string) []string {
+	if len(cfg.SidecarExtensions) == 0 {
+		return nil
+	}
+	if _, sidecar := cfg.sidecarStem(filepath.Base(path)); sidecar {
+		return nil
+	}
+	entries, err := os.ReadDir(filepath.Dir(path))
+	if err != nil {
+		return nil
+	}
+	var sidecars []string
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		candidate := filepath.Join(filepath.Dir(path), entry.Name())
+		if primary, ok := cfg.sidecarPrimary(candidate); ok && primary == path {
+			sidecars = append(sidecars, candidate)
+		}
+	}
+	return sidecars
+}
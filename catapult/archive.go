@@ -0,0 +1,791 @@
+package catapult
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/schollz/progressbar/v3"
+)
+
+// Archive formats bundle directories can be packed into at a destination.
+const (
+	BundleArchiveTar     = "tar"
+	BundleArchiveTarZstd = "tar.zst"
+	BundleArchiveZip     = "zip"
+)
+
+// bundleArchiveFormats lists the supported archive formats.
+var bundleArchiveFormats = []string{BundleArchiveTar, BundleArchiveTarZstd, BundleArchiveZip}
+
+// ValidateBundleArchive checks that a bundle archive format is known.
+//
+// Parameters:
+// - format: The archive format, or an empty string for none.
+//
+// Returns:
+// - error: An error object if the format is not supported.
+func ValidateBundleArchive(format string) error {
+	if format == "" {
+		return nil
+	}
+	for _, known := range bundleArchiveFormats {
+		if format == known {
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown bundle archive format: %s", format)
+}
+
+// archivePath returns the path of the archive holding a bundle directory.
+//
+// Parameters:
+// - destPath: The path the bundle would have in a mirrored destination.
+// - format: The archive format.
+//
+// Returns:
+// - string: The path of the archive file.
+func archivePath(destPath, format string) string {
+	return destPath + "." + format
+}
+
+// archiveFormatOf returns the archive format of a path from its extension.
+//
+// Parameters:
+// - path: The path of the archive.
+//
+// Returns:
+// - string: The archive format.
+// - bool: True if the extension is a supported archive format.
+func archiveFormatOf(path string) (string, bool) {
+	for _, format := range bundleArchiveFormats {
+		if strings.HasSuffix(path, "."+format) {
+			return format, true
+		}
+	}
+	return "", false
+}
+
+// throttledReader waits on rate limiters for every read.
+type throttledReader struct {
+	ctx      context.Context
+	reader   io.Reader
+	limiters []*RateLimiter
+}
+
+// Read reads from the underlying reader and waits until the bytes read are allowed by every limiter.
+func (r *throttledReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	n, err := r.reader.Read(p)
+	if n > 0 {
+		for _, limiter := range r.limiters {
+			if waitErr := limiter.WaitN(r.ctx, n); waitErr != nil {
+				return n, waitErr
+			}
+		}
+	}
+	return n, err
+}
+
+// archiveWriter adds members to a tar or zip archive.
+type archiveWriter interface {
+	// add starts a member and returns a writer for its content. Directories have no content.
+	add(name string, info os.FileInfo) (io.Writer, error)
+	Close() error
+}
+
+// tarArchiveWriter writes a tar archive, optionally through a compressor.
+type tarArchiveWriter struct {
+	tw         *tar.Writer
+	compressor io.WriteCloser
+}
+
+func (w *tarArchiveWriter) add(name string, info os.FileInfo) (io.Writer, error) {
+	header, err := tar.FileInfoHeader(info, "")
+	if err != nil {
+		return nil, err
+	}
+	header.Name = name
+	if info.IsDir() {
+		header.Name += "/"
+	}
+	return w.tw, w.tw.WriteHeader(header)
+}
+
+func (w *tarArchiveWriter) Close() error {
+	err := w.tw.Close()
+	if w.compressor != nil {
+		if closeErr := w.compressor.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+// zipArchiveWriter writes a zip archive with deflated members.
+type zipArchiveWriter struct {
+	zw *zip.Writer
+}
+
+func (w *zipArchiveWriter) add(name string, info os.FileInfo) (io.Writer, error) {
+	header, err := zip.FileInfoHeader(info)
+	if err != nil {
+		return nil, err
+	}
+	header.Name = name
+	header.Method = zip.Deflate
+	if info.IsDir() {
+		header.Name += "/"
+		header.Method = zip.Store
+	}
+	return w.zw.CreateHeader(header)
+}
+
+func (w *zipArchiveWriter) Close() error {
+	return w.zw.Close()
+}
+
+// newArchiveWriter creates a writer for an archive format.
+//
+// Parameters:
+// - w: The writer the archive is written to.
+// - format: The archive format.
+//
+// Returns:
+// - archiveWriter: The archive writer.
+// - error: An error object if the format is not supported.
+func newArchiveWriter(w io.Writer, format string) (archiveWriter, error) {
+	switch format {
+	case BundleArchiveTar:
+		return &tarArchiveWriter{tw: tar.NewWriter(w)}, nil
+	case BundleArchiveTarZstd:
+		encoder, err := zstd.NewWriter(w)
+		if err != nil {
+			return nil, err
+		}
+		return &tarArchiveWriter{tw: tar.NewWriter(encoder), compressor: encoder}, nil
+	case BundleArchiveZip:
+		return &zipArchiveWriter{zw: zip.NewWriter(w)}, nil
+	default:
+		return nil, fmt.Errorf("unknown bundle archive format: %s", format)
+	}
+}
+
+// packBundle streams every member of a bundle directory into a single archive, hashing each member as it is read.
+// Members are stored below a top-level directory named after the bundle, so that unpacking the archive recreates it.
+//
+// Parameters:
+// - ctx: The context to control the archiving lifecycle.
+// - folder: The source bundle directory.
+// - path: The path of the archive to write.
+// - format: The archive format.
+// - opts: The rate limiters, checksum algorithms, durability and progress bar of the copy.
+//
+// Returns:
+// - Manifest: The manifest of the source members as they were read.
+// - error: An error object if a member could not be read or the archive could not be written.
+func packBundle(ctx context.Context, folder, path, format string, opts CopyOptions) (Manifest, error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return Manifest{}, err
+	}
+	abort := func(err error) (Manifest, error) {
+		file.Close()
+		os.Remove(path)
+		return Manifest{}, err
+	}
+
+	buffered := bufio.NewWriterSize(file, checksumBufferSize)
+	archive, err := newArchiveWriter(buffered, format)
+	if err != nil {
+		return abort(err)
+	}
+
+	name := filepath.Base(folder)
+	buffer := make([]byte, checksumBufferSize)
+	var entries []ManifestEntry
+	err = filepath.Walk(folder, func(memberPath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		relPath, err := filepath.Rel(folder, memberPath)
+		if err != nil {
+			return err
+		}
+		memberName := name
+		if relPath != "." {
+			memberName = name + "/" + filepath.ToSlash(relPath)
+		}
+		// Links inside a bundle are archived as the files they point to, as they are when the bundle is copied.
+		if info.Mode()&os.ModeSymlink != 0 {
+			if info, err = os.Stat(memberPath); err != nil {
+				return err
+			}
+		}
+		if !info.IsDir() && !info.Mode().IsRegular() {
+			return fmt.Errorf("%s is not a regular file", memberPath)
+		}
+
+		writer, err := archive.add(memberName, info)
+		if err != nil || info.IsDir() {
+			return err
+		}
+		entry, err := archiveMember(ctx, memberPath, writer, info.Size(), opts, buffer)
+		if err != nil {
+			return err
+		}
+		entry.Path = filepath.ToSlash(relPath)
+		entries = append(entries, entry)
+		return nil
+	})
+	if err != nil {
+		return abort(err)
+	}
+
+	if err := archive.Close(); err != nil {
+		return abort(err)
+	}
+	if err := buffered.Flush(); err != nil {
+		return abort(err)
+	}
+	if opts.Sync {
+		if err := file.Sync(); err != nil {
+			return abort(err)
+		}
+	}
+	if err := file.Close(); err != nil {
+		os.Remove(path)
+		return Manifest{}, err
+	}
+	return newManifest(opts.Checksum, opts.SecondaryChecksum, entries), nil
+}
+
+// archiveMember streams a single source file into an archive member and hashes it.
+//
+// Parameters:
+// - ctx: The context to control the archiving lifecycle.
+// - src: The source file.
+// - writer: The writer of the archive member.
+// - size: The size recorded in the member header.
+// - opts: The rate limiters, checksum algorithms and progress bar of the copy.
+// - buffer: The buffer used for copying.
+//
+// Returns:
+// - ManifestEntry: The size and checksums of the member, without its path.
+// - error: An error object if the file could not be read or changed size while it was archived.
+func archiveMember(ctx context.Context, src string, writer io.Writer, size int64, opts CopyOptions, buffer []byte) (ManifestEntry, error) {
+	source, err := os.Open(src)
+	if err != nil {
+		return ManifestEntry{}, err
+	}
+	defer source.Close()
+
+	sums, err := newChecksummer(opts.Checksum, opts.SecondaryChecksum)
+	if err != nil {
+		return ManifestEntry{}, err
+	}
+	writers := []io.Writer{writer, sums}
+	if opts.Bar != nil {
+		writers = append(writers, opts.Bar)
+	}
+	reader := &throttledReader{ctx: ctx, reader: io.LimitReader(source, size), limiters: opts.Limiters}
+	n, err := io.CopyBuffer(io.MultiWriter(writers...), reader, buffer)
+	if err != nil {
+		return ManifestEntry{}, err
+	}
+	if n != size {
+		return ManifestEntry{}, fmt.Errorf("source file %s shrank while archiving", src)
+	}
+	return ManifestEntry{Size: n, Checksum: sums.sum(), SecondaryChecksum: sums.secondarySum()}, nil
+}
+
+// archiveMemberHeader describes a member read from an archive.
+type archiveMemberHeader struct {
+	Name    string
+	IsDir   bool
+	Mode    os.FileMode
+	ModTime time.Time
+	Size    int64
+}
+
+// walkArchive calls fn for every member of an archive in the order they are stored.
+//
+// Parameters:
+// - ctx: The context to control the reading lifecycle.
+// - path: The path of the archive.
+// - format: The archive format.
+// - limiters: The rate limiters every read of the archive waits on.
+// - fn: Called with the header and content of each member. Directories have no content.
+//
+// Returns:
+// - error: An error object if the archive could not be read, or the first error returned by fn.
+func walkArchive(ctx context.Context, path, format string, limiters []*RateLimiter, fn func(archiveMemberHeader, io.Reader) error) error {
+	if format == BundleArchiveZip {
+		archive, err := zip.OpenReader(path)
+		if err != nil {
+			return err
+		}
+		defer archive.Close()
+		for _, member := range archive.File {
+			info := member.FileInfo()
+			header := archiveMemberHeader{
+				Name:    strings.TrimSuffix(member.Name, "/"),
+				IsDir:   info.IsDir(),
+				Mode:    info.Mode(),
+				ModTime: member.Modified,
+				Size:    int64(member.UncompressedSize64),
+			}
+			if header.IsDir {
+				if err := fn(header, nil); err != nil {
+					return err
+				}
+				continue
+			}
+			content, err := member.Open()
+			if err != nil {
+				return err
+			}
+			err = fn(header, &throttledReader{ctx: ctx, reader: content, limiters: limiters})
+			content.Close()
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	var reader io.Reader = bufio.NewReaderSize(&throttledReader{ctx: ctx, reader: file, limiters: limiters}, checksumBufferSize)
+	switch format {
+	case BundleArchiveTarZstd:
+		decoder, err := zstd.NewReader(reader)
+		if err != nil {
+			return err
+		}
+		defer decoder.Close()
+		reader = decoder
+	case BundleArchiveTar:
+	default:
+		return fmt.Errorf("unknown bundle archive format: %s", format)
+	}
+
+	archive := tar.NewReader(reader)
+	for {
+		member, err := archive.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		header := archiveMemberHeader{
+			Name:    strings.TrimSuffix(member.Name, "/"),
+			IsDir:   member.Typeflag == tar.TypeDir,
+			Mode:    member.FileInfo().Mode(),
+			ModTime: member.ModTime,
+			Size:    member.Size,
+		}
+		if !header.IsDir && member.Typeflag != tar.TypeReg {
+			return fmt.Errorf("unsupported archive member %s", member.Name)
+		}
+		if err := fn(header, archive); err != nil {
+			return err
+		}
+	}
+}
+
+// splitArchiveMember splits the name of an archive member into the bundle directory and the path inside it.
+//
+// Parameters:
+// - name: The name of the member.
+//
+// Returns:
+// - string: The name of the bundle directory.
+// - string: The path of the member relative to the bundle directory, or an empty string for the directory itself.
+func splitArchiveMember(name string) (string, string) {
+	root, relPath, _ := strings.Cut(name, "/")
+	return root, relPath
+}
+
+// readArchiveManifest lists the members of a bundle archive, optionally hashing each of them.
+//
+// Parameters:
+// - ctx: The context to control the reading lifecycle.
+// - path: The path of the archive.
+// - format: The archive format.
+// - algorithm: The checksum algorithm.
+// - hash: Boolean indicating if the members are hashed. Without hashing only paths and sizes are listed.
+// - limiters: The rate limiters every read of the archive waits on.
+//
+// Returns:
+// - Manifest: The manifest of the members, with paths relative to the bundle directory.
+// - error: An error object if the archive could not be read.
+func readArchiveManifest(ctx context.Context, path, format, algorithm string, hash bool, limiters []*RateLimiter) (Manifest, error) {
+	var entries []ManifestEntry
+	err := walkArchive(ctx, path, format, limiters, func(header archiveMemberHeader, content io.Reader) error {
+		_, relPath := splitArchiveMember(header.Name)
+		if header.IsDir {
+			return nil
+		}
+		entry := ManifestEntry{Path: relPath, Size: header.Size}
+		if hash {
+			sums, err := newChecksummer(algorithm, "")
+			if err != nil {
+				return err
+			}
+			if _, err := io.Copy(sums, content); err != nil {
+				return err
+			}
+			entry.Checksum = sums.sum()
+		}
+		entries = append(entries, entry)
+		return nil
+	})
+	if err != nil {
+		return Manifest{}, err
+	}
+	return newManifest(algorithm, "", entries), nil
+}
+
+// copyArchivedBundle packs a bundle directory into an archive staged next to its final destination, verifies the
+// members of the written archive against the source, and renames the archive into place. The member index of the
+// archive is stored in the database.
+//
+// Parameters:
+// - ctx: The context to control the copying lifecycle.
+// - db: The database connection to track copied files.
+// - cfg: The configuration for the directory to monitor.
+// - folder: The source bundle directory.
+// - destPath: The path the bundle would have in a mirrored destination.
+// - destination: The destination directory.
+// - copyOptions: The options for reading the members.
+func copyArchivedBundle(ctx context.Context, db *sql.DB, cfg Configuration, folder, destPath, destination string, copyOptions CopyOptions) {
+	format := cfg.destinationConfig(destination).BundleArchive
+	archive := archivePath(destPath, format)
+	stagingPath := archive + ".cat.part"
+	verification := cfg.verificationMode(destination)
+
+	LogWithDatetime(fmt.Sprintf("Starting to archive folder: `%s` to destination: `%s`", folder, archive), true)
+	sendSlackNotification(fmt.Sprintf("Starting to archive folder: `%s` to destination: `%s`", folder, archive))
+
+	copyOptions.Bar = progressbar.NewOptions64(GetDirectorySize(folder),
+		progressbar.OptionSetDescription(fmt.Sprintf("Archiving folder %s to %s", folder, archive)),
+		progressbar.OptionShowBytes(true),
+	)
+	manifest, err := packBundle(ctx, folder, stagingPath, format, copyOptions)
+	if err != nil {
+		LogWithDatetime(fmt.Sprintf("Error archiving directory: %v", err), true)
+		sendSlackNotification(fmt.Sprintf("Error archiving directory: %v", err))
+		return
+	}
+
+	if verification != VerifyNone {
+		// The archive is read back; sizes alone are compared for size verification, checksums otherwise.
+		written, err := readArchiveManifest(ctx, stagingPath, format, copyOptions.Checksum, verification != VerifySize, copyOptions.Limiters)
+		if err != nil {
+			os.Remove(stagingPath)
+			LogWithDatetime(fmt.Sprintf("Error reading archive %s: %v", stagingPath, err), true)
+			sendSlackNotification(fmt.Sprintf("Error reading archive %s: %v", stagingPath, err))
+			return
+		}
+		if differences := DiffManifests(manifest, written); len(differences) > 0 {
+			os.Remove(stagingPath)
+			LogWithDatetime(fmt.Sprintf("Verification failed for %s:\n%s", folder, formatManifestDifferences(differences, 20)), true)
+			sendSlackNotification(fmt.Sprintf("Verification failed for %s:\n%s", folder, formatManifestDifferences(differences, 20)))
+			return
+		}
+	}
+
+	if err := os.Rename(stagingPath, archive); err != nil {
+		LogWithDatetime(fmt.Sprintf("Error renaming staged archive: %v", err), true)
+		sendSlackNotification(fmt.Sprintf("Error renaming staged archive: %v", err))
+		return
+	}
+	if copyOptions.Sync {
+		if err := syncDir(filepath.Dir(archive)); err != nil {
+			LogWithDatetime(fmt.Sprintf("Error syncing directory: %v", err), true)
+			sendSlackNotification(fmt.Sprintf("Error syncing directory: %v", err))
+			return
+		}
+	}
+
+	writeChecksumFiles(cfg, destination, archive, []ManifestEntry{{}}, "", "")
+
+	var bundleSize int64
+	for _, entry := range manifest.Entries {
+		bundleSize += entry.Size
+	}
+	checksum := manifest.Digest()
+	algorithm := digestAlgorithm(copyOptions.Checksum, true)
+
+	LogWithDatetime(fmt.Sprintf("Finished archiving folder: `%s` to destination: `%s`", folder, archive), true)
+	sendSlackNotification(fmt.Sprintf("Finished archiving folder: `%s` to destination: `%s`", folder, archive))
+	dbMutex.Lock()
+	MarkFileAsCopied(db, folder, destination, true)
+	UpdateCopiedFileChecksumWithAlgorithm(db, folder, destination, checksum, algorithm)
+	SaveFileSize(db, folder, bundleSize, true)
+	UpdateFileChecksumWithAlgorithm(db, folder, checksum, algorithm)
+	if copyOptions.SecondaryChecksum != "" {
+		UpdateFileSecondaryChecksum(db, folder, manifest.SecondaryDigest(), digestAlgorithm(copyOptions.SecondaryChecksum, true))
+	}
+	SaveManifest(db, folder, manifest)
+	SaveArchiveMembers(db, folder, destination, archive, manifest)
+	UpdateCopiedFileSize(db, folder, destination, bundleSize)
+	UpdateCopiedFileVerification(db, folder, destination, verification)
+	UpdateCopiedFileEngine(db, folder, destination, EngineBuffered)
+	dbMutex.Unlock()
+}
+
+// repairArchive rewrites a damaged or missing bundle archive from a bundle directory or from an archive of the same
+// format, and replaces the archive only if the digest of its members matches the recorded checksum.
+//
+// Parameters:
+// - ctx: The context to control the repair lifecycle.
+// - candidate: The bundle directory or archive to restore from.
+// - archive: The path of the archive at the destination.
+// - format: The archive format.
+// - record: The recorded copy.
+// - opts: The options for reading the candidate.
+//
+// Returns:
+// - error: An error object if the candidate could not be read or does not match.
+func repairArchive(ctx context.Context, candidate, archive, format string, record CopiedFileRecord, opts CopyOptions) error {
+	stagingPath := archive + ".cat.part"
+	info, err := os.Stat(candidate)
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		_, err = packBundle(ctx, candidate, stagingPath, format, opts)
+	} else if candidateFormat, ok := archiveFormatOf(candidate); ok && candidateFormat == format {
+		_, err = CopyFileWithOptions(ctx, candidate, archive, opts)
+	} else {
+		return fmt.Errorf("cannot repair a %s archive from %s", format, candidate)
+	}
+	if err != nil {
+		os.Remove(stagingPath)
+		return err
+	}
+
+	manifest, err := readArchiveManifest(ctx, stagingPath, format, opts.Checksum, true, opts.Limiters)
+	if err == nil && manifest.Digest() != record.Checksum {
+		err = fmt.Errorf("manifest digest %s does not match the recorded checksum", manifest.Digest())
+	}
+	if err != nil {
+		os.Remove(stagingPath)
+		return err
+	}
+	return os.Rename(stagingPath, archive)
+}
+
+// RestoreArchive unpacks a bundle archive into a directory and verifies every member against the member index
+// stored when the archive was written. The bundle is unpacked into a staging directory and only renamed into place
+// when every member matches.
+//
+// Parameters:
+// - db: The database connection to read the member index from. May be nil, in which case members are not verified.
+// - archive: The path of the archive.
+// - target: The directory to unpack the bundle directory into.
+//
+// Returns:
+// - error: An error object if the archive could not be unpacked or a member does not match the index.
+func RestoreArchive(db *sql.DB, archive, target string) error {
+	format, ok := archiveFormatOf(archive)
+	if !ok {
+		return fmt.Errorf("%s is not a tar, tar.zst or zip archive", archive)
+	}
+	expected, indexed := lookupArchiveMembers(db, archive)
+	algorithm := ChecksumSHA256
+	if indexed {
+		algorithm = expected.Algorithm
+	}
+
+	stagingPath := filepath.Join(target, strings.TrimSuffix(filepath.Base(archive), "."+format)+".cat.part")
+	if err := os.RemoveAll(stagingPath); err != nil {
+		return err
+	}
+	var name string
+	var entries []ManifestEntry
+	var directories []archiveMemberHeader
+	err := walkArchive(context.Background(), archive, format, nil, func(header archiveMemberHeader, content io.Reader) error {
+		root, relPath := splitArchiveMember(header.Name)
+		if name == "" {
+			name = root
+		}
+		if root != name || !filepath.IsLocal(root) || (relPath != "" && !filepath.IsLocal(filepath.FromSlash(relPath))) {
+			return fmt.Errorf("unexpected archive member %s", header.Name)
+		}
+		path := filepath.Join(stagingPath, filepath.FromSlash(relPath))
+		if header.IsDir {
+			directories = append(directories, header)
+			return os.MkdirAll(path, os.ModePerm)
+		}
+		entry, err := extractArchiveMember(path, header, content, algorithm)
+		if err != nil {
+			return err
+		}
+		entry.Path = relPath
+		entries = append(entries, entry)
+		return nil
+	})
+	if err == nil && name == "" {
+		err = fmt.Errorf("%s is empty", archive)
+	}
+	if err == nil && indexed {
+		if differences := DiffManifests(expected, newManifest(algorithm, "", entries)); len(differences) > 0 {
+			err = fmt.Errorf("restored bundle does not match the member index:\n%s", formatManifestDifferences(differences, 20))
+		}
+	}
+	if err != nil {
+		os.RemoveAll(stagingPath)
+		return err
+	}
+
+	// Directory times are set last, since extracting their members changes them.
+	for i := len(directories) - 1; i >= 0; i-- {
+		_, relPath := splitArchiveMember(directories[i].Name)
+		path := filepath.Join(stagingPath, filepath.FromSlash(relPath))
+		os.Chmod(path, directories[i].Mode.Perm())
+		os.Chtimes(path, directories[i].ModTime, directories[i].ModTime)
+	}
+
+	restorePath := filepath.Join(target, name)
+	if _, err := os.Stat(restorePath); err == nil {
+		os.RemoveAll(stagingPath)
+		return fmt.Errorf("%s already exists", restorePath)
+	}
+	if !indexed {
+		LogWithDatetime(fmt.Sprintf("No member index found for %s; members were not verified", archive), false)
+	}
+	return os.Rename(stagingPath, restorePath)
+}
+
+// extractArchiveMember writes the content of an archive member to a file and hashes it.
+//
+// Parameters:
+// - path: The path of the file to write.
+// - header: The header of the member.
+// - content: The content of the member.
+// - algorithm: The checksum algorithm.
+//
+// Returns:
+// - ManifestEntry: The size and checksum of the member, without its path.
+// - error: An error object if the file could not be written.
+func extractArchiveMember(path string, header archiveMemberHeader, content io.Reader, algorithm string) (ManifestEntry, error) {
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return ManifestEntry{}, err
+	}
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, header.Mode.Perm())
+	if err != nil {
+		return ManifestEntry{}, err
+	}
+	sums, err := newChecksummer(algorithm, "")
+	if err != nil {
+		file.Close()
+		return ManifestEntry{}, err
+	}
+	n, err := io.Copy(io.MultiWriter(file, sums), content)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return ManifestEntry{}, err
+	}
+	os.Chtimes(path, header.ModTime, header.ModTime)
+	return ManifestEntry{Size: n, Checksum: sums.sum()}, nil
+}
+
+// lookupArchiveMembers retrieves the member index of an archive by the path given and by its absolute path.
+//
+// Parameters:
+// - db: The database connection, or nil.
+// - archive: The path of the archive.
+//
+// Returns:
+// - Manifest: The indexed members.
+// - bool: True if an index was found.
+func lookupArchiveMembers(db *sql.DB, archive string) (Manifest, bool) {
+	if db == nil {
+		return Manifest{}, false
+	}
+	for _, path := range pathVariants(archive) {
+		manifest, found, err := GetArchiveMembers(db, path)
+		if err != nil {
+			LogWithDatetime(fmt.Sprintf("Error reading member index of %s: %v", archive, err), false)
+			return Manifest{}, false
+		}
+		if found {
+			return manifest, true
+		}
+	}
+	return Manifest{}, false
+}
+
+// copyManifest builds the manifest of a bundle copy at a destination, reading the members of archived bundles.
+//
+// Parameters:
+// - ctx: The context to control the hashing lifecycle.
+// - destination: The destination directory.
+// - copyPath: The path of the copy at the destination.
+// - algorithm: The checksum algorithm.
+// - limiters: The rate limiters every read waits on.
+//
+// Returns:
+// - Manifest: The manifest of the copy.
+// - error: An error object if the copy could not be read.
+func (cfg Configuration) copyManifest(ctx context.Context, destination, copyPath, algorithm string, limiters []*RateLimiter) (Manifest, error) {
+	if format := cfg.destinationConfig(destination).bundleArchive(true); format != "" {
+		return readArchiveManifest(ctx, copyPath, format, algorithm, true, limiters)
+	}
+	return walkManifest(ctx, copyPath, algorithm, "", true, limiters)
+}
+
+// copyChecksum hashes a copy at a destination so that it can be compared with the checksum of its source.
+// Archived bundles are hashed through the manifest of their members, and compressed or encrypted copies are decoded.
+// Encrypted copies return errEncryptedCopy if the destination has no identity file.
+//
+// Parameters:
+// - ctx: The context to control the hashing lifecycle.
+// - destination: The destination directory.
+// - copyPath: The path of the copy at the destination.
+// - isFolder: Boolean indicating if the copy is a bundle directory.
+// - limiters: The rate limiters every read waits on.
+//
+// Returns:
+// - string: The checksum in hexadecimal format, using the configured checksum algorithm.
+// - error: An error object if the copy could not be read.
+func (cfg Configuration) copyChecksum(ctx context.Context, destination, copyPath string, isFolder bool, limiters []*RateLimiter) (string, error) {
+	if isFolder {
+		manifest, err := cfg.copyManifest(ctx, destination, copyPath, cfg.checksumAlgorithm(), limiters)
+		if err != nil {
+			return "", err
+		}
+		return manifest.Digest(), nil
+	}
+	settings := cfg.destinationConfig(destination)
+	if settings.storedSuffix(isFolder) != "" {
+		identities, err := settings.decryptionIdentities(isFolder)
+		if err != nil {
+			return "", err
+		}
+		checksum, _, err := decodeFile(ctx, copyPath, settings.compression(isFolder), identities, cfg.checksumAlgorithm(), limiters, nil)
+		return checksum, err
+	}
+	checksum, _, err := calculateChecksums(ctx, copyPath, cfg.checksumAlgorithm(), "", limiters)
+	return checksum, err
+}
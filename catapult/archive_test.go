@@ -0,0 +1,110 @@
+package catapult
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// createTestBundle writes a small bundle directory with a nested member and an empty directory.
+func createTestBundle(t *testing.T, folder string) {
+	t.Helper()
+	for _, dir := range []string{"sub", "empty"} {
+		if err := os.MkdirAll(filepath.Join(folder, dir), 0755); err != nil {
+			t.Fatalf("Failed to create test bundle: %v", err)
+		}
+	}
+	os.WriteFile(filepath.Join(folder, "a.bin"), []byte("alpha"), 0644)
+	os.WriteFile(filepath.Join(folder, "sub", "b.bin"), []byte(strings.Repeat("beta", 1000)), 0644)
+}
+
+func TestCopyArchivedBundle(t *testing.T) {
+	for _, format := range bundleArchiveFormats {
+		t.Run(format, func(t *testing.T) {
+			db := setupTestDB(t)
+			defer db.Close()
+
+			tmpDir := t.TempDir()
+			src := filepath.Join(tmpDir, "src")
+			folder := filepath.Join(src, "run.d")
+			destination := filepath.Join(tmpDir, "dst")
+			createTestBundle(t, folder)
+			os.MkdirAll(destination, 0755)
+
+			cfg := Configuration{
+				Name:                "archive",
+				Directories:         []string{src},
+				Destinations:        []string{destination},
+				DestinationSettings: map[string]DestinationConfig{destination: {BundleArchive: format}},
+			}
+			copyArchivedBundle(context.Background(), db, cfg, folder, filepath.Join(destination, "run.d"), destination, CopyOptions{Checksum: ChecksumSHA256})
+
+			archive := filepath.Join(destination, "run.d."+format)
+			if path, ok := cfg.destinationPath(folder, destination, true); !ok || path != archive {
+				t.Fatalf("destinationPath() = %q, want %q", path, archive)
+			}
+			expected, _ := BuildManifest(folder, ChecksumSHA256, "")
+			checksum, err := cfg.copyChecksum(context.Background(), destination, archive, true, nil)
+			if err != nil || checksum != expected.Digest() {
+				t.Fatalf("copyChecksum() = %q, %v, want %q", checksum, err, expected.Digest())
+			}
+			recorded, _ := GetCopiedFileChecksumFor(db, folder, destination, digestAlgorithm(ChecksumSHA256, true))
+			if recorded != expected.Digest() {
+				t.Fatalf("Recorded checksum %q, want %q", recorded, expected.Digest())
+			}
+			index, found, err := GetArchiveMembers(db, archive)
+			if err != nil || !found || len(DiffManifests(expected, index)) != 0 {
+				t.Fatalf("Unexpected member index: %+v, %v, %v", index, found, err)
+			}
+
+			// Scrubbing hashes the members of the archive.
+			scrubDue(context.Background(), db, cfg, time.Hour)
+			if got := scrubStatus(t, db, folder, destination); got != ScrubOK {
+				t.Fatalf("scrub status = %q, want %q", got, ScrubOK)
+			}
+
+			restoreDir := filepath.Join(tmpDir, "restore")
+			if err := RestoreArchive(db, archive, restoreDir); err != nil {
+				t.Fatalf("RestoreArchive() error: %v", err)
+			}
+			restored, _ := BuildManifest(filepath.Join(restoreDir, "run.d"), ChecksumSHA256, "")
+			if differences := DiffManifests(expected, restored); len(differences) != 0 {
+				t.Fatalf("Restored bundle differs: %v", differences)
+			}
+			if _, err := os.Stat(filepath.Join(restoreDir, "run.d", "empty")); err != nil {
+				t.Fatalf("Expected empty directory to be restored: %v", err)
+			}
+			if err := RestoreArchive(db, archive, restoreDir); err == nil {
+				t.Fatalf("Expected RestoreArchive() to refuse to overwrite an existing directory")
+			}
+		})
+	}
+}
+
+func TestRestoreArchiveDetectsIndexMismatch(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+
+	tmpDir := t.TempDir()
+	folder := filepath.Join(tmpDir, "run.d")
+	createTestBundle(t, folder)
+	archive := filepath.Join(tmpDir, "run.d.tar")
+	manifest, err := packBundle(context.Background(), folder, archive, BundleArchiveTar, CopyOptions{Checksum: ChecksumSHA256})
+	if err != nil {
+		t.Fatalf("packBundle() error: %v", err)
+	}
+	manifest.Entries[0].Checksum = strings.Repeat("0", 64)
+	SaveArchiveMembers(db, folder, tmpDir, archive, manifest)
+
+	restoreDir := filepath.Join(tmpDir, "restore")
+	err = RestoreArchive(db, archive, restoreDir)
+	if err == nil || !strings.Contains(err.Error(), "checksum differs") {
+		t.Fatalf("Expected a checksum mismatch, got %v", err)
+	}
+	if entries, _ := os.ReadDir(restoreDir); len(entries) != 0 {
+		t.Fatalf("Expected nothing to be restored, found %d entries", len(entries))
+	}
+}
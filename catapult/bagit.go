@@ -0,0 +1,503 @@
+package catapult
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/schollz/progressbar/v3"
+)
+
+// Layouts a destination can write copies in.
+const (
+	// LayoutMirror mirrors the source tree at the destination.
+	LayoutMirror = "mirror"
+	// LayoutBagIt writes each file or bundle directory as a BagIt bag named <name>.bag.
+	LayoutBagIt = "bagit"
+	// LayoutContentAddressed stores each distinct content once under its checksum and hardlinks the mirrored paths to it.
+	LayoutContentAddressed = "cas"
+)
+
+// bagSuffix is appended to the name of a file or bundle directory to name its bag.
+const bagSuffix = ".bag"
+
+// bagItDeclaration is the content of the bagit.txt file of every bag.
+const bagItDeclaration = "BagIt-Version: 1.0\nTag-File-Character-Encoding: UTF-8\n"
+
+// bagInteropAlgorithms are the checksum algorithms every BagIt validator is expected to support. A bag whose
+// configured algorithms are not among them also gets a SHA-256 manifest.
+var bagInteropAlgorithms = map[string]bool{ChecksumMD5: true, ChecksumSHA256: true}
+
+// bagEncoder and bagDecoder percent-encode the characters of a payload path that cannot appear in a manifest line.
+var (
+	bagEncoder = strings.NewReplacer("%", "%25", "\r", "%0D", "\n", "%0A")
+	bagDecoder = strings.NewReplacer("%25", "%", "%0D", "\r", "%0d", "\r", "%0A", "\n", "%0a", "\n")
+)
+
+// bagPath returns the path of the bag holding a copy.
+//
+// Parameters:
+// - destPath: The path the copy would have in a mirrored destination.
+//
+// Returns:
+// - string: The path of the bag directory.
+func bagPath(destPath string) string {
+	return destPath + bagSuffix
+}
+
+// bagPayloadPath returns the path of a copied file or bundle directory inside its bag.
+//
+// Parameters:
+// - destPath: The path the copy would have in a mirrored destination.
+//
+// Returns:
+// - string: The path of the payload inside the data directory of the bag.
+func bagPayloadPath(destPath string) string {
+	return filepath.Join(bagPath(destPath), "data", filepath.Base(destPath))
+}
+
+// copyBagWithVerification copies a file or bundle directory into a BagIt bag staged next to its final destination.
+// The sidecars of a file are copied into the same payload, so that an acquisition is one bag. The payload is verified
+// like any other copy, the manifests and bag-info.txt are written, and the bag is validated before it is renamed into
+// place and recorded as copied.
+//
+// Parameters:
+// - ctx: The context to control the copying lifecycle.
+// - db: The database connection to track copied files.
+// - cfg: The configuration for the directory to monitor.
+// - source: The source file or bundle directory.
+// - destPath: The path the copy would have in a mirrored destination.
+// - destination: The destination directory.
+// - copyOptions: The options for copying each payload file.
+// - isFolder: Boolean indicating if the source is a bundle directory.
+func copyBagWithVerification(ctx context.Context, db *sql.DB, cfg Configuration, source, destPath, destination string, copyOptions CopyOptions, isFolder bool) {
+	bag := bagPath(destPath)
+	stagingPath := bag + ".cat.part"
+	verification := cfg.verificationMode(destination)
+	metadata := cfg.destinationConfig(destination).Metadata
+
+	// Bags are small to rebuild relative to their payload, so a staged bag is never resumed.
+	if err := os.RemoveAll(stagingPath); err != nil {
+		LogWithDatetime(fmt.Sprintf("Error removing stale staging directory: %v", err), true)
+		sendSlackNotification(fmt.Sprintf("Error removing stale staging directory: %v", err))
+		return
+	}
+
+	LogWithDatetime(fmt.Sprintf("Starting to bag: `%s` to destination: `%s`", source, bag), true)
+	sendSlackNotification(fmt.Sprintf("Starting to bag: `%s` to destination: `%s`", source, bag))
+
+	name := filepath.Base(source)
+	payloadPath := filepath.Join(stagingPath, "data", name)
+	var members, sidecars []string
+	var results, sidecarResults []CopyResult
+	if isFolder {
+		var totalSize int64
+		var err error
+		members, totalSize, err = stageBundleDirectories(source, payloadPath)
+		if err != nil {
+			LogWithDatetime(fmt.Sprintf("Error copying directory: %v", err), true)
+			sendSlackNotification(fmt.Sprintf("Error copying directory: %v", err))
+			return
+		}
+		memberOptions := copyOptions
+		memberOptions.Bar = progressbar.NewOptions64(totalSize,
+			progressbar.OptionSetDescription(fmt.Sprintf("Copying folder %s to %s", source, bag)),
+			progressbar.OptionShowBytes(true),
+		)
+		results, err = copyBundleMembers(ctx, source, payloadPath, members, memberOptions, verification, cfg.bundleWorkers())
+		if err != nil {
+			LogWithDatetime(fmt.Sprintf("Error copying directory: %v", err), true)
+			sendSlackNotification(fmt.Sprintf("Error copying directory: %v", err))
+			return
+		}
+		logMetadataError(bag, preserveTreeMetadata(source, payloadPath, metadata))
+	} else {
+		if err := os.MkdirAll(filepath.Dir(payloadPath), os.ModePerm); err != nil {
+			LogWithDatetime(fmt.Sprintf("Error creating directory: %v", err), true)
+			sendSlackNotification(fmt.Sprintf("Error creating directory: %v", err))
+			return
+		}
+		result, err := copyBundleMember(ctx, source, payloadPath, copyOptions, verification)
+		if err != nil {
+			LogWithDatetime(fmt.Sprintf("Error copying file: %v", err), true)
+			sendSlackNotification(fmt.Sprintf("Error copying file: %v", err))
+			return
+		}
+		logMetadataError(bag, PreserveMetadata(source, payloadPath, metadata))
+		members = []string{""}
+		results = []CopyResult{result}
+
+		sidecars = cfg.sidecarsOf(source)
+		for _, sidecar := range sidecars {
+			sidecarPath := filepath.Join(filepath.Dir(payloadPath), filepath.Base(sidecar))
+			result, err := copyBundleMember(ctx, sidecar, sidecarPath, copyOptions, verification)
+			if err != nil {
+				LogWithDatetime(fmt.Sprintf("Error copying sidecar: %v", err), true)
+				sendSlackNotification(fmt.Sprintf("Error copying sidecar: %v", err))
+				return
+			}
+			logMetadataError(bag, PreserveMetadata(sidecar, sidecarPath, metadata))
+			sidecarResults = append(sidecarResults, result)
+		}
+	}
+
+	// The payload entries are relative to the data directory, the manifest entries of a bundle to the bundle itself.
+	payload := make([]ManifestEntry, len(results))
+	entries := make([]ManifestEntry, len(results))
+	var size int64
+	for i, result := range results {
+		entries[i] = ManifestEntry{
+			Path:              filepath.ToSlash(members[i]),
+			Size:              result.Size,
+			Checksum:          result.Checksum,
+			SecondaryChecksum: result.SecondaryChecksum,
+		}
+		payload[i] = entries[i]
+		payload[i].Path = name
+		if members[i] != "" {
+			payload[i].Path = name + "/" + entries[i].Path
+		}
+		size += result.Size
+	}
+	manifest := newManifest(copyOptions.Checksum, copyOptions.SecondaryChecksum, entries)
+	// Sidecars are part of the payload, but the copy is recorded with the size and checksum of the file itself.
+	for i, result := range sidecarResults {
+		payload = append(payload, ManifestEntry{
+			Path:              filepath.Base(sidecars[i]),
+			Size:              result.Size,
+			Checksum:          result.Checksum,
+			SecondaryChecksum: result.SecondaryChecksum,
+		})
+	}
+
+	info, err := bagInfo(cfg, source, payload)
+	if err == nil {
+		err = writeBag(stagingPath, payload, copyOptions.Checksum, copyOptions.SecondaryChecksum, info)
+	}
+	if err != nil {
+		LogWithDatetime(fmt.Sprintf("Error writing bag %s: %v", bag, err), true)
+		sendSlackNotification(fmt.Sprintf("Error writing bag %s: %v", bag, err))
+		return
+	}
+	if err := ValidateBag(stagingPath); err != nil {
+		LogWithDatetime(fmt.Sprintf("Verification failed for %s: %v", source, err), true)
+		sendSlackNotification(fmt.Sprintf("Verification failed for %s: %v", source, err))
+		return
+	}
+	if copyOptions.Sync {
+		if err := syncTree(stagingPath); err != nil {
+			LogWithDatetime(fmt.Sprintf("Error syncing directory: %v", err), true)
+			sendSlackNotification(fmt.Sprintf("Error syncing directory: %v", err))
+			return
+		}
+	}
+
+	// An existing bag left after an override is moved aside, so it is only lost once the new bag is in place.
+	replacedPath := bag + ".cat.replaced"
+	if err := os.RemoveAll(replacedPath); err == nil {
+		err = os.Rename(bag, replacedPath)
+		if err != nil && !os.IsNotExist(err) {
+			LogWithDatetime(fmt.Sprintf("Error moving existing bag aside: %v", err), true)
+			sendSlackNotification(fmt.Sprintf("Error moving existing bag aside: %v", err))
+			return
+		}
+	}
+	if err := os.Rename(stagingPath, bag); err != nil {
+		LogWithDatetime(fmt.Sprintf("Error renaming staged bag: %v", err), true)
+		sendSlackNotification(fmt.Sprintf("Error renaming staged bag: %v", err))
+		return
+	}
+	os.RemoveAll(replacedPath)
+	if copyOptions.Sync {
+		if err := syncDir(filepath.Dir(bag)); err != nil {
+			LogWithDatetime(fmt.Sprintf("Error syncing directory: %v", err), true)
+			sendSlackNotification(fmt.Sprintf("Error syncing directory: %v", err))
+			return
+		}
+	}
+
+	checksum, secondary := entries[0].Checksum, entries[0].SecondaryChecksum
+	if isFolder {
+		checksum, secondary = manifest.Digest(), manifest.SecondaryDigest()
+	}
+	algorithm := digestAlgorithm(copyOptions.Checksum, isFolder)
+
+	LogWithDatetime(fmt.Sprintf("Finished bagging: `%s` to destination: `%s`", source, bag), true)
+	sendSlackNotification(fmt.Sprintf("Finished bagging: `%s` to destination: `%s`", source, bag))
+	dbMutex.Lock()
+	MarkFileAsCopied(db, source, destination, isFolder)
+	UpdateCopiedFileChecksumWithAlgorithm(db, source, destination, checksum, algorithm)
+	SaveFileSize(db, source, size, isFolder)
+	UpdateFileChecksumWithAlgorithm(db, source, checksum, algorithm)
+	if copyOptions.SecondaryChecksum != "" {
+		UpdateFileSecondaryChecksum(db, source, secondary, digestAlgorithm(copyOptions.SecondaryChecksum, isFolder))
+	}
+	if isFolder {
+		SaveManifest(db, source, manifest)
+	}
+	UpdateCopiedFileSize(db, source, destination, size)
+	UpdateCopiedFileVerification(db, source, destination, verification)
+	UpdateCopiedFileEngine(db, source, destination, combinedEngine(append(results, sidecarResults...)))
+	dbMutex.Unlock()
+}
+
+// bagAlgorithms returns the checksum algorithms a bag has manifests for.
+//
+// Parameters:
+// - algorithm: The configured checksum algorithm.
+// - secondary: The configured secondary checksum algorithm, or an empty string for none.
+//
+// Returns:
+// - []string: The configured algorithms, followed by SHA-256 if none of them is widely supported by validators.
+func bagAlgorithms(algorithm, secondary string) []string {
+	algorithms := []string{normalizeChecksumAlgorithm(algorithm)}
+	if secondary != "" && secondary != algorithms[0] {
+		algorithms = append(algorithms, secondary)
+	}
+	for _, a := range algorithms {
+		if bagInteropAlgorithms[a] {
+			return algorithms
+		}
+	}
+	return append(algorithms, ChecksumSHA256)
+}
+
+// bagInfo formats the bag-info.txt file of a bag, describing where and when the payload was acquired.
+//
+// Parameters:
+// - cfg: The configuration the copy belongs to.
+// - source: The source file or bundle directory.
+// - payload: The payload files of the bag.
+//
+// Returns:
+// - string: The content of bag-info.txt.
+// - error: An error object if the source could not be stated.
+func bagInfo(cfg Configuration, source string, payload []ManifestEntry) (string, error) {
+	info, err := os.Stat(source)
+	if err != nil {
+		return "", err
+	}
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown"
+	}
+	var octets int64
+	for _, entry := range payload {
+		octets += entry.Size
+	}
+
+	field := strings.NewReplacer("\r", " ", "\n", " ")
+	var b strings.Builder
+	fmt.Fprintf(&b, "Bagging-Date: %s\n", time.Now().Format("2006-01-02"))
+	fmt.Fprintf(&b, "Payload-Oxum: %d.%d\n", octets, len(payload))
+	fmt.Fprintf(&b, "External-Identifier: %s\n", field.Replace(source))
+	fmt.Fprintf(&b, "Catapult-Configuration: %s\n", field.Replace(cfg.Name))
+	fmt.Fprintf(&b, "Source-Host: %s\n", field.Replace(host))
+	fmt.Fprintf(&b, "Acquisition-Time: %s\n", info.ModTime().UTC().Format(time.RFC3339))
+	return b.String(), nil
+}
+
+// writeBag writes the tag files of a bag whose payload is already in its data directory: bagit.txt, bag-info.txt,
+// a payload manifest per algorithm and a tag manifest per algorithm.
+//
+// Parameters:
+// - bagDir: The bag directory.
+// - payload: The payload files with paths relative to the data directory.
+// - algorithm: The checksum algorithm of the payload entries.
+// - secondary: The secondary checksum algorithm of the payload entries, or an empty string for none.
+// - info: The content of bag-info.txt.
+//
+// Returns:
+// - error: An error object if a payload file could not be hashed or a tag file could not be written.
+func writeBag(bagDir string, payload []ManifestEntry, algorithm, secondary, info string) error {
+	tagFiles := map[string][]byte{
+		"bagit.txt":    []byte(bagItDeclaration),
+		"bag-info.txt": []byte(info),
+	}
+	algorithms := bagAlgorithms(algorithm, secondary)
+	for _, a := range algorithms {
+		var b strings.Builder
+		for _, entry := range payload {
+			path := filepath.Join(bagDir, "data", filepath.FromSlash(entry.Path))
+			checksum, err := checksumOf(path, entry, algorithm, secondary, a)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(&b, "%s  data/%s\n", checksum, bagEncoder.Replace(entry.Path))
+		}
+		tagFiles["manifest-"+a+".txt"] = []byte(b.String())
+	}
+
+	names := make([]string, 0, len(tagFiles))
+	for name := range tagFiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if err := os.WriteFile(filepath.Join(bagDir, name), tagFiles[name], 0644); err != nil {
+			return err
+		}
+	}
+
+	for _, a := range algorithms {
+		var b strings.Builder
+		for _, name := range names {
+			hash, err := newChecksumHash(a)
+			if err != nil {
+				return err
+			}
+			hash.Write(tagFiles[name])
+			fmt.Fprintf(&b, "%s  %s\n", hex.EncodeToString(hash.Sum(nil)), name)
+		}
+		if err := os.WriteFile(filepath.Join(bagDir, "tagmanifest-"+a+".txt"), []byte(b.String()), 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ValidateBag checks that a directory is a complete and valid BagIt bag: every payload file is listed in every
+// payload manifest, every listed file exists and matches its checksum, the tag manifests match the tag files, and
+// the Payload-Oxum of bag-info.txt matches the payload.
+//
+// Parameters:
+// - bagDir: The bag directory.
+//
+// Returns:
+// - error: An error object listing the problems found, or nil if the bag is valid.
+func ValidateBag(bagDir string) error {
+	declaration, err := os.ReadFile(filepath.Join(bagDir, "bagit.txt"))
+	if err != nil {
+		return err
+	}
+	if !strings.HasPrefix(string(declaration), "BagIt-Version:") {
+		return fmt.Errorf("bagit.txt does not declare a BagIt version")
+	}
+
+	payload := make(map[string]int64)
+	err = filepath.Walk(filepath.Join(bagDir, "data"), func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			relPath, err := filepath.Rel(bagDir, path)
+			if err != nil {
+				return err
+			}
+			payload[filepath.ToSlash(relPath)] = info.Size()
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	manifests, _ := filepath.Glob(filepath.Join(bagDir, "manifest-*.txt"))
+	if len(manifests) == 0 {
+		return fmt.Errorf("bag has no payload manifest")
+	}
+	var differences []ManifestDifference
+	for _, manifestPath := range manifests {
+		listed, problems := checkBagManifest(bagDir, manifestPath)
+		differences = append(differences, problems...)
+		for path := range payload {
+			if !listed[path] {
+				differences = append(differences, ManifestDifference{Path: path, Problem: "not listed in " + filepath.Base(manifestPath)})
+			}
+		}
+	}
+	tagManifests, _ := filepath.Glob(filepath.Join(bagDir, "tagmanifest-*.txt"))
+	for _, manifestPath := range tagManifests {
+		_, problems := checkBagManifest(bagDir, manifestPath)
+		differences = append(differences, problems...)
+	}
+
+	var octets int64
+	for _, size := range payload {
+		octets += size
+	}
+	if oxum := bagInfoField(bagDir, "Payload-Oxum"); oxum != "" && oxum != fmt.Sprintf("%d.%d", octets, len(payload)) {
+		differences = append(differences, ManifestDifference{Path: "bag-info.txt", Problem: fmt.Sprintf("Payload-Oxum %s, want %d.%d", oxum, octets, len(payload))})
+	}
+
+	if len(differences) > 0 {
+		sort.Slice(differences, func(i, j int) bool { return differences[i].Path < differences[j].Path })
+		return fmt.Errorf("invalid bag %s:\n%s", bagDir, formatManifestDifferences(differences, 20))
+	}
+	return nil
+}
+
+// checkBagManifest checks every file listed in a payload or tag manifest against its checksum.
+//
+// Parameters:
+// - bagDir: The bag directory.
+// - manifestPath: The path of the manifest, whose name contains the checksum algorithm.
+//
+// Returns:
+// - map[string]bool: The paths listed in the manifest, relative to the bag directory.
+// - []ManifestDifference: The listed files that are missing or do not match.
+func checkBagManifest(bagDir, manifestPath string) (map[string]bool, []ManifestDifference) {
+	name := filepath.Base(manifestPath)
+	algorithm := strings.TrimSuffix(name[strings.Index(name, "-")+1:], ".txt")
+	listed := make(map[string]bool)
+	if err := ValidateChecksumAlgorithm(algorithm); err != nil {
+		return listed, []ManifestDifference{{Path: name, Problem: err.Error()}}
+	}
+
+	file, err := os.Open(manifestPath)
+	if err != nil {
+		return listed, []ManifestDifference{{Path: name, Problem: err.Error()}}
+	}
+	defer file.Close()
+
+	var differences []ManifestDifference
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.SplitN(strings.TrimSpace(scanner.Text()), " ", 2)
+		if len(fields) != 2 {
+			continue
+		}
+		path := bagDecoder.Replace(strings.TrimLeft(fields[1], " \t"))
+		listed[path] = true
+		checksum, err := CalculateFileChecksum(filepath.Join(bagDir, filepath.FromSlash(path)), algorithm)
+		if os.IsNotExist(err) {
+			differences = append(differences, ManifestDifference{Path: path, Problem: "missing"})
+		} else if err != nil {
+			differences = append(differences, ManifestDifference{Path: path, Problem: err.Error()})
+		} else if !strings.EqualFold(checksum, fields[0]) {
+			differences = append(differences, ManifestDifference{Path: path, Problem: algorithm + " checksum differs"})
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		differences = append(differences, ManifestDifference{Path: name, Problem: err.Error()})
+	}
+	return listed, differences
+}
+
+// bagInfoField returns the value of a field of the bag-info.txt file of a bag.
+//
+// Parameters:
+// - bagDir: The bag directory.
+// - label: The label of the field.
+//
+// Returns:
+// - string: The value of the first field with the label, or an empty string if there is none.
+func bagInfoField(bagDir, label string) string {
+	content, err := os.ReadFile(filepath.Join(bagDir, "bag-info.txt"))
+	if err != nil {
+		return ""
+	}
+	for _, line := range strings.Split(string(content), "\n") {
+		if value, ok := strings.CutPrefix(line, label+":"); ok {
+			return strings.TrimSpace(value)
+		}
+	}
+	return ""
+}
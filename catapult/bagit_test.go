@@ -0,0 +1,174 @@
+package catapult
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCopyBagWithVerificationFolder(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+
+	tmpDir := t.TempDir()
+	folder := filepath.Join(tmpDir, "src", "run.d")
+	destination := filepath.Join(tmpDir, "dst")
+	os.MkdirAll(filepath.Join(folder, "sub"), 0755)
+	os.MkdirAll(destination, 0755)
+	os.WriteFile(filepath.Join(folder, "a.bin"), []byte("alpha"), 0644)
+	os.WriteFile(filepath.Join(folder, "sub", "b%\nc.bin"), []byte("beta"), 0644)
+
+	cfg := Configuration{
+		Name:                "bagit",
+		Directories:         []string{filepath.Dir(folder)},
+		Destinations:        []string{destination},
+		ChecksumAlgorithm:   ChecksumXXH3,
+		DestinationSettings: map[string]DestinationConfig{destination: {Layout: LayoutBagIt}},
+	}
+	opts := CopyOptions{Checksum: ChecksumXXH3}
+	copyBagWithVerification(context.Background(), db, cfg, folder, filepath.Join(destination, "run.d"), destination, opts, true)
+
+	bag := filepath.Join(destination, "run.d.bag")
+	if err := ValidateBag(bag); err != nil {
+		t.Fatalf("ValidateBag() error: %v", err)
+	}
+	for _, name := range []string{"bagit.txt", "bag-info.txt", "manifest-xxh3.txt", "manifest-sha256.txt", "tagmanifest-sha256.txt", "data/run.d/a.bin"} {
+		if _, err := os.Stat(filepath.Join(bag, name)); err != nil {
+			t.Errorf("Expected %s in bag: %v", name, err)
+		}
+	}
+	if got := bagInfoField(bag, "Catapult-Configuration"); got != "bagit" {
+		t.Errorf("Catapult-Configuration = %q, want %q", got, "bagit")
+	}
+	if got := bagInfoField(bag, "Payload-Oxum"); got != "9.2" {
+		t.Errorf("Payload-Oxum = %q, want %q", got, "9.2")
+	}
+	manifest, _ := os.ReadFile(filepath.Join(bag, "manifest-sha256.txt"))
+	if !strings.Contains(string(manifest), "data/run.d/sub/b%25%0Ac.bin") {
+		t.Errorf("Expected percent-encoded path in manifest:\n%s", manifest)
+	}
+
+	copied, err := IsFileCopied(db, folder, destination, true)
+	if err != nil || !copied {
+		t.Fatalf("Expected bag to be recorded as copied: %v", err)
+	}
+	expected, _ := BuildManifest(folder, ChecksumXXH3, "")
+	checksum, _ := GetCopiedFileChecksumFor(db, folder, destination, digestAlgorithm(ChecksumXXH3, true))
+	if checksum != expected.Digest() {
+		t.Fatalf("Recorded checksum %q, want %q", checksum, expected.Digest())
+	}
+	if path, ok := cfg.destinationPath(folder, destination, true); !ok || path != filepath.Join(bag, "data", "run.d") {
+		t.Fatalf("destinationPath() = %q, want the payload inside the bag", path)
+	}
+
+	os.WriteFile(filepath.Join(bag, "data", "run.d", "a.bin"), []byte("ALPHA"), 0644)
+	os.WriteFile(filepath.Join(bag, "data", "extra.bin"), []byte("extra"), 0644)
+	err = ValidateBag(bag)
+	if err == nil {
+		t.Fatalf("Expected ValidateBag() to fail for a tampered bag")
+	}
+	for _, want := range []string{"data/run.d/a.bin: xxh3 checksum differs", "data/extra.bin: not listed", "Payload-Oxum"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("Expected %q in error:\n%v", want, err)
+		}
+	}
+}
+
+func TestCopyBagWithVerificationFile(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+
+	tmpDir := t.TempDir()
+	file := filepath.Join(tmpDir, "sample.raw")
+	destination := filepath.Join(tmpDir, "dst")
+	os.MkdirAll(destination, 0755)
+	os.WriteFile(file, []byte("sample"), 0644)
+
+	cfg := Configuration{Name: "bagit", DestinationSettings: map[string]DestinationConfig{destination: {Layout: LayoutBagIt}}}
+	opts := CopyOptions{Checksum: ChecksumSHA256}
+	copyBagWithVerification(context.Background(), db, cfg, file, filepath.Join(destination, "sample.raw"), destination, opts, false)
+
+	bag := filepath.Join(destination, "sample.raw.bag")
+	if err := ValidateBag(bag); err != nil {
+		t.Fatalf("ValidateBag() error: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(bag, "manifest-sha256.txt")); err != nil {
+		t.Fatalf("Expected a SHA-256 manifest: %v", err)
+	}
+	if matches, _ := filepath.Glob(filepath.Join(bag, "manifest-*.txt")); len(matches) != 1 {
+		t.Fatalf("Expected a single payload manifest, got %v", matches)
+	}
+	content, err := os.ReadFile(filepath.Join(bag, "data", "sample.raw"))
+	if err != nil || string(content) != "sample" {
+		t.Fatalf("Unexpected payload: %q, %v", content, err)
+	}
+	expected, _ := CalculateFileHash(file)
+	checksum, _ := GetCopiedFileChecksumFor(db, file, destination, ChecksumSHA256)
+	if checksum != expected {
+		t.Fatalf("Recorded checksum %q, want %q", checksum, expected)
+	}
+}
+
+func TestCopyBagWithVerificationSidecars(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+
+	tmpDir := t.TempDir()
+	src := filepath.Join(tmpDir, "src")
+	destination := filepath.Join(tmpDir, "dst")
+	os.MkdirAll(src, 0755)
+	os.MkdirAll(destination, 0755)
+	for name, content := range map[string]string{
+		"sample.raw":       "sample",
+		"sample.sld":       "sequence",
+		"other.raw":        "other",
+		"blank.wiff":       "blank",
+		"blank.wiff.scan":  "scan",
+		"orphan.wiff.scan": "orphan",
+	} {
+		os.WriteFile(filepath.Join(src, name), []byte(content), 0644)
+	}
+
+	cfg := Configuration{
+		Name:                "bagit",
+		Directories:         []string{src},
+		Destinations:        []string{destination},
+		SidecarExtensions:   []string{".sld", ".scan"},
+		DestinationSettings: map[string]DestinationConfig{destination: {Layout: LayoutBagIt}},
+	}
+	for sidecar, want := range map[string]string{"sample.sld": "sample.raw", "blank.wiff.scan": "blank.wiff", "orphan.wiff.scan": "", "other.raw": ""} {
+		primary, _ := cfg.sidecarPrimary(filepath.Join(src, sidecar))
+		if want != "" {
+			want = filepath.Join(src, want)
+		}
+		if primary != want {
+			t.Errorf("sidecarPrimary(%s) = %q, want %q", sidecar, primary, want)
+		}
+	}
+	if needsCopy(db, filepath.Join(src, "sample.sld"), destination, cfg, false, 8) {
+		t.Fatalf("Expected the sidecar not to be copied on its own")
+	}
+	if !needsCopy(db, filepath.Join(src, "orphan.wiff.scan"), destination, cfg, false, 6) {
+		t.Fatalf("Expected a sidecar without its acquisition to be copied on its own")
+	}
+
+	file := filepath.Join(src, "sample.raw")
+	copyBagWithVerification(context.Background(), db, cfg, file, filepath.Join(destination, "sample.raw"), destination, CopyOptions{Checksum: ChecksumSHA256}, false)
+
+	bag := filepath.Join(destination, "sample.raw.bag")
+	if err := ValidateBag(bag); err != nil {
+		t.Fatalf("ValidateBag() error: %v", err)
+	}
+	if content, err := os.ReadFile(filepath.Join(bag, "data", "sample.sld")); err != nil || string(content) != "sequence" {
+		t.Fatalf("Expected the sidecar in the payload, got %q, %v", content, err)
+	}
+	if got := bagInfoField(bag, "Payload-Oxum"); got != "14.2" {
+		t.Errorf("Payload-Oxum = %q, want %q", got, "14.2")
+	}
+	expected, _ := CalculateFileHash(file)
+	if checksum, _ := GetCopiedFileChecksumFor(db, file, destination, ChecksumSHA256); checksum != expected {
+		t.Fatalf("Recorded checksum %q, want the checksum of the file %q", checksum, expected)
+	}
+}
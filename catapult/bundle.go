@@ -0,0 +1,317 @@
+package catapult
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/schollz/progressbar/v3"
+)
+
+// copyBundleWithVerification copies a bundle directory such as a .d folder into a staging directory next to its
+// final destination, verifies every member, and renames the staging directory into place only when every member
+// matches. Downstream software therefore never sees a half-populated bundle. The manifest of the bundle is stored
+// in the database so that later verifications can report which members differ.
+//
+// Parameters:
+// - ctx: The context to control the copying lifecycle.
+// - db: The database connection to track copied files.
+// - cfg: The configuration for the directory to monitor.
+// - folder: The source bundle directory.
+// - destPath: The final path of the bundle at the destination.
+// - destination: The destination directory.
+// - copyOptions: The options for copying each member.
+func copyBundleWithVerification(ctx context.Context, db *sql.DB, cfg Configuration, folder, destPath, destination string, copyOptions CopyOptions) {
+	stagingPath := destPath + ".cat.part"
+	verification := cfg.verificationMode(destination)
+
+	if !copyOptions.Resume {
+		if err := os.RemoveAll(stagingPath); err != nil {
+			LogWithDatetime(fmt.Sprintf("Error removing stale staging directory: %v", err), true)
+			sendSlackNotification(fmt.Sprintf("Error removing stale staging directory: %v", err))
+			return
+		}
+	}
+
+	LogWithDatetime(fmt.Sprintf("Starting to copy folder: `%s` to destination: `%s`", folder, destPath), true)
+	sendSlackNotification(fmt.Sprintf("Starting to copy folder: `%s` to destination: `%s`", folder, destPath))
+
+	members, totalSize, err := stageBundleDirectories(folder, stagingPath)
+	if err != nil {
+		LogWithDatetime(fmt.Sprintf("Error copying directory: %v", err), true)
+		sendSlackNotification(fmt.Sprintf("Error copying directory: %v", err))
+		return
+	}
+	if copyOptions.Resume {
+		if err := pruneStagedBundle(folder, stagingPath, members); err != nil {
+			LogWithDatetime(fmt.Sprintf("Error removing stale staged files: %v", err), true)
+			sendSlackNotification(fmt.Sprintf("Error removing stale staged files: %v", err))
+			return
+		}
+	}
+
+	memberOptions := copyOptions
+	memberOptions.Bar = progressbar.NewOptions64(totalSize,
+		progressbar.OptionSetDescription(fmt.Sprintf("Copying folder %s to %s", folder, destPath)),
+		progressbar.OptionShowBytes(true),
+	)
+	results, err := copyBundleMembers(ctx, folder, stagingPath, members, memberOptions, verification, cfg.bundleWorkers())
+	if err != nil {
+		LogWithDatetime(fmt.Sprintf("Error copying directory: %v", err), true)
+		sendSlackNotification(fmt.Sprintf("Error copying directory: %v", err))
+		return
+	}
+
+	var bundleSize int64
+	entries := make([]ManifestEntry, len(results))
+	for i, result := range results {
+		entries[i] = ManifestEntry{
+			Path:              filepath.ToSlash(members[i]),
+			Size:              result.Size,
+			Checksum:          result.Checksum,
+			SecondaryChecksum: result.SecondaryChecksum,
+		}
+		bundleSize += result.Size
+	}
+	manifest := newManifest(copyOptions.Checksum, copyOptions.SecondaryChecksum, entries)
+
+	if verification != VerifyNone {
+		// Every member was verified on its own; this catches leftovers of an earlier attempt in the staging directory.
+		staged, err := walkManifest(ctx, stagingPath, copyOptions.Checksum, copyOptions.SecondaryChecksum, false, copyOptions.Limiters)
+		if err != nil {
+			LogWithDatetime(fmt.Sprintf("Error listing staged folder: %v", err), true)
+			sendSlackNotification(fmt.Sprintf("Error listing staged folder: %v", err))
+			return
+		}
+		if differences := DiffManifests(manifest, staged); len(differences) > 0 {
+			LogWithDatetime(fmt.Sprintf("Verification failed for %s:\n%s", folder, formatManifestDifferences(differences, 20)), true)
+			sendSlackNotification(fmt.Sprintf("Verification failed for %s:\n%s", folder, formatManifestDifferences(differences, 20)))
+			// The next attempt starts from an empty staging directory rather than failing on the same leftovers.
+			os.RemoveAll(stagingPath)
+			return
+		}
+	}
+
+	logMetadataError(destPath, preserveTreeMetadata(folder, stagingPath, cfg.destinationConfig(destination).Metadata))
+	if copyOptions.Sync {
+		if err := syncTree(stagingPath); err != nil {
+			LogWithDatetime(fmt.Sprintf("Error syncing directory: %v", err), true)
+			sendSlackNotification(fmt.Sprintf("Error syncing directory: %v", err))
+			return
+		}
+	}
+
+	if err := os.Rename(stagingPath, destPath); err != nil {
+		LogWithDatetime(fmt.Sprintf("Error renaming staged folder: %v", err), true)
+		sendSlackNotification(fmt.Sprintf("Error renaming staged folder: %v", err))
+		return
+	}
+	if copyOptions.Sync {
+		if err := syncDir(filepath.Dir(destPath)); err != nil {
+			LogWithDatetime(fmt.Sprintf("Error syncing directory: %v", err), true)
+			sendSlackNotification(fmt.Sprintf("Error syncing directory: %v", err))
+			return
+		}
+	}
+
+	writeChecksumFiles(cfg, destination, destPath, manifest.Entries, manifest.Algorithm, manifest.SecondaryAlgorithm)
+
+	checksum := manifest.Digest()
+	algorithm := digestAlgorithm(copyOptions.Checksum, true)
+
+	LogWithDatetime(fmt.Sprintf("Finished copying folder: `%s` to destination: `%s`", folder, destPath), true)
+	sendSlackNotification(fmt.Sprintf("Finished copying folder: `%s` to destination: `%s`", folder, destPath))
+	dbMutex.Lock()
+	MarkFileAsCopied(db, folder, destination, true)
+	UpdateCopiedFileChecksumWithAlgorithm(db, folder, destination, checksum, algorithm)
+	SaveFileSize(db, folder, bundleSize, true)
+	UpdateFileChecksumWithAlgorithm(db, folder, checksum, algorithm)
+	if copyOptions.SecondaryChecksum != "" {
+		UpdateFileSecondaryChecksum(db, folder, manifest.SecondaryDigest(), digestAlgorithm(copyOptions.SecondaryChecksum, true))
+	}
+	SaveManifest(db, folder, manifest)
+	UpdateCopiedFileSize(db, folder, destination, bundleSize)
+	UpdateCopiedFileVerification(db, folder, destination, verification)
+	UpdateCopiedFileEngine(db, folder, destination, combinedEngine(results))
+	dbMutex.Unlock()
+}
+
+// combinedEngine returns the I/O engine recorded for a copy made of several files.
+//
+// Parameters:
+// - results: The results of copying each file.
+//
+// Returns:
+// - string: The engine shared by every file, or "mixed" if the files were copied with different engines.
+func combinedEngine(results []CopyResult) string {
+	engine := EngineBuffered
+	for i, result := range results {
+		if i > 0 && result.Engine != engine {
+			return "mixed"
+		}
+		engine = result.Engine
+	}
+	return engine
+}
+
+// stageBundleDirectories creates the directory tree of a bundle inside its staging directory and lists its files.
+//
+// Parameters:
+// - folder: The source bundle directory.
+// - stagingPath: The staging directory at the destination.
+//
+// Returns:
+// - []string: The member paths relative to the bundle directory, in walk order.
+// - int64: The total size of the members in bytes.
+// - error: An error object if the bundle could not be listed or a directory could not be created.
+func stageBundleDirectories(folder, stagingPath string) ([]string, int64, error) {
+	var members []string
+	var totalSize int64
+	err := filepath.Walk(folder, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		relPath, err := filepath.Rel(folder, path)
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return os.MkdirAll(filepath.Join(stagingPath, relPath), os.ModePerm)
+		}
+		members = append(members, relPath)
+		totalSize += info.Size()
+		return nil
+	})
+	return members, totalSize, err
+}
+
+// pruneStagedBundle removes what an earlier attempt left in a staging directory that is no longer part of the bundle,
+// such as members that were deleted or renamed at the source. Staged members and the partial copies and resume state
+// of members are kept, so that they can be resumed.
+//
+// Parameters:
+// - folder: The source bundle directory.
+// - stagingPath: The staging directory at the destination.
+// - members: The member paths relative to the bundle directory.
+//
+// Returns:
+// - error: An error object if the staging directory could not be listed or a stale path could not be removed.
+func pruneStagedBundle(folder, stagingPath string, members []string) error {
+	keep := make(map[string]bool, len(members)*3)
+	for _, member := range members {
+		keep[member] = true
+		keep[member+".cat.part"] = true
+		keep[member+".cat.part.state"] = true
+	}
+	return filepath.Walk(stagingPath, func(path string, info os.FileInfo, err error) error {
+		if err != nil || path == stagingPath {
+			return err
+		}
+		relPath, err := filepath.Rel(stagingPath, path)
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			if sourceInfo, err := os.Stat(filepath.Join(folder, relPath)); err == nil && sourceInfo.IsDir() {
+				return nil
+			}
+			if err := os.RemoveAll(path); err != nil {
+				return err
+			}
+			return filepath.SkipDir
+		}
+		if keep[relPath] {
+			return nil
+		}
+		return os.Remove(path)
+	})
+}
+
+// copyBundleMembers copies and verifies the members of a bundle into its staging directory using a bounded number
+// of parallel workers. The first error stops the remaining members and is returned.
+//
+// Parameters:
+// - ctx: The context to control the copying lifecycle.
+// - folder: The source bundle directory.
+// - stagingPath: The staging directory at the destination.
+// - members: The member paths relative to the bundle directory.
+// - opts: The options for copying each member.
+// - verification: The verification mode applied to each member.
+// - workers: The maximum number of members copied at the same time.
+//
+// Returns:
+// - []CopyResult: The result of each member, in the same order as members.
+// - error: The first error encountered.
+func copyBundleMembers(ctx context.Context, folder, stagingPath string, members []string, opts CopyOptions, verification string, workers int) ([]CopyResult, error) {
+	results := make([]CopyResult, len(members))
+	workerCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var firstErr error
+	var errOnce sync.Once
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				src := filepath.Join(folder, members[i])
+				stagedPath := filepath.Join(stagingPath, members[i])
+				result, err := copyBundleMember(workerCtx, src, stagedPath, opts, verification)
+				if err != nil {
+					errOnce.Do(func() {
+						firstErr = err
+						cancel()
+					})
+					continue
+				}
+				results[i] = result
+			}
+		}()
+	}
+
+dispatch:
+	for i := range members {
+		select {
+		case jobs <- i:
+		case <-workerCtx.Done():
+			break dispatch
+		}
+	}
+	close(jobs)
+	wg.Wait()
+
+	if firstErr == nil {
+		firstErr = ctx.Err()
+	}
+	return results, firstErr
+}
+
+// copyBundleMember copies a single bundle member to its staged path, verifies it and renames it into place
+// inside the staging directory.
+//
+// Parameters:
+// - ctx: The context to control the copying lifecycle.
+// - src: The source member path.
+// - stagedPath: The path of the member inside the staging directory.
+// - opts: The options for copying the member.
+// - verification: The verification mode applied to the member.
+//
+// Returns:
+// - CopyResult: The size, checksum and I/O engine of the copy.
+// - error: An error object if the member could not be copied or failed verification.
+func copyBundleMember(ctx context.Context, src, stagedPath string, opts CopyOptions, verification string) (CopyResult, error) {
+	result, err := CopyFileWithOptions(ctx, src, stagedPath, opts)
+	if err != nil {
+		return result, err
+	}
+	if err := VerifyCopy(verification, src, stagedPath+".cat.part", result.Size, result.Checksum, result.Algorithm); err != nil {
+		os.Remove(stagedPath + ".cat.part")
+		return result, err
+	}
+	return result, os.Rename(stagedPath+".cat.part", stagedPath)
+}
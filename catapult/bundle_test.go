@@ -0,0 +1,121 @@
+package catapult
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCopyBundleWithVerification(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+
+	tmpDir := t.TempDir()
+	src := filepath.Join(tmpDir, "src", "run.d")
+	destination := filepath.Join(tmpDir, "dst")
+	destPath := filepath.Join(destination, "run.d")
+	os.MkdirAll(filepath.Join(src, "sub"), 0755)
+	os.WriteFile(filepath.Join(src, "analysis.tdf"), []byte("analysis"), 0644)
+	os.WriteFile(filepath.Join(src, "sub", "analysis.tdf_bin"), []byte("binary data"), 0644)
+	os.WriteFile(filepath.Join(src, "empty"), nil, 0644)
+
+	cfg := Configuration{Name: "bundle", Destinations: []string{destination}}
+	copyBundleWithVerification(context.Background(), db, cfg, src, destPath, destination, CopyOptions{})
+
+	if _, err := os.Stat(destPath + ".cat.part"); !os.IsNotExist(err) {
+		t.Fatalf("Expected staging directory to be renamed into place")
+	}
+	content, err := os.ReadFile(filepath.Join(destPath, "sub", "analysis.tdf_bin"))
+	if err != nil || string(content) != "binary data" {
+		t.Fatalf("Bundle member not copied: %q, %v", content, err)
+	}
+
+	copied, err := IsFileCopied(db, src, destination, true)
+	if err != nil || !copied {
+		t.Fatalf("Expected bundle to be marked as copied: %v", err)
+	}
+	expectedHash, _ := CalculateFileHash(src)
+	checksum, _ := GetCopiedFileChecksum(db, src, destination)
+	if checksum != expectedHash {
+		t.Fatalf("bundle checksum = %s, want %s", checksum, expectedHash)
+	}
+	manifest, found, err := GetManifest(db, src)
+	if err != nil || !found || len(manifest.Entries) != 3 {
+		t.Fatalf("Expected bundle manifest with 3 entries, got %+v, %v", manifest, err)
+	}
+}
+
+func TestCopyBundleWithVerificationStaleStaging(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+
+	tmpDir := t.TempDir()
+	src := filepath.Join(tmpDir, "src", "run.d")
+	destination := filepath.Join(tmpDir, "dst")
+	destPath := filepath.Join(destination, "run.d")
+	os.MkdirAll(src, 0755)
+	os.WriteFile(filepath.Join(src, "analysis.tdf"), []byte("analysis"), 0644)
+
+	// An earlier attempt staged a member that was renamed at the source since, and a directory that is gone.
+	staging := destPath + ".cat.part"
+	os.MkdirAll(filepath.Join(staging, "removed"), 0755)
+	os.WriteFile(filepath.Join(staging, "renamed.tdf"), []byte("old"), 0644)
+	os.WriteFile(filepath.Join(staging, "renamed.tdf.cat.part"), []byte("ol"), 0644)
+	os.WriteFile(filepath.Join(staging, "removed", "member"), []byte("gone"), 0644)
+
+	cfg := Configuration{Name: "bundle", Destinations: []string{destination}, Resume: true}
+	for _, verification := range []string{VerifyFull, VerifyNone} {
+		cfg.Verification = verification
+		os.RemoveAll(destPath)
+		db.Exec(`DELETE FROM copied_files`)
+		copyBundleWithVerification(context.Background(), db, cfg, src, destPath, destination, CopyOptions{Resume: true})
+
+		entries, err := os.ReadDir(destPath)
+		if err != nil || len(entries) != 1 || entries[0].Name() != "analysis.tdf" {
+			t.Fatalf("%s: expected only the current member to be published, got %v, %v", verification, entries, err)
+		}
+		if copied, _ := IsFileCopied(db, src, destination, true); !copied {
+			t.Fatalf("%s: expected bundle to be marked as copied", verification)
+		}
+		os.MkdirAll(filepath.Join(staging, "removed"), 0755)
+		os.WriteFile(filepath.Join(staging, "renamed.tdf"), []byte("old"), 0644)
+	}
+}
+
+func TestCopyBundleMembersParallel(t *testing.T) {
+	tmpDir := t.TempDir()
+	src := filepath.Join(tmpDir, "run.d")
+	staging := filepath.Join(tmpDir, "out", "run.d.cat.part")
+	os.MkdirAll(src, 0755)
+	os.MkdirAll(staging, 0755)
+
+	var members []string
+	for i := 0; i < 20; i++ {
+		name := fmt.Sprintf("member%02d.bin", i)
+		os.WriteFile(filepath.Join(src, name), []byte(strings.Repeat(name, i+1)), 0644)
+		members = append(members, name)
+	}
+
+	results, err := copyBundleMembers(context.Background(), src, staging, members, CopyOptions{}, VerifyFull, 4)
+	if err != nil {
+		t.Fatalf("copyBundleMembers() error: %v", err)
+	}
+	for i, name := range members {
+		expectedHash, _ := CalculateFileHash(filepath.Join(src, name))
+		if results[i].Checksum != expectedHash {
+			t.Fatalf("result %d checksum = %s, want %s", i, results[i].Checksum, expectedHash)
+		}
+		if _, err := os.Stat(filepath.Join(staging, name)); err != nil {
+			t.Fatalf("Member %s not staged: %v", name, err)
+		}
+	}
+
+	// A missing member is reported as the first error.
+	members = append(members, "missing.bin")
+	if _, err := copyBundleMembers(context.Background(), src, staging, members, CopyOptions{}, VerifyFull, 4); err == nil {
+		t.Fatalf("Expected error for missing member")
+	}
+}
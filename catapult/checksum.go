@@ -0,0 +1,248 @@
+package catapult
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"os"
+
+	"github.com/zeebo/xxh3"
+	"lukechampine.com/blake3"
+)
+
+// Checksum algorithms that can be selected per configuration.
+const (
+	ChecksumSHA256 = "sha256"
+	ChecksumMD5    = "md5"
+	ChecksumCRC32C = "crc32c"
+	ChecksumXXH3   = "xxh3"
+	// ChecksumBLAKE3 hashes large chunks on several threads.
+	ChecksumBLAKE3 = "blake3"
+)
+
+// DefaultChecksumAlgorithm is used when a configuration does not select an algorithm. Records written before
+// algorithms were selectable have no algorithm stored and were hashed with it.
+const DefaultChecksumAlgorithm = ChecksumSHA256
+
+// checksumBufferSize is the read size used when hashing a file. Large reads let BLAKE3 spread the work of a
+// single write over several threads.
+const checksumBufferSize = 4 * 1024 * 1024
+
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+// newChecksumHash returns a new hash for the given checksum algorithm.
+//
+// Parameters:
+// - algorithm: The checksum algorithm. An empty algorithm is the same as DefaultChecksumAlgorithm.
+//
+// Returns:
+// - hash.Hash: The new hash.
+// - error: An error object if the algorithm is unknown.
+func newChecksumHash(algorithm string) (hash.Hash, error) {
+	switch normalizeChecksumAlgorithm(algorithm) {
+	case ChecksumSHA256:
+		return sha256.New(), nil
+	case ChecksumMD5:
+		return md5.New(), nil
+	case ChecksumCRC32C:
+		return crc32.New(crc32cTable), nil
+	case ChecksumXXH3:
+		return xxh3.New(), nil
+	case ChecksumBLAKE3:
+		return blake3.New(32, nil), nil
+	default:
+		return nil, fmt.Errorf("unknown checksum algorithm: %s", algorithm)
+	}
+}
+
+// normalizeChecksumAlgorithm maps an empty algorithm to DefaultChecksumAlgorithm.
+//
+// Parameters:
+// - algorithm: The checksum algorithm.
+//
+// Returns:
+// - string: The algorithm, or DefaultChecksumAlgorithm if it was empty.
+func normalizeChecksumAlgorithm(algorithm string) string {
+	if algorithm == "" {
+		return DefaultChecksumAlgorithm
+	}
+	return algorithm
+}
+
+// ValidateChecksumAlgorithm checks that a checksum algorithm is known.
+//
+// Parameters:
+// - algorithm: The checksum algorithm. An empty algorithm is valid.
+//
+// Returns:
+// - error: An error object if the algorithm is unknown.
+func ValidateChecksumAlgorithm(algorithm string) error {
+	_, err := newChecksumHash(algorithm)
+	return err
+}
+
+// checksumAlgorithm returns the primary checksum algorithm of the configuration.
+//
+// Returns:
+// - string: The checksum algorithm.
+func (cfg Configuration) checksumAlgorithm() string {
+	return normalizeChecksumAlgorithm(cfg.ChecksumAlgorithm)
+}
+
+// checksummer computes a primary and an optional secondary checksum in a single pass over the data.
+type checksummer struct {
+	primary   hash.Hash
+	secondary hash.Hash
+}
+
+// newChecksummer creates a checksummer for the given algorithms.
+//
+// Parameters:
+// - algorithm: The primary checksum algorithm.
+// - secondary: The secondary checksum algorithm, or an empty string for none.
+//
+// Returns:
+// - *checksummer: The new checksummer.
+// - error: An error object if an algorithm is unknown.
+func newChecksummer(algorithm, secondary string) (*checksummer, error) {
+	primary, err := newChecksumHash(algorithm)
+	if err != nil {
+		return nil, err
+	}
+	c := &checksummer{primary: primary}
+	if secondary != "" {
+		if c.secondary, err = newChecksumHash(secondary); err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// Write feeds data to both hashes.
+func (c *checksummer) Write(p []byte) (int, error) {
+	c.primary.Write(p)
+	if c.secondary != nil {
+		c.secondary.Write(p)
+	}
+	return len(p), nil
+}
+
+// Reset resets both hashes.
+func (c *checksummer) Reset() {
+	c.primary.Reset()
+	if c.secondary != nil {
+		c.secondary.Reset()
+	}
+}
+
+// sum returns the primary checksum in hexadecimal format.
+func (c *checksummer) sum() string {
+	return hex.EncodeToString(c.primary.Sum(nil))
+}
+
+// secondarySum returns the secondary checksum in hexadecimal format, or an empty string if there is none.
+func (c *checksummer) secondarySum() string {
+	if c.secondary == nil {
+		return ""
+	}
+	return hex.EncodeToString(c.secondary.Sum(nil))
+}
+
+// CalculateFileChecksum calculates the checksum of the file or directory at the given path with the given algorithm.
+//
+// Parameters:
+// - filePath: The path of the file or directory to calculate the checksum for.
+// - algorithm: The checksum algorithm.
+//
+// Returns:
+// - string: The checksum in hexadecimal format.
+// - error: An error object if there was an issue calculating the checksum.
+func CalculateFileChecksum(filePath, algorithm string) (string, error) {
+	checksum, _, err := CalculateFileChecksums(filePath, algorithm, "")
+	return checksum, err
+}
+
+// CalculateFileChecksums calculates a primary and an optional secondary checksum of the file or directory at the
+// given path, reading the data only once. The checksum of a directory is the digest of its manifest.
+//
+// Parameters:
+// - filePath: The path of the file or directory to calculate the checksums for.
+// - algorithm: The primary checksum algorithm.
+// - secondary: The secondary checksum algorithm, or an empty string for none.
+//
+// Returns:
+// - string: The primary checksum in hexadecimal format.
+// - string: The secondary checksum in hexadecimal format, or an empty string if there is none.
+// - error: An error object if there was an issue calculating the checksums.
+func CalculateFileChecksums(filePath, algorithm, secondary string) (string, string, error) {
+	return calculateChecksums(context.Background(), filePath, algorithm, secondary, nil)
+}
+
+// calculateChecksums calculates checksums like CalculateFileChecksums, reading the data at the pace allowed by
+// the given rate limiters.
+//
+// Parameters:
+// - ctx: The context to control the hashing lifecycle.
+// - filePath: The path of the file or directory to calculate the checksums for.
+// - algorithm: The primary checksum algorithm.
+// - secondary: The secondary checksum algorithm, or an empty string for none.
+// - limiters: The rate limiters every read waits on.
+//
+// Returns:
+// - string: The primary checksum in hexadecimal format.
+// - string: The secondary checksum in hexadecimal format, or an empty string if there is none.
+// - error: An error object if there was an issue calculating the checksums.
+func calculateChecksums(ctx context.Context, filePath, algorithm, secondary string, limiters []*RateLimiter) (string, string, error) {
+	info, err := os.Stat(filePath)
+	if err != nil {
+		return "", "", err
+	}
+
+	sums, err := newChecksummer(algorithm, secondary)
+	if err != nil {
+		return "", "", err
+	}
+
+	if info.IsDir() {
+		manifest, err := walkManifest(ctx, filePath, algorithm, secondary, true, limiters)
+		if err != nil {
+			return "", "", err
+		}
+		return manifest.Digest(), manifest.SecondaryDigest(), nil
+	}
+
+	file, err := os.Open(filePath)
+	if err != nil {
+		return "", "", err
+	}
+	defer file.Close()
+
+	buffer := make([]byte, checksumBufferSize)
+	for {
+		if err := ctx.Err(); err != nil {
+			return "", "", err
+		}
+		n, err := file.Read(buffer)
+		if n > 0 {
+			for _, limiter := range limiters {
+				if err := limiter.WaitN(ctx, n); err != nil {
+					return "", "", err
+				}
+			}
+			sums.Write(buffer[:n])
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", "", err
+		}
+	}
+
+	return sums.sum(), sums.secondarySum(), nil
+}
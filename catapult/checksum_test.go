@@ -0,0 +1,108 @@
+package catapult
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCalculateFileChecksum(t *testing.T) {
+	src := filepath.Join(t.TempDir(), "abc.txt")
+	if err := os.WriteFile(src, []byte("abc"), 0644); err != nil {
+		t.Fatalf("Failed to create test file: %v", err)
+	}
+
+	expected := map[string]string{
+		ChecksumSHA256: "ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad",
+		ChecksumMD5:    "900150983cd24fb0d6963f7d28e17f72",
+		ChecksumCRC32C: "364b3fb7",
+		ChecksumBLAKE3: "6437b3ac38465133ffb63b75273a8db548c558465d79db03fd359c6cd5bd9d85",
+	}
+	for algorithm, want := range expected {
+		got, err := CalculateFileChecksum(src, algorithm)
+		if err != nil {
+			t.Fatalf("CalculateFileChecksum(%s) error: %v", algorithm, err)
+		}
+		if got != want {
+			t.Errorf("CalculateFileChecksum(%s) = %s, want %s", algorithm, got, want)
+		}
+	}
+
+	if _, err := CalculateFileChecksum(src, "sha3"); err == nil {
+		t.Fatalf("Expected error for unknown algorithm")
+	}
+}
+
+func TestCopyFileWithChecksumAlgorithms(t *testing.T) {
+	tmpDir := t.TempDir()
+	src := filepath.Join(tmpDir, "source.raw")
+	content := make([]byte, 3*1024*1024+17)
+	for i := range content {
+		content[i] = byte(i % 253)
+	}
+	if err := os.WriteFile(src, content, 0644); err != nil {
+		t.Fatalf("Failed to create test file: %v", err)
+	}
+	md5Hash, _ := CalculateFileChecksum(src, ChecksumMD5)
+
+	for _, algorithm := range []string{ChecksumSHA256, ChecksumMD5, ChecksumCRC32C, ChecksumXXH3, ChecksumBLAKE3} {
+		dst := filepath.Join(tmpDir, algorithm, "source.raw")
+		opts := CopyOptions{Checksum: algorithm, SecondaryChecksum: ChecksumMD5, Engine: EngineBuffered}
+		result, err := CopyFileWithOptions(context.Background(), src, dst, opts)
+		if err != nil {
+			t.Fatalf("CopyFileWithOptions(%s) error: %v", algorithm, err)
+		}
+		expectedHash, _ := CalculateFileChecksum(src, algorithm)
+		if result.Checksum != expectedHash || result.Algorithm != algorithm {
+			t.Fatalf("%s checksum = %s (%s), want %s", algorithm, result.Checksum, result.Algorithm, expectedHash)
+		}
+		if result.SecondaryChecksum != md5Hash || result.SecondaryAlgorithm != ChecksumMD5 {
+			t.Fatalf("%s secondary checksum = %s, want %s", algorithm, result.SecondaryChecksum, md5Hash)
+		}
+		if err := VerifyCopy(VerifyFull, src, dst+".cat.part", result.Size, result.Checksum, result.Algorithm); err != nil {
+			t.Fatalf("VerifyCopy(%s) error: %v", algorithm, err)
+		}
+	}
+}
+
+func TestChecksumAlgorithmRecords(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+
+	filePath := "checksum_records.raw"
+	destination := "destination"
+	if err := SaveFileSize(db, filePath, 3, false); err != nil {
+		t.Fatalf("SaveFileSize() error: %v", err)
+	}
+	if err := MarkFileAsCopied(db, filePath, destination, false); err != nil {
+		t.Fatalf("MarkFileAsCopied() error: %v", err)
+	}
+
+	// Checksums recorded without an algorithm were SHA-256.
+	if _, err := db.Exec(`UPDATE file_sizes SET checksum = 'legacy' WHERE path = ?`, filePath); err != nil {
+		t.Fatalf("Failed to write legacy checksum: %v", err)
+	}
+	if got, _ := GetOriginFileChecksumFor(db, filePath, ChecksumSHA256); got != "legacy" {
+		t.Fatalf("legacy checksum = %q, want %q", got, "legacy")
+	}
+	if got, _ := GetOriginFileChecksumFor(db, filePath, ChecksumXXH3); got != "" {
+		t.Fatalf("legacy checksum for xxh3 = %q, want empty", got)
+	}
+
+	if err := UpdateFileChecksumWithAlgorithm(db, filePath, "1234", ChecksumXXH3); err != nil {
+		t.Fatalf("UpdateFileChecksumWithAlgorithm() error: %v", err)
+	}
+	if err := UpdateCopiedFileChecksumWithAlgorithm(db, filePath, destination, "5678", ChecksumMD5); err != nil {
+		t.Fatalf("UpdateCopiedFileChecksumWithAlgorithm() error: %v", err)
+	}
+	if got, _ := GetOriginFileChecksumFor(db, filePath, ChecksumXXH3); got != "1234" {
+		t.Fatalf("xxh3 checksum = %q, want %q", got, "1234")
+	}
+	if got, _ := GetCopiedFileChecksumFor(db, filePath, destination, ChecksumXXH3); got != "" {
+		t.Fatalf("md5 copy checksum for xxh3 = %q, want empty", got)
+	}
+	if got, _ := GetCopiedFileChecksumFor(db, filePath, destination, ChecksumMD5); got != "5678" {
+		t.Fatalf("md5 copy checksum = %q, want %q", got, "5678")
+	}
+}
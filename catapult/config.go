@@ -4,22 +4,107 @@ package catapult
 import (
 	"encoding/json"
 	"os"
+	"path/filepath"
+	"strings"
 	"time"
 )
 
 type Configuration struct {
-	Name                string   `json:"name"`
-	Directories         []string `json:"directories"`
-	Destinations        []string `json:"destinations"`
-	CheckInterval       string   `json:"check_interval"`
-	MinFreeSpace        int64    `json:"min_free_space"`
-	MinFileSize         int64    `json:"min_file_size"`
-	OverrideIfDifferent bool     `json:"override_if_different"`
+	Name                       string                       `json:"name"`
+	Directories                []string                     `json:"directories"`
+	Destinations               []string                     `json:"destinations"`
+	CheckInterval              string                       `json:"check_interval"`
+	MinFreeSpace               int64                        `json:"min_free_space"`
+	MinFileSize                int64                        `json:"min_file_size"`
+	OverrideIfDifferent        bool                         `json:"override_if_different"`
+	RateLimit                  int64                        `json:"rate_limit,omitempty"`
+	FanOut                     bool                         `json:"fan_out,omitempty"`
+	Verification               string                       `json:"verification,omitempty"`
+	Resume                     bool                         `json:"resume,omitempty"`
+	BundleWorkers              int                          `json:"bundle_workers,omitempty"`
+	ChecksumAlgorithm          string                       `json:"checksum_algorithm,omitempty"`
+	SecondaryChecksumAlgorithm string                       `json:"secondary_checksum_algorithm,omitempty"`
+	Scrub                      ScrubConfig                  `json:"scrub,omitempty"`
+	Versioning                 VersioningConfig             `json:"versioning,omitempty"`
+	Symlinks                   string                       `json:"symlinks,omitempty"`
+	SidecarExtensions          []string                     `json:"sidecar_extensions,omitempty"`
+	DestinationSettings        map[string]DestinationConfig `json:"destination_settings,omitempty"`
 }
+
+// DestinationConfig holds settings that apply to a single destination of a configuration.
+type DestinationConfig struct {
+	RateLimit      int64          `json:"rate_limit,omitempty"`
+	Verification   string         `json:"verification,omitempty"`
+	IOEngine       string         `json:"io_engine,omitempty"`
+	Metadata       MetadataConfig `json:"metadata,omitempty"`
+	Archive        bool           `json:"archive,omitempty"`
+	Durable        *bool          `json:"durable,omitempty"`
+	ChecksumFile   string         `json:"checksum_file,omitempty"`
+	Layout         string         `json:"layout,omitempty"`
+	BundleArchive  string         `json:"bundle_archive,omitempty"`
+	Compression    string         `json:"compression,omitempty"`
+	Encryption     string         `json:"encryption,omitempty"`
+	RecipientsFile string         `json:"recipients_file,omitempty"`
+	IdentityFile   string         `json:"identity_file,omitempty"`
+	Conflict       string         `json:"conflict,omitempty"`
+	Names          NameRules      `json:"names,omitempty"`
+}
+
+// ScrubConfig controls the background re-hashing of copies at the destinations of a configuration.
+type ScrubConfig struct {
+	// Interval is how often every copy is re-hashed, for example "2160h" for once a quarter. Empty disables scrubbing.
+	Interval  string `json:"interval,omitempty"`
+	RateLimit int64  `json:"rate_limit,omitempty"`
+	// Repair selects where damaged or missing copies are restored from: "none", "source", "destination" or "any".
+	Repair string `json:"repair,omitempty"`
+}
+
+// VersioningConfig controls what happens to a copy that is overridden because its source changed.
+type VersioningConfig struct {
+	// Keep is the number of previous versions kept per copy. Zero removes overridden copies.
+	Keep int `json:"keep,omitempty"`
+	// Directory is where versions are kept, relative to the destination. Defaults to ".catapult-versions".
+	Directory string `json:"directory,omitempty"`
+}
+
 type Configurations struct {
 	Configs        []Configuration `json:"configs"`
 	SlackToken     string          `json:"slack_token,omitempty"`
 	SlackChannelID string          `json:"slack_channel_id,omitempty"`
+	RateLimit      int64           `json:"rate_limit,omitempty"`
+}
+
+// destinationConfig returns the settings for the given destination, or the defaults if none are configured.
+//
+// Parameters:
+// - destination: The destination directory as listed in Destinations.
+//
+// Returns:
+// - DestinationConfig: The settings for the destination.
+func (cfg Configuration) destinationConfig(destination string) DestinationConfig {
+	return cfg.DestinationSettings[destination]
+}
+
+// destinationPath returns the path at a destination that a source path is copied to, taking the layout of the
+// destination into account.
+//
+// Parameters:
+// - file: The source file or directory.
+// - destination: The destination directory.
+// - isFolder: Boolean indicating if the source is a bundle directory.
+//
+// Returns:
+// - string: The path at the destination.
+// - bool: True if the source path is inside one of the configured directories.
+func (cfg Configuration) destinationPath(file, destination string, isFolder bool) (string, bool) {
+	for _, dir := range cfg.Directories {
+		relPath, err := filepath.Rel(dir, file)
+		if err != nil || relPath == "." || relPath == ".." || strings.HasPrefix(relPath, ".."+string(filepath.Separator)) {
+			continue
+		}
+		return cfg.destinationConfig(destination).copyLocation(cfg.mirrorPath(destination, relPath), isFolder), true
+	}
+	return "", false
 }
 
 // CreateTemplateConfig creates a template configuration file with example values.
@@ -107,3 +192,124 @@ func ReadConfigsFromFile(filePath string) (Configurations, error) {
 	err = decoder.Decode(&configs)
 	return configs, err
 }
+
+// durable reports whether copies to the destination are flushed to stable storage before they are recorded
+// as copied. Durability is on by default for archive destinations.
+//
+// Returns:
+// - bool: True if copies must be durable.
+func (d DestinationConfig) durable() bool {
+	if d.Durable != nil {
+		return *d.Durable
+	}
+	return d.Archive
+}
+
+// layout returns how copies are laid out at the destination.
+//
+// Returns:
+// - string: The layout, LayoutMirror unless another layout is configured.
+func (d DestinationConfig) layout() string {
+	if d.Layout == "" {
+		return LayoutMirror
+	}
+	return d.Layout
+}
+
+// bundleArchive returns the archive format bundle directories are packed into at the destination.
+//
+// Parameters:
+// - isFolder: Boolean indicating if the copy is a bundle directory.
+//
+// Returns:
+// - string: The archive format, or an empty string if the copy is not archived.
+func (d DestinationConfig) bundleArchive(isFolder bool) string {
+	if !isFolder || d.layout() != LayoutMirror {
+		return ""
+	}
+	return d.BundleArchive
+}
+
+// compression returns the compression applied to copies of single files at the destination.
+//
+// Parameters:
+// - isFolder: Boolean indicating if the copy is a bundle directory.
+//
+// Returns:
+// - string: The compression, or an empty string if the copy is stored as is.
+func (d DestinationConfig) compression(isFolder bool) string {
+	if isFolder || d.layout() != LayoutMirror {
+		return ""
+	}
+	return d.Compression
+}
+
+// encryption returns the encryption applied to copies of single files at the destination.
+//
+// Parameters:
+// - isFolder: Boolean indicating if the copy is a bundle directory.
+//
+// Returns:
+// - string: The encryption, or an empty string if the copy is stored unencrypted.
+func (d DestinationConfig) encryption(isFolder bool) string {
+	if isFolder || d.layout() != LayoutMirror {
+		return ""
+	}
+	return d.Encryption
+}
+
+// storedSuffix returns the suffix appended to the name of a copy that is compressed or encrypted.
+//
+// Parameters:
+// - isFolder: Boolean indicating if the copy is a bundle directory.
+//
+// Returns:
+// - string: The suffix, or an empty string if the copy is stored as is.
+func (d DestinationConfig) storedSuffix(isFolder bool) string {
+	suffix := ""
+	if d.compression(isFolder) != "" {
+		suffix += compressedSuffix
+	}
+	if d.encryption(isFolder) != "" {
+		suffix += encryptedSuffix
+	}
+	return suffix
+}
+
+// plainFileCopies reports whether single files are copied byte for byte to their mirrored path, which lets them be
+// streamed to several destinations at once.
+//
+// Returns:
+// - bool: True if single files are stored as plain copies.
+func (d DestinationConfig) plainFileCopies() bool {
+	return d.layout() == LayoutMirror && d.storedSuffix(false) == ""
+}
+
+// copyLocation returns where the copy of a file or bundle directory is found at the destination.
+//
+// Parameters:
+// - destPath: The path of the copy in the mirrored source tree.
+// - isFolder: Boolean indicating if the copy is a bundle directory.
+//
+// Returns:
+// - string: The path of the copy, which is inside its bag, an archive or a compressed or encrypted file for some destinations.
+func (d DestinationConfig) copyLocation(destPath string, isFolder bool) string {
+	if d.layout() == LayoutBagIt {
+		return bagPayloadPath(destPath)
+	}
+	if format := d.bundleArchive(isFolder); format != "" {
+		return archivePath(destPath, format)
+	}
+	return destPath + d.storedSuffix(isFolder)
+}
+
+// bundleWorkers returns the number of bundle members copied in parallel, which is at least one.
+//
+// Returns:
+// - int: The number of parallel workers.
+func (cfg Configuration) bundleWorkers() int {
+	if cfg.BundleWorkers < 1 {
+		return 1
+	}
+	return cfg.BundleWorkers
+}
@@ -0,0 +1,357 @@
+package catapult
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Policies for a copy that already exists at a destination and differs from its source.
+const (
+	// ConflictSkip leaves the existing copy in place and records the conflict for review.
+	ConflictSkip = "skip"
+	// ConflictOverwrite replaces the existing copy, keeping it as a version if versioning is configured.
+	ConflictOverwrite = "overwrite"
+	// ConflictKeepBoth renames the existing copy with a numbered suffix and copies the source next to it.
+	ConflictKeepBoth = "keep_both"
+	// ConflictNewer overwrites the existing copy if the source was modified more recently, and skips otherwise.
+	ConflictNewer = "newer"
+	// ConflictLarger overwrites the existing copy if the source is larger, and skips otherwise.
+	ConflictLarger = "larger"
+	// ConflictQuarantine moves the existing copy into the quarantine directory of the destination.
+	ConflictQuarantine = "quarantine"
+)
+
+// Actions taken for a conflict.
+const (
+	ConflictActionSkipped     = "skipped"
+	ConflictActionOverwritten = "overwritten"
+	ConflictActionKeptBoth    = "kept_both"
+	ConflictActionQuarantined = "quarantined"
+)
+
+// Review states of a conflict.
+const (
+	// ConflictOpen is a skipped conflict waiting for review.
+	ConflictOpen = "open"
+	// ConflictPending has a resolution chosen for it that is applied the next time the source is checked.
+	ConflictPending = "pending"
+	// ConflictResolved needs no further action.
+	ConflictResolved = "resolved"
+)
+
+// quarantineDirectory is where quarantined copies are moved, relative to the destination.
+const quarantineDirectory = ".catapult-quarantine"
+
+// conflictPolicies are the valid conflict policies.
+var conflictPolicies = []string{ConflictSkip, ConflictOverwrite, ConflictKeepBoth, ConflictNewer, ConflictLarger, ConflictQuarantine}
+
+// Conflict is a source whose copy already existed at a destination with different content.
+type Conflict struct {
+	ID                  int64
+	FilePath            string
+	Destination         string
+	Path                string
+	Policy              string
+	Action              string
+	KeptPath            string
+	SourceSize          int64
+	SourceModified      time.Time
+	SourceChecksum      string
+	DestinationSize     int64
+	DestinationModified time.Time
+	DestinationChecksum string
+	ChecksumAlgorithm   string
+	Detected            time.Time
+	LastSeen            time.Time
+	Status              string
+	Resolution          string
+}
+
+// ValidateConflictPolicy checks that a conflict policy is known.
+//
+// Parameters:
+// - policy: The policy, or an empty string for the default.
+//
+// Returns:
+// - error: An error object if the policy is not supported.
+func ValidateConflictPolicy(policy string) error {
+	if policy == "" {
+		return nil
+	}
+	for _, known := range conflictPolicies {
+		if policy == known {
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown conflict policy: %s", policy)
+}
+
+// conflictPolicy returns the conflict policy of a destination. Without a policy, OverrideIfDifferent selects between
+// overwriting and skipping.
+//
+// Parameters:
+// - destination: The destination directory.
+//
+// Returns:
+// - string: The conflict policy.
+func (cfg Configuration) conflictPolicy(destination string) string {
+	if policy := cfg.destinationConfig(destination).Conflict; policy != "" {
+		return policy
+	}
+	if cfg.OverrideIfDifferent {
+		return ConflictOverwrite
+	}
+	return ConflictSkip
+}
+
+// conflictAction decides what a policy does with a conflict.
+//
+// Parameters:
+// - policy: The conflict policy.
+// - source: The source and its size.
+// - existing: The existing copy and its size.
+//
+// Returns:
+// - string: The action to take.
+func conflictAction(policy string, sourceModified, existingModified time.Time, sourceSize, existingSize int64) string {
+	switch policy {
+	case ConflictOverwrite:
+		return ConflictActionOverwritten
+	case ConflictKeepBoth:
+		return ConflictActionKeptBoth
+	case ConflictQuarantine:
+		return ConflictActionQuarantined
+	case ConflictNewer:
+		if sourceModified.After(existingModified) {
+			return ConflictActionOverwritten
+		}
+	case ConflictLarger:
+		if sourceSize > existingSize {
+			return ConflictActionOverwritten
+		}
+	}
+	return ConflictActionSkipped
+}
+
+// numberedPath returns the first path that does not exist yet with a number inserted before the extension, for
+// example sample.1.raw for sample.raw.
+//
+// Parameters:
+// - path: The path to number.
+//
+// Returns:
+// - string: The numbered path.
+func numberedPath(path string) string {
+	ext := filepath.Ext(path)
+	stem := strings.TrimSuffix(path, ext)
+	for n := 1; ; n++ {
+		candidate := fmt.Sprintf("%s.%d%s", stem, n, ext)
+		if _, err := os.Lstat(candidate); os.IsNotExist(err) {
+			return candidate
+		}
+	}
+}
+
+// resolveConflict applies the conflict policy of a destination to a copy that differs from its source and records
+// the conflict. A skipped conflict is only reported once for the same source and copy. A resolution chosen through
+// ResolveConflict replaces the policy for the conflict it was chosen for.
+//
+// Parameters:
+// - db: The database connection to record the conflict in.
+// - cfg: The configuration the copy belongs to.
+// - file: The source file or bundle directory.
+// - destPath: The path of the existing copy at the destination.
+// - destination: The destination directory.
+// - isFolder: Boolean indicating if the source is a bundle directory.
+// - sourceChecksum: The checksum of the source.
+// - destinationChecksum: The checksum of the existing copy.
+// - algorithm: The checksum algorithm of both checksums.
+//
+// Returns:
+// - bool: True if the source should be copied.
+func resolveConflict(db *sql.DB, cfg Configuration, file, destPath, destination string, isFolder bool, sourceChecksum, destinationChecksum, algorithm string) bool {
+	copyPath := destPath
+	if cfg.destinationConfig(destination).layout() == LayoutBagIt {
+		// The whole bag is replaced, so it is handled rather than only its payload.
+		copyPath = filepath.Dir(filepath.Dir(destPath))
+	}
+	sourceInfo, err := os.Stat(file)
+	if err == nil {
+		var existingInfo os.FileInfo
+		if existingInfo, err = os.Stat(copyPath); err == nil {
+			return applyConflictPolicy(db, cfg, file, destPath, copyPath, destination, isFolder, sourceInfo, existingInfo, sourceChecksum, destinationChecksum, algorithm)
+		}
+	}
+	LogWithDatetime(fmt.Sprintf("Error stating conflicting copy: %v", err), true)
+	sendSlackNotification(fmt.Sprintf("Error stating conflicting copy: %v", err))
+	return false
+}
+
+// applyConflictPolicy takes and records the action for a conflict whose paths were stated by resolveConflict.
+//
+// Parameters:
+// - db: The database connection to record the conflict in.
+// - cfg: The configuration the copy belongs to.
+// - file: The source file or bundle directory.
+// - destPath: The path of the existing copy at the destination.
+// - copyPath: The path that is moved aside, which is the bag holding destPath for BagIt destinations.
+// - destination: The destination directory.
+// - isFolder: Boolean indicating if the source is a bundle directory.
+// - sourceInfo: The information of the source.
+// - existingInfo: The information of the existing copy.
+// - sourceChecksum: The checksum of the source.
+// - destinationChecksum: The checksum of the existing copy.
+// - algorithm: The checksum algorithm of both checksums.
+//
+// Returns:
+// - bool: True if the source should be copied.
+func applyConflictPolicy(db *sql.DB, cfg Configuration, file, destPath, copyPath, destination string, isFolder bool, sourceInfo, existingInfo os.FileInfo, sourceChecksum, destinationChecksum, algorithm string) bool {
+	now := time.Now()
+	policy := cfg.conflictPolicy(destination)
+	previous, found, err := GetLatestConflict(db, file, destination)
+	if err != nil {
+		LogWithDatetime(fmt.Sprintf("Error getting conflict from database: %v", err), true)
+		sendSlackNotification(fmt.Sprintf("Error getting conflict from database: %v", err))
+		return false
+	}
+	pending := found && previous.Status == ConflictPending
+	if found && previous.SourceChecksum == sourceChecksum && previous.DestinationChecksum == destinationChecksum {
+		if pending {
+			policy = previous.Resolution
+		} else if previous.Action == ConflictActionSkipped {
+			dbMutex.Lock()
+			TouchConflict(db, previous.ID, now)
+			dbMutex.Unlock()
+			return false
+		}
+	}
+
+	sourceSize, existingSize := sourceInfo.Size(), existingInfo.Size()
+	if isFolder {
+		sourceSize, existingSize = GetDirectorySize(file), GetDirectorySize(copyPath)
+	}
+	if recorded, err := GetCopiedFileSize(db, file, destination); err == nil && recorded >= 0 {
+		// Stored copies are compared by the size of their content.
+		existingSize = recorded
+	}
+
+	action := conflictAction(policy, sourceInfo.ModTime(), existingInfo.ModTime(), sourceSize, existingSize)
+	var keptPath string
+	switch action {
+	case ConflictActionSkipped:
+		LogWithDatetime(fmt.Sprintf("File already exists but is different: %s", destPath), true)
+		sendSlackNotification(fmt.Sprintf("File already exists but is different: %s", destPath))
+	case ConflictActionOverwritten:
+		LogWithDatetime(fmt.Sprintf("Overriding file: %s because it is different", destPath), true)
+		sendSlackNotification(fmt.Sprintf("Overriding file: %s because it is different", destPath))
+		if cfg.Versioning.Keep > 0 {
+			err = keepVersion(db, cfg, file, copyPath, destination, isFolder, destinationChecksum, algorithm)
+		} else if cfg.destinationConfig(destination).layout() != LayoutBagIt {
+			// The bag writer moves an existing bag aside itself, and only removes it once the new bag is in place.
+			err = os.RemoveAll(copyPath)
+		}
+	case ConflictActionKeptBoth, ConflictActionQuarantined:
+		keptPath = numberedPath(copyPath)
+		if action == ConflictActionQuarantined {
+			var relPath string
+			if relPath, err = filepath.Rel(destination, copyPath); err == nil {
+				keptPath = timestampedPath(filepath.Join(destination, quarantineDirectory, relPath), now)
+				err = os.MkdirAll(filepath.Dir(keptPath), os.ModePerm)
+			}
+		}
+		if err == nil {
+			err = os.Rename(copyPath, keptPath)
+		}
+		if err == nil && cfg.destinationConfig(destination).durable() {
+			if err = syncDir(filepath.Dir(keptPath)); err == nil {
+				err = syncDir(filepath.Dir(copyPath))
+			}
+		}
+		if err == nil {
+			LogWithDatetime(fmt.Sprintf("Moved conflicting copy %s to %s", copyPath, keptPath), true)
+			sendSlackNotification(fmt.Sprintf("Moved conflicting copy %s to %s", copyPath, keptPath))
+		}
+	}
+	if err != nil {
+		LogWithDatetime(fmt.Sprintf("Error resolving conflict for %s: %v", destPath, err), true)
+		sendSlackNotification(fmt.Sprintf("Error resolving conflict for %s: %v", destPath, err))
+		return false
+	}
+
+	status := ConflictResolved
+	if action == ConflictActionSkipped {
+		status = ConflictOpen
+	}
+	dbMutex.Lock()
+	defer dbMutex.Unlock()
+	if pending {
+		err = UpdateConflictOutcome(db, previous.ID, action, keptPath, status, now)
+	} else {
+		err = SaveConflict(db, Conflict{
+			FilePath:            file,
+			Destination:         destination,
+			Path:                copyPath,
+			Policy:              policy,
+			Action:              action,
+			KeptPath:            keptPath,
+			SourceSize:          sourceSize,
+			SourceModified:      sourceInfo.ModTime(),
+			SourceChecksum:      sourceChecksum,
+			DestinationSize:     existingSize,
+			DestinationModified: existingInfo.ModTime(),
+			DestinationChecksum: destinationChecksum,
+			ChecksumAlgorithm:   algorithm,
+			Detected:            now,
+			LastSeen:            now,
+			Status:              status,
+		})
+	}
+	if err != nil {
+		LogWithDatetime(fmt.Sprintf("Error recording conflict for %s: %v", destPath, err), true)
+	}
+	return action != ConflictActionSkipped
+}
+
+// ResolveConflict chooses how an open conflict is resolved. Skipping closes the conflict and leaves the copy in
+// place; any other policy is applied the next time the source is checked.
+//
+// Parameters:
+// - db: The database connection holding the conflicts.
+// - id: The ID of the conflict.
+// - resolution: The conflict policy to apply.
+//
+// Returns:
+// - error: An error object if the conflict is unknown, already resolved or the resolution is not a policy.
+func ResolveConflict(db *sql.DB, id int64, resolution string) error {
+	if resolution == "" {
+		return fmt.Errorf("a resolution is required")
+	}
+	if err := ValidateConflictPolicy(resolution); err != nil {
+		return err
+	}
+	status := ConflictPending
+	if resolution == ConflictSkip {
+		status = ConflictResolved
+	}
+	return SetConflictResolution(db, id, resolution, status)
+}
+
+// PrintConflicts prints conflicts to the console, oldest first.
+//
+// Parameters:
+// - conflicts: The conflicts to print.
+func PrintConflicts(conflicts []Conflict) {
+	for _, c := range conflicts {
+		fmt.Printf("%-5d %-8s %-10s %s\n", c.ID, c.Status, c.Policy, c.Path)
+		fmt.Printf("      source      %s %12d %s %s\n", c.SourceModified.Format(time.RFC3339), c.SourceSize, c.SourceChecksum, c.FilePath)
+		fmt.Printf("      destination %s %12d %s\n", c.DestinationModified.Format(time.RFC3339), c.DestinationSize, c.DestinationChecksum)
+		if c.Resolution != "" {
+			fmt.Printf("      resolution  %s\n", c.Resolution)
+		}
+	}
+	LogWithDatetime(fmt.Sprintf("%d conflicts", len(conflicts)), false)
+}
@@ -0,0 +1,137 @@
+package catapult
+
+import (
+	"context"
+	"database/sql"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// setupConflict creates a source and a different copy of it at a destination with a conflict policy.
+func setupConflict(t *testing.T, db *sql.DB, policy string) (Configuration, string, string, string) {
+	t.Helper()
+	tmpDir := t.TempDir()
+	src := filepath.Join(tmpDir, "src")
+	destination := filepath.Join(tmpDir, "dst")
+	os.MkdirAll(src, 0755)
+	os.MkdirAll(destination, 0755)
+	file := filepath.Join(src, "sample.raw")
+	os.WriteFile(file, []byte("source"), 0644)
+	SaveFileSize(db, file, int64(len("source")), false)
+	copyPath := filepath.Join(destination, "sample.raw")
+	os.WriteFile(copyPath, []byte("existing copy"), 0644)
+
+	cfg := Configuration{
+		Name:                "conflicts",
+		Directories:         []string{src},
+		Destinations:        []string{destination},
+		DestinationSettings: map[string]DestinationConfig{destination: {Conflict: policy}},
+	}
+	return cfg, file, destination, copyPath
+}
+
+func TestConflictSkipRecordsOpenConflict(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+	cfg, file, destination, copyPath := setupConflict(t, db, "")
+
+	for i := 0; i < 2; i++ {
+		copyFileWithVerification(context.Background(), db, file, filepath.Dir(file), destination, cfg, math.MaxInt64)
+	}
+	if content, _ := os.ReadFile(copyPath); string(content) != "existing copy" {
+		t.Fatalf("Expected the existing copy to be kept, got %q", content)
+	}
+	conflicts, err := ListConflicts(db)
+	if err != nil || len(conflicts) != 1 {
+		t.Fatalf("ListConflicts() = %d conflicts, %v, want 1", len(conflicts), err)
+	}
+	c := conflicts[0]
+	if c.Status != ConflictOpen || c.Action != ConflictActionSkipped || c.Policy != ConflictSkip {
+		t.Fatalf("Unexpected conflict %+v", c)
+	}
+	if c.SourceSize != int64(len("source")) || c.DestinationSize != int64(len("existing copy")) || c.SourceChecksum == c.DestinationChecksum {
+		t.Fatalf("Unexpected conflict details %+v", c)
+	}
+
+	// Resolving the conflict applies the resolution on the next pass and closes it.
+	if err := ResolveConflict(db, c.ID, ConflictKeepBoth); err != nil {
+		t.Fatalf("ResolveConflict() error: %v", err)
+	}
+	copyFileWithVerification(context.Background(), db, file, filepath.Dir(file), destination, cfg, math.MaxInt64)
+	if content, _ := os.ReadFile(copyPath); string(content) != "source" {
+		t.Fatalf("Expected the source to be copied, got %q", content)
+	}
+	if content, _ := os.ReadFile(filepath.Join(destination, "sample.1.raw")); string(content) != "existing copy" {
+		t.Fatalf("Expected the existing copy to be kept as sample.1.raw, got %q", content)
+	}
+	if conflicts, _ := ListConflicts(db); len(conflicts) != 0 {
+		t.Fatalf("Expected no unresolved conflicts, got %+v", conflicts)
+	}
+	if err := ResolveConflict(db, c.ID, ConflictOverwrite); err == nil {
+		t.Fatalf("Expected ResolveConflict() to fail for a resolved conflict")
+	}
+}
+
+func TestConflictPolicies(t *testing.T) {
+	tests := []struct {
+		policy   string
+		aged     bool
+		wantCopy bool
+	}{
+		{ConflictOverwrite, false, true},
+		{ConflictNewer, false, false},
+		{ConflictNewer, true, true},
+		{ConflictLarger, false, false},
+		{ConflictQuarantine, false, true},
+	}
+	for _, tt := range tests {
+		db := setupTestDB(t)
+		cfg, file, destination, copyPath := setupConflict(t, db, tt.policy)
+		// The older of the two is the copy if it is aged, and the source otherwise.
+		old := time.Now().Add(-time.Hour)
+		if tt.aged {
+			os.Chtimes(copyPath, old, old)
+		} else {
+			os.Chtimes(file, old, old)
+		}
+		copyFileWithVerification(context.Background(), db, file, filepath.Dir(file), destination, cfg, math.MaxInt64)
+
+		content, _ := os.ReadFile(copyPath)
+		if copied := string(content) == "source"; copied != tt.wantCopy {
+			t.Fatalf("%s (aged %v): copy = %q, want copied %v", tt.policy, tt.aged, content, tt.wantCopy)
+		}
+		if tt.policy == ConflictQuarantine {
+			quarantined, _ := filepath.Glob(filepath.Join(destination, quarantineDirectory, "sample.raw.*"))
+			if len(quarantined) != 1 {
+				t.Fatalf("Expected one quarantined copy, got %v", quarantined)
+			}
+			if content, _ := os.ReadFile(quarantined[0]); string(content) != "existing copy" {
+				t.Fatalf("Unexpected quarantined content %q", content)
+			}
+		}
+		c, found, err := GetLatestConflict(db, file, destination)
+		if err != nil || !found || c.Policy != tt.policy {
+			t.Fatalf("%s: GetLatestConflict() = %+v, %v, %v", tt.policy, c, found, err)
+		}
+		if wantStatus := map[bool]string{true: ConflictResolved, false: ConflictOpen}[tt.wantCopy]; c.Status != wantStatus {
+			t.Fatalf("%s: status = %q, want %q", tt.policy, c.Status, wantStatus)
+		}
+		db.Close()
+	}
+}
+
+func TestNumberedPath(t *testing.T) {
+	tmpDir := t.TempDir()
+	path := filepath.Join(tmpDir, "run.d")
+	os.WriteFile(filepath.Join(tmpDir, "run.1.d"), nil, 0644)
+	if got := numberedPath(path); got != filepath.Join(tmpDir, "run.2.d") {
+		t.Fatalf("numberedPath() = %s", got)
+	}
+	if err := ValidateConflictPolicy("newest"); err == nil || !strings.Contains(err.Error(), "newest") {
+		t.Fatalf("Expected ValidateConflictPolicy() to reject an unknown policy, got %v", err)
+	}
+}
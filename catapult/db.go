@@ -3,7 +3,9 @@ package catapult
 
 import (
 	"database/sql"
+	"fmt"
 	_ "modernc.org/sqlite"
+	"strings"
 	"testing"
 	"time"
 )
@@ -22,6 +24,23 @@ func setupTestDB(t *testing.T) *sql.DB {
 		t.Fatalf("sql.Open() error: %v", err)
 	}
 
+	err = createTables(db)
+	if err != nil {
+		t.Fatalf("Failed to create tables: %v", err)
+	}
+
+	return db
+}
+
+// createTables creates the tables for storing file sizes and copied status if they do not exist,
+// and adds any columns introduced since the database was created.
+//
+// Parameters:
+// - db: The database connection.
+//
+// Returns:
+// - error: An error object if there was an issue creating or migrating the tables.
+func createTables(db *sql.DB) error {
 	createTableSQL := `
 	 CREATE TABLE IF NOT EXISTS file_sizes (
 	  path TEXT PRIMARY KEY,
@@ -37,13 +56,180 @@ func setupTestDB(t *testing.T) *sql.DB {
 	  checksum TEXT,
 	  size INTEGER,
 	  PRIMARY KEY (file_path, destination, is_folder)
-	 );`
-	_, err = db.Exec(createTableSQL)
+	 );
+	 CREATE TABLE IF NOT EXISTS manifest_entries (
+	  path TEXT,
+	  member TEXT,
+	  size INTEGER,
+	  checksum TEXT,
+	  checksum_algorithm TEXT,
+	  secondary_checksum TEXT,
+	  secondary_checksum_algorithm TEXT,
+	  PRIMARY KEY (path, member)
+	 );
+	 CREATE TABLE IF NOT EXISTS archive_members (
+	  file_path TEXT,
+	  destination TEXT,
+	  archive_path TEXT,
+	  member TEXT,
+	  size INTEGER,
+	  checksum TEXT,
+	  checksum_algorithm TEXT,
+	  PRIMARY KEY (file_path, destination, member)
+	 );
+	 CREATE INDEX IF NOT EXISTS archive_members_archive_path ON archive_members (archive_path);
+	 CREATE TABLE IF NOT EXISTS store_objects (
+	  destination TEXT,
+	  checksum_algorithm TEXT,
+	  checksum TEXT,
+	  size INTEGER,
+	  refcount INTEGER DEFAULT 0,
+	  PRIMARY KEY (destination, checksum_algorithm, checksum)
+	 );
+	 CREATE TABLE IF NOT EXISTS store_links (
+	  destination TEXT,
+	  link_path TEXT,
+	  file_path TEXT,
+	  checksum_algorithm TEXT,
+	  checksum TEXT,
+	  PRIMARY KEY (destination, link_path)
+	 );
+	 CREATE INDEX IF NOT EXISTS store_links_file_path ON store_links (destination, file_path);
+	 CREATE INDEX IF NOT EXISTS store_links_object ON store_links (destination, checksum_algorithm, checksum);
+	 CREATE TABLE IF NOT EXISTS versions (
+	  file_path TEXT,
+	  destination TEXT,
+	  path TEXT,
+	  version_path TEXT PRIMARY KEY,
+	  is_folder BOOLEAN,
+	  checksum TEXT,
+	  checksum_algorithm TEXT,
+	  size INTEGER,
+	  created INTEGER
+	 );
+	 CREATE INDEX IF NOT EXISTS versions_path ON versions (path, created);
+	 CREATE INDEX IF NOT EXISTS versions_file_path ON versions (file_path, created);
+	 CREATE TABLE IF NOT EXISTS conflicts (
+	  id INTEGER PRIMARY KEY AUTOINCREMENT,
+	  file_path TEXT,
+	  destination TEXT,
+	  path TEXT,
+	  policy TEXT,
+	  action TEXT,
+	  kept_path TEXT,
+	  source_size INTEGER,
+	  source_modified INTEGER,
+	  source_checksum TEXT,
+	  destination_size INTEGER,
+	  destination_modified INTEGER,
+	  destination_checksum TEXT,
+	  checksum_algorithm TEXT,
+	  detected INTEGER,
+	  last_seen INTEGER,
+	  status TEXT,
+	  resolution TEXT
+	 );
+	 CREATE INDEX IF NOT EXISTS conflicts_file_path ON conflicts (file_path, destination);
+	 CREATE INDEX IF NOT EXISTS conflicts_status ON conflicts (status);
+	 CREATE TABLE IF NOT EXISTS name_mappings (
+	  destination TEXT,
+	  file_path TEXT,
+	  original TEXT,
+	  path TEXT,
+	  folded_path TEXT,
+	  PRIMARY KEY (destination, file_path)
+	 );
+	 CREATE INDEX IF NOT EXISTS name_mappings_folded_path ON name_mappings (destination, folded_path);`
+	_, err := db.Exec(createTableSQL)
 	if err != nil {
-		t.Fatalf("Failed to create tables: %v", err)
+		return err
 	}
 
-	return db
+	for _, c := range addedColumns {
+		if err := ensureColumn(db, c.table, c.column, c.definition); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addedColumns are the columns added to existing tables after they were first created. InitDB adds any that are
+// missing from an older database.
+var addedColumns = []struct{ table, column, definition string }{
+	{"copied_files", "verification", "TEXT"},
+	{"copied_files", "engine", "TEXT"},
+	{"copied_files", "checksum_algorithm", "TEXT"},
+	{"file_sizes", "checksum_algorithm", "TEXT"},
+	{"file_sizes", "secondary_checksum", "TEXT"},
+	{"file_sizes", "secondary_checksum_algorithm", "TEXT"},
+	{"copied_files", "last_scrubbed", "INTEGER"},
+	{"copied_files", "scrub_status", "TEXT"},
+	{"copied_files", "stored_path", "TEXT"},
+	{"copied_files", "stored_size", "INTEGER"},
+	{"copied_files", "stored_checksum", "TEXT"},
+	{"copied_files", "compression", "TEXT"},
+	{"copied_files", "compression_ratio", "REAL"},
+	{"copied_files", "encryption", "TEXT"},
+}
+
+// missingColumns lists the added columns an older database does not have yet, for connections that cannot migrate it.
+//
+// Parameters:
+// - db: The database connection.
+//
+// Returns:
+// - []string: The missing columns as table.column.
+// - error: An error object if there was an issue inspecting the tables.
+func missingColumns(db *sql.DB) ([]string, error) {
+	var missing []string
+	for _, c := range addedColumns {
+		var count int
+		err := db.QueryRow(`SELECT COUNT(*) FROM pragma_table_info(?) WHERE name = ?`, c.table, c.column).Scan(&count)
+		if err != nil {
+			return nil, err
+		}
+		if count == 0 {
+			missing = append(missing, c.table+"."+c.column)
+		}
+	}
+	return missing, nil
+}
+
+// ensureColumn adds a column to a table if it does not exist yet.
+//
+// Parameters:
+// - db: The database connection.
+// - table: The table to add the column to.
+// - column: The name of the column.
+// - definition: The type and constraints of the column.
+//
+// Returns:
+// - error: An error object if there was an issue inspecting or altering the table.
+func ensureColumn(db *sql.DB, table, column, definition string) error {
+	rows, err := db.Query(fmt.Sprintf("PRAGMA table_info(%s)", table))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var cid, notNull, pk int
+		var name, columnType string
+		var defaultValue sql.NullString
+		if err := rows.Scan(&cid, &name, &columnType, &notNull, &defaultValue, &pk); err != nil {
+			return err
+		}
+		if name == column {
+			return nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	rows.Close()
+
+	_, err = db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition))
+	return err
 }
 
 // InitDB initializes the SQLite database with the given file path.
@@ -61,23 +247,7 @@ func InitDB(dbPath string) (*sql.DB, error) {
 		return nil, err
 	}
 
-	createTableSQL := `
-	 CREATE TABLE IF NOT EXISTS file_sizes (
-	  path TEXT PRIMARY KEY,
-	  size INTEGER,
-	  is_folder BOOLEAN,
-	  last_modified TIMESTAMP,
-	  checksum TEXT
-	 );
-	 CREATE TABLE IF NOT EXISTS copied_files (
-	  file_path TEXT,
-	  destination TEXT,
-	  is_folder BOOLEAN,
-	  checksum TEXT,
-	  size INTEGER,
-	  PRIMARY KEY (file_path, destination, is_folder)
- 	);`
-	_, err = db.Exec(createTableSQL)
+	err = createTables(db)
 	if err != nil {
 		return nil, err
 	}
@@ -176,15 +346,11 @@ func MarkFileAsCopied(db *sql.DB, filePath, destination string, isFolder bool) e
 }
 
 func UpdateFileChecksum(db *sql.DB, filePath, checksum string) error {
-	query := `UPDATE file_sizes SET checksum = ? WHERE path = ?`
-	_, err := db.Exec(query, checksum, filePath)
-	return err
+	return UpdateFileChecksumWithAlgorithm(db, filePath, checksum, ChecksumSHA256)
 }
 
 func UpdateCopiedFileChecksum(db *sql.DB, filePath, destination, checksum string) error {
-	query := `UPDATE copied_files SET checksum = ? WHERE file_path = ? AND destination = ?`
-	_, err := db.Exec(query, checksum, filePath, destination)
-	return err
+	return UpdateCopiedFileChecksumWithAlgorithm(db, filePath, destination, checksum, ChecksumSHA256)
 }
 
 func GetOriginFileChecksum(db *sql.DB, filePath string) (string, error) {
@@ -213,6 +379,104 @@ func GetCopiedFileChecksum(db *sql.DB, filePath, destination string) (string, er
 	return "", nil
 }
 
+// UpdateFileChecksumWithAlgorithm records the checksum of a source file together with its checksum algorithm.
+//
+// Parameters:
+// - db: The database connection.
+// - filePath: The path of the source file.
+// - checksum: The checksum in hexadecimal format.
+// - algorithm: The checksum algorithm.
+//
+// Returns:
+// - error: An error object if there was an issue updating the database.
+func UpdateFileChecksumWithAlgorithm(db *sql.DB, filePath, checksum, algorithm string) error {
+	query := `UPDATE file_sizes SET checksum = ?, checksum_algorithm = ? WHERE path = ?`
+	_, err := db.Exec(query, checksum, normalizeChecksumAlgorithm(algorithm), filePath)
+	return err
+}
+
+// UpdateCopiedFileChecksumWithAlgorithm records the checksum of a copied file together with its checksum algorithm.
+//
+// Parameters:
+// - db: The database connection.
+// - filePath: The path of the source file.
+// - destination: The destination the file was copied to.
+// - checksum: The checksum in hexadecimal format.
+// - algorithm: The checksum algorithm.
+//
+// Returns:
+// - error: An error object if there was an issue updating the database.
+func UpdateCopiedFileChecksumWithAlgorithm(db *sql.DB, filePath, destination, checksum, algorithm string) error {
+	query := `UPDATE copied_files SET checksum = ?, checksum_algorithm = ? WHERE file_path = ? AND destination = ?`
+	_, err := db.Exec(query, checksum, normalizeChecksumAlgorithm(algorithm), filePath, destination)
+	return err
+}
+
+// UpdateFileSecondaryChecksum records the secondary checksum of a source file together with its checksum algorithm.
+//
+// Parameters:
+// - db: The database connection.
+// - filePath: The path of the source file.
+// - checksum: The checksum in hexadecimal format.
+// - algorithm: The checksum algorithm.
+//
+// Returns:
+// - error: An error object if there was an issue updating the database.
+func UpdateFileSecondaryChecksum(db *sql.DB, filePath, checksum, algorithm string) error {
+	query := `UPDATE file_sizes SET secondary_checksum = ?, secondary_checksum_algorithm = ? WHERE path = ?`
+	_, err := db.Exec(query, checksum, algorithm, filePath)
+	return err
+}
+
+// GetOriginFileChecksumFor retrieves the checksum of a source file if it was recorded with the given algorithm.
+// Checksums recorded before algorithms were stored count as DefaultChecksumAlgorithm.
+//
+// Parameters:
+// - db: The database connection.
+// - filePath: The path of the source file.
+// - algorithm: The checksum algorithm the caller compares with.
+//
+// Returns:
+// - string: The checksum, or an empty string if none was recorded with the algorithm.
+// - error: An error object if there was an issue querying the database.
+func GetOriginFileChecksumFor(db *sql.DB, filePath, algorithm string) (string, error) {
+	var checksum, stored sql.NullString
+	query := `SELECT checksum, checksum_algorithm FROM file_sizes WHERE path = ?`
+	err := db.QueryRow(query, filePath).Scan(&checksum, &stored)
+	if err != nil {
+		return "", err
+	}
+	if !checksum.Valid || normalizeChecksumAlgorithm(stored.String) != normalizeChecksumAlgorithm(algorithm) {
+		return "", nil
+	}
+	return checksum.String, nil
+}
+
+// GetCopiedFileChecksumFor retrieves the checksum of a copied file if it was recorded with the given algorithm.
+// Checksums recorded before algorithms were stored count as DefaultChecksumAlgorithm.
+//
+// Parameters:
+// - db: The database connection.
+// - filePath: The path of the source file.
+// - destination: The destination the file was copied to.
+// - algorithm: The checksum algorithm the caller compares with.
+//
+// Returns:
+// - string: The checksum, or an empty string if none was recorded with the algorithm.
+// - error: An error object if there was an issue querying the database.
+func GetCopiedFileChecksumFor(db *sql.DB, filePath, destination, algorithm string) (string, error) {
+	var checksum, stored sql.NullString
+	query := `SELECT checksum, checksum_algorithm FROM copied_files WHERE file_path = ? AND destination = ?`
+	err := db.QueryRow(query, filePath, destination).Scan(&checksum, &stored)
+	if err != nil {
+		return "", err
+	}
+	if !checksum.Valid || normalizeChecksumAlgorithm(stored.String) != normalizeChecksumAlgorithm(algorithm) {
+		return "", nil
+	}
+	return checksum.String, nil
+}
+
 func UpdateCopiedFileSize(db *sql.DB, filePath, destination string, size int64) error {
 	query := `UPDATE copied_files SET size = ? WHERE file_path = ? AND destination = ?`
 	_, err := db.Exec(query, size, filePath, destination)
@@ -231,3 +495,801 @@ func GetCopiedFileSize(db *sql.DB, filePath, destination string) (int64, error)
 	}
 	return -1, nil
 }
+
+// UpdateCopiedFileVerification records the verification mode used for a copied file.
+//
+// Parameters:
+// - db: The database connection.
+// - filePath: The path of the source file.
+// - destination: The destination the file was copied to.
+// - verification: The verification mode applied to the copy.
+//
+// Returns:
+// - error: An error object if there was an issue updating the database.
+func UpdateCopiedFileVerification(db *sql.DB, filePath, destination, verification string) error {
+	query := `UPDATE copied_files SET verification = ? WHERE file_path = ? AND destination = ?`
+	_, err := db.Exec(query, verification, filePath, destination)
+	return err
+}
+
+// UpdateCopiedFileEngine records the I/O engine that transferred a copied file.
+//
+// Parameters:
+// - db: The database connection.
+// - filePath: The path of the source file.
+// - destination: The destination the file was copied to.
+// - engine: The I/O engine used for the copy.
+//
+// Returns:
+// - error: An error object if there was an issue updating the database.
+func UpdateCopiedFileEngine(db *sql.DB, filePath, destination, engine string) error {
+	query := `UPDATE copied_files SET engine = ? WHERE file_path = ? AND destination = ?`
+	_, err := db.Exec(query, engine, filePath, destination)
+	return err
+}
+
+// UpdateCopiedFileStorage records how a copied file is stored at the destination when the stored bytes differ from
+// the source, such as a compressed or encrypted copy.
+//
+// Parameters:
+// - db: The database connection.
+// - filePath: The path of the source file.
+// - destination: The destination the file was copied to.
+// - storedPath: The path of the stored file at the destination.
+// - storedSize: The size of the stored file in bytes.
+// - storedChecksum: The checksum of the stored file, using the checksum algorithm of the copy.
+// - compression: The compression of the stored file, or an empty string for none.
+// - encryption: The encryption of the stored file, or an empty string for none.
+// - ratio: The size of the stored file divided by the size of the source.
+//
+// Returns:
+// - error: An error object if there was an issue updating the database.
+func UpdateCopiedFileStorage(db *sql.DB, filePath, destination, storedPath string, storedSize int64, storedChecksum, compression, encryption string, ratio float64) error {
+	query := `UPDATE copied_files SET stored_path = ?, stored_size = ?, stored_checksum = ?, compression = ?, encryption = ?, compression_ratio = ? WHERE file_path = ? AND destination = ?`
+	_, err := db.Exec(query, storedPath, storedSize, storedChecksum, compression, encryption, ratio, filePath, destination)
+	return err
+}
+
+// UpdateCopiedFileStoredChecksum updates the checksum of the stored file of a copy, such as after it was repaired.
+//
+// Parameters:
+// - db: The database connection.
+// - filePath: The path of the source file.
+// - destination: The destination the file was copied to.
+// - storedChecksum: The checksum of the stored file, using the checksum algorithm of the copy.
+//
+// Returns:
+// - error: An error object if there was an issue updating the database.
+func UpdateCopiedFileStoredChecksum(db *sql.DB, filePath, destination, storedChecksum string) error {
+	query := `UPDATE copied_files SET stored_checksum = ? WHERE file_path = ? AND destination = ?`
+	_, err := db.Exec(query, storedChecksum, filePath, destination)
+	return err
+}
+
+// GetStoredCopy retrieves the copy recorded for a stored file at a destination.
+//
+// Parameters:
+// - db: The database connection.
+// - storedPath: The path of the stored file.
+//
+// Returns:
+// - CopiedFileRecord: The recorded copy, whose checksum is the checksum of the source.
+// - bool: True if a copy is recorded for the stored file.
+// - error: An error object if there was an issue querying the database.
+func GetStoredCopy(db *sql.DB, storedPath string) (CopiedFileRecord, bool, error) {
+	rows, err := db.Query(`SELECT file_path, destination, is_folder, checksum, checksum_algorithm, stored_checksum FROM copied_files WHERE stored_path = ?`, storedPath)
+	if err != nil {
+		return CopiedFileRecord{}, false, err
+	}
+	records, err := scanCopiedFileRecords(rows)
+	if err != nil || len(records) == 0 {
+		return CopiedFileRecord{}, false, err
+	}
+	return records[0], true, nil
+}
+
+// SaveManifest replaces the stored manifest of a source directory.
+//
+// Parameters:
+// - db: The database connection.
+// - path: The path of the source directory.
+// - manifest: The manifest of the directory.
+//
+// Returns:
+// - error: An error object if there was an issue updating the database.
+func SaveManifest(db *sql.DB, path string, manifest Manifest) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`DELETE FROM manifest_entries WHERE path = ?`, path); err != nil {
+		return err
+	}
+	insertSQL := `INSERT INTO manifest_entries (path, member, size, checksum, checksum_algorithm, secondary_checksum, secondary_checksum_algorithm) VALUES (?, ?, ?, ?, ?, ?, ?)`
+	for _, entry := range manifest.Entries {
+		_, err := tx.Exec(insertSQL, path, entry.Path, entry.Size, entry.Checksum, manifest.Algorithm, entry.SecondaryChecksum, manifest.SecondaryAlgorithm)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// GetManifest retrieves the stored manifest of a source directory.
+//
+// Parameters:
+// - db: The database connection.
+// - path: The path of the source directory.
+//
+// Returns:
+// - Manifest: The stored manifest.
+// - bool: True if a manifest is stored for the directory.
+// - error: An error object if there was an issue querying the database.
+func GetManifest(db *sql.DB, path string) (Manifest, bool, error) {
+	query := `SELECT member, size, checksum, checksum_algorithm, secondary_checksum, secondary_checksum_algorithm FROM manifest_entries WHERE path = ?`
+	rows, err := db.Query(query, path)
+	if err != nil {
+		return Manifest{}, false, err
+	}
+	defer rows.Close()
+
+	var algorithm, secondary string
+	var entries []ManifestEntry
+	for rows.Next() {
+		var entry ManifestEntry
+		var checksum, secondaryChecksum, entryAlgorithm, entrySecondary sql.NullString
+		if err := rows.Scan(&entry.Path, &entry.Size, &checksum, &entryAlgorithm, &secondaryChecksum, &entrySecondary); err != nil {
+			return Manifest{}, false, err
+		}
+		entry.Checksum = checksum.String
+		entry.SecondaryChecksum = secondaryChecksum.String
+		algorithm, secondary = entryAlgorithm.String, entrySecondary.String
+		entries = append(entries, entry)
+	}
+	if err := rows.Err(); err != nil {
+		return Manifest{}, false, err
+	}
+	if len(entries) == 0 {
+		return Manifest{}, false, nil
+	}
+	return newManifest(algorithm, secondary, entries), true, nil
+}
+
+// SaveArchiveMembers replaces the member index of a bundle archived at a destination.
+//
+// Parameters:
+// - db: The database connection.
+// - filePath: The path of the source bundle directory.
+// - destination: The destination directory.
+// - archivePath: The path of the archive at the destination.
+// - manifest: The manifest of the archive members, with paths relative to the bundle directory.
+//
+// Returns:
+// - error: An error object if there was an issue saving the index.
+func SaveArchiveMembers(db *sql.DB, filePath, destination, archivePath string, manifest Manifest) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`DELETE FROM archive_members WHERE file_path = ? AND destination = ?`, filePath, destination); err != nil {
+		return err
+	}
+	insertSQL := `INSERT INTO archive_members (file_path, destination, archive_path, member, size, checksum, checksum_algorithm) VALUES (?, ?, ?, ?, ?, ?, ?)`
+	for _, entry := range manifest.Entries {
+		_, err := tx.Exec(insertSQL, filePath, destination, archivePath, entry.Path, entry.Size, entry.Checksum, manifest.Algorithm)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// GetArchiveMembers retrieves the member index of an archive.
+//
+// Parameters:
+// - db: The database connection.
+// - archivePath: The path of the archive at the destination.
+//
+// Returns:
+// - Manifest: The indexed members, with paths relative to the bundle directory.
+// - bool: True if an index is stored for the archive.
+// - error: An error object if there was an issue querying the database.
+func GetArchiveMembers(db *sql.DB, archivePath string) (Manifest, bool, error) {
+	query := `SELECT member, size, checksum, checksum_algorithm FROM archive_members WHERE archive_path = ?`
+	rows, err := db.Query(query, archivePath)
+	if err != nil {
+		return Manifest{}, false, err
+	}
+	defer rows.Close()
+
+	var algorithm string
+	var entries []ManifestEntry
+	for rows.Next() {
+		var entry ManifestEntry
+		var checksum, entryAlgorithm sql.NullString
+		if err := rows.Scan(&entry.Path, &entry.Size, &checksum, &entryAlgorithm); err != nil {
+			return Manifest{}, false, err
+		}
+		entry.Checksum = checksum.String
+		algorithm = entryAlgorithm.String
+		entries = append(entries, entry)
+	}
+	if err := rows.Err(); err != nil {
+		return Manifest{}, false, err
+	}
+	if len(entries) == 0 {
+		return Manifest{}, false, nil
+	}
+	return newManifest(algorithm, "", entries), true, nil
+}
+
+// SaveStoreObject records an object in the store of a content-addressed destination. An object that is already
+// recorded keeps its reference count.
+//
+// Parameters:
+// - db: The database connection.
+// - destination: The destination directory.
+// - algorithm: The checksum algorithm of the object.
+// - checksum: The checksum of the object.
+// - size: The size of the object in bytes.
+//
+// Returns:
+// - error: An error object if there was an issue updating the database.
+func SaveStoreObject(db *sql.DB, destination, algorithm, checksum string, size int64) error {
+	query := `INSERT OR IGNORE INTO store_objects (destination, checksum_algorithm, checksum, size, refcount) VALUES (?, ?, ?, ?, 0)`
+	_, err := db.Exec(query, destination, algorithm, checksum, size)
+	return err
+}
+
+// HasStoreObjectOfSize checks whether a content-addressed destination stores an object of the given size.
+//
+// Parameters:
+// - db: The database connection.
+// - destination: The destination directory.
+// - algorithm: The checksum algorithm the objects are named by.
+// - size: The size in bytes.
+//
+// Returns:
+// - bool: True if an object of the size is stored.
+// - error: An error object if there was an issue querying the database.
+func HasStoreObjectOfSize(db *sql.DB, destination, algorithm string, size int64) (bool, error) {
+	var exists bool
+	query := `SELECT EXISTS(SELECT 1 FROM store_objects WHERE destination = ? AND checksum_algorithm = ? AND size = ?)`
+	err := db.QueryRow(query, destination, algorithm, size).Scan(&exists)
+	return exists, err
+}
+
+// ReplaceStoreLinks replaces the links recorded for a source at a content-addressed destination and updates the
+// reference counts of the objects they point to.
+//
+// Parameters:
+// - db: The database connection.
+// - destination: The destination directory.
+// - filePath: The path of the source file or bundle directory.
+// - links: The paths linked for the source and their objects.
+//
+// Returns:
+// - error: An error object if there was an issue updating the database.
+func ReplaceStoreLinks(db *sql.DB, destination, filePath string, links []StoreLink) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	release := func(where string, args ...interface{}) error {
+		// Every link counts once, even if a bundle links several members to the same object.
+		_, err := tx.Exec(`UPDATE store_objects SET refcount = refcount - (SELECT COUNT(*) FROM store_links l
+			WHERE l.destination = store_objects.destination AND l.checksum_algorithm = store_objects.checksum_algorithm
+			AND l.checksum = store_objects.checksum AND `+where+`) WHERE destination = ?`, append(args, destination)...)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(`DELETE FROM store_links WHERE `+where, args...)
+		return err
+	}
+	if err := release(`destination = ? AND file_path = ?`, destination, filePath); err != nil {
+		return err
+	}
+	for _, link := range links {
+		// A path linked for another source is released first, so that its object is not counted twice.
+		if err := release(`destination = ? AND link_path = ?`, destination, link.Path); err != nil {
+			return err
+		}
+		_, err := tx.Exec(`INSERT INTO store_links (destination, link_path, file_path, checksum_algorithm, checksum) VALUES (?, ?, ?, ?, ?)`,
+			destination, link.Path, filePath, link.Algorithm, link.Checksum)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(`INSERT OR IGNORE INTO store_objects (destination, checksum_algorithm, checksum, size, refcount) VALUES (?, ?, ?, ?, 0)`,
+			destination, link.Algorithm, link.Checksum, link.Size)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(`UPDATE store_objects SET refcount = refcount + 1 WHERE destination = ? AND checksum_algorithm = ? AND checksum = ?`,
+			destination, link.Algorithm, link.Checksum)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// GetStoreObjectLinks retrieves the paths linked to an object of a content-addressed destination.
+//
+// Parameters:
+// - db: The database connection.
+// - destination: The destination directory.
+// - algorithm: The checksum algorithm of the object.
+// - checksum: The checksum of the object.
+//
+// Returns:
+// - []string: The linked paths.
+// - error: An error object if there was an issue querying the database.
+func GetStoreObjectLinks(db *sql.DB, destination, algorithm, checksum string) ([]string, error) {
+	query := `SELECT link_path FROM store_links WHERE destination = ? AND checksum_algorithm = ? AND checksum = ?`
+	rows, err := db.Query(query, destination, algorithm, checksum)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var links []string
+	for rows.Next() {
+		var link string
+		if err := rows.Scan(&link); err != nil {
+			return nil, err
+		}
+		links = append(links, link)
+	}
+	return links, rows.Err()
+}
+
+// GetUnreferencedStoreObjects retrieves the objects of a content-addressed destination that no path is linked to.
+//
+// Parameters:
+// - db: The database connection.
+// - destination: The destination directory.
+//
+// Returns:
+// - []StoreObject: The unreferenced objects.
+// - error: An error object if there was an issue querying the database.
+func GetUnreferencedStoreObjects(db *sql.DB, destination string) ([]StoreObject, error) {
+	query := `SELECT checksum, checksum_algorithm, size FROM store_objects WHERE destination = ? AND refcount <= 0`
+	rows, err := db.Query(query, destination)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var objects []StoreObject
+	for rows.Next() {
+		var object StoreObject
+		if err := rows.Scan(&object.Checksum, &object.Algorithm, &object.Size); err != nil {
+			return nil, err
+		}
+		objects = append(objects, object)
+	}
+	return objects, rows.Err()
+}
+
+// DeleteStoreObject removes an unreferenced object of a content-addressed destination from the catalog.
+//
+// Parameters:
+// - db: The database connection.
+// - destination: The destination directory.
+// - algorithm: The checksum algorithm of the object.
+// - checksum: The checksum of the object.
+//
+// Returns:
+// - error: An error object if there was an issue updating the database.
+func DeleteStoreObject(db *sql.DB, destination, algorithm, checksum string) error {
+	query := `DELETE FROM store_objects WHERE destination = ? AND checksum_algorithm = ? AND checksum = ? AND refcount <= 0`
+	_, err := db.Exec(query, destination, algorithm, checksum)
+	return err
+}
+
+// SaveVersion records a version kept at a destination.
+//
+// Parameters:
+// - db: The database connection.
+// - version: The version.
+//
+// Returns:
+// - error: An error object if there was an issue updating the database.
+func SaveVersion(db *sql.DB, version Version) error {
+	query := `INSERT OR REPLACE INTO versions (file_path, destination, path, version_path, is_folder, checksum, checksum_algorithm, size, created)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`
+	_, err := db.Exec(query, version.FilePath, version.Destination, version.Path, version.VersionPath, version.IsFolder,
+		version.Checksum, version.ChecksumAlgorithm, version.Size, version.Created.UnixNano())
+	return err
+}
+
+// GetVersions retrieves the versions kept for a copy, newest first.
+//
+// Parameters:
+// - db: The database connection.
+// - path: The path of the copy at the destination.
+//
+// Returns:
+// - []Version: The versions.
+// - error: An error object if there was an issue querying the database.
+func GetVersions(db *sql.DB, path string) ([]Version, error) {
+	return queryVersions(db, `WHERE path = ? ORDER BY created DESC`, path)
+}
+
+// ListVersions retrieves the versions kept for a copy, or for every copy of a source, newest first.
+//
+// Parameters:
+// - db: The database connection.
+// - path: The path of the copy at the destination, or of its source.
+//
+// Returns:
+// - []Version: The versions.
+// - error: An error object if there was an issue querying the database.
+func ListVersions(db *sql.DB, path string) ([]Version, error) {
+	return queryVersions(db, `WHERE path = ? OR file_path = ? ORDER BY created DESC`, path, path)
+}
+
+// GetVersion retrieves a version by its path.
+//
+// Parameters:
+// - db: The database connection.
+// - versionPath: The path of the version.
+//
+// Returns:
+// - Version: The version.
+// - bool: True if the version is recorded.
+// - error: An error object if there was an issue querying the database.
+func GetVersion(db *sql.DB, versionPath string) (Version, bool, error) {
+	versions, err := queryVersions(db, `WHERE version_path = ?`, versionPath)
+	if err != nil || len(versions) == 0 {
+		return Version{}, false, err
+	}
+	return versions[0], true, nil
+}
+
+// queryVersions reads the versions selected by a condition.
+//
+// Parameters:
+// - db: The database connection.
+// - condition: The WHERE and ORDER BY clauses of the query.
+// - args: The arguments of the condition.
+//
+// Returns:
+// - []Version: The versions.
+// - error: An error object if there was an issue querying the database.
+func queryVersions(db *sql.DB, condition string, args ...interface{}) ([]Version, error) {
+	rows, err := db.Query(`SELECT file_path, destination, path, version_path, is_folder, checksum, checksum_algorithm, size, created
+		FROM versions `+condition, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var versions []Version
+	for rows.Next() {
+		var version Version
+		var checksum, algorithm sql.NullString
+		var created int64
+		err := rows.Scan(&version.FilePath, &version.Destination, &version.Path, &version.VersionPath, &version.IsFolder,
+			&checksum, &algorithm, &version.Size, &created)
+		if err != nil {
+			return nil, err
+		}
+		version.Checksum = checksum.String
+		version.ChecksumAlgorithm = algorithm.String
+		version.Created = time.Unix(0, created).UTC()
+		versions = append(versions, version)
+	}
+	return versions, rows.Err()
+}
+
+// DeleteVersion removes a version from the database.
+//
+// Parameters:
+// - db: The database connection.
+// - destination: The destination the version is kept at.
+// - versionPath: The path of the version.
+//
+// Returns:
+// - error: An error object if there was an issue updating the database.
+func DeleteVersion(db *sql.DB, destination, versionPath string) error {
+	_, err := db.Exec(`DELETE FROM versions WHERE destination = ? AND version_path = ?`, destination, versionPath)
+	return err
+}
+
+// SaveConflict records a conflict.
+//
+// Parameters:
+// - db: The database connection.
+// - c: The conflict. Its ID is assigned by the database.
+//
+// Returns:
+// - error: An error object if there was an issue updating the database.
+func SaveConflict(db *sql.DB, c Conflict) error {
+	query := `INSERT INTO conflicts (file_path, destination, path, policy, action, kept_path, source_size, source_modified,
+		source_checksum, destination_size, destination_modified, destination_checksum, checksum_algorithm, detected, last_seen,
+		status, resolution) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
+	_, err := db.Exec(query, c.FilePath, c.Destination, c.Path, c.Policy, c.Action, c.KeptPath, c.SourceSize,
+		c.SourceModified.UnixNano(), c.SourceChecksum, c.DestinationSize, c.DestinationModified.UnixNano(),
+		c.DestinationChecksum, c.ChecksumAlgorithm, c.Detected.UnixNano(), c.LastSeen.UnixNano(), c.Status, c.Resolution)
+	return err
+}
+
+// GetLatestConflict retrieves the most recent conflict of a source at a destination.
+//
+// Parameters:
+// - db: The database connection.
+// - filePath: The path of the source.
+// - destination: The destination directory.
+//
+// Returns:
+// - Conflict: The conflict.
+// - bool: True if a conflict is recorded.
+// - error: An error object if there was an issue querying the database.
+func GetLatestConflict(db *sql.DB, filePath, destination string) (Conflict, bool, error) {
+	conflicts, err := queryConflicts(db, `WHERE file_path = ? AND destination = ? ORDER BY id DESC LIMIT 1`, filePath, destination)
+	if err != nil || len(conflicts) == 0 {
+		return Conflict{}, false, err
+	}
+	return conflicts[0], true, nil
+}
+
+// ListConflicts retrieves the conflicts that are open or have a pending resolution, oldest first.
+//
+// Parameters:
+// - db: The database connection.
+//
+// Returns:
+// - []Conflict: The conflicts.
+// - error: An error object if there was an issue querying the database.
+func ListConflicts(db *sql.DB) ([]Conflict, error) {
+	return queryConflicts(db, `WHERE status IN (?, ?) ORDER BY id`, ConflictOpen, ConflictPending)
+}
+
+// TouchConflict records that a conflict was seen again.
+//
+// Parameters:
+// - db: The database connection.
+// - id: The ID of the conflict.
+// - seen: The time the conflict was seen.
+//
+// Returns:
+// - error: An error object if there was an issue updating the database.
+func TouchConflict(db *sql.DB, id int64, seen time.Time) error {
+	_, err := db.Exec(`UPDATE conflicts SET last_seen = ? WHERE id = ?`, seen.UnixNano(), id)
+	return err
+}
+
+// UpdateConflictOutcome records the action taken for a conflict.
+//
+// Parameters:
+// - db: The database connection.
+// - id: The ID of the conflict.
+// - action: The action taken.
+// - keptPath: The path the existing copy was moved to, if it was kept.
+// - status: The new status of the conflict.
+// - seen: The time the action was taken.
+//
+// Returns:
+// - error: An error object if there was an issue updating the database.
+func UpdateConflictOutcome(db *sql.DB, id int64, action, keptPath, status string, seen time.Time) error {
+	_, err := db.Exec(`UPDATE conflicts SET action = ?, kept_path = ?, status = ?, last_seen = ? WHERE id = ?`,
+		action, keptPath, status, seen.UnixNano(), id)
+	return err
+}
+
+// SetConflictResolution sets the resolution of an open or pending conflict.
+//
+// Parameters:
+// - db: The database connection.
+// - id: The ID of the conflict.
+// - resolution: The resolution.
+// - status: The new status of the conflict.
+//
+// Returns:
+// - error: An error object if the conflict is unknown or already resolved, or there was an issue updating the database.
+func SetConflictResolution(db *sql.DB, id int64, resolution, status string) error {
+	result, err := db.Exec(`UPDATE conflicts SET resolution = ?, status = ? WHERE id = ? AND status IN (?, ?)`,
+		resolution, status, id, ConflictOpen, ConflictPending)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return fmt.Errorf("no open conflict with ID %d", id)
+	}
+	return nil
+}
+
+// queryConflicts reads the conflicts selected by a condition.
+//
+// Parameters:
+// - db: The database connection.
+// - condition: The WHERE, ORDER BY and LIMIT clauses of the query.
+// - args: The arguments of the condition.
+//
+// Returns:
+// - []Conflict: The conflicts.
+// - error: An error object if there was an issue querying the database.
+func queryConflicts(db *sql.DB, condition string, args ...interface{}) ([]Conflict, error) {
+	rows, err := db.Query(`SELECT id, file_path, destination, path, policy, action, kept_path, source_size, source_modified,
+		source_checksum, destination_size, destination_modified, destination_checksum, checksum_algorithm, detected, last_seen,
+		status, resolution FROM conflicts `+condition, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var conflicts []Conflict
+	for rows.Next() {
+		var c Conflict
+		var keptPath, resolution sql.NullString
+		var sourceModified, destinationModified, detected, lastSeen int64
+		err := rows.Scan(&c.ID, &c.FilePath, &c.Destination, &c.Path, &c.Policy, &c.Action, &keptPath, &c.SourceSize,
+			&sourceModified, &c.SourceChecksum, &c.DestinationSize, &destinationModified, &c.DestinationChecksum,
+			&c.ChecksumAlgorithm, &detected, &lastSeen, &c.Status, &resolution)
+		if err != nil {
+			return nil, err
+		}
+		c.KeptPath = keptPath.String
+		c.Resolution = resolution.String
+		c.SourceModified = time.Unix(0, sourceModified)
+		c.DestinationModified = time.Unix(0, destinationModified)
+		c.Detected = time.Unix(0, detected)
+		c.LastSeen = time.Unix(0, lastSeen)
+		conflicts = append(conflicts, c)
+	}
+	return conflicts, rows.Err()
+}
+
+// SaveNameMapping records the path a source is written to at a destination.
+//
+// Parameters:
+// - db: The database connection.
+// - mapping: The mapping.
+//
+// Returns:
+// - error: An error object if there was an issue updating the database.
+func SaveNameMapping(db *sql.DB, mapping NameMapping) error {
+	_, err := db.Exec(`INSERT OR REPLACE INTO name_mappings (destination, file_path, original, path, folded_path) VALUES (?, ?, ?, ?, ?)`,
+		mapping.Destination, mapping.FilePath, mapping.Original, mapping.Path, strings.ToLower(mapping.Path))
+	return err
+}
+
+// GetNameMappingsByPath retrieves the mappings of other sources to a destination path, ignoring case.
+//
+// Parameters:
+// - db: The database connection.
+// - destination: The destination directory.
+// - foldedPath: The destination path in lower case.
+// - filePath: The source whose own mapping is left out.
+//
+// Returns:
+// - []NameMapping: The mappings.
+// - error: An error object if there was an issue querying the database.
+func GetNameMappingsByPath(db *sql.DB, destination, foldedPath, filePath string) ([]NameMapping, error) {
+	rows, err := db.Query(`SELECT destination, file_path, original, path FROM name_mappings
+		WHERE destination = ? AND folded_path = ? AND file_path != ?`, destination, foldedPath, filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var mappings []NameMapping
+	for rows.Next() {
+		var mapping NameMapping
+		if err := rows.Scan(&mapping.Destination, &mapping.FilePath, &mapping.Original, &mapping.Path); err != nil {
+			return nil, err
+		}
+		mappings = append(mappings, mapping)
+	}
+	return mappings, rows.Err()
+}
+
+// CopiedFileRecord is a row of copied_files with the checksum recorded for the copy.
+type CopiedFileRecord struct {
+	FilePath          string
+	Destination       string
+	IsFolder          bool
+	Checksum          string
+	ChecksumAlgorithm string
+	// StoredChecksum is the checksum of the stored bytes of a compressed or encrypted copy.
+	StoredChecksum string
+}
+
+// scanCopiedFileRecords reads the rows of a query selecting file_path, destination, is_folder, checksum,
+// checksum_algorithm and stored_checksum from copied_files.
+//
+// Parameters:
+// - rows: The rows to read.
+//
+// Returns:
+// - []CopiedFileRecord: The records.
+// - error: An error object if a row could not be read.
+func scanCopiedFileRecords(rows *sql.Rows) ([]CopiedFileRecord, error) {
+	defer rows.Close()
+	var records []CopiedFileRecord
+	for rows.Next() {
+		var record CopiedFileRecord
+		var checksum, algorithm, storedChecksum sql.NullString
+		if err := rows.Scan(&record.FilePath, &record.Destination, &record.IsFolder, &checksum, &algorithm, &storedChecksum); err != nil {
+			return nil, err
+		}
+		record.Checksum = checksum.String
+		record.ChecksumAlgorithm = algorithm.String
+		record.StoredChecksum = storedChecksum.String
+		records = append(records, record)
+	}
+	return records, rows.Err()
+}
+
+// GetScrubCandidates retrieves the copies at the given destinations that have not been scrubbed since the given time,
+// least recently scrubbed first. Recreated symbolic links are not scrubbed.
+//
+// Parameters:
+// - db: The database connection.
+// - destinations: The destinations to scrub.
+// - before: Copies scrubbed at or after this time are skipped.
+//
+// Returns:
+// - []CopiedFileRecord: The copies due for scrubbing.
+// - error: An error object if there was an issue querying the database.
+func GetScrubCandidates(db *sql.DB, destinations []string, before time.Time) ([]CopiedFileRecord, error) {
+	if len(destinations) == 0 {
+		return nil, nil
+	}
+	args := []interface{}{}
+	for _, destination := range destinations {
+		args = append(args, destination)
+	}
+	args = append(args, before.Unix(), EngineSymlink)
+	query := fmt.Sprintf(`SELECT file_path, destination, is_folder, checksum, checksum_algorithm, stored_checksum FROM copied_files
+		WHERE destination IN (?%s) AND (last_scrubbed IS NULL OR last_scrubbed < ?) AND COALESCE(engine, '') != ?
+		ORDER BY COALESCE(last_scrubbed, 0)`, strings.Repeat(", ?", len(destinations)-1))
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	return scanCopiedFileRecords(rows)
+}
+
+// GetCopiesOf retrieves every recorded copy of a source file or directory.
+//
+// Parameters:
+// - db: The database connection.
+// - filePath: The path of the source file or directory.
+//
+// Returns:
+// - []CopiedFileRecord: The copies of the source.
+// - error: An error object if there was an issue querying the database.
+func GetCopiesOf(db *sql.DB, filePath string) ([]CopiedFileRecord, error) {
+	rows, err := db.Query(`SELECT file_path, destination, is_folder, checksum, checksum_algorithm, stored_checksum FROM copied_files WHERE file_path = ?`, filePath)
+	if err != nil {
+		return nil, err
+	}
+	return scanCopiedFileRecords(rows)
+}
+
+// UpdateScrubResult records the outcome of scrubbing a copied file.
+//
+// Parameters:
+// - db: The database connection.
+// - filePath: The path of the source file.
+// - destination: The destination the file was copied to.
+// - status: The outcome of the scrub.
+// - scrubbed: The time of the scrub.
+//
+// Returns:
+// - error: An error object if there was an issue updating the database.
+func UpdateScrubResult(db *sql.DB, filePath, destination, status string, scrubbed time.Time) error {
+	query := `UPDATE copied_files SET scrub_status = ?, last_scrubbed = ? WHERE file_path = ? AND destination = ?`
+	_, err := db.Exec(query, status, scrubbed.Unix(), filePath, destination)
+	return err
+}
@@ -2,6 +2,8 @@
 package catapult
 
 import (
+	"database/sql"
+	"path/filepath"
 	"testing"
 	"time"
 )
@@ -118,3 +120,29 @@ func TestMarkFileAsCopied(t *testing.T) {
 		t.Fatalf("Expected 1 record in copied_files, got %d", count)
 	}
 }
+
+func TestInitDBMigratesColumns(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "old.db")
+	db, err := sql.Open("sqlite", dbPath)
+	if err != nil {
+		t.Fatalf("sql.Open() error: %v", err)
+	}
+	_, err = db.Exec(`CREATE TABLE copied_files (file_path TEXT, destination TEXT, is_folder BOOLEAN, checksum TEXT, size INTEGER, PRIMARY KEY (file_path, destination, is_folder));`)
+	if err != nil {
+		t.Fatalf("Failed to create old table: %v", err)
+	}
+	db.Close()
+
+	db, err = InitDB(dbPath)
+	if err != nil {
+		t.Fatalf("InitDB() error: %v", err)
+	}
+	defer db.Close()
+
+	if err := MarkFileAsCopied(db, "a.raw", "destination", false); err != nil {
+		t.Fatalf("MarkFileAsCopied() error: %v", err)
+	}
+	if err := UpdateCopiedFileVerification(db, "a.raw", "destination", VerifySampled); err != nil {
+		t.Fatalf("UpdateCopiedFileVerification() error: %v", err)
+	}
+}
@@ -0,0 +1,384 @@
+package catapult
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Planned actions reported by a dry run.
+const (
+	PlanActionCopy      = "copy"
+	PlanActionSkip      = "skip"
+	PlanActionOverwrite = "overwrite"
+	PlanActionConflict  = "conflict"
+)
+
+// PlannedAction describes what a real run would do with a single source path for a single destination.
+type PlannedAction struct {
+	Config             string `json:"config"`
+	Source             string `json:"source"`
+	Destination        string `json:"destination"`
+	DestinationPath    string `json:"destination_path"`
+	IsFolder           bool   `json:"is_folder"`
+	Size               int64  `json:"size"`
+	Action             string `json:"action"`
+	Reason             string `json:"reason"`
+	ProjectedFreeSpace int64  `json:"projected_free_space"`
+}
+
+// OpenDBReadOnly opens an existing SQLite database without creating or altering any tables.
+// If the database file does not exist, nil is returned so that callers can plan as if nothing had been seen yet.
+//
+// Parameters:
+// - dbPath: The file path for the SQLite database.
+//
+// Returns:
+// - *sql.DB: The read-only database connection, or nil if the file does not exist.
+// - error: An error object if there was an issue opening the database.
+func OpenDBReadOnly(dbPath string) (*sql.DB, error) {
+	if _, err := os.Stat(dbPath); os.IsNotExist(err) {
+		return nil, nil
+	}
+	absPath, err := filepath.Abs(dbPath)
+	if err != nil {
+		return nil, err
+	}
+	db, err := sql.Open("sqlite", "file:"+filepath.ToSlash(absPath)+"?mode=ro")
+	if err != nil {
+		return nil, err
+	}
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+// PlanMirror walks every configured source and evaluates the same rules as a real run without writing to
+// destinations or mutating the database.
+//
+// Parameters:
+// - db: The database connection to read history from. May be nil if no database exists yet.
+// - config: The configurations containing directory monitoring settings.
+//
+// Returns:
+// - []PlannedAction: The planned action for every source path and destination pair.
+// - error: An error object if a configuration could not be evaluated or the database has not been migrated yet.
+func PlanMirror(db *sql.DB, config Configurations) ([]PlannedAction, error) {
+	var plan []PlannedAction
+	if db != nil {
+		// The database is opened read-only, so an older one is not migrated and its checksums cannot be compared.
+		missing, err := missingColumns(db)
+		if err != nil {
+			return plan, fmt.Errorf("error inspecting database: %v", err)
+		}
+		if len(missing) > 0 {
+			return plan, fmt.Errorf("database is missing columns %s; run once without -dry-run to migrate it, as the plan cannot be trusted until then", strings.Join(missing, ", "))
+		}
+	}
+	for _, cfg := range config.Configs {
+		duration, err := time.ParseDuration(cfg.CheckInterval)
+		if err != nil {
+			return plan, fmt.Errorf("invalid check_interval for %s: %v", cfg.Name, err)
+		}
+		for _, destination := range cfg.Destinations {
+			freeSpace, err := GetFreeSpace(destination)
+			if err != nil {
+				return plan, fmt.Errorf("error getting free space for %s: %v", destination, err)
+			}
+			for _, dir := range cfg.Directories {
+				actions, remaining, err := planDirectory(db, cfg, dir, destination, freeSpace, duration)
+				if err != nil {
+					return plan, err
+				}
+				freeSpace = remaining
+				plan = append(plan, actions...)
+			}
+		}
+	}
+	return plan, nil
+}
+
+// planDirectory evaluates a single source directory against a single destination.
+//
+// Parameters:
+// - db: The database connection to read history from. May be nil.
+// - cfg: The configuration the directory belongs to.
+// - dir: The source directory.
+// - destination: The destination directory.
+// - freeSpace: The projected free space at the destination before this directory.
+// - duration: The check interval used to decide whether a path is stable.
+//
+// Returns:
+// - []PlannedAction: The planned actions for the directory.
+// - int64: The projected free space after the planned copies.
+// - error: An error object if the directory could not be listed.
+func planDirectory(db *sql.DB, cfg Configuration, dir, destination string, freeSpace int64, duration time.Duration) ([]PlannedAction, int64, error) {
+	paths, skips, err := ListFiles(dir, cfg.Symlinks)
+	if err != nil {
+		return nil, freeSpace, fmt.Errorf("error listing files and directories in %s: %v", dir, err)
+	}
+	logListingSkips(dir, skips)
+
+	var actions []PlannedAction
+	for _, path := range paths {
+		if isSymlink(cfg, path) {
+			actions = append(actions, planSymlink(cfg, path, dir, destination))
+			continue
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			return actions, freeSpace, err
+		}
+		isFolder := info.IsDir()
+		var size int64
+		if isFolder && strings.HasSuffix(path, ".d") {
+			size = GetDirectorySize(path)
+		} else if !isFolder {
+			size = GetFileSize(path)
+		} else {
+			continue
+		}
+
+		relPath, err := filepath.Rel(dir, path)
+		if err != nil {
+			return actions, freeSpace, err
+		}
+		mapping, nameErr := checkDestinationName(db, cfg, path, relPath, destination, isFolder)
+		action := PlannedAction{
+			Config:          cfg.Name,
+			Source:          path,
+			Destination:     destination,
+			DestinationPath: cfg.destinationConfig(destination).copyLocation(mapping.Path, isFolder),
+			IsFolder:        isFolder,
+			Size:            size,
+		}
+
+		action.Action, action.Reason = planPath(db, cfg, action, info, duration)
+		if nameErr != nil && action.Action != PlanActionSkip {
+			action.Action, action.Reason = PlanActionConflict, fmt.Sprintf("name rules: %v", nameErr)
+		}
+		if action.Action == PlanActionCopy || action.Action == PlanActionOverwrite {
+			projected := freeSpace - size
+			if action.Action == PlanActionOverwrite && action.IsFolder {
+				projected += GetDirectorySize(action.DestinationPath)
+			} else if action.Action == PlanActionOverwrite {
+				projected += GetFileSize(action.DestinationPath)
+			}
+			if projected <= cfg.MinFreeSpace {
+				action.Action = PlanActionSkip
+				action.Reason = "would breach minimum free space"
+			} else {
+				freeSpace = projected
+			}
+		}
+		action.ProjectedFreeSpace = freeSpace
+		actions = append(actions, action)
+	}
+	return actions, freeSpace, nil
+}
+
+// planPath decides the action for a single source path using the same filters as processFiles.
+//
+// Parameters:
+// - db: The database connection to read history from. May be nil.
+// - cfg: The configuration the path belongs to.
+// - action: The partially filled planned action.
+// - info: The file information of the source path.
+// - duration: The check interval used to decide whether a path is stable.
+//
+// Returns:
+// - string: The planned action.
+// - string: A human readable reason for the action.
+func planPath(db *sql.DB, cfg Configuration, action PlannedAction, info os.FileInfo, duration time.Duration) (string, string) {
+	if action.Size < cfg.MinFileSize {
+		return PlanActionSkip, "smaller than minimum size"
+	}
+	if action.Size == 0 {
+		return PlanActionSkip, "empty"
+	}
+	if cfg.destinationConfig(action.Destination).layout() == LayoutBagIt {
+		if primary, ok := cfg.sidecarPrimary(action.Source); ok {
+			return PlanActionSkip, fmt.Sprintf("sidecar bagged with %s", primary)
+		}
+	}
+
+	if db == nil {
+		if time.Since(info.ModTime()) < duration {
+			return PlanActionSkip, "recently modified"
+		}
+	} else {
+		initialSize, err := GetFileSizeFromDB(db, action.Source, action.IsFolder)
+		if err != nil {
+			return PlanActionSkip, fmt.Sprintf("error reading file size from DB: %v", err)
+		}
+		if initialSize == -1 {
+			if time.Since(info.ModTime()) < duration {
+				return PlanActionSkip, "not yet seen and recently modified"
+			}
+		} else if initialSize != action.Size {
+			return PlanActionSkip, "size changed since last check"
+		} else if lastModified, err := GetLastModifiedTime(db, action.Source); err == nil && time.Since(lastModified) < duration {
+			return PlanActionSkip, "recently modified"
+		}
+
+		if cfg.conflictPolicy(action.Destination) == ConflictSkip {
+			copied, err := IsFileCopied(db, action.Source, action.Destination, action.IsFolder)
+			if err != nil {
+				return PlanActionSkip, fmt.Sprintf("error checking if copied: %v", err)
+			}
+			if copied {
+				return PlanActionSkip, "already copied"
+			}
+		}
+	}
+
+	destInfo, err := os.Stat(action.DestinationPath)
+	if os.IsNotExist(err) {
+		return PlanActionCopy, "not present at destination"
+	} else if err != nil {
+		return PlanActionSkip, fmt.Sprintf("error stating destination: %v", err)
+	}
+	destSize := destInfo.Size()
+	if settings := cfg.destinationConfig(action.Destination); settings.bundleArchive(action.IsFolder) != "" || settings.storedSuffix(action.IsFolder) != "" {
+		// Archived, compressed and encrypted copies are compared by the size recorded for their content.
+		destSize = -1
+		if db != nil {
+			destSize, _ = GetCopiedFileSize(db, action.Source, action.Destination)
+		}
+	} else if action.IsFolder {
+		destSize = GetDirectorySize(action.DestinationPath)
+	}
+
+	if destSize == action.Size && db != nil {
+		algorithm := digestAlgorithm(cfg.checksumAlgorithm(), action.IsFolder)
+		originHash, err := GetOriginFileChecksumFor(db, action.Source, algorithm)
+		if err != nil && err != sql.ErrNoRows {
+			return PlanActionSkip, fmt.Sprintf("error reading checksums: %v", err)
+		}
+		destinationHash, err := GetCopiedFileChecksumFor(db, action.Source, action.Destination, algorithm)
+		if err != nil && err != sql.ErrNoRows {
+			return PlanActionSkip, fmt.Sprintf("error reading checksums: %v", err)
+		}
+		if originHash != "" && originHash == destinationHash {
+			return PlanActionSkip, "identical file already at destination"
+		}
+	}
+	switch policy := cfg.conflictPolicy(action.Destination); policy {
+	case ConflictKeepBoth:
+		return PlanActionCopy, "destination exists and may differ; the existing copy is kept under a numbered name"
+	case ConflictQuarantine:
+		return PlanActionCopy, "destination exists and may differ; the existing copy is quarantined"
+	case ConflictSkip:
+		return PlanActionConflict, "destination exists and may differ"
+	default:
+		if conflictAction(policy, info.ModTime(), destInfo.ModTime(), action.Size, destSize) == ConflictActionSkipped {
+			return PlanActionConflict, fmt.Sprintf("destination exists and may differ; kept by the %s policy", policy)
+		}
+	}
+	if cfg.Versioning.Keep > 0 {
+		return PlanActionOverwrite, "destination exists and may differ; the existing copy is kept as a version"
+	}
+	return PlanActionOverwrite, "destination exists and may differ"
+}
+
+// planSymlink plans recreating a link at a destination.
+//
+// Parameters:
+// - cfg: The configuration the link belongs to.
+// - link: The link in the monitored directory.
+// - dir: The monitored directory.
+// - destination: The destination directory.
+//
+// Returns:
+// - PlannedAction: The planned action for the link.
+func planSymlink(cfg Configuration, link, dir, destination string) PlannedAction {
+	relPath, _ := filepath.Rel(dir, link)
+	action := PlannedAction{
+		Config:          cfg.Name,
+		Source:          link,
+		Destination:     destination,
+		DestinationPath: cfg.mirrorPath(destination, relPath),
+		Action:          PlanActionCopy,
+		Reason:          "symbolic link",
+	}
+	target, err := os.Readlink(link)
+	if err != nil {
+		action.Action, action.Reason = PlanActionSkip, fmt.Sprintf("error reading symbolic link: %v", err)
+	} else if existing, err := os.Readlink(action.DestinationPath); err == nil && existing == target {
+		action.Action, action.Reason = PlanActionSkip, "identical symbolic link already at destination"
+	} else if info, err := os.Lstat(action.DestinationPath); err == nil && info.Mode()&os.ModeSymlink == 0 {
+		action.Action, action.Reason = PlanActionConflict, "destination exists and is not a symbolic link"
+	}
+	return action
+}
+
+// PrintPlan prints a summary of the planned actions to the console.
+//
+// Parameters:
+// - plan: The planned actions to print.
+func PrintPlan(plan []PlannedAction) {
+	counts := make(map[string]int)
+	var bytes int64
+	for _, action := range plan {
+		counts[action.Action]++
+		if action.Action == PlanActionCopy || action.Action == PlanActionOverwrite {
+			bytes += action.Size
+		}
+		fmt.Printf("%-9s %s -> %s (%s)\n", action.Action, action.Source, action.DestinationPath, action.Reason)
+	}
+	LogWithDatetime(fmt.Sprintf("Dry run: %d copy, %d overwrite, %d conflict, %d skip, %d bytes to transfer",
+		counts[PlanActionCopy], counts[PlanActionOverwrite], counts[PlanActionConflict], counts[PlanActionSkip], bytes), false)
+}
+
+// ExportPlan writes the planned actions to a JSON or CSV file, chosen by the file extension.
+//
+// Parameters:
+// - plan: The planned actions to export.
+// - filePath: The path of the output file. Must end in .json or .csv.
+//
+// Returns:
+// - error: An error object if there was an issue writing the file.
+func ExportPlan(plan []PlannedAction, filePath string) error {
+	ext := strings.ToLower(filepath.Ext(filePath))
+	if ext != ".json" && ext != ".csv" {
+		return fmt.Errorf("unsupported dry run output format: %s", filePath)
+	}
+
+	file, err := os.Create(filePath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if ext == ".json" {
+		encoder := json.NewEncoder(file)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(plan)
+	}
+
+	writer := csv.NewWriter(file)
+	writer.Write([]string{"config", "source", "destination", "destination_path", "is_folder", "size", "action", "reason", "projected_free_space"})
+	for _, action := range plan {
+		writer.Write([]string{
+			action.Config,
+			action.Source,
+			action.Destination,
+			action.DestinationPath,
+			strconv.FormatBool(action.IsFolder),
+			strconv.FormatInt(action.Size, 10),
+			action.Action,
+			action.Reason,
+			strconv.FormatInt(action.ProjectedFreeSpace, 10),
+		})
+	}
+	writer.Flush()
+	return writer.Error()
+}
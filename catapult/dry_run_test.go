@@ -0,0 +1,121 @@
+package catapult
+
+import (
+	"database/sql"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPlanMirror(t *testing.T) {
+	srcDir := t.TempDir()
+	dstDir := t.TempDir()
+
+	old := time.Now().Add(-time.Hour)
+	for name, content := range map[string]string{
+		"new.raw":      "new content",
+		"existing.raw": "source content",
+		"tiny.raw":     "x",
+	} {
+		path := filepath.Join(srcDir, name)
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatalf("Failed to create test file: %v", err)
+		}
+		os.Chtimes(path, old, old)
+	}
+	if err := os.WriteFile(filepath.Join(dstDir, "existing.raw"), []byte("different"), 0644); err != nil {
+		t.Fatalf("Failed to create destination file: %v", err)
+	}
+
+	configs := Configurations{
+		Configs: []Configuration{
+			{
+				Name:          "test",
+				Directories:   []string{srcDir},
+				Destinations:  []string{dstDir},
+				CheckInterval: "1s",
+				MinFileSize:   2,
+			},
+		},
+	}
+
+	plan, err := PlanMirror(nil, configs)
+	if err != nil {
+		t.Fatalf("PlanMirror() error: %v", err)
+	}
+
+	actions := make(map[string]string)
+	for _, action := range plan {
+		actions[filepath.Base(action.Source)] = action.Action
+	}
+	want := map[string]string{
+		"new.raw":      PlanActionCopy,
+		"existing.raw": PlanActionConflict,
+		"tiny.raw":     PlanActionSkip,
+	}
+	for name, action := range want {
+		if actions[name] != action {
+			t.Errorf("action for %s = %q, want %q", name, actions[name], action)
+		}
+	}
+
+	entries, err := os.ReadDir(dstDir)
+	if err != nil {
+		t.Fatalf("Failed to read destination: %v", err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("Dry run wrote to destination: %d entries", len(entries))
+	}
+}
+
+func TestPlanMirrorUnmigratedDB(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "old.db")
+	old, err := sql.Open("sqlite", dbPath)
+	if err != nil {
+		t.Fatalf("Failed to create database: %v", err)
+	}
+	_, err = old.Exec(`CREATE TABLE file_sizes (path TEXT PRIMARY KEY, size INTEGER, is_folder BOOLEAN, last_modified TIMESTAMP, checksum TEXT);
+		CREATE TABLE copied_files (file_path TEXT, destination TEXT, is_folder BOOLEAN, checksum TEXT, size INTEGER, PRIMARY KEY (file_path, destination, is_folder));`)
+	old.Close()
+	if err != nil {
+		t.Fatalf("Failed to create old tables: %v", err)
+	}
+
+	db, err := OpenDBReadOnly(dbPath)
+	if err != nil {
+		t.Fatalf("OpenDBReadOnly() error: %v", err)
+	}
+	defer db.Close()
+	configs := Configurations{Configs: []Configuration{{Name: "test", Directories: []string{t.TempDir()}, Destinations: []string{t.TempDir()}, CheckInterval: "1s"}}}
+	if _, err := PlanMirror(db, configs); err == nil || !strings.Contains(err.Error(), "file_sizes.checksum_algorithm") {
+		t.Fatalf("Expected PlanMirror() to report the missing columns, got %v", err)
+	}
+
+	migrated := setupTestDB(t)
+	defer migrated.Close()
+	if _, err := PlanMirror(migrated, configs); err != nil {
+		t.Fatalf("PlanMirror() error on a migrated database: %v", err)
+	}
+}
+
+func TestExportPlan(t *testing.T) {
+	plan := []PlannedAction{{Config: "test", Source: "a.raw", Action: PlanActionCopy, Size: 10}}
+	output := filepath.Join(t.TempDir(), "plan.csv")
+
+	if err := ExportPlan(plan, output); err != nil {
+		t.Fatalf("ExportPlan() error: %v", err)
+	}
+	content, err := os.ReadFile(output)
+	if err != nil {
+		t.Fatalf("Failed to read plan: %v", err)
+	}
+	if !strings.Contains(string(content), "a.raw") {
+		t.Fatalf("Exported plan missing source path: %s", content)
+	}
+
+	if err := ExportPlan(plan, filepath.Join(t.TempDir(), "plan.txt")); err == nil {
+		t.Fatalf("Expected error for unsupported format")
+	}
+}
@@ -0,0 +1,412 @@
+package catapult
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"filippo.io/age"
+	"github.com/klauspost/compress/zstd"
+	"github.com/schollz/progressbar/v3"
+)
+
+// CompressionZstd compresses copies at a destination with zstd.
+const CompressionZstd = "zstd"
+
+// compressedSuffix is appended to the name of a compressed copy.
+const compressedSuffix = ".zst"
+
+// ValidateCompression checks that a compression is known.
+//
+// Parameters:
+// - compression: The compression, or an empty string for none.
+//
+// Returns:
+// - error: An error object if the compression is not supported.
+func ValidateCompression(compression string) error {
+	if compression != "" && compression != CompressionZstd {
+		return fmt.Errorf("unknown compression: %s", compression)
+	}
+	return nil
+}
+
+// countingWriter counts the bytes written through it.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// copyFileEncoded copies a file through a compressor and an encryptor, hashing both the source and the bytes written.
+// The copy is written to a temporary file with a ".cat.part" suffix like any other copy.
+//
+// Parameters:
+// - ctx: The context to control the file copying lifecycle.
+// - src: The source file path.
+// - dst: The path of the stored file at the destination.
+// - opts: The options controlling the copy.
+//
+// Returns:
+// - CopyResult: The size and checksums of the source and of the stored file.
+// - error: An error object if there was an issue copying the file.
+func copyFileEncoded(ctx context.Context, src, dst string, opts CopyOptions) (CopyResult, error) {
+	dstPart := dst + ".cat.part"
+	source, err := os.Open(src)
+	if err != nil {
+		return CopyResult{}, err
+	}
+	defer source.Close()
+	info, err := source.Stat()
+	if err != nil {
+		return CopyResult{}, err
+	}
+	totalSize := info.Size()
+
+	hash, err := newChecksummer(opts.Checksum, opts.SecondaryChecksum)
+	if err != nil {
+		return CopyResult{}, err
+	}
+	storedHash, err := newChecksummer(opts.Checksum, "")
+	if err != nil {
+		return CopyResult{}, err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(dstPart), os.ModePerm); err != nil {
+		return CopyResult{}, err
+	}
+	// Encoded copies are never resumed, so a partial file from an earlier attempt is overwritten.
+	destinationFile, err := os.Create(dstPart)
+	if err != nil {
+		return CopyResult{}, err
+	}
+	abort := func(err error) (CopyResult, error) {
+		destinationFile.Close()
+		os.Remove(dstPart)
+		return CopyResult{}, err
+	}
+
+	stored := &countingWriter{w: io.MultiWriter(destinationFile, storedHash)}
+	buffered := bufio.NewWriterSize(stored, checksumBufferSize)
+	encoder, err := newEncoder(buffered, opts)
+	if err != nil {
+		return abort(err)
+	}
+
+	bar := opts.Bar
+	if bar == nil {
+		bar = progressbar.NewOptions64(totalSize,
+			progressbar.OptionSetDescription(fmt.Sprintf("Encoding %s to %s", src, dst)),
+			progressbar.OptionShowBytes(true),
+		)
+	}
+	started := time.Now()
+
+	reader := &throttledReader{ctx: ctx, reader: io.LimitReader(source, totalSize), limiters: opts.Limiters}
+	n, err := io.CopyBuffer(io.MultiWriter(encoder, hash, bar), reader, make([]byte, checksumBufferSize))
+	if err != nil {
+		return abort(err)
+	}
+	if n != totalSize {
+		return abort(fmt.Errorf("source file %s shrank while copying", src))
+	}
+	if err := encoder.Close(); err != nil {
+		return abort(err)
+	}
+	if err := buffered.Flush(); err != nil {
+		return abort(err)
+	}
+	if opts.Sync {
+		if err := destinationFile.Sync(); err != nil {
+			return abort(err)
+		}
+	}
+	if err := destinationFile.Close(); err != nil {
+		os.Remove(dstPart)
+		return CopyResult{}, err
+	}
+
+	LogWithDatetime(fmt.Sprintf("Finished encoding %s to %s at %s", src, dst, formatThroughput(totalSize, time.Since(started))), true)
+	return CopyResult{
+		Size:               totalSize,
+		Checksum:           hash.sum(),
+		Algorithm:          normalizeChecksumAlgorithm(opts.Checksum),
+		SecondaryChecksum:  hash.secondarySum(),
+		SecondaryAlgorithm: opts.SecondaryChecksum,
+		Engine:             EngineBuffered,
+		StoredSize:         stored.n,
+		StoredChecksum:     storedHash.sum(),
+	}, nil
+}
+
+// encoderChain writes through a chain of encoders and closes them in order.
+type encoderChain struct {
+	io.Writer
+	closers []io.Closer
+}
+
+// Close flushes every encoder, the outermost last.
+func (c *encoderChain) Close() error {
+	for i := len(c.closers) - 1; i >= 0; i-- {
+		if err := c.closers[i].Close(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// newEncoder returns a writer that encodes data as configured for a copy before it is stored. Data is compressed
+// before it is encrypted, since encrypted data does not compress.
+//
+// Parameters:
+// - w: The writer the encoded data is written to.
+// - opts: The options controlling the copy.
+//
+// Returns:
+// - io.WriteCloser: The encoder. Closing it flushes the encoded data but does not close w.
+// - error: An error object if the encoding is not supported.
+func newEncoder(w io.Writer, opts CopyOptions) (io.WriteCloser, error) {
+	chain := &encoderChain{Writer: w}
+	switch opts.Encryption {
+	case "":
+	case EncryptionAge:
+		encryptor, err := age.Encrypt(chain.Writer, opts.Recipients...)
+		if err != nil {
+			return nil, err
+		}
+		chain.Writer = encryptor
+		chain.closers = append(chain.closers, encryptor)
+	default:
+		return nil, fmt.Errorf("unknown encryption: %s", opts.Encryption)
+	}
+	switch opts.Compression {
+	case "":
+	case CompressionZstd:
+		compressor, err := zstd.NewWriter(chain.Writer)
+		if err != nil {
+			return nil, err
+		}
+		chain.Writer = compressor
+		chain.closers = append(chain.closers, compressor)
+	default:
+		return nil, fmt.Errorf("unknown compression: %s", opts.Compression)
+	}
+	return chain, nil
+}
+
+// decodeFile reads a stored file, decodes it and hashes the original content.
+//
+// Parameters:
+// - ctx: The context to control the reading lifecycle.
+// - path: The path of the stored file.
+// - compression: The compression of the stored file, or an empty string for none.
+// - identities: The identities to decrypt the stored file with, or nil if it is not encrypted.
+// - algorithm: The checksum algorithm.
+// - limiters: The rate limiters every read of the stored file waits on.
+// - w: A writer that receives the original content, or nil.
+//
+// Returns:
+// - string: The checksum of the original content in hexadecimal format.
+// - int64: The size of the original content in bytes.
+// - error: An error object if the file could not be read or decoded.
+func decodeFile(ctx context.Context, path, compression string, identities []age.Identity, algorithm string, limiters []*RateLimiter, w io.Writer) (string, int64, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", 0, err
+	}
+	defer file.Close()
+
+	var reader io.Reader = bufio.NewReaderSize(&throttledReader{ctx: ctx, reader: file, limiters: limiters}, checksumBufferSize)
+	if identities != nil {
+		if reader, err = age.Decrypt(reader, identities...); err != nil {
+			return "", 0, err
+		}
+	}
+	switch compression {
+	case "":
+	case CompressionZstd:
+		decoder, err := zstd.NewReader(reader)
+		if err != nil {
+			return "", 0, err
+		}
+		defer decoder.Close()
+		reader = decoder
+	default:
+		return "", 0, fmt.Errorf("unknown compression: %s", compression)
+	}
+
+	sums, err := newChecksummer(algorithm, "")
+	if err != nil {
+		return "", 0, err
+	}
+	writer := io.Writer(sums)
+	if w != nil {
+		writer = io.MultiWriter(w, sums)
+	}
+	n, err := io.CopyBuffer(writer, reader, make([]byte, checksumBufferSize))
+	if err != nil {
+		return "", 0, err
+	}
+	return sums.sum(), n, nil
+}
+
+// verifyEncodedCopy checks a written compressed or encrypted copy. Full verification decodes the copy and compares
+// it with the source checksum; sampled verification re-reads the stored bytes and compares them with the checksum of
+// the stored stream. Encrypted copies can only be decoded with an identity file, and are otherwise verified against
+// the checksum of the stored stream.
+//
+// Parameters:
+// - mode: The verification mode.
+// - copyPath: The path of the written copy.
+// - result: The result of the copy.
+// - settings: The settings of the destination.
+//
+// Returns:
+// - error: An error object describing the mismatch, or nil if the copy passed verification.
+func verifyEncodedCopy(mode, copyPath string, result CopyResult, settings DestinationConfig) error {
+	identities, err := settings.decryptionIdentities(false)
+	if mode == VerifyFull || mode == "" {
+		if errors.Is(err, errEncryptedCopy) {
+			mode = VerifySampled
+		} else if err != nil {
+			return err
+		}
+	}
+
+	switch mode {
+	case VerifyNone:
+		return nil
+	case VerifySize, VerifySampled:
+		if storedSize := GetFileSize(copyPath); storedSize != result.StoredSize {
+			return fmt.Errorf("size mismatch for %s: %d, want %d", copyPath, storedSize, result.StoredSize)
+		}
+		if mode == VerifySize {
+			return nil
+		}
+		storedHash, err := CalculateFileChecksum(copyPath, result.Algorithm)
+		if err != nil {
+			return err
+		}
+		if storedHash != result.StoredChecksum {
+			return fmt.Errorf("file hash mismatch for: %s", copyPath)
+		}
+		return nil
+	case VerifyFull, "":
+		checksum, size, err := decodeFile(context.Background(), copyPath, settings.compression(false), identities, result.Algorithm, nil, nil)
+		if err != nil {
+			return err
+		}
+		if size != result.Size || checksum != result.Checksum {
+			return fmt.Errorf("file hash mismatch for: %s", copyPath)
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown verification mode: %s", mode)
+	}
+}
+
+// RestoreStoredCopy decrypts and decompresses a stored copy into a directory and verifies it against the checksum
+// recorded for its source. The file is written with a ".cat.part" suffix and only renamed into place when it matches.
+//
+// Parameters:
+// - db: The database connection to read the recorded checksum from. May be nil, in which case the file is not verified.
+// - path: The path of the stored copy, ending in .zst, .age or both.
+// - target: The directory to restore the file into.
+// - identityFile: The age identity file to decrypt the copy with, required for encrypted copies.
+//
+// Returns:
+// - error: An error object if the copy could not be decoded or does not match its source.
+func RestoreStoredCopy(db *sql.DB, path, target, identityFile string) error {
+	name := filepath.Base(path)
+	var identities []age.Identity
+	if strings.HasSuffix(name, encryptedSuffix) {
+		if identityFile == "" {
+			return errEncryptedCopy
+		}
+		var err error
+		if identities, err = LoadIdentities(identityFile); err != nil {
+			return err
+		}
+		name = strings.TrimSuffix(name, encryptedSuffix)
+	}
+	var compression string
+	if strings.HasSuffix(name, compressedSuffix) {
+		compression = CompressionZstd
+		name = strings.TrimSuffix(name, compressedSuffix)
+	}
+
+	record, found := lookupStoredCopy(db, path)
+	algorithm := ChecksumSHA256
+	if found {
+		algorithm = normalizeChecksumAlgorithm(record.ChecksumAlgorithm)
+	}
+
+	restorePath := filepath.Join(target, name)
+	if _, err := os.Stat(restorePath); err == nil {
+		return fmt.Errorf("%s already exists", restorePath)
+	}
+	if err := os.MkdirAll(target, os.ModePerm); err != nil {
+		return err
+	}
+	partPath := restorePath + ".cat.part"
+	file, err := os.Create(partPath)
+	if err != nil {
+		return err
+	}
+	checksum, _, err := decodeFile(context.Background(), path, compression, identities, algorithm, nil, file)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil && found && checksum != record.Checksum {
+		err = fmt.Errorf("restored file %s does not match the checksum recorded for %s", restorePath, record.FilePath)
+	}
+	if err != nil {
+		os.Remove(partPath)
+		return err
+	}
+
+	if info, err := os.Stat(path); err == nil {
+		os.Chtimes(partPath, info.ModTime(), info.ModTime())
+	}
+	if !found {
+		LogWithDatetime(fmt.Sprintf("No copy recorded for %s; the restored file was not verified", path), false)
+	}
+	return os.Rename(partPath, restorePath)
+}
+
+// lookupStoredCopy retrieves the copy recorded for a stored file by the path given and by its absolute path.
+//
+// Parameters:
+// - db: The database connection, or nil.
+// - path: The path of the stored file.
+//
+// Returns:
+// - CopiedFileRecord: The recorded copy.
+// - bool: True if a copy was found.
+func lookupStoredCopy(db *sql.DB, path string) (CopiedFileRecord, bool) {
+	if db == nil {
+		return CopiedFileRecord{}, false
+	}
+	for _, candidate := range pathVariants(path) {
+		record, found, err := GetStoredCopy(db, candidate)
+		if err != nil {
+			LogWithDatetime(fmt.Sprintf("Error reading recorded copy of %s: %v", path, err), false)
+			return CopiedFileRecord{}, false
+		}
+		if found {
+			return record, true
+		}
+	}
+	return CopiedFileRecord{}, false
+}
@@ -0,0 +1,101 @@
+package catapult
+
+import (
+	"bytes"
+	"context"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCompressedCopy(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+
+	tmpDir := t.TempDir()
+	src := filepath.Join(tmpDir, "src")
+	destination := filepath.Join(tmpDir, "dst")
+	os.MkdirAll(src, 0755)
+	os.MkdirAll(destination, 0755)
+	content := bytes.Repeat([]byte("compressible vendor data "), 4096)
+	file := filepath.Join(src, "sample.raw")
+	os.WriteFile(file, content, 0644)
+
+	cfg := Configuration{
+		Name:                "compressed",
+		Directories:         []string{src},
+		Destinations:        []string{destination},
+		DestinationSettings: map[string]DestinationConfig{destination: {Compression: CompressionZstd}},
+	}
+	copyFileWithVerification(context.Background(), db, file, src, destination, cfg, math.MaxInt64)
+
+	stored := filepath.Join(destination, "sample.raw.zst")
+	info, err := os.Stat(stored)
+	if err != nil {
+		t.Fatalf("Expected compressed copy: %v", err)
+	}
+	if info.Size() >= int64(len(content)) {
+		t.Fatalf("Compressed copy is %d bytes, source is %d", info.Size(), len(content))
+	}
+
+	var storedSize int64
+	var storedChecksum, compression string
+	var ratio float64
+	err = db.QueryRow(`SELECT stored_size, stored_checksum, compression, compression_ratio FROM copied_files WHERE file_path = ? AND destination = ?`, file, destination).
+		Scan(&storedSize, &storedChecksum, &compression, &ratio)
+	if err != nil {
+		t.Fatalf("Failed to query stored copy: %v", err)
+	}
+	expectedStored, _ := CalculateFileHash(stored)
+	if storedSize != info.Size() || storedChecksum != expectedStored || compression != CompressionZstd {
+		t.Fatalf("Unexpected stored copy: %d, %s, %s", storedSize, storedChecksum, compression)
+	}
+	if want := float64(info.Size()) / float64(len(content)); math.Abs(ratio-want) > 1e-9 {
+		t.Fatalf("compression_ratio = %f, want %f", ratio, want)
+	}
+
+	// The recorded checksum is the checksum of the source, so scrubbing decompresses the copy.
+	scrubDue(context.Background(), db, cfg, time.Hour)
+	if got := scrubStatus(t, db, file, destination); got != ScrubOK {
+		t.Fatalf("scrub status = %q, want %q", got, ScrubOK)
+	}
+
+	restoreDir := filepath.Join(tmpDir, "restore")
+	if err := Restore(db, stored, restoreDir, ""); err != nil {
+		t.Fatalf("Restore() error: %v", err)
+	}
+	restored, err := os.ReadFile(filepath.Join(restoreDir, "sample.raw"))
+	if err != nil || !bytes.Equal(restored, content) {
+		t.Fatalf("Restored file differs from the source: %v", err)
+	}
+}
+
+func TestVerifyEncodedCopy(t *testing.T) {
+	tmpDir := t.TempDir()
+	file := filepath.Join(tmpDir, "source.raw")
+	os.WriteFile(file, bytes.Repeat([]byte("abc"), 10000), 0644)
+	stored := filepath.Join(tmpDir, "source.raw.zst")
+
+	result, err := CopyFileWithOptions(context.Background(), file, stored, CopyOptions{Compression: CompressionZstd})
+	if err != nil {
+		t.Fatalf("CopyFileWithOptions() error: %v", err)
+	}
+	part := stored + ".cat.part"
+	for _, mode := range []string{VerifySize, VerifySampled, VerifyFull} {
+		if err := verifyEncodedCopy(mode, part, result, DestinationConfig{Compression: CompressionZstd}); err != nil {
+			t.Fatalf("verifyEncodedCopy(%s) error: %v", mode, err)
+		}
+	}
+
+	// Flipping a byte keeps the size but breaks the compressed stream checksum.
+	data, _ := os.ReadFile(part)
+	data[len(data)/2] ^= 0xff
+	os.WriteFile(part, data, 0644)
+	for _, mode := range []string{VerifySampled, VerifyFull} {
+		if err := verifyEncodedCopy(mode, part, result, DestinationConfig{Compression: CompressionZstd}); err == nil {
+			t.Fatalf("Expected verifyEncodedCopy(%s) to fail for a corrupted copy", mode)
+		}
+	}
+}
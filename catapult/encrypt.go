@@ -0,0 +1,98 @@
+package catapult
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"filippo.io/age"
+)
+
+// EncryptionAge encrypts copies at a destination to age recipients.
+const EncryptionAge = "age"
+
+// encryptedSuffix is appended to the name of an encrypted copy.
+const encryptedSuffix = ".age"
+
+// errEncryptedCopy is returned when an encrypted copy has to be decrypted but no identity is configured.
+var errEncryptedCopy = errors.New("encrypted copy cannot be decrypted without an identity file")
+
+// ValidateEncryption checks that an encryption is known and that its recipients can be loaded.
+//
+// Parameters:
+// - d: The settings of the destination.
+//
+// Returns:
+// - error: An error object if the encryption is not supported or its recipients are unusable.
+func ValidateEncryption(d DestinationConfig) error {
+	switch d.Encryption {
+	case "":
+		return nil
+	case EncryptionAge:
+		_, err := d.recipients()
+		return err
+	default:
+		return fmt.Errorf("unknown encryption: %s", d.Encryption)
+	}
+}
+
+// recipients loads the age recipients copies to the destination are encrypted to.
+//
+// Returns:
+// - []age.Recipient: The recipients.
+// - error: An error object if the recipients file could not be read or lists no recipient.
+func (d DestinationConfig) recipients() ([]age.Recipient, error) {
+	if d.RecipientsFile == "" {
+		return nil, fmt.Errorf("encryption requires a recipients_file")
+	}
+	file, err := os.Open(d.RecipientsFile)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	recipients, err := age.ParseRecipients(file)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse recipients in %s: %v", d.RecipientsFile, err)
+	}
+	return recipients, nil
+}
+
+// decryptionIdentities loads the identities that decrypt copies at the destination, if they are encrypted.
+//
+// Parameters:
+// - isFolder: Boolean indicating if the copy is a bundle directory.
+//
+// Returns:
+// - []age.Identity: The identities, or nil if the copy is not encrypted.
+// - error: errEncryptedCopy if the copy is encrypted without an identity file, or an error loading the identities.
+func (d DestinationConfig) decryptionIdentities(isFolder bool) ([]age.Identity, error) {
+	if d.encryption(isFolder) == "" {
+		return nil, nil
+	}
+	if d.IdentityFile == "" {
+		return nil, errEncryptedCopy
+	}
+	return LoadIdentities(d.IdentityFile)
+}
+
+// LoadIdentities loads age identities from a file. Errors never include the content of the file, so that secret
+// keys cannot end up in logs or notifications.
+//
+// Parameters:
+// - path: The path of the identity file.
+//
+// Returns:
+// - []age.Identity: The identities.
+// - error: An error object if the file could not be read or parsed.
+func LoadIdentities(path string) ([]age.Identity, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	identities, err := age.ParseIdentities(file)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse identities in %s", path)
+	}
+	return identities, nil
+}
@@ -0,0 +1,138 @@
+package catapult
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"filippo.io/age"
+)
+
+// writeTestKeys writes an age recipients file and the identity file that decrypts it.
+func writeTestKeys(t *testing.T, dir string) (string, string) {
+	t.Helper()
+	identity, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatalf("Failed to generate identity: %v", err)
+	}
+	recipientsFile := filepath.Join(dir, "recipients.txt")
+	identityFile := filepath.Join(dir, "identity.txt")
+	os.WriteFile(recipientsFile, []byte(identity.Recipient().String()+"\n"), 0644)
+	os.WriteFile(identityFile, []byte(identity.String()+"\n"), 0600)
+	return recipientsFile, identityFile
+}
+
+func TestEncryptedCopy(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+
+	tmpDir := t.TempDir()
+	src := filepath.Join(tmpDir, "src")
+	destination := filepath.Join(tmpDir, "dst")
+	os.MkdirAll(src, 0755)
+	os.MkdirAll(destination, 0755)
+	recipientsFile, identityFile := writeTestKeys(t, tmpDir)
+	content := bytes.Repeat([]byte("patient-derived data "), 1024)
+	file := filepath.Join(src, "sample.raw")
+	os.WriteFile(file, content, 0644)
+
+	settings := DestinationConfig{Compression: CompressionZstd, Encryption: EncryptionAge, RecipientsFile: recipientsFile}
+	cfg := Configuration{
+		Name:                "encrypted",
+		Directories:         []string{src},
+		Destinations:        []string{destination},
+		DestinationSettings: map[string]DestinationConfig{destination: settings},
+	}
+	copyFileWithVerification(context.Background(), db, file, src, destination, cfg, math.MaxInt64)
+
+	stored := filepath.Join(destination, "sample.raw.zst.age")
+	ciphertext, err := os.ReadFile(stored)
+	if err != nil {
+		t.Fatalf("Expected encrypted copy: %v", err)
+	}
+	if bytes.Contains(ciphertext, []byte("patient-derived")) {
+		t.Fatalf("Encrypted copy contains plaintext")
+	}
+
+	var storedChecksum, encryption string
+	err = db.QueryRow(`SELECT stored_checksum, encryption FROM copied_files WHERE file_path = ? AND destination = ?`, file, destination).
+		Scan(&storedChecksum, &encryption)
+	if err != nil {
+		t.Fatalf("Failed to query stored copy: %v", err)
+	}
+	expectedStored, _ := CalculateFileHash(stored)
+	if storedChecksum != expectedStored || encryption != EncryptionAge {
+		t.Fatalf("Unexpected stored copy: %s, %s", storedChecksum, encryption)
+	}
+	expected, _ := CalculateFileHash(file)
+	if checksum, _ := GetCopiedFileChecksumFor(db, file, destination, ChecksumSHA256); checksum != expected {
+		t.Fatalf("Recorded checksum %q, want the plaintext checksum %q", checksum, expected)
+	}
+
+	// Without an identity file the destination is scrubbed against the checksum of the ciphertext.
+	scrubDue(context.Background(), db, cfg, time.Hour)
+	if got := scrubStatus(t, db, file, destination); got != ScrubOK {
+		t.Fatalf("scrub status = %q, want %q", got, ScrubOK)
+	}
+
+	restoreDir := filepath.Join(tmpDir, "restore")
+	if err := Restore(db, stored, restoreDir, ""); !errors.Is(err, errEncryptedCopy) {
+		t.Fatalf("Expected Restore() without an identity to fail, got %v", err)
+	}
+	if err := Restore(db, stored, restoreDir, identityFile); err != nil {
+		t.Fatalf("Restore() error: %v", err)
+	}
+	restored, err := os.ReadFile(filepath.Join(restoreDir, "sample.raw"))
+	if err != nil || !bytes.Equal(restored, content) {
+		t.Fatalf("Restored file differs from the source: %v", err)
+	}
+
+	// A damaged copy is re-encrypted from the source and its new ciphertext checksum recorded.
+	ciphertext[len(ciphertext)/2] ^= 0xff
+	os.WriteFile(stored, ciphertext, 0644)
+	cfg.Scrub.Repair = RepairSource
+	db.Exec(`UPDATE copied_files SET last_scrubbed = NULL`)
+	scrubDue(context.Background(), db, cfg, time.Hour)
+	if got := scrubStatus(t, db, file, destination); got != ScrubRepaired {
+		t.Fatalf("scrub status = %q, want %q", got, ScrubRepaired)
+	}
+	db.QueryRow(`SELECT stored_checksum FROM copied_files WHERE file_path = ? AND destination = ?`, file, destination).Scan(&storedChecksum)
+	if repaired, _ := CalculateFileHash(stored); storedChecksum != repaired {
+		t.Fatalf("Stored checksum %q, want %q after repair", storedChecksum, repaired)
+	}
+
+	// With an identity file the destination is scrubbed against the plaintext checksum.
+	settings.IdentityFile = identityFile
+	cfg.DestinationSettings[destination] = settings
+	db.Exec(`UPDATE copied_files SET last_scrubbed = NULL`)
+	scrubDue(context.Background(), db, cfg, time.Hour)
+	if got := scrubStatus(t, db, file, destination); got != ScrubOK {
+		t.Fatalf("scrub status with identity = %q, want %q", got, ScrubOK)
+	}
+}
+
+func TestValidateEncryption(t *testing.T) {
+	recipientsFile, identityFile := writeTestKeys(t, t.TempDir())
+	if err := ValidateEncryption(DestinationConfig{Encryption: EncryptionAge, RecipientsFile: recipientsFile}); err != nil {
+		t.Fatalf("ValidateEncryption() error: %v", err)
+	}
+	if err := ValidateEncryption(DestinationConfig{Encryption: EncryptionAge}); err == nil {
+		t.Fatalf("Expected an error without a recipients file")
+	}
+	if err := ValidateEncryption(DestinationConfig{Encryption: "rot13", RecipientsFile: recipientsFile}); err == nil {
+		t.Fatalf("Expected an error for an unknown encryption")
+	}
+
+	// Parse errors never echo the secret key.
+	secret, _ := os.ReadFile(identityFile)
+	os.WriteFile(identityFile, append([]byte("garbage "), secret...), 0600)
+	_, err := LoadIdentities(identityFile)
+	if err == nil || bytes.Contains([]byte(err.Error()), bytes.TrimSpace(secret)) {
+		t.Fatalf("Expected a parse error without the key, got %v", err)
+	}
+}
@@ -0,0 +1,243 @@
+package catapult
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/schollz/progressbar/v3"
+)
+
+// I/O engines used to transfer file data.
+const (
+	// EngineAuto tries reflink cloning, then a sparse copy for files with holes, then the buffered loop.
+	// copy_file_range and sendfile are not tried, because the source would have to be read a second time to hash
+	// it, which costs more than the buffered loop that hashes while it copies.
+	EngineAuto = "auto"
+	// EngineReflink clones the source extents into the destination without copying data. The clone never sees the
+	// data, so the source is read once afterwards to hash it; a reflink trades the write for that read.
+	EngineReflink = "reflink"
+	// EngineSparse copies only the data regions of a file with holes and recreates the holes at the destination.
+	EngineSparse = "sparse"
+	// EngineCopyFileRange copies data inside the kernel with copy_file_range.
+	EngineCopyFileRange = "copy_file_range"
+	// EngineSendfile copies data inside the kernel with sendfile.
+	EngineSendfile = "sendfile"
+	// EngineBuffered copies data through a userspace buffer.
+	EngineBuffered = "buffered"
+)
+
+// kernelCopyChunkSize is the amount of data handed to the kernel per call, so that cancellation,
+// throttling and progress reporting keep working during kernel copies.
+const kernelCopyChunkSize = 8 * 1024 * 1024
+
+// errEngineUnsupported is returned when an I/O engine cannot be used for a pair of files.
+var errEngineUnsupported = errors.New("I/O engine not supported")
+
+// engineOrder returns the kernel engines to try for the requested engine, in order.
+//
+// Parameters:
+// - engine: The requested engine.
+//
+// Returns:
+// - []string: The kernel engines to try. An empty list means the buffered loop is used directly.
+func engineOrder(engine string) []string {
+	switch engine {
+	case EngineAuto, "":
+		return []string{EngineReflink, EngineSparse}
+	case EngineReflink, EngineSparse, EngineCopyFileRange, EngineSendfile:
+		return []string{engine}
+	default:
+		return nil
+	}
+}
+
+// kernelCopy copies the source file into the destination file with the first kernel engine that works.
+// Both files must be positioned at their start. If no engine works, both files are rewound, the
+// destination is truncated and the hash is reset so that the caller can fall back to the buffered loop.
+//
+// Parameters:
+// - ctx: The context to control the file copying lifecycle.
+// - sourceFile: The open source file.
+// - destinationFile: The open, empty destination file.
+// - totalSize: The size of the source file.
+// - opts: The options controlling the copy.
+// - bar: The progress bar to advance.
+// - hash: The running hash of the copy, fed by the engines that read the data.
+//
+// Returns:
+// - string: The engine that copied the file.
+// - error: errEngineUnsupported if no kernel engine could be used, or the error that stopped the copy.
+func kernelCopy(ctx context.Context, sourceFile, destinationFile *os.File, totalSize int64, opts CopyOptions, bar *progressbar.ProgressBar, hash *checksummer) (string, error) {
+	for _, engine := range engineOrder(opts.Engine) {
+		if opts.Resume && engine != EngineReflink {
+			// Only a clone is all or nothing. The other engines would leave a partial copy without resume state.
+			continue
+		}
+		var err error
+		var copiedSize int64
+		if engine == EngineReflink {
+			err = reflinkFile(sourceFile, destinationFile)
+			if err == nil {
+				bar.Add64(totalSize)
+			}
+		} else if engine == EngineSparse {
+			copiedSize, err = sparseCopy(ctx, sourceFile, destinationFile, totalSize, opts, bar, hash)
+		} else {
+			copiedSize, err = chunkedKernelCopy(ctx, engine, sourceFile, destinationFile, totalSize, opts, bar)
+		}
+		if err == nil {
+			return engine, nil
+		}
+		if !errors.Is(err, errEngineUnsupported) {
+			return engine, err
+		}
+
+		// The progress bar may be shared with other copies, so only this attempt is taken back.
+		bar.Add64(-copiedSize)
+		hash.Reset()
+		if _, err := sourceFile.Seek(0, io.SeekStart); err != nil {
+			return engine, err
+		}
+		if err := destinationFile.Truncate(0); err != nil {
+			return engine, err
+		}
+		if _, err := destinationFile.Seek(0, io.SeekStart); err != nil {
+			return engine, err
+		}
+	}
+	return "", errEngineUnsupported
+}
+
+// chunkedKernelCopy copies a file in chunks with copy_file_range or sendfile.
+//
+// Parameters:
+// - ctx: The context to control the file copying lifecycle.
+// - engine: EngineCopyFileRange or EngineSendfile.
+// - sourceFile: The open source file.
+// - destinationFile: The open destination file.
+// - totalSize: The size of the source file.
+// - opts: The options controlling the copy.
+// - bar: The progress bar to advance.
+//
+// Returns:
+// - int64: The number of bytes copied.
+// - error: errEngineUnsupported if the engine cannot be used, or the error that stopped the copy.
+func chunkedKernelCopy(ctx context.Context, engine string, sourceFile, destinationFile *os.File, totalSize int64, opts CopyOptions, bar *progressbar.ProgressBar) (int64, error) {
+	var copiedSize int64
+	for copiedSize < totalSize {
+		if err := ctx.Err(); err != nil {
+			return copiedSize, err
+		}
+		chunk := totalSize - copiedSize
+		if chunk > kernelCopyChunkSize {
+			chunk = kernelCopyChunkSize
+		}
+		for _, limiter := range opts.Limiters {
+			if err := limiter.WaitN(ctx, int(chunk)); err != nil {
+				return copiedSize, err
+			}
+		}
+
+		var n int
+		var err error
+		if engine == EngineCopyFileRange {
+			n, err = copyFileRangeChunk(sourceFile, destinationFile, int(chunk))
+		} else {
+			n, err = sendfileChunk(sourceFile, destinationFile, int(chunk))
+		}
+		if err != nil {
+			return copiedSize, err
+		}
+		if n == 0 {
+			return copiedSize, fmt.Errorf("source file %s shrank while copying", sourceFile.Name())
+		}
+		copiedSize += int64(n)
+		bar.Add(n)
+	}
+	return copiedSize, nil
+}
+
+// extent is a region of a file that holds data.
+type extent struct {
+	offset int64
+	length int64
+}
+
+// sparseCopy copies the data regions of a file with holes and leaves the holes unwritten, so that the destination
+// has the same holes. The data is hashed as it is read, with holes hashed as the zeros they read as. Holes are not
+// throttled, since no data is transferred for them.
+//
+// Parameters:
+// - ctx: The context to control the file copying lifecycle.
+// - sourceFile: The open source file.
+// - destinationFile: The open, empty destination file.
+// - totalSize: The size of the source file.
+// - opts: The options controlling the copy.
+// - bar: The progress bar to advance.
+// - hash: The running hash of the copy.
+//
+// Returns:
+// - int64: The number of bytes the progress bar was advanced by.
+// - error: errEngineUnsupported if the holes of the source cannot be found or it has none, or the error that stopped the copy.
+func sparseCopy(ctx context.Context, sourceFile, destinationFile *os.File, totalSize int64, opts CopyOptions, bar *progressbar.ProgressBar, hash *checksummer) (int64, error) {
+	extents, err := dataExtents(sourceFile, totalSize)
+	if err != nil {
+		return 0, err
+	}
+	if len(extents) == 1 && extents[0].offset == 0 && extents[0].length == totalSize {
+		// Files without holes are copied faster by the other engines.
+		return 0, errEngineUnsupported
+	}
+
+	buffer := make([]byte, 1024*1024)
+	zeros := make([]byte, len(buffer))
+	hashHole := func(length int64) {
+		for ; length > int64(len(zeros)); length -= int64(len(zeros)) {
+			hash.Write(zeros)
+		}
+		hash.Write(zeros[:length])
+	}
+	var position int64
+	for _, e := range extents {
+		hashHole(e.offset - position)
+		bar.Add64(e.offset - position)
+		position = e.offset
+		for end := e.offset + e.length; position < end; {
+			if err := ctx.Err(); err != nil {
+				return position, err
+			}
+			chunk := buffer
+			if remaining := end - position; remaining < int64(len(chunk)) {
+				chunk = chunk[:remaining]
+			}
+			for _, limiter := range opts.Limiters {
+				if err := limiter.WaitN(ctx, len(chunk)); err != nil {
+					return position, err
+				}
+			}
+			n, err := sourceFile.ReadAt(chunk, position)
+			if n == 0 && err != nil {
+				if err == io.EOF {
+					return position, fmt.Errorf("source file %s shrank while copying", sourceFile.Name())
+				}
+				return position, err
+			}
+			if _, err := destinationFile.WriteAt(chunk[:n], position); err != nil {
+				return position, err
+			}
+			hash.Write(chunk[:n])
+			position += int64(n)
+			bar.Add(n)
+		}
+	}
+	// Truncating extends the file with a trailing hole if it ends in one.
+	if err := destinationFile.Truncate(totalSize); err != nil {
+		return position, err
+	}
+	hashHole(totalSize - position)
+	bar.Add64(totalSize - position)
+	return totalSize, nil
+}
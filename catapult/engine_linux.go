@@ -0,0 +1,109 @@
+//go:build linux
+// +build linux
+
+package catapult
+
+import (
+	"errors"
+	"io"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// reflinkFile clones the extents of the source file into the destination file with the FICLONE ioctl.
+// This only works when both files are on the same reflink-capable filesystem, such as XFS or Btrfs.
+//
+// Parameters:
+// - src: The open source file.
+// - dst: The open destination file.
+//
+// Returns:
+// - error: errEngineUnsupported if the filesystem cannot clone the file, or another error.
+func reflinkFile(src, dst *os.File) error {
+	return engineError(unix.IoctlFileClone(int(dst.Fd()), int(src.Fd())))
+}
+
+// copyFileRangeChunk copies up to n bytes from the current offset of src to the current offset of dst
+// inside the kernel with copy_file_range.
+//
+// Parameters:
+// - src: The open source file.
+// - dst: The open destination file.
+// - n: The maximum number of bytes to copy.
+//
+// Returns:
+// - int: The number of bytes copied.
+// - error: errEngineUnsupported if copy_file_range cannot be used for these files, or another error.
+func copyFileRangeChunk(src, dst *os.File, n int) (int, error) {
+	written, err := unix.CopyFileRange(int(src.Fd()), nil, int(dst.Fd()), nil, n, 0)
+	return written, engineError(err)
+}
+
+// sendfileChunk copies up to n bytes from the current offset of src to the current offset of dst
+// inside the kernel with sendfile.
+//
+// Parameters:
+// - src: The open source file.
+// - dst: The open destination file.
+// - n: The maximum number of bytes to copy.
+//
+// Returns:
+// - int: The number of bytes copied.
+// - error: errEngineUnsupported if sendfile cannot be used for these files, or another error.
+func sendfileChunk(src, dst *os.File, n int) (int, error) {
+	written, err := unix.Sendfile(int(dst.Fd()), int(src.Fd()), nil, n)
+	return written, engineError(err)
+}
+
+// dataExtents finds the data regions of a file with SEEK_DATA and SEEK_HOLE. The file is positioned at its start
+// afterwards.
+//
+// Parameters:
+// - f: The open file.
+// - size: The size of the file.
+//
+// Returns:
+// - []extent: The data regions of the file, in order.
+// - error: errEngineUnsupported if the filesystem cannot report holes, or another error.
+func dataExtents(f *os.File, size int64) ([]extent, error) {
+	defer f.Seek(0, io.SeekStart)
+	fd := int(f.Fd())
+	var extents []extent
+	for offset := int64(0); offset < size; {
+		start, err := unix.Seek(fd, offset, unix.SEEK_DATA)
+		if errors.Is(err, unix.ENXIO) {
+			// There is no data after offset, so the file ends in a hole.
+			break
+		}
+		if err != nil {
+			return nil, engineError(err)
+		}
+		end, err := unix.Seek(fd, start, unix.SEEK_HOLE)
+		if err != nil {
+			return nil, engineError(err)
+		}
+		if end > size {
+			end = size
+		}
+		if end <= start {
+			break
+		}
+		extents = append(extents, extent{offset: start, length: end - start})
+		offset = end
+	}
+	return extents, nil
+}
+
+// engineError maps the errors the kernel returns for unsupported file combinations to errEngineUnsupported.
+func engineError(err error) error {
+	if err == nil {
+		return nil
+	}
+	for _, unsupported := range []error{unix.EXDEV, unix.EINVAL, unix.ENOSYS, unix.EOPNOTSUPP, unix.ENOTSUP, unix.ENOTTY, unix.EBADF, unix.EPERM} {
+		if errors.Is(err, unsupported) {
+			return errEngineUnsupported
+		}
+	}
+	return err
+}
@@ -0,0 +1,63 @@
+//go:build linux
+// +build linux
+
+package catapult
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestCopyFileSparse(t *testing.T) {
+	tmpDir := t.TempDir()
+	src := filepath.Join(tmpDir, "preallocated.raw")
+	const size = 64 * 1024 * 1024
+	f, err := os.Create(src)
+	if err != nil {
+		t.Fatalf("Failed to create test file: %v", err)
+	}
+	f.Truncate(size)
+	f.WriteAt([]byte("acquisition header"), 0)
+	f.WriteAt([]byte("spectrum"), 20*1024*1024)
+	f.Close()
+
+	extents, err := dataExtents(mustOpen(t, src), size)
+	if err != nil || len(extents) < 2 {
+		t.Skipf("Filesystem does not report holes: %d extents, %v", len(extents), err)
+	}
+	expectedHash, _ := CalculateFileHash(src)
+
+	for _, engine := range []string{EngineAuto, EngineSparse} {
+		dst := filepath.Join(tmpDir, engine, "preallocated.raw")
+		result, err := CopyFileWithOptions(context.Background(), src, dst, CopyOptions{Engine: engine})
+		if err != nil {
+			t.Fatalf("CopyFileWithOptions(%s) error: %v", engine, err)
+		}
+		if result.Engine != EngineSparse && result.Engine != EngineReflink {
+			t.Fatalf("%s: engine = %s, want %s", engine, result.Engine, EngineSparse)
+		}
+		if result.Checksum != expectedHash || result.Size != size {
+			t.Fatalf("%s: checksum = %s, size = %d, want %s, %d", engine, result.Checksum, result.Size, expectedHash, size)
+		}
+		if copiedHash, _ := CalculateFileHash(dst + ".cat.part"); copiedHash != expectedHash {
+			t.Fatalf("%s: copy hash = %s, want %s", engine, copiedHash, expectedHash)
+		}
+		info, _ := os.Stat(dst + ".cat.part")
+		if allocated := info.Sys().(*syscall.Stat_t).Blocks * 512; info.Size() != size || allocated >= size/2 {
+			t.Fatalf("%s: copy is %d bytes with %d allocated, want %d bytes with holes", engine, info.Size(), allocated, size)
+		}
+	}
+}
+
+func mustOpen(t *testing.T, path string) *os.File {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("Failed to open %s: %v", path, err)
+	}
+	t.Cleanup(func() { f.Close() })
+	return f
+}
@@ -0,0 +1,28 @@
+//go:build !linux
+// +build !linux
+
+package catapult
+
+import (
+	"os"
+)
+
+// reflinkFile is not supported on this platform.
+func reflinkFile(src, dst *os.File) error {
+	return errEngineUnsupported
+}
+
+// copyFileRangeChunk is not supported on this platform.
+func copyFileRangeChunk(src, dst *os.File, n int) (int, error) {
+	return 0, errEngineUnsupported
+}
+
+// sendfileChunk is not supported on this platform.
+func sendfileChunk(src, dst *os.File, n int) (int, error) {
+	return 0, errEngineUnsupported
+}
+
+// dataExtents is not supported on this platform.
+func dataExtents(f *os.File, size int64) ([]extent, error) {
+	return nil, errEngineUnsupported
+}
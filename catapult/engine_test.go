@@ -0,0 +1,67 @@
+package catapult
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCopyFileEngines(t *testing.T) {
+	tmpDir := t.TempDir()
+	src := filepath.Join(tmpDir, "source.raw")
+	content := make([]byte, 10*1024*1024+3)
+	for i := range content {
+		content[i] = byte(i % 241)
+	}
+	if err := os.WriteFile(src, content, 0644); err != nil {
+		t.Fatalf("Failed to create test file: %v", err)
+	}
+	expectedHash, _ := CalculateFileHash(src)
+
+	for _, engine := range []string{EngineAuto, EngineReflink, EngineSparse, EngineCopyFileRange, EngineSendfile, EngineBuffered} {
+		dst := filepath.Join(tmpDir, engine, "source.raw")
+		result, err := CopyFileWithOptions(context.Background(), src, dst, CopyOptions{Engine: engine})
+		if err != nil {
+			t.Fatalf("CopyFileWithOptions(%s) error: %v", engine, err)
+		}
+		if result.Engine == "" {
+			t.Fatalf("CopyFileWithOptions(%s) did not report an engine", engine)
+		}
+		if engine == EngineBuffered && result.Engine != EngineBuffered {
+			t.Fatalf("engine = %s, want %s", result.Engine, EngineBuffered)
+		}
+		if engine == EngineAuto && (result.Engine == EngineSendfile || result.Engine == EngineCopyFileRange) {
+			t.Fatalf("auto engine used %s, which reads the source twice", result.Engine)
+		}
+		if result.Checksum != expectedHash {
+			t.Fatalf("%s checksum = %s, want %s", engine, result.Checksum, expectedHash)
+		}
+		if copiedHash, _ := CalculateFileHash(dst + ".cat.part"); copiedHash != expectedHash {
+			t.Fatalf("%s copy hash = %s, want %s", result.Engine, copiedHash, expectedHash)
+		}
+	}
+}
+
+func TestCopyFileEngineResume(t *testing.T) {
+	tmpDir := t.TempDir()
+	src := filepath.Join(tmpDir, "source.raw")
+	if err := os.WriteFile(src, make([]byte, 3*1024*1024), 0644); err != nil {
+		t.Fatalf("Failed to create test file: %v", err)
+	}
+
+	// A cancelled kernel copy would leave nothing to resume, so resumable copies use the buffered loop.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	dst := filepath.Join(tmpDir, "dst", "source.raw")
+	if _, err := CopyFileWithOptions(ctx, src, dst, CopyOptions{Engine: EngineCopyFileRange, Resume: true}); err == nil {
+		t.Fatalf("Expected a cancelled copy to fail")
+	}
+	result, err := CopyFileWithOptions(context.Background(), src, dst, CopyOptions{Engine: EngineCopyFileRange, Resume: true})
+	if err != nil {
+		t.Fatalf("CopyFileWithOptions() error: %v", err)
+	}
+	if result.Engine != EngineBuffered {
+		t.Fatalf("engine = %s, want %s", result.Engine, EngineBuffered)
+	}
+}
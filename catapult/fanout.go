@@ -0,0 +1,208 @@
+package catapult
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/schollz/progressbar/v3"
+)
+
+// fanOutQueueLength is the number of chunks buffered for each destination of a fan-out copy,
+// so that a briefly slow destination does not stall the others.
+const fanOutQueueLength = 8
+
+// FanOutTarget is a single destination of a fan-out copy.
+type FanOutTarget struct {
+	// Dst is the final destination path. The data is written to Dst + ".cat.part".
+	Dst string
+	// Options apply to this destination only.
+	Options CopyOptions
+	// Context cancels the writes to this destination only. If nil, the context of the copy is used.
+	Context context.Context
+}
+
+// fanOutWriter writes the chunks of a fan-out copy to a single destination.
+type fanOutWriter struct {
+	target FanOutTarget
+	file   *os.File
+	chunks chan []byte
+	err    error
+}
+
+// run writes chunks until the channel is closed. After a failure the remaining chunks are drained
+// and discarded so that the reader and the other destinations are not blocked.
+func (w *fanOutWriter) run(ctx context.Context, wg *sync.WaitGroup) {
+	defer wg.Done()
+	if w.target.Context != nil {
+		ctx = w.target.Context
+	}
+	for chunk := range w.chunks {
+		if w.err != nil {
+			continue
+		}
+		if err := ctx.Err(); err != nil {
+			w.err = err
+			continue
+		}
+		for _, limiter := range w.target.Options.Limiters {
+			if err := limiter.WaitN(ctx, len(chunk)); err != nil {
+				w.err = err
+				break
+			}
+		}
+		if w.err != nil {
+			continue
+		}
+		if _, err := w.file.Write(chunk); err != nil {
+			w.err = err
+		}
+	}
+}
+
+// CopyFileToMany reads the source file once and streams it into the .cat.part files of all targets at the same time.
+// The source is hashed while it is read. A failing destination is dropped and reported in its own error slot without
+// affecting the other destinations.
+//
+// Parameters:
+// - ctx: The context to control the file copying lifecycle.
+// - src: The source file path.
+// - targets: The destinations to write to.
+// - opts: The options applied to the shared source read, including the checksum algorithms.
+//
+// Returns:
+// - CopyResult: The size and checksums of the source file.
+// - []error: The error of each target, or nil for targets that were written successfully.
+// - error: An error object if the source could not be read, in which case no target is usable.
+func CopyFileToMany(ctx context.Context, src string, targets []FanOutTarget, opts CopyOptions) (CopyResult, []error, error) {
+	errs := make([]error, len(targets))
+
+	hash, err := newChecksummer(opts.Checksum, opts.SecondaryChecksum)
+	if err != nil {
+		return CopyResult{}, errs, err
+	}
+
+	sourceFile, err := os.Open(src)
+	if err != nil {
+		return CopyResult{}, errs, err
+	}
+	defer sourceFile.Close()
+
+	sourceFileInfo, err := sourceFile.Stat()
+	if err != nil {
+		return CopyResult{}, errs, err
+	}
+	totalSize := sourceFileInfo.Size()
+
+	var writersWg sync.WaitGroup
+	writers := make([]*fanOutWriter, len(targets))
+	for i, target := range targets {
+		dstPart := target.Dst + ".cat.part"
+		if err := os.MkdirAll(filepath.Dir(dstPart), os.ModePerm); err != nil {
+			errs[i] = err
+			continue
+		}
+		file, err := os.Create(dstPart)
+		if err != nil {
+			errs[i] = err
+			continue
+		}
+		os.Remove(dstPart + ".state")
+		writers[i] = &fanOutWriter{target: target, file: file, chunks: make(chan []byte, fanOutQueueLength)}
+		writersWg.Add(1)
+		go writers[i].run(ctx, &writersWg)
+	}
+
+	finish := func(readErr error) {
+		for _, writer := range writers {
+			if writer != nil {
+				close(writer.chunks)
+			}
+		}
+		writersWg.Wait()
+		for i, writer := range writers {
+			if writer == nil {
+				continue
+			}
+			if writer.err == nil && readErr == nil && writer.target.Options.Sync {
+				writer.err = writer.file.Sync()
+			}
+			if err := writer.file.Close(); err != nil && writer.err == nil {
+				writer.err = err
+			}
+			if readErr != nil {
+				errs[i] = readErr
+			} else {
+				errs[i] = writer.err
+			}
+			if errs[i] != nil {
+				os.Remove(writer.target.Dst + ".cat.part")
+			}
+		}
+	}
+
+	bar := progressbar.NewOptions64(totalSize,
+		progressbar.OptionSetDescription(fmt.Sprintf("Copying %s to %d destinations", src, len(targets))),
+		progressbar.OptionShowBytes(true),
+	)
+	started := time.Now()
+	var copiedSize int64
+
+	for copiedSize < totalSize {
+		if err := ctx.Err(); err != nil {
+			finish(err)
+			return CopyResult{}, errs, err
+		}
+
+		buffer := make([]byte, 1024*1024)
+		n, err := sourceFile.Read(buffer)
+		if err != nil && err != io.EOF {
+			finish(err)
+			return CopyResult{}, errs, err
+		}
+		if n == 0 {
+			err := fmt.Errorf("source file %s shrank while copying", src)
+			finish(err)
+			return CopyResult{}, errs, err
+		}
+		chunk := buffer[:n]
+		hash.Write(chunk)
+
+		for _, limiter := range opts.Limiters {
+			if err := limiter.WaitN(ctx, n); err != nil {
+				finish(err)
+				return CopyResult{}, errs, err
+			}
+		}
+
+		for _, writer := range writers {
+			if writer == nil {
+				continue
+			}
+			select {
+			case writer.chunks <- chunk:
+			case <-ctx.Done():
+				finish(ctx.Err())
+				return CopyResult{}, errs, ctx.Err()
+			}
+		}
+
+		copiedSize += int64(n)
+		bar.Add(n)
+	}
+
+	finish(nil)
+	LogWithDatetime(fmt.Sprintf("Finished copying %s to %d destinations at %s", src, len(targets), formatThroughput(totalSize, time.Since(started))), true)
+	return CopyResult{
+		Size:               totalSize,
+		Checksum:           hash.sum(),
+		Algorithm:          normalizeChecksumAlgorithm(opts.Checksum),
+		SecondaryChecksum:  hash.secondarySum(),
+		SecondaryAlgorithm: opts.SecondaryChecksum,
+		Engine:             EngineBuffered,
+	}, errs, nil
+}
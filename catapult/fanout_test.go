@@ -0,0 +1,55 @@
+package catapult
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCopyFileToMany(t *testing.T) {
+	tmpDir := t.TempDir()
+	src := filepath.Join(tmpDir, "source.raw")
+	content := make([]byte, 3*1024*1024+17)
+	for i := range content {
+		content[i] = byte(i)
+	}
+	if err := os.WriteFile(src, content, 0644); err != nil {
+		t.Fatalf("Failed to create test file: %v", err)
+	}
+
+	// A regular file where a destination directory is expected makes that destination fail.
+	blocker := filepath.Join(tmpDir, "blocker")
+	os.WriteFile(blocker, []byte("x"), 0644)
+
+	targets := []FanOutTarget{
+		{Dst: filepath.Join(tmpDir, "out1", "source.raw")},
+		{Dst: filepath.Join(blocker, "out2", "source.raw")},
+		{Dst: filepath.Join(tmpDir, "out3", "source.raw")},
+	}
+
+	result, errs, err := CopyFileToMany(context.Background(), src, targets, CopyOptions{})
+	if err != nil {
+		t.Fatalf("CopyFileToMany() error: %v", err)
+	}
+	expectedHash, _ := CalculateFileHash(src)
+	if result.Checksum != expectedHash {
+		t.Fatalf("hash = %s, want %s", result.Checksum, expectedHash)
+	}
+	if errs[1] == nil {
+		t.Fatalf("Expected error for blocked destination")
+	}
+
+	for _, i := range []int{0, 2} {
+		if errs[i] != nil {
+			t.Fatalf("target %d error: %v", i, errs[i])
+		}
+		copiedHash, err := CalculateFileHash(targets[i].Dst + ".cat.part")
+		if err != nil {
+			t.Fatalf("Failed to hash copy: %v", err)
+		}
+		if copiedHash != expectedHash {
+			t.Fatalf("target %d hash = %s, want %s", i, copiedHash, expectedHash)
+		}
+	}
+}
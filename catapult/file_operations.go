@@ -3,41 +3,132 @@ package catapult
 
 import (
 	"context"
-	"crypto/sha256"
 	"database/sql"
-	"encoding/hex"
+	"filippo.io/age"
 	"fmt"
 	"github.com/schollz/progressbar/v3"
 	"io"
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 )
 
+// ListingSkips counts the paths ListFiles left out of a listing.
+type ListingSkips struct {
+	// SymbolicLinks are links skipped by the symlink policy, broken links, and links to bundle directories.
+	SymbolicLinks int
+	// Cycles are links to a directory that contains them, which would otherwise be followed forever.
+	Cycles int
+	// SpecialFiles are FIFOs, sockets and devices, which are never copied.
+	SpecialFiles int
+}
+
 // ListFiles returns a list of all files and directories in the given root directory and its subdirectories,
-// excluding the contents of directories ending with .d.
+// excluding the contents of directories ending with .d. Symbolic links are followed, listed as links or skipped
+// according to the symlink policy, and special files are skipped.
 //
 // Parameters:
 // - root: The root directory to list files and directories from.
+// - symlinks: The symlink policy, or an empty string to follow links.
 //
 // Returns:
 // - []string: A slice of file and directory paths.
+// - ListingSkips: The number of paths that were skipped.
 // - error: An error object if there was an issue listing the files and directories.
-func ListFiles(root string) ([]string, error) {
-	var paths []string
-	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
-		if err != nil {
-			return err
+func ListFiles(root, symlinks string) ([]string, ListingSkips, error) {
+	var skips ListingSkips
+	info, err := os.Stat(root)
+	if err != nil {
+		return nil, skips, err
+	}
+	paths := []string{root}
+	// Include directories ending with .d but skip their contents
+	if !info.IsDir() || filepath.Ext(root) == ".d" {
+		return paths, skips, nil
+	}
+	err = listDirectory(root, symlinks, []os.FileInfo{info}, &paths, &skips)
+	return paths, skips, err
+}
+
+// listDirectory appends the entries of a directory to a listing for ListFiles, descending into subdirectories.
+//
+// Parameters:
+// - dir: The directory to list.
+// - symlinks: The symlink policy.
+// - ancestors: The directories that contain dir, including dir itself, used to detect cycles.
+// - paths: The listing to append to.
+// - skips: The counts of skipped paths to update.
+//
+// Returns:
+// - error: An error object if a directory could not be read.
+func listDirectory(dir, symlinks string, ancestors []os.FileInfo, paths *[]string, skips *ListingSkips) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		path := filepath.Join(dir, entry.Name())
+		mode := entry.Type()
+		if mode&os.ModeSymlink != 0 {
+			if symlinks == SymlinkCopy {
+				*paths = append(*paths, path)
+				continue
+			}
+			if symlinks == SymlinkSkip {
+				skips.SymbolicLinks++
+				continue
+			}
+			info, err := os.Stat(path)
+			if err != nil || (info.IsDir() && filepath.Ext(path) == ".d") {
+				// Broken links cannot be copied, and bundles are only copied from where they are.
+				skips.SymbolicLinks++
+				continue
+			}
+			if info.IsDir() && isAncestor(info, ancestors) {
+				skips.Cycles++
+				continue
+			}
+			mode = info.Mode().Type()
 		}
-		// Include directories ending with .d but skip their contents
-		if info.IsDir() && filepath.Ext(info.Name()) == ".d" {
-			paths = append(paths, path)
-			return filepath.SkipDir
+
+		switch {
+		case mode.IsDir():
+			*paths = append(*paths, path)
+			if filepath.Ext(path) == ".d" {
+				continue
+			}
+			info, err := os.Stat(path)
+			if err != nil {
+				return err
+			}
+			if err := listDirectory(path, symlinks, append(ancestors, info), paths, skips); err != nil {
+				return err
+			}
+		case mode.IsRegular():
+			*paths = append(*paths, path)
+		default:
+			skips.SpecialFiles++
 		}
-		paths = append(paths, path)
-		return nil
-	})
-	return paths, err
+	}
+	return nil
+}
+
+// isAncestor checks whether a directory is one of the directories a listing is currently inside.
+//
+// Parameters:
+// - info: The information of the directory.
+// - ancestors: The directories the listing is inside.
+//
+// Returns:
+// - bool: True if the directory is an ancestor.
+func isAncestor(info os.FileInfo, ancestors []os.FileInfo) bool {
+	for _, ancestor := range ancestors {
+		if os.SameFile(info, ancestor) {
+			return true
+		}
+	}
+	return false
 }
 
 // IsFileCompleted checks if a file or directory has completed writing by comparing its size over a specified duration.
@@ -118,6 +209,50 @@ func GetFileSize(filePath string) int64 {
 	return fileInfo.Size()
 }
 
+// CopyOptions controls how CopyFileWithOptions transfers a file.
+type CopyOptions struct {
+	// Limiters throttle the copy. Every chunk waits on all of them.
+	Limiters []*RateLimiter
+	// Resume keeps interrupted .cat.part files and continues them on the next attempt.
+	Resume bool
+	// Engine selects the I/O engine. An empty engine is the same as EngineAuto.
+	Engine string
+	// Sync flushes the written data to stable storage before the copy is reported as finished.
+	Sync bool
+	// Bar is a shared progress bar to advance instead of showing a progress bar for this copy.
+	Bar *progressbar.ProgressBar
+	// Checksum is the checksum algorithm of the source. An empty algorithm is the same as DefaultChecksumAlgorithm.
+	Checksum string
+	// SecondaryChecksum is an optional second checksum algorithm computed in the same pass.
+	SecondaryChecksum string
+	// Compression compresses the copy while it is written. An empty compression stores a plain copy.
+	Compression string
+	// Encryption encrypts the copy to Recipients while it is written. An empty encryption stores a plain copy.
+	Encryption string
+	// Recipients are the age recipients of an encrypted copy.
+	Recipients []age.Recipient
+}
+
+// CopyResult describes a completed copy.
+type CopyResult struct {
+	// Size is the total size of the copied file in bytes.
+	Size int64
+	// Checksum is the hash of the source, computed while it was read.
+	Checksum string
+	// Algorithm is the checksum algorithm of Checksum.
+	Algorithm string
+	// SecondaryChecksum is the hash of the source with the secondary algorithm, if one was requested.
+	SecondaryChecksum string
+	// SecondaryAlgorithm is the checksum algorithm of SecondaryChecksum.
+	SecondaryAlgorithm string
+	// Engine is the I/O engine that transferred the data.
+	Engine string
+	// StoredSize is the size of the stored file for copies that are compressed or encrypted, or zero for plain copies.
+	StoredSize int64
+	// StoredChecksum is the hash of the stored file using Algorithm, or an empty string for plain copies.
+	StoredChecksum string
+}
+
 // CopyFile copies a file from the source path to the destination path, with support for context cancellation.
 //
 // Parameters:
@@ -129,75 +264,196 @@ func GetFileSize(filePath string) int64 {
 // - int64: The total size of the copied file in bytes.
 // - error: An error object if there was an issue copying the file.
 func CopyFile(ctx context.Context, src, dst string) (int64, error) {
+	result, err := CopyFileWithOptions(ctx, src, dst, CopyOptions{})
+	return result.Size, err
+}
 
-	dstPart := dst + ".cat.part"
-	// check if the file already exists
-	if _, err := os.Stat(dstPart); err == nil {
-		// file already exists, remove it
-		if err := os.Remove(dstPart); err != nil {
-			fmt.Printf("Error removing existing file: %v\n", err)
-			return 0, err
-		}
+// CopyFileWithOptions copies a file from the source path to the destination path like CopyFile,
+// applying the given copy options. The source is hashed while it is read, so it does not have to be read again.
+//
+// Parameters:
+// - ctx: The context to control the file copying lifecycle.
+// - src: The source file path.
+// - dst: The destination file path.
+// - opts: The options controlling the copy.
+//
+// Returns:
+// - CopyResult: The size and checksum of the copied file.
+// - error: An error object if there was an issue copying the file.
+func CopyFileWithOptions(ctx context.Context, src, dst string, opts CopyOptions) (CopyResult, error) {
+	if opts.Compression != "" || opts.Encryption != "" {
+		return copyFileEncoded(ctx, src, dst, opts)
 	}
+
+	dstPart := dst + ".cat.part"
+	statePath := dstPart + ".state"
 	sourceFile, err := os.Open(src)
 	if err != nil {
-		return 0, err
+		return CopyResult{}, err
 	}
 	defer sourceFile.Close()
 
+	sourceFileInfo, err := sourceFile.Stat()
+	if err != nil {
+		return CopyResult{}, err
+	}
+	totalSize := sourceFileInfo.Size()
+	hash, err := newChecksummer(opts.Checksum, opts.SecondaryChecksum)
+	if err != nil {
+		return CopyResult{}, err
+	}
+	algorithm := normalizeChecksumAlgorithm(opts.Checksum)
+
+	var offset int64
+	if opts.Resume {
+		offset = resumeOffset(sourceFile, src, dstPart, statePath, totalSize, algorithm, hash)
+	}
+
+	if offset == 0 {
+		// check if the file already exists
+		if _, err := os.Stat(dstPart); err == nil {
+			// file already exists, remove it
+			if err := os.Remove(dstPart); err != nil {
+				fmt.Printf("Error removing existing file: %v\n", err)
+				return CopyResult{}, err
+			}
+		}
+		os.Remove(statePath)
+	}
+
 	if err := os.MkdirAll(filepath.Dir(dstPart), os.ModePerm); err != nil {
-		return 0, err
+		return CopyResult{}, err
 	}
 
-	destinationFile, err := os.Create(dstPart)
+	destinationFile, err := os.OpenFile(dstPart, os.O_CREATE|os.O_WRONLY, 0666)
 	if err != nil {
-		return 0, err
+		return CopyResult{}, err
 	}
 	defer destinationFile.Close()
 
-	sourceFileInfo, err := sourceFile.Stat()
-	if err != nil {
-		return 0, err
+	if err := destinationFile.Truncate(offset); err != nil {
+		return CopyResult{}, err
 	}
-	totalSize := sourceFileInfo.Size()
+	if _, err := destinationFile.Seek(offset, io.SeekStart); err != nil {
+		return CopyResult{}, err
+	}
+
 	buffer := make([]byte, 1024*1024)
-	var copiedSize int64
+	copiedSize := offset
+	lastCheckpoint := offset
+
+	// checkpoint records how far the partial file was written. The file is flushed first, so that the state never
+	// covers data that could still be lost.
+	checkpoint := func() bool {
+		if err := destinationFile.Sync(); err != nil {
+			LogWithDatetime(fmt.Sprintf("Error flushing partial copy %s: %v", dstPart, err), false)
+			os.Remove(statePath)
+			return false
+		}
+		saveCopyState(statePath, copyState{Source: src, Offset: copiedSize, Algorithm: algorithm, PrefixHash: hash.sum()})
+		return true
+	}
 
-	bar := progressbar.NewOptions64(totalSize, progressbar.OptionSetDescription(fmt.Sprintf("Copying %s to %s", src, dst)))
+	// abort keeps the partial file for a later resume, or removes it if resuming is disabled.
+	abort := func(err error) (CopyResult, error) {
+		if !opts.Resume || copiedSize == 0 || !checkpoint() {
+			os.Remove(dstPart)
+		}
+		return CopyResult{}, err
+	}
 
-copyLoop:
-	for {
+	bar := opts.Bar
+	if bar == nil {
+		bar = progressbar.NewOptions64(totalSize,
+			progressbar.OptionSetDescription(fmt.Sprintf("Copying %s to %s", src, dst)),
+			progressbar.OptionShowBytes(true),
+		)
+	}
+	bar.Add64(offset)
+	started := time.Now()
+
+	if offset == 0 {
+		engine, err := kernelCopy(ctx, sourceFile, destinationFile, totalSize, opts, bar, hash)
+		if err == nil && opts.Sync {
+			err = destinationFile.Sync()
+		}
+		if err == nil {
+			checksum, secondaryChecksum := hash.sum(), hash.secondarySum()
+			if engine != EngineSparse {
+				// The other kernel engines never see the data, so the source is hashed separately.
+				checksum, secondaryChecksum, err = CalculateFileChecksums(src, algorithm, opts.SecondaryChecksum)
+				if err != nil {
+					return abort(err)
+				}
+			}
+			LogWithDatetime(fmt.Sprintf("Finished copying %s to %s with %s at %s", src, dst, engine, formatThroughput(totalSize, time.Since(started))), true)
+			return CopyResult{
+				Size:               totalSize,
+				Checksum:           checksum,
+				Algorithm:          algorithm,
+				SecondaryChecksum:  secondaryChecksum,
+				SecondaryAlgorithm: opts.SecondaryChecksum,
+				Engine:             engine,
+			}, nil
+		}
+		if err != errEngineUnsupported {
+			os.Remove(dstPart)
+			return CopyResult{}, err
+		}
+	}
+
+	for copiedSize < totalSize {
 		select {
 		case <-ctx.Done():
-			os.Remove(dstPart)
-			return 0, ctx.Err()
+			return abort(ctx.Err())
 		default:
+		}
 
-			n, err := sourceFile.Read(buffer)
-			if err != nil && err != io.EOF {
-				return 0, err
-			}
-			if n == 0 {
-				break
-			}
+		n, err := sourceFile.Read(buffer)
+		if err != nil && err != io.EOF {
+			return abort(err)
+		}
+		if n == 0 {
+			return abort(fmt.Errorf("source file %s shrank while copying", src))
+		}
 
-			if _, err := destinationFile.Write(buffer[:n]); err != nil {
-				return 0, err
+		for _, limiter := range opts.Limiters {
+			if err := limiter.WaitN(ctx, n); err != nil {
+				return abort(err)
 			}
+		}
 
-			copiedSize += int64(n)
-			err = bar.Add(n)
-			if err != nil {
-				return 0, err
-			}
-			if copiedSize == totalSize {
-				break copyLoop
-			}
+		if _, err := destinationFile.Write(buffer[:n]); err != nil {
+			return abort(err)
+		}
+		hash.Write(buffer[:n])
+
+		copiedSize += int64(n)
+		if opts.Resume && copiedSize-lastCheckpoint >= resumeCheckpointInterval {
+			checkpoint()
+			lastCheckpoint = copiedSize
+		}
+		err = bar.Add(n)
+		if err != nil {
+			return abort(err)
+		}
+	}
+	if opts.Sync {
+		if err := destinationFile.Sync(); err != nil {
+			return abort(err)
 		}
 	}
+	os.Remove(statePath)
 
-	LogWithDatetime(fmt.Sprintf("Finished copying %s to %s", src, dst), true)
-	return totalSize, nil
+	LogWithDatetime(fmt.Sprintf("Finished copying %s to %s at %s", src, dst, formatThroughput(totalSize-offset, time.Since(started))), true)
+	return CopyResult{
+		Size:               totalSize,
+		Checksum:           hash.sum(),
+		Algorithm:          algorithm,
+		SecondaryChecksum:  hash.secondarySum(),
+		SecondaryAlgorithm: opts.SecondaryChecksum,
+		Engine:             EngineBuffered,
+	}, nil
 }
 
 // CalculateFileHash calculates the SHA-256 hash of the file or directory at the given path.
@@ -209,41 +465,5 @@ copyLoop:
 // - string: The SHA-256 hash in hexadecimal format.
 // - error: An error object if there was an issue calculating the hash.
 func CalculateFileHash(filePath string) (string, error) {
-	info, err := os.Stat(filePath)
-	if err != nil {
-		return "", err
-	}
-
-	hash := sha256.New()
-
-	if info.IsDir() {
-		err := filepath.Walk(filePath, func(path string, info os.FileInfo, err error) error {
-			if err != nil {
-				return err
-			}
-			if !info.IsDir() {
-				fileHash, err := CalculateFileHash(path)
-				if err != nil {
-					return err
-				}
-				hash.Write([]byte(fileHash))
-			}
-			return nil
-		})
-		if err != nil {
-			return "", err
-		}
-	} else {
-		file, err := os.Open(filePath)
-		if err != nil {
-			return "", err
-		}
-		defer file.Close()
-
-		if _, err := io.Copy(hash, file); err != nil {
-			return "", err
-		}
-	}
-
-	return hex.EncodeToString(hash.Sum(nil)), nil
+	return CalculateFileChecksum(filePath, ChecksumSHA256)
 }
@@ -0,0 +1,358 @@
+package catapult
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// DestinationLeaseFile is the name of the lease file written into every destination directory.
+const DestinationLeaseFile = ".catapult.lease"
+
+// DefaultLeaseTimeout is how long a lease held by another host is honoured without being renewed.
+const DefaultLeaseTimeout = 10 * time.Minute
+
+// LockInfo is the content of a lock or lease file.
+type LockInfo struct {
+	Host     string    `json:"host"`
+	PID      int       `json:"pid"`
+	Acquired time.Time `json:"acquired"`
+	Renewed  time.Time `json:"renewed"`
+}
+
+// Lock is an exclusive lock held through a lock file.
+type Lock struct {
+	path string
+	info LockInfo
+	mu   sync.Mutex
+	// lost is closed once the lock could not be renewed, with lostErr holding the reason.
+	lost     chan struct{}
+	lostOnce sync.Once
+	lostErr  error
+}
+
+// destinationLeases holds the lease of every destination by the absolute path of the destination, so that copies
+// can be cancelled when a lease is lost.
+var (
+	destinationLeases   = make(map[string]*Lock)
+	destinationLeasesMu sync.Mutex
+)
+
+// AcquireLock creates the lock file at the given path, failing if another live process holds it.
+// A lock held by a process on this host is stale once that process has exited. A lock held by another host
+// is stale once it has not been renewed for staleAfter; a zero staleAfter never expires locks from other hosts.
+//
+// Parameters:
+// - path: The path of the lock file.
+// - staleAfter: How long a lock from another host is honoured without being renewed.
+//
+// Returns:
+// - *Lock: The acquired lock.
+// - error: An error object if the lock is held by another process or could not be created.
+func AcquireLock(path string, staleAfter time.Duration) (*Lock, error) {
+	host, err := os.Hostname()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	lock := &Lock{
+		path: path,
+		info: LockInfo{Host: host, PID: os.Getpid(), Acquired: now, Renewed: now},
+		lost: make(chan struct{}),
+	}
+
+	for attempt := 0; attempt < 2; attempt++ {
+		file, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+		if err == nil {
+			err = json.NewEncoder(file).Encode(lock.info)
+			file.Close()
+			if err != nil {
+				os.Remove(path)
+				return nil, err
+			}
+			return lock, nil
+		}
+		if !os.IsExist(err) {
+			return nil, err
+		}
+
+		holder, err := ReadLockInfo(path)
+		if err != nil {
+			return nil, fmt.Errorf("lock %s exists but could not be read: %v", path, err)
+		}
+		if !isLockStale(holder, host, staleAfter) {
+			return nil, fmt.Errorf("%s is locked by PID %d on %s since %s", path, holder.PID, holder.Host, holder.Acquired.Format("2006-01-02 15:04:05"))
+		}
+		LogWithDatetime(fmt.Sprintf("Removing stale lock %s held by PID %d on %s", path, holder.PID, holder.Host), true)
+		if err := removeStaleLock(path, holder, host); err != nil {
+			return nil, err
+		}
+	}
+	return nil, fmt.Errorf("could not acquire lock %s", path)
+}
+
+// removeStaleLock removes a lock file found stale without racing other processes that replace it at the same time.
+// The file is renamed to a name of this process first, which only one process can do, and is then checked to still
+// record the stale owner. A lock that was renewed or replaced after it was found stale is put back.
+//
+// Parameters:
+// - path: The path of the lock file.
+// - stale: The owner that was found stale.
+// - host: The name of this host.
+//
+// Returns:
+// - error: An error object if the lock changed while it was being removed or could not be removed.
+func removeStaleLock(path string, stale LockInfo, host string) error {
+	claimed := fmt.Sprintf("%s.%s.%d.stale", path, host, os.Getpid())
+	if err := os.Rename(path, claimed); err != nil {
+		if os.IsNotExist(err) {
+			// Another process removed it first, and the next attempt to create the lock decides who holds it.
+			return nil
+		}
+		return err
+	}
+	defer os.Remove(claimed)
+
+	holder, err := ReadLockInfo(claimed)
+	if err == nil && holder.Host == stale.Host && holder.PID == stale.PID && holder.Renewed.Equal(stale.Renewed) {
+		return nil
+	}
+	if err := os.Link(claimed, path); err != nil && !os.IsExist(err) {
+		return err
+	}
+	return fmt.Errorf("lock %s changed while it was being replaced", path)
+}
+
+// ReadLockInfo reads the owner recorded in a lock or lease file.
+//
+// Parameters:
+// - path: The path of the lock file.
+//
+// Returns:
+// - LockInfo: The recorded owner.
+// - error: An error object if the file could not be read or decoded.
+func ReadLockInfo(path string) (LockInfo, error) {
+	var info LockInfo
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return info, err
+	}
+	err = json.Unmarshal(content, &info)
+	return info, err
+}
+
+// isLockStale reports whether a lock owner can be safely replaced.
+func isLockStale(holder LockInfo, host string, staleAfter time.Duration) bool {
+	if holder.Host == host {
+		return holder.PID == os.Getpid() || !isProcessRunning(holder.PID)
+	}
+	return staleAfter > 0 && time.Since(holder.Renewed) > staleAfter
+}
+
+// Renew refreshes the renewal time of the lock so that other hosts keep honouring it.
+//
+// Returns:
+// - error: An error object if the lock was taken over or could not be written.
+func (l *Lock) Renew() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	holder, err := ReadLockInfo(l.path)
+	if err != nil {
+		return err
+	}
+	if holder.Host != l.info.Host || holder.PID != l.info.PID {
+		return fmt.Errorf("lock %s was taken over by PID %d on %s", l.path, holder.PID, holder.Host)
+	}
+
+	l.info.Renewed = time.Now()
+	content, err := json.Marshal(l.info)
+	if err != nil {
+		return err
+	}
+	tmpPath := l.path + ".tmp"
+	if err := os.WriteFile(tmpPath, append(content, '\n'), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, l.path)
+}
+
+// lose gives up the lock after it could not be renewed, cancelling the contexts derived from it.
+//
+// Parameters:
+// - err: The reason the lock was lost.
+func (l *Lock) lose(err error) {
+	l.lostOnce.Do(func() {
+		l.lostErr = err
+		close(l.lost)
+	})
+}
+
+// Release removes the lock file if it is still owned by this process.
+//
+// Returns:
+// - error: An error object if the lock file could not be removed.
+func (l *Lock) Release() error {
+	destinationLeasesMu.Lock()
+	for destination, lease := range destinationLeases {
+		if lease == l {
+			delete(destinationLeases, destination)
+		}
+	}
+	destinationLeasesMu.Unlock()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	holder, err := ReadLockInfo(l.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	if holder.Host != l.info.Host || holder.PID != l.info.PID {
+		return nil
+	}
+	return os.Remove(l.path)
+}
+
+// AcquireDestinationLeases writes a lease file into every configured destination directory.
+// If any destination is leased by another instance, the leases acquired so far are released.
+//
+// Parameters:
+// - config: The configurations containing the destinations.
+// - staleAfter: How long a lease from another host is honoured without being renewed.
+//
+// Returns:
+// - []*Lock: The acquired leases.
+// - error: An error object if a destination is leased by another instance.
+func AcquireDestinationLeases(config Configurations, staleAfter time.Duration) ([]*Lock, error) {
+	var leases []*Lock
+	seen := make(map[string]bool)
+	for _, cfg := range config.Configs {
+		for _, destination := range cfg.Destinations {
+			absDestination, err := filepath.Abs(destination)
+			if err != nil {
+				ReleaseLocks(leases)
+				return nil, err
+			}
+			if seen[absDestination] {
+				continue
+			}
+			seen[absDestination] = true
+
+			if err := os.MkdirAll(destination, os.ModePerm); err != nil {
+				ReleaseLocks(leases)
+				return nil, err
+			}
+			lease, err := AcquireLock(filepath.Join(destination, DestinationLeaseFile), staleAfter)
+			if err != nil {
+				ReleaseLocks(leases)
+				return nil, err
+			}
+			leases = append(leases, lease)
+			destinationLeasesMu.Lock()
+			destinationLeases[absDestination] = lease
+			destinationLeasesMu.Unlock()
+		}
+	}
+	return leases, nil
+}
+
+// destinationContext derives a context for the copies to a destination, which is cancelled once the lease of the
+// destination is lost.
+//
+// Parameters:
+// - ctx: The parent context.
+// - destination: The destination directory.
+//
+// Returns:
+// - context.Context: The derived context.
+// - context.CancelFunc: The function releasing the derived context.
+func destinationContext(ctx context.Context, destination string) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancelCause(ctx)
+	absDestination, err := filepath.Abs(destination)
+	if err != nil {
+		return ctx, func() { cancel(nil) }
+	}
+	destinationLeasesMu.Lock()
+	lease := destinationLeases[absDestination]
+	destinationLeasesMu.Unlock()
+	if lease == nil {
+		return ctx, func() { cancel(nil) }
+	}
+
+	select {
+	case <-lease.lost:
+		cancel(lease.lostErr)
+		return ctx, func() {}
+	default:
+	}
+	go func() {
+		select {
+		case <-lease.lost:
+			cancel(lease.lostErr)
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, func() { cancel(nil) }
+}
+
+// RenewLocks renews the given locks at the given interval until the context is cancelled. A lock that cannot be
+// renewed is given up: it is no longer renewed, and the copies to its destination are cancelled.
+//
+// Parameters:
+// - ctx: The context to control the renewal lifecycle.
+// - locks: The locks to renew.
+// - interval: The renewal interval.
+//
+// Returns:
+// - error: The errors of the locks that were given up, once the context is cancelled or no lock is left to renew.
+func RenewLocks(ctx context.Context, locks []*Lock, interval time.Duration) error {
+	if interval <= 0 {
+		return nil
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	var errs []error
+	for len(locks) > 0 {
+		select {
+		case <-ctx.Done():
+			return errors.Join(errs...)
+		case <-ticker.C:
+			var held []*Lock
+			for _, lock := range locks {
+				if err := lock.Renew(); err != nil {
+					err = fmt.Errorf("lease %s lost: %v", lock.path, err)
+					LogWithDatetime(fmt.Sprintf("Error renewing lease, stopping copies to %s: %v", filepath.Dir(lock.path), err), true)
+					sendSlackNotification(fmt.Sprintf("Error renewing lease, stopping copies to %s: %v", filepath.Dir(lock.path), err))
+					lock.lose(err)
+					errs = append(errs, err)
+					continue
+				}
+				held = append(held, lock)
+			}
+			locks = held
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// ReleaseLocks releases all the given locks, logging any failures.
+//
+// Parameters:
+// - locks: The locks to release.
+func ReleaseLocks(locks []*Lock) {
+	for _, lock := range locks {
+		if err := lock.Release(); err != nil {
+			LogWithDatetime(fmt.Sprintf("Error releasing lock: %v", err), true)
+		}
+	}
+}
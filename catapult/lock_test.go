@@ -0,0 +1,124 @@
+package catapult
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestAcquireLock(t *testing.T) {
+	lockPath := filepath.Join(t.TempDir(), "file_sizes.db.lock")
+
+	lock, err := AcquireLock(lockPath, 0)
+	if err != nil {
+		t.Fatalf("AcquireLock() error: %v", err)
+	}
+
+	// A live owner on another host must be honoured.
+	holder, err := ReadLockInfo(lockPath)
+	if err != nil {
+		t.Fatalf("ReadLockInfo() error: %v", err)
+	}
+	holder.Host = "other-host"
+	holder.Renewed = time.Now()
+	content, _ := json.Marshal(holder)
+	os.WriteFile(lockPath, content, 0644)
+
+	if _, err := AcquireLock(lockPath, time.Minute); err == nil {
+		t.Fatalf("Expected lock held by another host to be refused")
+	}
+
+	// Once the other host stops renewing, the lock is stale.
+	holder.Renewed = time.Now().Add(-time.Hour)
+	content, _ = json.Marshal(holder)
+	os.WriteFile(lockPath, content, 0644)
+
+	lock, err = AcquireLock(lockPath, time.Minute)
+	if err != nil {
+		t.Fatalf("Expected stale lock to be replaced: %v", err)
+	}
+	if err := lock.Renew(); err != nil {
+		t.Fatalf("Renew() error: %v", err)
+	}
+	if err := lock.Release(); err != nil {
+		t.Fatalf("Release() error: %v", err)
+	}
+	if _, err := os.Stat(lockPath); !os.IsNotExist(err) {
+		t.Fatalf("Expected lock file to be removed")
+	}
+}
+
+func TestAcquireLockDeadProcess(t *testing.T) {
+	lockPath := filepath.Join(t.TempDir(), "file_sizes.db.lock")
+	host, _ := os.Hostname()
+
+	content, _ := json.Marshal(LockInfo{Host: host, PID: 1 << 30, Acquired: time.Now(), Renewed: time.Now()})
+	os.WriteFile(lockPath, content, 0644)
+
+	lock, err := AcquireLock(lockPath, 0)
+	if err != nil {
+		t.Fatalf("Expected lock of exited process to be replaced: %v", err)
+	}
+	lock.Release()
+}
+
+func TestRemoveStaleLockRenewed(t *testing.T) {
+	lockPath := filepath.Join(t.TempDir(), "file_sizes.db.lock")
+	stale := LockInfo{Host: "other-host", PID: 42, Acquired: time.Now().Add(-time.Hour), Renewed: time.Now().Add(-time.Hour)}
+
+	// The owner renewed the lock after it was found stale, so it must be put back.
+	renewed := stale
+	renewed.Renewed = time.Now()
+	content, _ := json.Marshal(renewed)
+	os.WriteFile(lockPath, content, 0644)
+	if err := removeStaleLock(lockPath, stale, "this-host"); err == nil {
+		t.Fatalf("Expected a renewed lock not to be removed")
+	}
+	if holder, err := ReadLockInfo(lockPath); err != nil || !holder.Renewed.Equal(renewed.Renewed) {
+		t.Fatalf("Expected the renewed lock to be put back, got %+v, %v", holder, err)
+	}
+
+	content, _ = json.Marshal(stale)
+	os.WriteFile(lockPath, content, 0644)
+	if err := removeStaleLock(lockPath, stale, "this-host"); err != nil {
+		t.Fatalf("removeStaleLock() error: %v", err)
+	}
+	entries, _ := os.ReadDir(filepath.Dir(lockPath))
+	if len(entries) != 0 {
+		t.Fatalf("Expected the stale lock to be removed, found %d files", len(entries))
+	}
+}
+
+func TestRenewLocksLostLease(t *testing.T) {
+	destination := t.TempDir()
+	configs := Configurations{Configs: []Configuration{{Name: "test", Destinations: []string{destination}}}}
+	leases, err := AcquireDestinationLeases(configs, time.Minute)
+	if err != nil {
+		t.Fatalf("AcquireDestinationLeases() error: %v", err)
+	}
+	defer ReleaseLocks(leases)
+
+	ctx, cancel := destinationContext(context.Background(), destination)
+	defer cancel()
+
+	// Another host takes the lease over, so the next renewal fails.
+	content, _ := json.Marshal(LockInfo{Host: "other-host", PID: 42, Acquired: time.Now(), Renewed: time.Now()})
+	os.WriteFile(filepath.Join(destination, DestinationLeaseFile), content, 0644)
+
+	renewCtx, stop := context.WithTimeout(context.Background(), 5*time.Second)
+	defer stop()
+	if err := RenewLocks(renewCtx, leases, 10*time.Millisecond); err == nil {
+		t.Fatalf("Expected RenewLocks() to return the renewal error")
+	}
+	select {
+	case <-ctx.Done():
+	case <-time.After(time.Second):
+		t.Fatalf("Expected the copies to the destination to be cancelled")
+	}
+	if copyCtx, _ := destinationContext(context.Background(), destination); copyCtx.Err() == nil {
+		t.Fatalf("Expected new copies to the destination to be cancelled")
+	}
+}
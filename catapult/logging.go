@@ -13,6 +13,7 @@ var (
 	logChannel           = make(chan string, 100)
 	MaxLogFileSize int64 = 10 * 1024 * 1024 // 10 MB
 	wg             sync.WaitGroup
+	loggerStarted  bool
 )
 
 // StartLogger initializes the logger and starts the log writer goroutine.
@@ -23,6 +24,7 @@ func StartLogger(logFilePath string) error {
 		return fmt.Errorf("error opening log file: %v", err)
 	}
 
+	loggerStarted = true
 	wg.Add(1)
 	go logWriter()
 	return nil
@@ -49,12 +51,12 @@ func logWriter() {
 }
 
 // LogWithDatetime logs a message with the current datetime.
-// If logToFile is true, the message is also written to the log file.
+// If logToFile is true and the logger has been started, the message is also written to the log file.
 func LogWithDatetime(message string, logToFile bool) {
 	timestamp := time.Now().Format("2006-01-02 15:04:05")
 	logMessage := fmt.Sprintf("%s: %s\n", timestamp, message)
 	fmt.Print(logMessage)
-	if logToFile {
+	if logToFile && loggerStarted {
 		logChannel <- logMessage
 	}
 }
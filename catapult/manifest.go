@@ -0,0 +1,222 @@
+package catapult
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// manifestAlgorithmSuffix marks checksums of directories that are digests of a manifest, so that they are never
+// compared with directory checksums recorded before manifests were introduced.
+const manifestAlgorithmSuffix = "-manifest"
+
+// ManifestEntry describes a single file of a directory manifest.
+type ManifestEntry struct {
+	// Path is the path of the file relative to the directory, with forward slashes.
+	Path              string `json:"path"`
+	Size              int64  `json:"size"`
+	Checksum          string `json:"checksum,omitempty"`
+	SecondaryChecksum string `json:"secondary_checksum,omitempty"`
+}
+
+// Manifest lists every file of a directory with its size and checksums, sorted by path.
+type Manifest struct {
+	Algorithm          string          `json:"algorithm"`
+	SecondaryAlgorithm string          `json:"secondary_algorithm,omitempty"`
+	Entries            []ManifestEntry `json:"entries"`
+}
+
+// ManifestDifference describes a file that differs between two manifests.
+type ManifestDifference struct {
+	Path    string
+	Problem string
+}
+
+// String returns a human readable description of the difference.
+func (d ManifestDifference) String() string {
+	return fmt.Sprintf("%s: %s", d.Path, d.Problem)
+}
+
+// digestAlgorithm returns the algorithm recorded for the checksum of a file or directory.
+//
+// Parameters:
+// - algorithm: The checksum algorithm.
+// - isFolder: Boolean indicating if the path is a folder.
+//
+// Returns:
+// - string: The algorithm, marked as a manifest digest for folders.
+func digestAlgorithm(algorithm string, isFolder bool) string {
+	algorithm = normalizeChecksumAlgorithm(algorithm)
+	if isFolder {
+		return algorithm + manifestAlgorithmSuffix
+	}
+	return algorithm
+}
+
+// newManifest creates a manifest from unsorted entries.
+//
+// Parameters:
+// - algorithm: The checksum algorithm of the entries.
+// - secondary: The secondary checksum algorithm of the entries, or an empty string for none.
+// - entries: The entries of the manifest.
+//
+// Returns:
+// - Manifest: The manifest with its entries sorted by path.
+func newManifest(algorithm, secondary string, entries []ManifestEntry) Manifest {
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Path < entries[j].Path })
+	return Manifest{Algorithm: normalizeChecksumAlgorithm(algorithm), SecondaryAlgorithm: secondary, Entries: entries}
+}
+
+// BuildManifest hashes every file below a directory and returns its manifest.
+//
+// Parameters:
+// - dir: The directory to build the manifest for.
+// - algorithm: The checksum algorithm.
+// - secondary: The secondary checksum algorithm, or an empty string for none.
+//
+// Returns:
+// - Manifest: The manifest of the directory.
+// - error: An error object if a file could not be listed or hashed.
+func BuildManifest(dir, algorithm, secondary string) (Manifest, error) {
+	return walkManifest(context.Background(), dir, algorithm, secondary, true, nil)
+}
+
+// walkManifest lists every file below a directory, optionally hashing each of them.
+//
+// Parameters:
+// - ctx: The context to control the hashing lifecycle.
+// - dir: The directory to list.
+// - algorithm: The checksum algorithm.
+// - secondary: The secondary checksum algorithm, or an empty string for none.
+// - hash: Boolean indicating if the files are hashed. Without hashing only paths and sizes are listed.
+// - limiters: The rate limiters every read waits on while hashing.
+//
+// Returns:
+// - Manifest: The manifest of the directory.
+// - error: An error object if a file could not be listed or hashed.
+func walkManifest(ctx context.Context, dir, algorithm, secondary string, hash bool, limiters []*RateLimiter) (Manifest, error) {
+	var entries []ManifestEntry
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		relPath, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		entry := ManifestEntry{Path: filepath.ToSlash(relPath), Size: info.Size()}
+		if hash {
+			entry.Checksum, entry.SecondaryChecksum, err = calculateChecksums(ctx, path, algorithm, secondary, limiters)
+			if err != nil {
+				return err
+			}
+		}
+		entries = append(entries, entry)
+		return nil
+	})
+	if err != nil {
+		return Manifest{}, err
+	}
+	return newManifest(algorithm, secondary, entries), nil
+}
+
+// Digest returns the top-level checksum of the manifest. It covers the path, size and checksum of every entry,
+// so renaming, moving or changing any member changes the digest.
+//
+// Returns:
+// - string: The digest in hexadecimal format, using the manifest's checksum algorithm.
+func (m Manifest) Digest() string {
+	return manifestDigest(m.Algorithm, m.Entries, func(e ManifestEntry) string { return e.Checksum })
+}
+
+// SecondaryDigest returns the top-level checksum of the manifest using the secondary checksums.
+//
+// Returns:
+// - string: The digest in hexadecimal format, or an empty string if the manifest has no secondary algorithm.
+func (m Manifest) SecondaryDigest() string {
+	if m.SecondaryAlgorithm == "" {
+		return ""
+	}
+	return manifestDigest(m.SecondaryAlgorithm, m.Entries, func(e ManifestEntry) string { return e.SecondaryChecksum })
+}
+
+// manifestDigest hashes one line per entry containing its checksum, size and quoted path.
+//
+// Parameters:
+// - algorithm: The checksum algorithm of the digest.
+// - entries: The entries sorted by path.
+// - checksum: Selects the checksum of an entry to include.
+//
+// Returns:
+// - string: The digest in hexadecimal format, or an empty string if the algorithm is unknown.
+func manifestDigest(algorithm string, entries []ManifestEntry, checksum func(ManifestEntry) string) string {
+	hash, err := newChecksumHash(algorithm)
+	if err != nil {
+		return ""
+	}
+	for _, entry := range entries {
+		fmt.Fprintf(hash, "%s %d %q\n", checksum(entry), entry.Size, entry.Path)
+	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// DiffManifests compares an actual manifest with the expected one. Checksums are only compared when both entries
+// have one, so a manifest listed without hashing can be used to check the structure alone.
+//
+// Parameters:
+// - expected: The manifest the directory should match.
+// - actual: The manifest of the directory.
+//
+// Returns:
+// - []ManifestDifference: The differing files, sorted by path.
+func DiffManifests(expected, actual Manifest) []ManifestDifference {
+	var differences []ManifestDifference
+	i, j := 0, 0
+	for i < len(expected.Entries) || j < len(actual.Entries) {
+		switch {
+		case j == len(actual.Entries) || (i < len(expected.Entries) && expected.Entries[i].Path < actual.Entries[j].Path):
+			differences = append(differences, ManifestDifference{Path: expected.Entries[i].Path, Problem: "missing"})
+			i++
+		case i == len(expected.Entries) || actual.Entries[j].Path < expected.Entries[i].Path:
+			differences = append(differences, ManifestDifference{Path: actual.Entries[j].Path, Problem: "unexpected file"})
+			j++
+		default:
+			want, got := expected.Entries[i], actual.Entries[j]
+			if want.Size != got.Size {
+				differences = append(differences, ManifestDifference{Path: want.Path, Problem: fmt.Sprintf("size %d, want %d", got.Size, want.Size)})
+			} else if want.Checksum != "" && got.Checksum != "" && want.Checksum != got.Checksum {
+				differences = append(differences, ManifestDifference{Path: want.Path, Problem: "checksum differs"})
+			}
+			i++
+			j++
+		}
+	}
+	return differences
+}
+
+// formatManifestDifferences joins differences into a single message, listing at most limit of them.
+//
+// Parameters:
+// - differences: The differences to format.
+// - limit: The maximum number of differences to list.
+//
+// Returns:
+// - string: The formatted differences.
+func formatManifestDifferences(differences []ManifestDifference, limit int) string {
+	var lines []string
+	for i, difference := range differences {
+		if i == limit {
+			lines = append(lines, fmt.Sprintf("and %d more", len(differences)-limit))
+			break
+		}
+		lines = append(lines, difference.String())
+	}
+	return strings.Join(lines, "\n")
+}
@@ -0,0 +1,87 @@
+package catapult
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestManifestDigestCoversStructure(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "sample.d")
+	if err := os.MkdirAll(filepath.Join(dir, "sub"), 0755); err != nil {
+		t.Fatalf("Failed to create test directory: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "a.bin"), []byte("first"), 0644); err != nil {
+		t.Fatalf("Failed to create test file: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "sub", "b.bin"), []byte("second"), 0644); err != nil {
+		t.Fatalf("Failed to create test file: %v", err)
+	}
+
+	before, err := BuildManifest(dir, ChecksumSHA256, "")
+	if err != nil {
+		t.Fatalf("BuildManifest() error: %v", err)
+	}
+	if len(before.Entries) != 2 || before.Entries[0].Path != "a.bin" || before.Entries[1].Path != "sub/b.bin" {
+		t.Fatalf("Unexpected manifest entries: %+v", before.Entries)
+	}
+	if digest, _ := CalculateFileHash(dir); digest != before.Digest() {
+		t.Fatalf("CalculateFileHash() = %s, want manifest digest %s", digest, before.Digest())
+	}
+
+	// Moving a member keeps every member hash but must change the digest.
+	if err := os.Rename(filepath.Join(dir, "sub", "b.bin"), filepath.Join(dir, "b.bin")); err != nil {
+		t.Fatalf("Failed to move test file: %v", err)
+	}
+	after, err := BuildManifest(dir, ChecksumSHA256, "")
+	if err != nil {
+		t.Fatalf("BuildManifest() error: %v", err)
+	}
+	if after.Digest() == before.Digest() {
+		t.Fatalf("Digest did not change after moving a member")
+	}
+
+	differences := DiffManifests(before, after)
+	want := []ManifestDifference{{Path: "b.bin", Problem: "unexpected file"}, {Path: "sub/b.bin", Problem: "missing"}}
+	if len(differences) != len(want) {
+		t.Fatalf("DiffManifests() = %v, want %v", differences, want)
+	}
+	for i := range want {
+		if differences[i] != want[i] {
+			t.Fatalf("DiffManifests()[%d] = %v, want %v", i, differences[i], want[i])
+		}
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, "a.bin"), []byte("FIRST"), 0644); err != nil {
+		t.Fatalf("Failed to change test file: %v", err)
+	}
+	changed, _ := BuildManifest(dir, ChecksumSHA256, "")
+	differences = DiffManifests(after, changed)
+	if len(differences) != 1 || differences[0].Path != "a.bin" || differences[0].Problem != "checksum differs" {
+		t.Fatalf("DiffManifests() = %v, want checksum difference for a.bin", differences)
+	}
+}
+
+func TestSaveManifest(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+
+	manifest := newManifest(ChecksumXXH3, "", []ManifestEntry{
+		{Path: "z.bin", Size: 2, Checksum: "02"},
+		{Path: "a.bin", Size: 1, Checksum: "01"},
+	})
+	if err := SaveManifest(db, "manifest_test.d", manifest); err != nil {
+		t.Fatalf("SaveManifest() error: %v", err)
+	}
+	stored, found, err := GetManifest(db, "manifest_test.d")
+	if err != nil || !found {
+		t.Fatalf("GetManifest() = %v, %v", found, err)
+	}
+	if stored.Algorithm != ChecksumXXH3 || stored.Digest() != manifest.Digest() {
+		t.Fatalf("Stored manifest %+v does not match %+v", stored, manifest)
+	}
+
+	if _, found, _ := GetManifest(db, "missing.d"); found {
+		t.Fatalf("Expected no manifest for missing.d")
+	}
+}
@@ -0,0 +1,115 @@
+package catapult
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// MetadataConfig controls which file metadata is preserved at a destination.
+// Modification and access times and permission bits are preserved unless skipped;
+// ownership and extended attributes are only preserved when enabled.
+type MetadataConfig struct {
+	SkipTimes       bool `json:"skip_times,omitempty"`
+	SkipPermissions bool `json:"skip_permissions,omitempty"`
+	Ownership       bool `json:"ownership,omitempty"`
+	Xattrs          bool `json:"xattrs,omitempty"`
+}
+
+// PreserveMetadata copies the metadata of the source file or directory to the destination according to the
+// given settings. Every requested kind of metadata is attempted even if an earlier one fails.
+//
+// Parameters:
+// - src: The source path.
+// - dst: The destination path.
+// - opts: The metadata to preserve.
+//
+// Returns:
+// - error: The first error encountered while applying the metadata.
+func PreserveMetadata(src, dst string, opts MetadataConfig) error {
+	info, err := os.Lstat(src)
+	if err != nil {
+		return err
+	}
+
+	var firstErr error
+	record := func(err error) {
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	if opts.Xattrs {
+		record(copyXattrs(src, dst))
+	}
+	if opts.Ownership {
+		record(copyOwnership(info, dst))
+	}
+	if !opts.SkipPermissions {
+		record(os.Chmod(dst, info.Mode().Perm()))
+	}
+	if !opts.SkipTimes {
+		record(os.Chtimes(dst, accessTime(src, info), info.ModTime()))
+	}
+	return firstErr
+}
+
+// preserveTreeMetadata copies the metadata of every file and directory below src to the matching path below dst.
+// Directories are handled after their contents, because writing into a directory changes its modification time.
+//
+// Parameters:
+// - src: The source directory.
+// - dst: The destination directory.
+// - opts: The metadata to preserve.
+//
+// Returns:
+// - error: The first error encountered while applying the metadata.
+func preserveTreeMetadata(src, dst string, opts MetadataConfig) error {
+	var firstErr error
+	var directories []string
+	err := filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			directories = append(directories, path)
+			return nil
+		}
+		relPath, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		if err := PreserveMetadata(path, filepath.Join(dst, relPath), opts); err != nil && firstErr == nil {
+			firstErr = err
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for i := len(directories) - 1; i >= 0; i-- {
+		relPath, err := filepath.Rel(src, directories[i])
+		if err != nil {
+			return err
+		}
+		if err := PreserveMetadata(directories[i], filepath.Join(dst, relPath), opts); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// logMetadataError reports a failure to preserve metadata. The copy itself is kept, since some filesystems
+// reject parts of the metadata; such destinations should skip them in their metadata settings.
+//
+// Parameters:
+// - dst: The destination path.
+// - err: The error returned while preserving metadata.
+func logMetadataError(dst string, err error) {
+	if err == nil {
+		return
+	}
+	LogWithDatetime(fmt.Sprintf("Error preserving metadata for %s: %v", dst, err), true)
+	sendSlackNotification(fmt.Sprintf("Error preserving metadata for %s: %v", dst, err))
+}
@@ -0,0 +1,24 @@
+//go:build !linux && !darwin && !windows
+// +build !linux,!darwin,!windows
+
+package catapult
+
+import (
+	"os"
+	"time"
+)
+
+// accessTime returns the modification time on platforms without access time support.
+func accessTime(path string, info os.FileInfo) time.Time {
+	return info.ModTime()
+}
+
+// copyOwnership is not supported on this platform.
+func copyOwnership(info os.FileInfo, dst string) error {
+	return nil
+}
+
+// copyXattrs is not supported on this platform.
+func copyXattrs(src, dst string) error {
+	return nil
+}
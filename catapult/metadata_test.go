@@ -0,0 +1,70 @@
+package catapult
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestPreserveMetadata(t *testing.T) {
+	tmpDir := t.TempDir()
+	src := filepath.Join(tmpDir, "source.raw")
+	dst := filepath.Join(tmpDir, "copy.raw")
+	os.WriteFile(src, []byte("content"), 0640)
+	os.WriteFile(dst, []byte("content"), 0666)
+	acquired := time.Date(2024, 3, 1, 12, 30, 0, 0, time.UTC)
+	os.Chtimes(src, acquired, acquired)
+
+	if err := PreserveMetadata(src, dst, MetadataConfig{}); err != nil {
+		t.Fatalf("PreserveMetadata() error: %v", err)
+	}
+	info, err := os.Stat(dst)
+	if err != nil {
+		t.Fatalf("Failed to stat copy: %v", err)
+	}
+	if !info.ModTime().Equal(acquired) {
+		t.Fatalf("mtime = %v, want %v", info.ModTime(), acquired)
+	}
+	if runtime.GOOS != "windows" && info.Mode().Perm() != 0640 {
+		t.Fatalf("mode = %v, want %v", info.Mode().Perm(), os.FileMode(0640))
+	}
+
+	other := filepath.Join(tmpDir, "other.raw")
+	os.WriteFile(other, []byte("content"), 0666)
+	if err := PreserveMetadata(src, other, MetadataConfig{SkipTimes: true, SkipPermissions: true}); err != nil {
+		t.Fatalf("PreserveMetadata() error: %v", err)
+	}
+	if info, _ := os.Stat(other); info.ModTime().Equal(acquired) {
+		t.Fatalf("mtime preserved although skipped")
+	}
+}
+
+func TestPreserveTreeMetadata(t *testing.T) {
+	tmpDir := t.TempDir()
+	src := filepath.Join(tmpDir, "run.d")
+	dst := filepath.Join(tmpDir, "out", "run.d")
+	os.MkdirAll(filepath.Join(src, "sub"), 0755)
+	os.MkdirAll(filepath.Join(dst, "sub"), 0755)
+	os.WriteFile(filepath.Join(src, "sub", "analysis.tdf"), []byte("data"), 0644)
+	os.WriteFile(filepath.Join(dst, "sub", "analysis.tdf"), []byte("data"), 0644)
+
+	acquired := time.Date(2024, 3, 1, 12, 30, 0, 0, time.UTC)
+	for _, path := range []string{filepath.Join(src, "sub", "analysis.tdf"), filepath.Join(src, "sub"), src} {
+		os.Chtimes(path, acquired, acquired)
+	}
+
+	if err := preserveTreeMetadata(src, dst, MetadataConfig{}); err != nil {
+		t.Fatalf("preserveTreeMetadata() error: %v", err)
+	}
+	for _, path := range []string{filepath.Join(dst, "sub", "analysis.tdf"), filepath.Join(dst, "sub"), dst} {
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatalf("Failed to stat %s: %v", path, err)
+		}
+		if !info.ModTime().Equal(acquired) {
+			t.Fatalf("mtime of %s = %v, want %v", path, info.ModTime(), acquired)
+		}
+	}
+}
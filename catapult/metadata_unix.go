@@ -0,0 +1,86 @@
+//go:build linux || darwin
+// +build linux darwin
+
+package catapult
+
+import (
+	"bytes"
+	"os"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// accessTime returns the last access time of a file on Unix-based systems.
+//
+// Parameters:
+// - path: The path of the file.
+// - info: The file information returned by os.Lstat.
+//
+// Returns:
+// - time.Time: The last access time, or the modification time if it is not available.
+func accessTime(path string, info os.FileInfo) time.Time {
+	var stat unix.Stat_t
+	if err := unix.Lstat(path, &stat); err != nil {
+		return info.ModTime()
+	}
+	return time.Unix(stat.Atim.Unix())
+}
+
+// copyOwnership sets the owner and group of the destination to those of the source on Unix-based systems.
+// This usually requires running as root.
+//
+// Parameters:
+// - info: The file information of the source.
+// - dst: The destination path.
+//
+// Returns:
+// - error: An error object if the ownership could not be changed.
+func copyOwnership(info os.FileInfo, dst string) error {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return nil
+	}
+	return os.Lchown(dst, int(stat.Uid), int(stat.Gid))
+}
+
+// copyXattrs copies all extended attributes of the source to the destination on Unix-based systems.
+//
+// Parameters:
+// - src: The source path.
+// - dst: The destination path.
+//
+// Returns:
+// - error: An error object if the attributes could not be read or written.
+func copyXattrs(src, dst string) error {
+	size, err := unix.Llistxattr(src, nil)
+	if err != nil || size == 0 {
+		return err
+	}
+	names := make([]byte, size)
+	size, err = unix.Llistxattr(src, names)
+	if err != nil {
+		return err
+	}
+
+	for _, name := range bytes.Split(names[:size], []byte{0}) {
+		if len(name) == 0 {
+			continue
+		}
+		attr := string(name)
+		valueSize, err := unix.Lgetxattr(src, attr, nil)
+		if err != nil {
+			return err
+		}
+		value := make([]byte, valueSize)
+		valueSize, err = unix.Lgetxattr(src, attr, value)
+		if err != nil {
+			return err
+		}
+		if err := unix.Lsetxattr(dst, attr, value[:valueSize], 0); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,36 @@
+//go:build windows
+// +build windows
+
+package catapult
+
+import (
+	"os"
+	"syscall"
+	"time"
+)
+
+// accessTime returns the last access time of a file on Windows systems.
+//
+// Parameters:
+// - path: The path of the file.
+// - info: The file information returned by os.Lstat.
+//
+// Returns:
+// - time.Time: The last access time, or the modification time if it is not available.
+func accessTime(path string, info os.FileInfo) time.Time {
+	data, ok := info.Sys().(*syscall.Win32FileAttributeData)
+	if !ok {
+		return info.ModTime()
+	}
+	return time.Unix(0, data.LastAccessTime.Nanoseconds())
+}
+
+// copyOwnership is not supported on Windows systems, where ownership is part of the security descriptor.
+func copyOwnership(info os.FileInfo, dst string) error {
+	return nil
+}
+
+// copyXattrs is not supported on Windows systems.
+func copyXattrs(src, dst string) error {
+	return nil
+}
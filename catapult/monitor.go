@@ -4,6 +4,7 @@ package catapult
 import (
 	"context"
 	"database/sql"
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
@@ -15,7 +16,8 @@ import (
 var dbMutex sync.Mutex
 
 // MonitorAndMirror initializes the Slack client and starts monitoring directories as per the provided configurations.
-// It launches a goroutine for each directory configuration to monitor and mirror files.
+// It launches a goroutine for each directory configuration to monitor and mirror files, and another to scrub its
+// destinations if scrubbing is configured.
 //
 // Parameters:
 // - ctx: The context to control the monitoring lifecycle.
@@ -23,6 +25,7 @@ var dbMutex sync.Mutex
 // - config: The configurations containing directory monitoring settings.
 func MonitorAndMirror(ctx context.Context, db *sql.DB, config Configurations) {
 	InitSlack(config)
+	ApplyRateLimits(config)
 
 	var wg sync.WaitGroup
 
@@ -32,6 +35,14 @@ func MonitorAndMirror(ctx context.Context, db *sql.DB, config Configurations) {
 			defer wg.Done()
 			monitorDirectory(ctx, db, cfg)
 		}(cfg)
+
+		if cfg.Scrub.Interval != "" {
+			wg.Add(1)
+			go func(cfg Configuration) {
+				defer wg.Done()
+				ScrubDestinations(ctx, db, cfg)
+			}(cfg)
+		}
 	}
 
 	wg.Wait()
@@ -51,6 +62,45 @@ func monitorDirectory(ctx context.Context, db *sql.DB, cfg Configuration) {
 		sendSlackNotification(fmt.Sprintf("Invalid check_interval: %v", err))
 		return
 	}
+	for _, algorithm := range []string{cfg.ChecksumAlgorithm, cfg.SecondaryChecksumAlgorithm} {
+		if err := ValidateChecksumAlgorithm(algorithm); err != nil {
+			LogWithDatetime(fmt.Sprintf("Invalid checksum algorithm for %s: %v", cfg.Name, err), true)
+			sendSlackNotification(fmt.Sprintf("Invalid checksum algorithm for %s: %v", cfg.Name, err))
+			return
+		}
+	}
+	if err := ValidateSymlinkPolicy(cfg.Symlinks); err != nil {
+		LogWithDatetime(fmt.Sprintf("Invalid symlink policy for %s: %v", cfg.Name, err), true)
+		sendSlackNotification(fmt.Sprintf("Invalid symlink policy for %s: %v", cfg.Name, err))
+		return
+	}
+	for _, destination := range cfg.Destinations {
+		if layout := cfg.destinationConfig(destination).layout(); layout != LayoutMirror && layout != LayoutBagIt && layout != LayoutContentAddressed {
+			LogWithDatetime(fmt.Sprintf("Invalid layout for %s: %s", destination, layout), true)
+			sendSlackNotification(fmt.Sprintf("Invalid layout for %s: %s", destination, layout))
+			return
+		}
+		if err := ValidateBundleArchive(cfg.destinationConfig(destination).BundleArchive); err != nil {
+			LogWithDatetime(fmt.Sprintf("Invalid bundle archive for %s: %v", destination, err), true)
+			sendSlackNotification(fmt.Sprintf("Invalid bundle archive for %s: %v", destination, err))
+			return
+		}
+		if err := ValidateCompression(cfg.destinationConfig(destination).Compression); err != nil {
+			LogWithDatetime(fmt.Sprintf("Invalid compression for %s: %v", destination, err), true)
+			sendSlackNotification(fmt.Sprintf("Invalid compression for %s: %v", destination, err))
+			return
+		}
+		if err := ValidateEncryption(cfg.destinationConfig(destination)); err != nil {
+			LogWithDatetime(fmt.Sprintf("Invalid encryption for %s: %v", destination, err), true)
+			sendSlackNotification(fmt.Sprintf("Invalid encryption for %s: %v", destination, err))
+			return
+		}
+		if err := ValidateConflictPolicy(cfg.destinationConfig(destination).Conflict); err != nil {
+			LogWithDatetime(fmt.Sprintf("Invalid conflict policy for %s: %v", destination, err), true)
+			sendSlackNotification(fmt.Sprintf("Invalid conflict policy for %s: %v", destination, err))
+			return
+		}
+	}
 	ticker := time.NewTicker(duration)
 	defer ticker.Stop()
 
@@ -61,19 +111,28 @@ func monitorDirectory(ctx context.Context, db *sql.DB, cfg Configuration) {
 			return
 		case <-ticker.C:
 
-			for _, destination := range cfg.Destinations {
+			if cfg.FanOut {
 				fmt.Printf("Monitoring directory: %s\n", cfg.Name)
-				LogWithDatetime(fmt.Sprintf("Checking free space for destination: %s", destination), false)
-				freeSpace, err := GetFreeSpace(destination)
-				if err != nil {
-					LogWithDatetime("Error getting free space:", true)
-					sendSlackNotification(fmt.Sprintf("Error getting free space: %v", err))
-					return
+				freeSpaces := make(map[string]int64)
+				for _, destination := range cfg.Destinations {
+					freeSpace, ok := checkDestinationSpace(destination, cfg)
+					if !ok {
+						return
+					}
+					freeSpaces[destination] = freeSpace
 				}
 
-				if freeSpace <= cfg.MinFreeSpace {
-					LogWithDatetime("No space left at destination.", true)
-					sendSlackNotification("No space left at destination.")
+				for _, dir := range cfg.Directories {
+					fmt.Printf("Processing directory: %s\n", dir)
+					processFilesFanOut(ctx, db, dir, cfg, freeSpaces, duration)
+				}
+				continue
+			}
+
+			for _, destination := range cfg.Destinations {
+				fmt.Printf("Monitoring directory: %s\n", cfg.Name)
+				freeSpace, ok := checkDestinationSpace(destination, cfg)
+				if !ok {
 					return
 				}
 
@@ -86,16 +145,32 @@ func monitorDirectory(ctx context.Context, db *sql.DB, cfg Configuration) {
 	}
 }
 
-// processFiles processes the files and directories in a directory, checking if they are completed and copying them if necessary.
-// It verifies if the files and directories are already copied and if they are completed before initiating the copy process.
+// checkDestinationSpace checks that a destination has more free space than the configured minimum.
 //
 // Parameters:
-// - ctx: The context to control the file processing lifecycle.
-// - db: The database connection to track copied files.
-// - dir: The directory to process files and directories from.
-// - cfg: The configuration for the directory to monitor.
-// - freeSpace: The available free space in the destination directory.
-// - duration: The interval duration for checking file completion.
+// - destination: The destination directory to check.
+// - cfg: The configuration the destination belongs to.
+//
+// Returns:
+// - int64: The available free space in the destination directory.
+// - bool: True if there is enough free space to continue.
+func checkDestinationSpace(destination string, cfg Configuration) (int64, bool) {
+	LogWithDatetime(fmt.Sprintf("Checking free space for destination: %s", destination), false)
+	freeSpace, err := GetFreeSpace(destination)
+	if err != nil {
+		LogWithDatetime("Error getting free space:", true)
+		sendSlackNotification(fmt.Sprintf("Error getting free space: %v", err))
+		return 0, false
+	}
+
+	if freeSpace <= cfg.MinFreeSpace {
+		LogWithDatetime("No space left at destination.", true)
+		sendSlackNotification("No space left at destination.")
+		return freeSpace, false
+	}
+	return freeSpace, true
+}
+
 // processFiles processes the files and directories in a directory, checking if they are completed and copying them if necessary.
 // It verifies if the files and directories are already copied and if they are completed before initiating the copy process.
 //
@@ -108,121 +183,227 @@ func monitorDirectory(ctx context.Context, db *sql.DB, cfg Configuration) {
 // - duration: The interval duration for checking file completion.
 func processFiles(ctx context.Context, db *sql.DB, dir string, cfg Configuration, destination string, freeSpace int64, duration time.Duration) {
 	LogWithDatetime(fmt.Sprintf("Listing files and directories in directory: %s", dir), false)
-	paths, err := ListFiles(dir)
+	paths, skips, err := ListFiles(dir, cfg.Symlinks)
 	if err != nil {
 		LogWithDatetime("Error listing files and directories:", true)
 		sendSlackNotification(fmt.Sprintf("Error listing files and directories: %v", err))
 		return
 	}
+	logListingSkips(dir, skips)
 
 	for _, path := range paths {
-		info, err := os.Stat(path)
-		if err != nil {
-			LogWithDatetime(fmt.Sprintf("Error stating path: %v", err), true)
-			sendSlackNotification(fmt.Sprintf("Error stating path: %v", err))
-			continue
-		}
-		isFolder := info.IsDir()
-		var size int64
-		if isFolder && strings.HasSuffix(path, ".d") {
-			size = GetDirectorySize(path)
-		} else if !isFolder {
-			size = GetFileSize(path)
-		} else {
+		if isSymlink(cfg, path) {
+			copySymlink(db, path, dir, destination, cfg)
 			continue
 		}
-
-		// Ignore files or directories smaller than the minimum file size
-		if size < cfg.MinFileSize {
-			LogWithDatetime(fmt.Sprintf("Ignoring file or directory smaller than minimum size: %s", path), false)
+		size, isFolder, ready := checkPathReady(db, path, cfg, duration)
+		if !ready {
 			continue
 		}
-		// Ignore empty files or directories
-		if size == 0 {
-			LogWithDatetime(fmt.Sprintf("Ignoring empty file or directory: %s", path), false)
+		if !needsCopy(db, path, destination, cfg, isFolder, size) {
 			continue
 		}
 
-		initialSize, err := GetFileSizeFromDB(db, path, isFolder)
-		if err != nil {
-			LogWithDatetime(fmt.Sprintf("Error getting file size from DB: %v", err), true)
-			sendSlackNotification(fmt.Sprintf("Error getting file size from DB: %v", err))
+		copyFileWithVerification(ctx, db, path, dir, destination, cfg, freeSpace)
+	}
+}
+
+// processFilesFanOut processes the files and directories in a directory like processFiles, but for all destinations at once.
+// Single files needed by more than one destination are read once and streamed to every destination simultaneously.
+//
+// Parameters:
+// - ctx: The context to control the file processing lifecycle.
+// - db: The database connection to track copied files.
+// - dir: The directory to process files and directories from.
+// - cfg: The configuration for the directory to monitor.
+// - freeSpaces: The available free space in each destination directory.
+// - duration: The interval duration for checking file completion.
+func processFilesFanOut(ctx context.Context, db *sql.DB, dir string, cfg Configuration, freeSpaces map[string]int64, duration time.Duration) {
+	LogWithDatetime(fmt.Sprintf("Listing files and directories in directory: %s", dir), false)
+	paths, skips, err := ListFiles(dir, cfg.Symlinks)
+	if err != nil {
+		LogWithDatetime("Error listing files and directories:", true)
+		sendSlackNotification(fmt.Sprintf("Error listing files and directories: %v", err))
+		return
+	}
+	logListingSkips(dir, skips)
+
+	for _, path := range paths {
+		if isSymlink(cfg, path) {
+			for _, destination := range cfg.Destinations {
+				copySymlink(db, path, dir, destination, cfg)
+			}
 			continue
 		}
-
-		if initialSize == -1 {
-			dbMutex.Lock()
-			SaveFileSize(db, path, size, isFolder)
-			dbMutex.Unlock()
-			LogWithDatetime(fmt.Sprintf("First time seeing file or directory, added to DB: %s", path), false)
+		size, isFolder, ready := checkPathReady(db, path, cfg, duration)
+		if !ready {
 			continue
 		}
 
-		if initialSize != size {
-			dbMutex.Lock()
-			SaveFileSize(db, path, size, isFolder)
-			dbMutex.Unlock()
-			LogWithDatetime(fmt.Sprintf("File or directory size changed, not ready for copying: %s", path), false)
-			continue
+		var targets []string
+		for _, destination := range cfg.Destinations {
+			if needsCopy(db, path, destination, cfg, isFolder, size) {
+				targets = append(targets, destination)
+			}
 		}
 
-		lastModified, err := GetLastModifiedTime(db, path)
-		if err != nil {
-			LogWithDatetime(fmt.Sprintf("Error retrieving last modified time: %v", err), true)
-			sendSlackNotification(fmt.Sprintf("Error retrieving last modified time: %v", err))
-			continue
+		// Folders, bags and compressed copies are written one destination at a time; only plain file copies are
+		// streamed together.
+		var streamed []string
+		for _, destination := range targets {
+			if isFolder || !cfg.destinationConfig(destination).plainFileCopies() {
+				copyFileWithVerification(ctx, db, path, dir, destination, cfg, freeSpaces[destination])
+			} else {
+				streamed = append(streamed, destination)
+			}
 		}
+		if len(streamed) == 1 {
+			copyFileWithVerification(ctx, db, path, dir, streamed[0], cfg, freeSpaces[streamed[0]])
+		} else if len(streamed) > 1 {
+			copyFileToDestinations(ctx, db, path, dir, streamed, cfg, freeSpaces)
+		}
+	}
+}
 
-		if time.Since(lastModified) < duration {
-			LogWithDatetime(fmt.Sprintf("File or directory not ready for copying due to recent modification: %s", path), false)
-			continue
+// checkPathReady checks whether a file or directory is large enough and has stopped changing, so that it can be copied.
+// The size of the path is recorded in the database to detect changes between checks.
+//
+// Parameters:
+// - db: The database connection to track file sizes.
+// - path: The file or directory to check.
+// - cfg: The configuration for the directory to monitor.
+// - duration: The interval duration for checking file completion.
+//
+// Returns:
+// - int64: The size of the file or directory.
+// - bool: True if the path is a folder.
+// - bool: True if the path is ready for copying.
+func checkPathReady(db *sql.DB, path string, cfg Configuration, duration time.Duration) (int64, bool, bool) {
+	info, err := os.Stat(path)
+	if err != nil {
+		LogWithDatetime(fmt.Sprintf("Error stating path: %v", err), true)
+		sendSlackNotification(fmt.Sprintf("Error stating path: %v", err))
+		return 0, false, false
+	}
+	isFolder := info.IsDir()
+	var size int64
+	if isFolder && strings.HasSuffix(path, ".d") {
+		size = GetDirectorySize(path)
+	} else if !isFolder {
+		size = GetFileSize(path)
+	} else {
+		return 0, isFolder, false
+	}
+
+	// Ignore files or directories smaller than the minimum file size
+	if size < cfg.MinFileSize {
+		LogWithDatetime(fmt.Sprintf("Ignoring file or directory smaller than minimum size: %s", path), false)
+		return size, isFolder, false
+	}
+	// Ignore empty files or directories
+	if size == 0 {
+		LogWithDatetime(fmt.Sprintf("Ignoring empty file or directory: %s", path), false)
+		return size, isFolder, false
+	}
+
+	initialSize, err := GetFileSizeFromDB(db, path, isFolder)
+	if err != nil {
+		LogWithDatetime(fmt.Sprintf("Error getting file size from DB: %v", err), true)
+		sendSlackNotification(fmt.Sprintf("Error getting file size from DB: %v", err))
+		return size, isFolder, false
+	}
+
+	if initialSize == -1 {
+		dbMutex.Lock()
+		SaveFileSize(db, path, size, isFolder)
+		dbMutex.Unlock()
+		LogWithDatetime(fmt.Sprintf("First time seeing file or directory, added to DB: %s", path), false)
+		return size, isFolder, false
+	}
+
+	if initialSize != size {
+		dbMutex.Lock()
+		SaveFileSize(db, path, size, isFolder)
+		dbMutex.Unlock()
+		LogWithDatetime(fmt.Sprintf("File or directory size changed, not ready for copying: %s", path), false)
+		return size, isFolder, false
+	}
+
+	lastModified, err := GetLastModifiedTime(db, path)
+	if err != nil {
+		LogWithDatetime(fmt.Sprintf("Error retrieving last modified time: %v", err), true)
+		sendSlackNotification(fmt.Sprintf("Error retrieving last modified time: %v", err))
+		return size, isFolder, false
+	}
+
+	if time.Since(lastModified) < duration {
+		LogWithDatetime(fmt.Sprintf("File or directory not ready for copying due to recent modification: %s", path), false)
+		return size, isFolder, false
+	}
+	return size, isFolder, true
+}
+
+// needsCopy checks whether a ready file or directory still has to be copied to a destination.
+// A previous copy with matching checksums is marked as copied instead, and sidecars are left to the bag of their
+// acquisition at BagIt destinations.
+//
+// Parameters:
+// - db: The database connection to track copied files.
+// - path: The file or directory to check.
+// - destination: The destination directory.
+// - cfg: The configuration for the directory to monitor.
+// - isFolder: Boolean indicating if the path is a folder.
+// - size: The size of the file or directory.
+//
+// Returns:
+// - bool: True if the path should be copied to the destination.
+func needsCopy(db *sql.DB, path, destination string, cfg Configuration, isFolder bool, size int64) bool {
+	if cfg.destinationConfig(destination).layout() == LayoutBagIt {
+		if primary, ok := cfg.sidecarPrimary(path); ok {
+			LogWithDatetime(fmt.Sprintf("Sidecar %s is bagged with %s", path, primary), false)
+			return false
 		}
-		if !cfg.OverrideIfDifferent {
-			copied, err := IsFileCopied(db, path, destination, isFolder)
-			if err != nil {
-				LogWithDatetime(fmt.Sprintf("Error checking if file or directory is copied: %v", err), true)
-				sendSlackNotification(fmt.Sprintf("Error checking if file or directory is copied: %v", err))
-				continue
-			}
-			if copied {
-				continue
-			}
+	}
+	if cfg.conflictPolicy(destination) == ConflictSkip {
+		copied, err := IsFileCopied(db, path, destination, isFolder)
+		if err != nil {
+			LogWithDatetime(fmt.Sprintf("Error checking if file or directory is copied: %v", err), true)
+			sendSlackNotification(fmt.Sprintf("Error checking if file or directory is copied: %v", err))
+			return false
+		}
+		if copied {
+			return false
 		}
+	}
 
-		copiedFileSize, err := GetCopiedFileSize(db, path, destination)
+	copiedFileSize, err := GetCopiedFileSize(db, path, destination)
+	if err != nil && err != sql.ErrNoRows {
+		LogWithDatetime(fmt.Sprintf("Error getting copied file size: %v", err), true)
+		sendSlackNotification(fmt.Sprintf("Error getting copied file size: %v", err))
+		return false
+	}
+	if copiedFileSize != -1 && copiedFileSize == size {
+		originHash, err := GetOriginFileChecksumFor(db, path, digestAlgorithm(cfg.checksumAlgorithm(), isFolder))
 		if err != nil && err != sql.ErrNoRows {
-			LogWithDatetime(fmt.Sprintf("Error getting copied file size: %v", err), true)
-			sendSlackNotification(fmt.Sprintf("Error getting copied file size: %v", err))
-			continue
+			LogWithDatetime(fmt.Sprintf("Error getting origin file checksum: %v", err), true)
+			sendSlackNotification(fmt.Sprintf("Error getting origin file checksum: %v", err))
+			return false
 		}
-		if copiedFileSize != -1 && copiedFileSize == size {
-			originHash, err := GetOriginFileChecksum(db, path)
-			if err != nil && err != sql.ErrNoRows {
-				LogWithDatetime(fmt.Sprintf("Error getting origin file checksum: %v", err), true)
-				sendSlackNotification(fmt.Sprintf("Error getting origin file checksum: %v", err))
-				continue
-			}
-			destinationHash, err := GetCopiedFileChecksum(db, path, destination)
-			if err != nil && err != sql.ErrNoRows {
-				LogWithDatetime(fmt.Sprintf("Error getting copied file checksum: %v", err), true)
-				sendSlackNotification(fmt.Sprintf("Error getting copied file checksum: %v", err))
-				continue
-			}
-			if originHash == "" || destinationHash == "" {
-				copyFileWithVerification(ctx, db, path, dir, destination, cfg, freeSpace)
-				continue
-
-			} else if originHash == destinationHash {
-				dbMutex.Lock()
-				MarkFileAsCopied(db, path, destination, isFolder)
-				dbMutex.Unlock()
-				LogWithDatetime(fmt.Sprintf("File or directory already copied: %s", path), false)
-				continue
-			}
+		destinationHash, err := GetCopiedFileChecksumFor(db, path, destination, digestAlgorithm(cfg.checksumAlgorithm(), isFolder))
+		if err != nil && err != sql.ErrNoRows {
+			LogWithDatetime(fmt.Sprintf("Error getting copied file checksum: %v", err), true)
+			sendSlackNotification(fmt.Sprintf("Error getting copied file checksum: %v", err))
+			return false
+		}
+		if originHash != "" && destinationHash != "" && originHash == destinationHash {
+			dbMutex.Lock()
+			MarkFileAsCopied(db, path, destination, isFolder)
+			dbMutex.Unlock()
+			LogWithDatetime(fmt.Sprintf("File or directory already copied: %s", path), false)
+			return false
 		}
-
-		copyFileWithVerification(ctx, db, path, dir, destination, cfg, freeSpace)
 	}
+	return true
 }
 
 // copyFileWithVerification copies a file or directory to the destination directory and verifies its integrity by comparing file hashes.
@@ -236,13 +417,18 @@ func processFiles(ctx context.Context, db *sql.DB, dir string, cfg Configuration
 // - cfg: The configuration for the directory to monitor.
 // - freeSpace: The available free space in the destination directory.
 func copyFileWithVerification(ctx context.Context, db *sql.DB, file, dir, destination string, cfg Configuration, freeSpace int64) {
+	ctx, cancel := destinationContext(ctx, destination)
+	defer cancel()
+	if ctx.Err() != nil {
+		// The lease of the destination was lost, which was already reported.
+		return
+	}
 	relPath, err := filepath.Rel(dir, file)
 	if err != nil {
 		LogWithDatetime(fmt.Sprintf("Error getting relative path: %v", err), true)
 		sendSlackNotification(fmt.Sprintf("Error getting relative path: %v", err))
 		return
 	}
-	destPath := filepath.Join(destination, relPath)
 	info, err := os.Stat(file)
 	if err != nil {
 		LogWithDatetime(fmt.Sprintf("Error stating path: %v", err), true)
@@ -250,115 +436,83 @@ func copyFileWithVerification(ctx context.Context, db *sql.DB, file, dir, destin
 		return
 	}
 	isFolder := info.IsDir()
+	destPath, ok := prepareDestinationName(db, cfg, file, relPath, destination, isFolder)
+	if !ok {
+		return
+	}
+	copyOptions := CopyOptions{
+		Limiters:          copyLimiters(cfg, destination),
+		Resume:            cfg.Resume,
+		Engine:            cfg.destinationConfig(destination).IOEngine,
+		Sync:              cfg.destinationConfig(destination).durable(),
+		Checksum:          cfg.checksumAlgorithm(),
+		SecondaryChecksum: cfg.SecondaryChecksumAlgorithm,
+		Compression:       cfg.destinationConfig(destination).compression(isFolder),
+		Encryption:        cfg.destinationConfig(destination).encryption(isFolder),
+	}
+	if copyOptions.Encryption != "" {
+		if copyOptions.Recipients, err = cfg.destinationConfig(destination).recipients(); err != nil {
+			LogWithDatetime(fmt.Sprintf("Error loading recipients for %s: %v", destination, err), true)
+			sendSlackNotification(fmt.Sprintf("Error loading recipients for %s: %v", destination, err))
+			return
+		}
+	}
 
-	if isFolder {
-		LogWithDatetime(fmt.Sprintf("Starting to copy folder: `%s` to destination: `%s`", file, destPath), true)
-		sendSlackNotification(fmt.Sprintf("Starting to copy folder: `%s` to destination: `%s`", file, destPath))
-		err := filepath.Walk(file, func(path string, info os.FileInfo, err error) error {
-			if err != nil {
-				return err
-			}
-			relPath, err := filepath.Rel(file, path)
-			if err != nil {
-				return err
-			}
-			destFilePath := filepath.Join(destPath, relPath)
-
-			if info.IsDir() {
-				if err := os.MkdirAll(destFilePath, os.ModePerm); err != nil {
-					return err
-				}
-			} else {
-				if _, err := CopyFile(ctx, path, destFilePath); err != nil {
-					return err
-				}
-
-				originalHash, err := CalculateFileHash(path)
-				if err != nil {
-					return err
-				}
+	if cfg.destinationConfig(destination).layout() == LayoutBagIt {
+		if !resolveExistingDestination(db, file, bagPayloadPath(destPath), destination, cfg, isFolder) {
+			return
+		}
 
-				copiedHash, err := CalculateFileHash(destFilePath)
-				if err != nil {
-					return err
-				}
+		size := GetFileSize(file)
+		if isFolder {
+			size = GetDirectorySize(file)
+		}
+		if freeSpace-size <= cfg.MinFreeSpace {
+			LogWithDatetime("Bag size will breach minimum free space. Shutting down gracefully.", false)
+			sendSlackNotification("Bag size will breach minimum free space. Shutting down gracefully.")
+			return
+		}
 
-				if originalHash != copiedHash {
-					return fmt.Errorf("file hash mismatch for: %s", path)
-				}
-			}
-			return nil
-		})
-		if err != nil {
-			LogWithDatetime(fmt.Sprintf("Error copying directory: %v", err), true)
-			sendSlackNotification(fmt.Sprintf("Error copying directory: %v", err))
+		copyBagWithVerification(ctx, db, cfg, file, destPath, destination, copyOptions, isFolder)
+	} else if cfg.destinationConfig(destination).layout() == LayoutContentAddressed {
+		if !resolveExistingDestination(db, file, destPath, destination, cfg, isFolder) {
 			return
 		}
-		LogWithDatetime(fmt.Sprintf("Finished copying folder: `%s` to destination: `%s`", file, destPath), true)
-		sendSlackNotification(fmt.Sprintf("Finished copying folder: `%s` to destination: `%s`", file, destPath))
-	} else {
-		// Check if the file already exists at the destination
-		if _, err := os.Stat(destPath); err == nil {
-			destinationHash, err := GetCopiedFileChecksum(db, file, destination)
-			if err != nil && err != sql.ErrNoRows {
-				LogWithDatetime(fmt.Sprintf("Error getting copied file checksum from database: %v", err), true)
-				sendSlackNotification(fmt.Sprintf("Error getting copied file checksum from database: %v", err))
-				return
-			}
 
-			if destinationHash == "" {
-				// Calculate the hash of the destination file
-				destinationHash, err = CalculateFileHash(destPath)
-				if err != nil {
-					LogWithDatetime(fmt.Sprintf("Error calculating hash for destination file: %v", err), true)
-					sendSlackNotification(fmt.Sprintf("Error calculating hash for destination file: %v", err))
-					return
-				}
-			}
+		// Content already in the store costs no space, but it is not known until the source is hashed.
+		size := GetFileSize(file)
+		if isFolder {
+			size = GetDirectorySize(file)
+		}
+		if freeSpace-size <= cfg.MinFreeSpace {
+			LogWithDatetime("File size will breach minimum free space. Shutting down gracefully.", false)
+			sendSlackNotification("File size will breach minimum free space. Shutting down gracefully.")
+			return
+		}
 
-			originalHash, err := GetOriginFileChecksum(db, file)
-			if err != nil {
-				LogWithDatetime(fmt.Sprintf("Error getting origin file checksum from database: %v", err), true)
-				sendSlackNotification(fmt.Sprintf("Error getting origin file checksum from database: %v", err))
-				return
-			}
+		copyStoredWithVerification(ctx, db, cfg, file, destPath, destination, copyOptions, isFolder)
+	} else if isFolder {
+		copyPath := cfg.destinationConfig(destination).copyLocation(destPath, isFolder)
+		if !resolveExistingDestination(db, file, copyPath, destination, cfg, isFolder) {
+			return
+		}
 
-			if originalHash == "" {
-				originalHash, err = CalculateFileHash(file)
-				if err != nil {
-					LogWithDatetime(fmt.Sprintf("Error calculating hash for original file: %v", err), true)
-					sendSlackNotification(fmt.Sprintf("Error calculating hash for original file: %v", err))
-					return
-				}
-				err = UpdateFileChecksum(db, file, originalHash)
-				if err != nil {
-					LogWithDatetime(fmt.Sprintf("Error updating origin file checksum in database: %v", err), true)
-					sendSlackNotification(fmt.Sprintf("Error updating origin file checksum in database: %v", err))
-					return
-				}
-			}
+		folderSize := GetDirectorySize(file)
+		if freeSpace-folderSize <= cfg.MinFreeSpace {
+			LogWithDatetime("Folder size will breach minimum free space. Shutting down gracefully.", false)
+			sendSlackNotification("Folder size will breach minimum free space. Shutting down gracefully.")
+			return
+		}
 
-			if originalHash == destinationHash {
-				LogWithDatetime(fmt.Sprintf("File already exists and is identical: %s", destPath), true)
-				sendSlackNotification(fmt.Sprintf("File already exists and is identical: %s", destPath))
-				dbMutex.Lock()
-				MarkFileAsCopied(db, file, destination, isFolder)
-				UpdateCopiedFileChecksum(db, file, destination, destinationHash)
-				dbMutex.Unlock()
-				return
-			} else if cfg.OverrideIfDifferent {
-				LogWithDatetime(fmt.Sprintf("Overriding file: %s because it is different", destPath), true)
-				sendSlackNotification(fmt.Sprintf("Overriding file: %s because it is different", destPath))
-				if err := os.Remove(destPath); err != nil {
-					LogWithDatetime(fmt.Sprintf("Error removing existing file: %v", err), true)
-					sendSlackNotification(fmt.Sprintf("Error removing existing file: %v", err))
-					return
-				}
-			} else {
-				LogWithDatetime(fmt.Sprintf("File already exists but is different: %s", destPath), true)
-				sendSlackNotification(fmt.Sprintf("File already exists but is different: %s", destPath))
-				return
-			}
+		if copyPath != destPath {
+			copyArchivedBundle(ctx, db, cfg, file, destPath, destination, copyOptions)
+		} else {
+			copyBundleWithVerification(ctx, db, cfg, file, destPath, destination, copyOptions)
+		}
+	} else {
+		destPath = cfg.destinationConfig(destination).copyLocation(destPath, isFolder)
+		if !resolveExistingDestination(db, file, destPath, destination, cfg, isFolder) {
+			return
 		}
 
 		fileSize := GetFileSize(file)
@@ -369,48 +523,272 @@ func copyFileWithVerification(ctx context.Context, db *sql.DB, file, dir, destin
 		}
 
 		sendSlackNotification(fmt.Sprintf("Starting to copy file: `%s` to destination: `%s`", file, destPath))
-		_, err = CopyFile(ctx, file, destPath)
+		result, err := CopyFileWithOptions(ctx, file, destPath, copyOptions)
 		if err != nil {
 			LogWithDatetime(fmt.Sprintf("Error copying file: %v", err), true)
 			sendSlackNotification(fmt.Sprintf("Error copying file: %v", err))
 		} else {
 			LogWithDatetime(fmt.Sprintf("Copied file: %s to %s.cat.part", file, destPath), true)
+			finalizeCopy(db, cfg, file, destPath, destination, isFolder, result)
+		}
+	}
+}
 
-			originalHash, err := CalculateFileHash(file)
-			if err != nil {
-				LogWithDatetime(fmt.Sprintf("Error calculating hash for original file: %v", err), true)
-				sendSlackNotification(fmt.Sprintf("Error calculating hash for original file: %v", err))
-				return
-			}
+// copyFileToDestinations copies a single file to several destinations at once, reading the source only once.
+// Each destination is verified and finalized on its own, so a failed destination does not affect the others.
+//
+// Parameters:
+// - ctx: The context to control the file copying lifecycle.
+// - db: The database connection to track copied files.
+// - file: The file to be copied.
+// - dir: The source directory of the file.
+// - destinations: The destination directories to copy the file to.
+// - cfg: The configuration for the directory to monitor.
+// - freeSpaces: The available free space in each destination directory.
+func copyFileToDestinations(ctx context.Context, db *sql.DB, file, dir string, destinations []string, cfg Configuration, freeSpaces map[string]int64) {
+	relPath, err := filepath.Rel(dir, file)
+	if err != nil {
+		LogWithDatetime(fmt.Sprintf("Error getting relative path: %v", err), true)
+		sendSlackNotification(fmt.Sprintf("Error getting relative path: %v", err))
+		return
+	}
+	fileSize := GetFileSize(file)
+
+	var targets []FanOutTarget
+	var targetDestinations []string
+	for _, destination := range destinations {
+		destinationCtx, cancel := destinationContext(ctx, destination)
+		defer cancel()
+		if destinationCtx.Err() != nil {
+			continue
+		}
+		destPath, ok := prepareDestinationName(db, cfg, file, relPath, destination, false)
+		if !ok || !resolveExistingDestination(db, file, destPath, destination, cfg, false) {
+			continue
+		}
+		if freeSpaces[destination]-fileSize <= cfg.MinFreeSpace {
+			LogWithDatetime(fmt.Sprintf("File size will breach minimum free space at %s. Skipping destination.", destination), false)
+			sendSlackNotification(fmt.Sprintf("File size will breach minimum free space at %s. Skipping destination.", destination))
+			continue
+		}
+		targets = append(targets, FanOutTarget{
+			Dst: destPath,
+			Options: CopyOptions{
+				Limiters: []*RateLimiter{getRateLimiter("destination:"+destination, cfg.destinationConfig(destination).RateLimit)},
+				Sync:     cfg.destinationConfig(destination).durable(),
+			},
+			Context: destinationCtx,
+		})
+		targetDestinations = append(targetDestinations, destination)
+	}
+	if len(targets) == 0 {
+		return
+	}
 
-			copiedHash, err := CalculateFileHash(destPath + ".cat.part")
-			if err != nil {
-				LogWithDatetime(fmt.Sprintf("Error calculating hash for copied file: %v", err), true)
-				sendSlackNotification(fmt.Sprintf("Error calculating hash for copied file: %v", err))
-				return
-			}
+	sendSlackNotification(fmt.Sprintf("Starting to copy file: `%s` to %d destinations", file, len(targets)))
+	sharedOptions := CopyOptions{
+		Limiters:          []*RateLimiter{getRateLimiter("global", 0), getRateLimiter("config:"+cfg.Name, cfg.RateLimit)},
+		Checksum:          cfg.checksumAlgorithm(),
+		SecondaryChecksum: cfg.SecondaryChecksumAlgorithm,
+	}
+	result, errs, err := CopyFileToMany(ctx, file, targets, sharedOptions)
+	if err != nil {
+		LogWithDatetime(fmt.Sprintf("Error copying file: %v", err), true)
+		sendSlackNotification(fmt.Sprintf("Error copying file: %v", err))
+		return
+	}
+
+	for i, target := range targets {
+		if errs[i] != nil {
+			LogWithDatetime(fmt.Sprintf("Error copying file to %s: %v", target.Dst, errs[i]), true)
+			sendSlackNotification(fmt.Sprintf("Error copying file to %s: %v", target.Dst, errs[i]))
+			continue
+		}
+		LogWithDatetime(fmt.Sprintf("Copied file: %s to %s.cat.part", file, target.Dst), true)
+		finalizeCopy(db, cfg, file, target.Dst, targetDestinations[i], false, result)
+	}
+}
+
+// resolveExistingDestination checks whether a file already exists at the destination and decides whether to copy it.
+// Identical files are marked as copied, and differing files are handled by the conflict policy of the destination.
+//
+// Parameters:
+// - db: The database connection to track copied files.
+// - file: The source file.
+// - destPath: The path of the file at the destination.
+// - destination: The destination directory.
+// - cfg: The configuration for the directory to monitor.
+// - isFolder: Boolean indicating if the path is a folder.
+//
+// Returns:
+// - bool: True if the file should be copied.
+func resolveExistingDestination(db *sql.DB, file, destPath, destination string, cfg Configuration, isFolder bool) bool {
+	// Check if the file already exists at the destination
+	if _, err := os.Stat(destPath); err != nil {
+		return true
+	}
+
+	algorithm := cfg.checksumAlgorithm()
+	recordAlgorithm := digestAlgorithm(algorithm, isFolder)
+	destinationHash, err := GetCopiedFileChecksumFor(db, file, destination, recordAlgorithm)
+	if err != nil && err != sql.ErrNoRows {
+		LogWithDatetime(fmt.Sprintf("Error getting copied file checksum from database: %v", err), true)
+		sendSlackNotification(fmt.Sprintf("Error getting copied file checksum from database: %v", err))
+		return false
+	}
+
+	if destinationHash == "" {
+		// Calculate the hash of the destination file
+		destinationHash, err = cfg.copyChecksum(context.Background(), destination, destPath, isFolder, nil)
+		if errors.Is(err, errEncryptedCopy) {
+			// An unrecorded encrypted copy cannot be compared without an identity, so it is treated as different.
+			destinationHash, err = "", nil
+		}
+		if err != nil {
+			LogWithDatetime(fmt.Sprintf("Error calculating hash for destination file: %v", err), true)
+			sendSlackNotification(fmt.Sprintf("Error calculating hash for destination file: %v", err))
+			return false
+		}
+	}
+
+	originalHash, err := GetOriginFileChecksumFor(db, file, recordAlgorithm)
+	if err != nil {
+		LogWithDatetime(fmt.Sprintf("Error getting origin file checksum from database: %v", err), true)
+		sendSlackNotification(fmt.Sprintf("Error getting origin file checksum from database: %v", err))
+		return false
+	}
+
+	if originalHash == "" {
+		originalHash, err = CalculateFileChecksum(file, algorithm)
+		if err != nil {
+			LogWithDatetime(fmt.Sprintf("Error calculating hash for original file: %v", err), true)
+			sendSlackNotification(fmt.Sprintf("Error calculating hash for original file: %v", err))
+			return false
+		}
+		err = UpdateFileChecksumWithAlgorithm(db, file, originalHash, recordAlgorithm)
+		if err != nil {
+			LogWithDatetime(fmt.Sprintf("Error updating origin file checksum in database: %v", err), true)
+			sendSlackNotification(fmt.Sprintf("Error updating origin file checksum in database: %v", err))
+			return false
+		}
+	}
+
+	if originalHash == destinationHash {
+		LogWithDatetime(fmt.Sprintf("File already exists and is identical: %s", destPath), true)
+		sendSlackNotification(fmt.Sprintf("File already exists and is identical: %s", destPath))
+		dbMutex.Lock()
+		MarkFileAsCopied(db, file, destination, isFolder)
+		UpdateCopiedFileChecksumWithAlgorithm(db, file, destination, destinationHash, recordAlgorithm)
+		dbMutex.Unlock()
+		return false
+	}
+	if isFolder {
+		reportManifestDifferences(db, cfg, file, destPath, destination)
+	}
+	return resolveConflict(db, cfg, file, destPath, destination, isFolder, originalHash, destinationHash, recordAlgorithm)
+}
+
+// reportManifestDifferences logs which members of a folder at the destination differ from the source. The stored
+// manifest of the source is used if there is one, otherwise the source is hashed.
+//
+// Parameters:
+// - db: The database connection to read the stored manifest from.
+// - cfg: The configuration the folder belongs to.
+// - folder: The source folder.
+// - destPath: The path of the folder or its archive at the destination.
+// - destination: The destination directory.
+func reportManifestDifferences(db *sql.DB, cfg Configuration, folder, destPath, destination string) {
+	algorithm := cfg.checksumAlgorithm()
+	expected, found, err := GetManifest(db, folder)
+	if err == nil && (!found || expected.Algorithm != algorithm) {
+		expected, err = BuildManifest(folder, algorithm, "")
+	}
+	if err != nil {
+		LogWithDatetime(fmt.Sprintf("Error building manifest for %s: %v", folder, err), true)
+		return
+	}
+	actual, err := cfg.copyManifest(context.Background(), destination, destPath, algorithm, nil)
+	if err != nil {
+		LogWithDatetime(fmt.Sprintf("Error building manifest for %s: %v", destPath, err), true)
+		return
+	}
+	if differences := DiffManifests(expected, actual); len(differences) > 0 {
+		LogWithDatetime(fmt.Sprintf("Folder %s differs from %s:\n%s", destPath, folder, formatManifestDifferences(differences, 20)), true)
+		sendSlackNotification(fmt.Sprintf("Folder %s differs from %s:\n%s", destPath, folder, formatManifestDifferences(differences, 20)))
+	}
+}
 
-			if originalHash == copiedHash {
-				err := os.Rename(destPath+".cat.part", destPath)
-				if err != nil {
-					LogWithDatetime(fmt.Sprintf("Error renaming file: %v", err), true)
-					sendSlackNotification(fmt.Sprintf("Error renaming file: %v", err))
-				} else {
-					LogWithDatetime(fmt.Sprintf("File verified and renamed: %s", destPath), true)
-					sendSlackNotification(fmt.Sprintf("Finished copying file: %s", destPath))
-					dbMutex.Lock()
-					MarkFileAsCopied(db, file, destination, isFolder)
-					UpdateCopiedFileChecksum(db, file, destination, copiedHash)
-					SaveFileSize(db, file, fileSize, isFolder)
-					UpdateFileChecksum(db, file, originalHash)
-					UpdateCopiedFileSize(db, file, destination, fileSize)
-					dbMutex.Unlock()
+// finalizeCopy verifies a copied .cat.part file against the original file using the verification mode of the
+// destination, preserves the source metadata, renames it to its final destination name, writes the configured
+// checksum files and records the copy in the database. A mismatching copy is removed.
+//
+// Parameters:
+// - db: The database connection to track copied files.
+// - cfg: The configuration for the directory to monitor.
+// - file: The source file.
+// - destPath: The final path of the file at the destination.
+// - destination: The destination directory.
+// - isFolder: Boolean indicating if the path is a folder.
+// - result: The size, source checksums and I/O engine of the copy.
+func finalizeCopy(db *sql.DB, cfg Configuration, file, destPath, destination string, isFolder bool, result CopyResult) {
+	fileSize := result.Size
+	originalHash := result.Checksum
+	verification := cfg.verificationMode(destination)
+	settings := cfg.destinationConfig(destination)
+	stored := settings.storedSuffix(isFolder) != ""
+	var verifyErr error
+	if stored {
+		verifyErr = verifyEncodedCopy(verification, destPath+".cat.part", result, settings)
+	} else {
+		verifyErr = VerifyCopy(verification, file, destPath+".cat.part", fileSize, originalHash, result.Algorithm)
+	}
+	if verifyErr == nil {
+		logMetadataError(destPath, PreserveMetadata(file, destPath+".cat.part", cfg.destinationConfig(destination).Metadata))
+
+		err := os.Rename(destPath+".cat.part", destPath)
+		var syncErr error
+		if err == nil && cfg.destinationConfig(destination).durable() {
+			// The rename only survives a power loss once the parent directory is flushed.
+			syncErr = syncDir(filepath.Dir(destPath))
+		}
+		if err != nil {
+			LogWithDatetime(fmt.Sprintf("Error renaming file: %v", err), true)
+			sendSlackNotification(fmt.Sprintf("Error renaming file: %v", err))
+		} else if syncErr != nil {
+			LogWithDatetime(fmt.Sprintf("Error syncing directory: %v", syncErr), true)
+			sendSlackNotification(fmt.Sprintf("Error syncing directory: %v", syncErr))
+		} else {
+			LogWithDatetime(fmt.Sprintf("File verified and renamed: %s", destPath), true)
+			entry := ManifestEntry{Checksum: originalHash, SecondaryChecksum: result.SecondaryChecksum}
+			if stored {
+				// Checksum files describe the stored bytes, so that they can be checked without decoding.
+				entry = ManifestEntry{Checksum: result.StoredChecksum}
+			}
+			writeChecksumFiles(cfg, destination, destPath, []ManifestEntry{entry}, result.Algorithm, result.SecondaryAlgorithm)
+			sendSlackNotification(fmt.Sprintf("Finished copying file: %s", destPath))
+			dbMutex.Lock()
+			MarkFileAsCopied(db, file, destination, isFolder)
+			UpdateCopiedFileChecksumWithAlgorithm(db, file, destination, originalHash, result.Algorithm)
+			SaveFileSize(db, file, fileSize, isFolder)
+			UpdateFileChecksumWithAlgorithm(db, file, originalHash, result.Algorithm)
+			if result.SecondaryChecksum != "" {
+				UpdateFileSecondaryChecksum(db, file, result.SecondaryChecksum, result.SecondaryAlgorithm)
+			}
+			UpdateCopiedFileSize(db, file, destination, fileSize)
+			UpdateCopiedFileVerification(db, file, destination, verification)
+			UpdateCopiedFileEngine(db, file, destination, result.Engine)
+			if stored {
+				ratio := 1.0
+				if fileSize > 0 {
+					ratio = float64(result.StoredSize) / float64(fileSize)
 				}
-			} else {
-				LogWithDatetime(fmt.Sprintf("File hash mismatch for: %s", file), true)
-				sendSlackNotification(fmt.Sprintf("File hash mismatch for: %s", file))
-				os.Remove(destPath + ".cat.part")
+				UpdateCopiedFileStorage(db, file, destination, destPath, result.StoredSize, result.StoredChecksum, settings.compression(isFolder), settings.encryption(isFolder), ratio)
 			}
+			dbMutex.Unlock()
 		}
+	} else {
+		LogWithDatetime(fmt.Sprintf("Verification failed for %s: %v", file, verifyErr), true)
+		sendSlackNotification(fmt.Sprintf("Verification failed for %s: %v", file, verifyErr))
+		os.Remove(destPath + ".cat.part")
 	}
 }
@@ -0,0 +1,328 @@
+package catapult
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"unicode/utf16"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// NameRules controls how names are rewritten and checked before they are copied to a destination.
+type NameRules struct {
+	// Windows applies the rules of Windows and SMB shares on top of the other settings: reserved characters and
+	// control characters are replaced with an underscore, trailing dots and spaces are trimmed, reserved device
+	// names get an underscore appended, names are limited to 255 and paths to 260 characters, and case is ignored.
+	Windows bool `json:"windows,omitempty"`
+	// Replace maps characters or strings in names to their replacements.
+	Replace map[string]string `json:"replace,omitempty"`
+	// NFC normalises names to Unicode normalisation form C.
+	NFC bool `json:"nfc,omitempty"`
+	// TrimTrailing lists characters removed from the end of every name.
+	TrimTrailing string `json:"trim_trailing,omitempty"`
+	// MaxNameLength is the maximum length of every name in a path, in UTF-16 code units. Zero means no limit.
+	MaxNameLength int `json:"max_name_length,omitempty"`
+	// MaxPathLength is the maximum length of a full destination path, including the staging suffix, in UTF-16 code
+	// units. Zero means no limit.
+	MaxPathLength int `json:"max_path_length,omitempty"`
+	// CaseInsensitive reports paths that only differ from another path at the destination by case.
+	CaseInsensitive bool `json:"case_insensitive,omitempty"`
+}
+
+// NameMapping records the name a source was given at a destination.
+type NameMapping struct {
+	Destination string
+	FilePath    string
+	// Original is the destination path the source would have had without the name rules.
+	Original string
+	// Path is the destination path after the name rules were applied.
+	Path string
+}
+
+// windowsReservedCharacters are the characters Windows does not allow in names.
+var windowsReservedCharacters = []string{"<", ">", ":", "\"", "|", "?", "*", "\\"}
+
+// windowsReservedNames are the device names Windows does not allow as names, with or without an extension.
+var windowsReservedNames = map[string]bool{
+	"CON": true, "PRN": true, "AUX": true, "NUL": true,
+	"COM1": true, "COM2": true, "COM3": true, "COM4": true, "COM5": true, "COM6": true, "COM7": true, "COM8": true, "COM9": true,
+	"LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true, "LPT5": true, "LPT6": true, "LPT7": true, "LPT8": true, "LPT9": true,
+}
+
+// rules returns the name rules with the Windows rules applied. Explicit settings take precedence over them.
+//
+// Returns:
+// - NameRules: The effective name rules.
+func (r NameRules) rules() NameRules {
+	if !r.Windows {
+		return r
+	}
+	replace := map[string]string{}
+	for _, c := range windowsReservedCharacters {
+		replace[c] = "_"
+	}
+	for c := rune(0); c < 0x20; c++ {
+		replace[string(c)] = "_"
+	}
+	for from, to := range r.Replace {
+		replace[from] = to
+	}
+	r.Replace = replace
+	r.TrimTrailing += ". "
+	if r.MaxNameLength == 0 {
+		r.MaxNameLength = 255
+	}
+	if r.MaxPathLength == 0 {
+		r.MaxPathLength = 260
+	}
+	r.CaseInsensitive = true
+	return r
+}
+
+// enabled checks whether any name rule is set.
+//
+// Returns:
+// - bool: True if names are rewritten or checked.
+func (r NameRules) enabled() bool {
+	return r.Windows || len(r.Replace) > 0 || r.NFC || r.TrimTrailing != "" || r.MaxNameLength > 0 || r.MaxPathLength > 0 || r.CaseInsensitive
+}
+
+// replacer builds a replacer for the replacement map. Longer strings are replaced first, so that the result does
+// not depend on the order of the map.
+//
+// Returns:
+// - *strings.Replacer: The replacer, or nil if there are no replacements.
+func (r NameRules) replacer() *strings.Replacer {
+	if len(r.Replace) == 0 {
+		return nil
+	}
+	keys := make([]string, 0, len(r.Replace))
+	for from := range r.Replace {
+		if from != "" {
+			keys = append(keys, from)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if len(keys[i]) != len(keys[j]) {
+			return len(keys[i]) > len(keys[j])
+		}
+		return keys[i] < keys[j]
+	})
+	var pairs []string
+	for _, from := range keys {
+		pairs = append(pairs, from, r.Replace[from])
+	}
+	return strings.NewReplacer(pairs...)
+}
+
+// sanitizeName applies the name rules to a single name.
+//
+// Parameters:
+// - name: The name.
+// - replacer: The replacer built by replacer, or nil.
+//
+// Returns:
+// - string: The sanitised name.
+func (r NameRules) sanitizeName(name string, replacer *strings.Replacer) string {
+	if r.NFC {
+		name = norm.NFC.String(name)
+	}
+	if replacer != nil {
+		name = replacer.Replace(name)
+	}
+	if r.TrimTrailing != "" {
+		name = strings.TrimRight(name, r.TrimTrailing)
+	}
+	if r.Windows {
+		parts := strings.SplitN(name, ".", 2)
+		if windowsReservedNames[strings.ToUpper(parts[0])] {
+			parts[0] += "_"
+			name = strings.Join(parts, ".")
+		}
+	}
+	if name == "" {
+		return "_"
+	}
+	return name
+}
+
+// sanitizePath applies the name rules to every name in a relative path.
+//
+// Parameters:
+// - relPath: The path relative to the monitored directory.
+//
+// Returns:
+// - string: The sanitised relative path.
+func (r NameRules) sanitizePath(relPath string) string {
+	replacer := r.replacer()
+	names := strings.Split(relPath, string(filepath.Separator))
+	for i, name := range names {
+		names[i] = r.sanitizeName(name, replacer)
+	}
+	return filepath.Join(names...)
+}
+
+// checkLength checks a destination path against the length limits.
+//
+// Parameters:
+// - path: The full destination path, including any staging suffix.
+// - relPath: The part of the path whose names are checked against the name limit.
+//
+// Returns:
+// - error: An error object if the path or one of its names is too long.
+func (r NameRules) checkLength(path, relPath string) error {
+	if r.MaxPathLength > 0 && utf16Length(path) > r.MaxPathLength {
+		return fmt.Errorf("%s is longer than %d characters", path, r.MaxPathLength)
+	}
+	if r.MaxNameLength > 0 {
+		for _, name := range strings.Split(relPath, string(filepath.Separator)) {
+			if utf16Length(name) > r.MaxNameLength {
+				return fmt.Errorf("%s has a name longer than %d characters", path, r.MaxNameLength)
+			}
+		}
+	}
+	return nil
+}
+
+// utf16Length returns the length of a string in UTF-16 code units, which is how Windows measures names and paths.
+func utf16Length(s string) int {
+	return len(utf16.Encode([]rune(s)))
+}
+
+// mirrorPath returns the path a source is mirrored to at a destination, with the name rules of the destination
+// applied.
+//
+// Parameters:
+// - destination: The destination directory.
+// - relPath: The path of the source relative to its monitored directory.
+//
+// Returns:
+// - string: The path at the destination.
+func (cfg Configuration) mirrorPath(destination, relPath string) string {
+	if rules := cfg.destinationConfig(destination).Names.rules(); rules.enabled() {
+		relPath = rules.sanitizePath(relPath)
+	}
+	return filepath.Join(destination, relPath)
+}
+
+// checkDestinationName checks, before anything is copied, that a source can be written to a destination under the
+// name rules of the destination: its path and the paths of bundle members must be within the length limits, bundle
+// members must not need renaming, and no other source may be mapped to the same path, or a path that only differs
+// by case if case is ignored.
+//
+// Parameters:
+// - db: The database connection holding the name mappings. May be nil, in which case only the destination is checked.
+// - cfg: The configuration the source belongs to.
+// - file: The source file or bundle directory.
+// - relPath: The path of the source relative to its monitored directory.
+// - destination: The destination directory.
+// - isFolder: Boolean indicating if the source is a bundle directory.
+//
+// Returns:
+// - NameMapping: The mapping of the source to its path at the destination.
+// - error: An error object describing why the source cannot be written.
+func checkDestinationName(db *sql.DB, cfg Configuration, file, relPath, destination string, isFolder bool) (NameMapping, error) {
+	rules := cfg.destinationConfig(destination).Names.rules()
+	mapping := NameMapping{
+		Destination: destination,
+		FilePath:    file,
+		Original:    filepath.Join(destination, relPath),
+		Path:        cfg.mirrorPath(destination, relPath),
+	}
+	if !rules.enabled() {
+		return mapping, nil
+	}
+
+	stagingPath := cfg.destinationConfig(destination).copyLocation(mapping.Path, isFolder) + ".cat.part"
+	sanitizedRel, _ := filepath.Rel(destination, stagingPath)
+	if err := rules.checkLength(stagingPath, sanitizedRel); err != nil {
+		return mapping, err
+	}
+	if isFolder {
+		err := filepath.Walk(file, func(path string, info os.FileInfo, err error) error {
+			if err != nil || path == file {
+				return err
+			}
+			memberRel, err := filepath.Rel(file, path)
+			if err != nil {
+				return err
+			}
+			if sanitized := rules.sanitizePath(memberRel); sanitized != memberRel {
+				return fmt.Errorf("bundle member %s would have to be renamed to %s", path, sanitized)
+			}
+			return rules.checkLength(filepath.Join(stagingPath, memberRel), memberRel)
+		})
+		if err != nil {
+			return mapping, err
+		}
+	}
+
+	if rules.CaseInsensitive {
+		copyPath := cfg.destinationConfig(destination).copyLocation(mapping.Path, isFolder)
+		if entries, err := os.ReadDir(filepath.Dir(copyPath)); err == nil {
+			name := filepath.Base(copyPath)
+			for _, entry := range entries {
+				if entry.Name() != name && strings.EqualFold(entry.Name(), name) {
+					return mapping, fmt.Errorf("%s only differs by case from %s", copyPath, filepath.Join(filepath.Dir(copyPath), entry.Name()))
+				}
+			}
+		}
+	}
+	if db == nil {
+		return mapping, nil
+	}
+	others, err := GetNameMappingsByPath(db, destination, strings.ToLower(mapping.Path), file)
+	if err != nil {
+		return mapping, err
+	}
+	for _, other := range others {
+		if _, err := os.Lstat(other.FilePath); os.IsNotExist(err) {
+			// The other source is gone, so its name is free again.
+			continue
+		}
+		if other.Path == mapping.Path || rules.CaseInsensitive {
+			return mapping, fmt.Errorf("%s and %s both map to %s", file, other.FilePath, other.Path)
+		}
+	}
+	return mapping, nil
+}
+
+// prepareDestinationName checks the name of a source at a destination with checkDestinationName and records the
+// mapping. Problems are reported, so that the source is not copied.
+//
+// Parameters:
+// - db: The database connection holding the name mappings.
+// - cfg: The configuration the source belongs to.
+// - file: The source file or bundle directory.
+// - relPath: The path of the source relative to its monitored directory.
+// - destination: The destination directory.
+// - isFolder: Boolean indicating if the source is a bundle directory.
+//
+// Returns:
+// - string: The path of the source at the destination.
+// - bool: True if the source can be copied.
+func prepareDestinationName(db *sql.DB, cfg Configuration, file, relPath, destination string, isFolder bool) (string, bool) {
+	mapping, err := checkDestinationName(db, cfg, file, relPath, destination, isFolder)
+	if err != nil {
+		LogWithDatetime(fmt.Sprintf("Cannot copy %s to %s: %v", file, destination, err), true)
+		sendSlackNotification(fmt.Sprintf("Cannot copy %s to %s: %v", file, destination, err))
+		return "", false
+	}
+	if !cfg.destinationConfig(destination).Names.enabled() {
+		return mapping.Path, true
+	}
+	if mapping.Path != mapping.Original {
+		LogWithDatetime(fmt.Sprintf("Renaming %s to %s at %s", relPath, strings.TrimPrefix(mapping.Path, destination+string(filepath.Separator)), destination), false)
+	}
+	dbMutex.Lock()
+	err = SaveNameMapping(db, mapping)
+	dbMutex.Unlock()
+	if err != nil {
+		LogWithDatetime(fmt.Sprintf("Error recording name mapping for %s: %v", file, err), true)
+	}
+	return mapping.Path, true
+}
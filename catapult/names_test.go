@@ -0,0 +1,99 @@
+package catapult
+
+import (
+	"context"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSanitizePath(t *testing.T) {
+	windows := NameRules{Windows: true, NFC: true, Replace: map[string]string{"#": "-", ":": "-"}}.rules()
+	tests := []struct {
+		rules NameRules
+		in    string
+		want  string
+	}{
+		{windows, filepath.Join("run:01", "sample.raw."), filepath.Join("run-01", "sample.raw")},
+		{windows, "what?<now>|*.raw", "what__now___.raw"},
+		{windows, "CON.txt", "CON_.txt"},
+		{windows, "console.txt", "console.txt"},
+		{windows, "plate #1 .raw ", "plate -1 .raw"},
+		{windows, "...", "_"},
+		{windows, "cafe\u0301.raw", "caf\u00e9.raw"},
+		{NameRules{}, "café:.raw", "café:.raw"},
+		{NameRules{Replace: map[string]string{"ab": "x", "a": "y"}}, "aab.txt", "yx.txt"},
+	}
+	for _, tt := range tests {
+		if got := tt.rules.sanitizePath(tt.in); got != tt.want {
+			t.Fatalf("sanitizePath(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+
+	if err := windows.checkLength(strings.Repeat("a", 261), "a"); err == nil {
+		t.Fatalf("Expected a path over 260 characters to be rejected")
+	}
+	if err := windows.checkLength("dst/"+strings.Repeat("é", 255), strings.Repeat("é", 255)); err != nil {
+		t.Fatalf("Expected a name of 255 characters to be accepted: %v", err)
+	}
+	if err := windows.checkLength("dst/"+strings.Repeat("\U0001F600", 128), strings.Repeat("\U0001F600", 128)); err == nil {
+		t.Fatalf("Expected a name of 256 UTF-16 code units to be rejected")
+	}
+}
+
+func TestCopyWithNameRules(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+
+	tmpDir := t.TempDir()
+	src := filepath.Join(tmpDir, "src")
+	destination := filepath.Join(tmpDir, "dst")
+	os.MkdirAll(filepath.Join(src, "run:01"), 0755)
+	os.MkdirAll(destination, 0755)
+	files := []string{filepath.Join("run:01", "a.raw"), filepath.Join("run_01", "a.raw"), "Sample.raw", "sample.raw", strings.Repeat("x", 60) + ".raw"}
+	for _, name := range files {
+		os.MkdirAll(filepath.Dir(filepath.Join(src, name)), 0755)
+		os.WriteFile(filepath.Join(src, name), []byte(name), 0644)
+	}
+
+	cfg := Configuration{
+		Name:         "names",
+		Directories:  []string{src},
+		Destinations: []string{destination},
+		DestinationSettings: map[string]DestinationConfig{
+			destination: {Names: NameRules{Windows: true, MaxPathLength: len(destination) + 50}},
+		},
+	}
+	for _, name := range files {
+		copyFileWithVerification(context.Background(), db, filepath.Join(src, name), src, destination, cfg, math.MaxInt64)
+	}
+
+	if content, err := os.ReadFile(filepath.Join(destination, "run_01", "a.raw")); err != nil || string(content) != filepath.Join("run:01", "a.raw") {
+		t.Fatalf("Expected run:01/a.raw to be copied to run_01/a.raw, got %q, %v", content, err)
+	}
+	if content, _ := os.ReadFile(filepath.Join(destination, "Sample.raw")); string(content) != "Sample.raw" {
+		t.Fatalf("Expected Sample.raw to be copied, got %q", content)
+	}
+	if _, err := os.Stat(filepath.Join(destination, "sample.raw")); !os.IsNotExist(err) {
+		t.Fatalf("Expected sample.raw not to be copied next to Sample.raw: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(destination, files[4])); !os.IsNotExist(err) {
+		t.Fatalf("Expected a path over the limit not to be copied: %v", err)
+	}
+	for _, rejected := range []string{files[1], files[3], files[4]} {
+		if copied, _ := IsFileCopied(db, filepath.Join(src, rejected), destination, false); copied {
+			t.Fatalf("Expected %s not to be copied", rejected)
+		}
+	}
+
+	var original, path string
+	db.QueryRow(`SELECT original, path FROM name_mappings WHERE file_path = ?`, filepath.Join(src, files[0])).Scan(&original, &path)
+	if original != filepath.Join(destination, files[0]) || path != filepath.Join(destination, "run_01", "a.raw") {
+		t.Fatalf("Unexpected name mapping %s -> %s", original, path)
+	}
+	if dest, ok := cfg.destinationPath(filepath.Join(src, files[0]), destination, false); !ok || dest != path {
+		t.Fatalf("destinationPath() = %s, want %s", dest, path)
+	}
+}
@@ -0,0 +1,24 @@
+//go:build !windows
+// +build !windows
+
+package catapult
+
+import (
+	"golang.org/x/sys/unix"
+)
+
+// isProcessRunning reports whether a process with the given PID exists on Unix-based systems.
+// It sends the null signal, which performs error checking without delivering a signal.
+//
+// Parameters:
+// - pid: The process ID to check.
+//
+// Returns:
+// - bool: True if the process exists.
+func isProcessRunning(pid int) bool {
+	if pid <= 0 {
+		return false
+	}
+	err := unix.Kill(pid, 0)
+	return err == nil || err == unix.EPERM
+}
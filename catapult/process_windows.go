@@ -0,0 +1,36 @@
+//go:build windows
+// +build windows
+
+package catapult
+
+import (
+	"golang.org/x/sys/windows"
+)
+
+// stillActive is the exit code reported by GetExitCodeProcess for a process that has not exited.
+const stillActive = 259
+
+// isProcessRunning reports whether a process with the given PID is running on Windows systems.
+// It opens the process and checks that it has not yet reported an exit code.
+//
+// Parameters:
+// - pid: The process ID to check.
+//
+// Returns:
+// - bool: True if the process is running.
+func isProcessRunning(pid int) bool {
+	if pid <= 0 {
+		return false
+	}
+	handle, err := windows.OpenProcess(windows.PROCESS_QUERY_LIMITED_INFORMATION, false, uint32(pid))
+	if err != nil {
+		return false
+	}
+	defer windows.CloseHandle(handle)
+
+	var exitCode uint32
+	if err := windows.GetExitCodeProcess(handle, &exitCode); err != nil {
+		return false
+	}
+	return exitCode == stillActive
+}
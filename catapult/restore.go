@@ -0,0 +1,45 @@
+package catapult
+
+import (
+	"database/sql"
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// Restore restores a bundle archive or a compressed or encrypted copy from a destination into a directory, verifying
+// it against what was recorded when it was copied.
+//
+// Parameters:
+// - db: The database connection to read recorded checksums from. May be nil, in which case nothing is verified.
+// - path: The path of the archive or stored copy.
+// - target: The directory to restore into.
+// - identityFile: The age identity file to decrypt encrypted copies with, or an empty string.
+//
+// Returns:
+// - error: An error object if the path could not be restored or does not match the recorded checksums.
+func Restore(db *sql.DB, path, target, identityFile string) error {
+	if _, ok := archiveFormatOf(path); ok {
+		return RestoreArchive(db, path, target)
+	}
+	if strings.HasSuffix(path, compressedSuffix) || strings.HasSuffix(path, encryptedSuffix) {
+		return RestoreStoredCopy(db, path, target, identityFile)
+	}
+	return fmt.Errorf("%s is not a bundle archive or a compressed or encrypted copy", path)
+}
+
+// pathVariants returns the path given and, if it differs, its absolute path, so that destination paths recorded as
+// configured can be found from a relative path.
+//
+// Parameters:
+// - path: The path to look up.
+//
+// Returns:
+// - []string: The paths to look up, the path given first.
+func pathVariants(path string) []string {
+	paths := []string{path}
+	if absPath, err := filepath.Abs(path); err == nil && absPath != path {
+		paths = append(paths, absPath)
+	}
+	return paths
+}
@@ -0,0 +1,94 @@
+package catapult
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+)
+
+// resumeCheckpointInterval is how many bytes are copied between updates of the resume state.
+const resumeCheckpointInterval = 64 * 1024 * 1024
+
+// copyState records how far a .cat.part file was written, so an interrupted copy can be resumed.
+type copyState struct {
+	Source     string `json:"source"`
+	Offset     int64  `json:"offset"`
+	Algorithm  string `json:"algorithm,omitempty"`
+	PrefixHash string `json:"prefix_hash"`
+}
+
+// saveCopyState atomically writes the resume state of a partial copy next to the .cat.part file. The partial file
+// must be flushed to disk first, as a resume trusts the data up to the recorded offset.
+//
+// Parameters:
+// - statePath: The path of the state file.
+// - state: The state to write.
+func saveCopyState(statePath string, state copyState) {
+	content, err := json.Marshal(state)
+	if err != nil {
+		return
+	}
+	tmpPath := statePath + ".tmp"
+	if err := os.WriteFile(tmpPath, content, 0644); err != nil {
+		LogWithDatetime(fmt.Sprintf("Error saving copy state: %v", err), false)
+		return
+	}
+	if err := os.Rename(tmpPath, statePath); err != nil {
+		LogWithDatetime(fmt.Sprintf("Error saving copy state: %v", err), false)
+	}
+}
+
+// resumeOffset checks whether a partial copy can be continued and returns the offset to continue from.
+// The source prefix is re-read into the running hash and compared with the hash recorded when the partial
+// copy was written. On success the source is positioned at the returned offset; on any mismatch the hash
+// and the source are reset and 0 is returned, so that the copy restarts from the beginning.
+//
+// Parameters:
+// - sourceFile: The open source file.
+// - src: The source file path.
+// - dstPart: The path of the partial copy.
+// - statePath: The path of the state file.
+// - totalSize: The current size of the source file.
+// - algorithm: The checksum algorithm of the running hash.
+// - hash: The running hash of the copy.
+//
+// Returns:
+// - int64: The offset to continue copying from, or 0 to restart.
+func resumeOffset(sourceFile *os.File, src, dstPart, statePath string, totalSize int64, algorithm string, hash *checksummer) int64 {
+	content, err := os.ReadFile(statePath)
+	if err != nil {
+		return 0
+	}
+	var state copyState
+	if err := json.Unmarshal(content, &state); err != nil {
+		return 0
+	}
+	if state.Source != src || state.Offset <= 0 || state.Offset > totalSize {
+		return 0
+	}
+	if normalizeChecksumAlgorithm(state.Algorithm) != algorithm {
+		LogWithDatetime(fmt.Sprintf("Partial copy %s was hashed with %s, restarting", dstPart, normalizeChecksumAlgorithm(state.Algorithm)), false)
+		return 0
+	}
+	if partSize := GetFileSize(dstPart); partSize < state.Offset {
+		LogWithDatetime(fmt.Sprintf("Partial copy %s is shorter than its recorded offset, restarting", dstPart), false)
+		return 0
+	}
+
+	restart := func() int64 {
+		hash.Reset()
+		sourceFile.Seek(0, io.SeekStart)
+		return 0
+	}
+	if _, err := io.CopyN(hash, sourceFile, state.Offset); err != nil {
+		return restart()
+	}
+	if hash.sum() != state.PrefixHash {
+		LogWithDatetime(fmt.Sprintf("Source %s changed since the partial copy was written, restarting", src), true)
+		return restart()
+	}
+
+	LogWithDatetime(fmt.Sprintf("Resuming copy of %s at offset %d", src, state.Offset), true)
+	return state.Offset
+}
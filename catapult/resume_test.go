@@ -0,0 +1,67 @@
+package catapult
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCopyFileResume(t *testing.T) {
+	tmpDir := t.TempDir()
+	src := filepath.Join(tmpDir, "source.raw")
+	dst := filepath.Join(tmpDir, "out", "source.raw")
+	content := make([]byte, 3*1024*1024)
+	for i := range content {
+		content[i] = byte(i % 253)
+	}
+	if err := os.WriteFile(src, content, 0644); err != nil {
+		t.Fatalf("Failed to create test file: %v", err)
+	}
+	expectedHash, _ := CalculateFileHash(src)
+
+	// Simulate an interrupted copy that wrote the first megabyte.
+	offset := int64(1024 * 1024)
+	os.MkdirAll(filepath.Dir(dst), 0755)
+	os.WriteFile(dst+".cat.part", content[:offset], 0644)
+	prefixHash, _ := CalculateFileHash(dst + ".cat.part")
+	saveCopyState(dst+".cat.part.state", copyState{Source: src, Offset: offset, PrefixHash: prefixHash})
+
+	result, err := CopyFileWithOptions(context.Background(), src, dst, CopyOptions{Resume: true})
+	if err != nil {
+		t.Fatalf("CopyFileWithOptions() error: %v", err)
+	}
+	if result.Checksum != expectedHash {
+		t.Fatalf("checksum = %s, want %s", result.Checksum, expectedHash)
+	}
+	if copiedHash, _ := CalculateFileHash(dst + ".cat.part"); copiedHash != expectedHash {
+		t.Fatalf("resumed copy hash = %s, want %s", copiedHash, expectedHash)
+	}
+	if _, err := os.Stat(dst + ".cat.part.state"); !os.IsNotExist(err) {
+		t.Fatalf("Expected state file to be removed after completion")
+	}
+}
+
+func TestCopyFileResumeSourceChanged(t *testing.T) {
+	tmpDir := t.TempDir()
+	src := filepath.Join(tmpDir, "source.raw")
+	dst := filepath.Join(tmpDir, "out", "source.raw")
+	content := []byte("new source content that differs from the partial copy")
+	if err := os.WriteFile(src, content, 0644); err != nil {
+		t.Fatalf("Failed to create test file: %v", err)
+	}
+
+	stale := []byte("old source")
+	os.MkdirAll(filepath.Dir(dst), 0755)
+	os.WriteFile(dst+".cat.part", stale, 0644)
+	prefixHash, _ := CalculateFileHash(dst + ".cat.part")
+	saveCopyState(dst+".cat.part.state", copyState{Source: src, Offset: int64(len(stale)), PrefixHash: prefixHash})
+
+	if _, err := CopyFileWithOptions(context.Background(), src, dst, CopyOptions{Resume: true}); err != nil {
+		t.Fatalf("CopyFileWithOptions() error: %v", err)
+	}
+	copied, _ := os.ReadFile(dst + ".cat.part")
+	if string(copied) != string(content) {
+		t.Fatalf("copy = %q, want %q", copied, content)
+	}
+}
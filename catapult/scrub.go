@@ -0,0 +1,454 @@
+package catapult
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Outcomes of scrubbing a copy, recorded in the scrub_status column of copied_files.
+const (
+	ScrubOK       = "ok"
+	ScrubChanged  = "changed"
+	ScrubMissing  = "missing"
+	ScrubRepaired = "repaired"
+	// ScrubBaseline means no checksum with the configured algorithm was recorded, so one was taken from the source
+	// and the copy matched it.
+	ScrubBaseline = "baseline"
+	// ScrubUnverified means no checksum with the configured algorithm was recorded and the source is gone, so the copy
+	// could not be checked.
+	ScrubUnverified = "unverified"
+	ScrubError      = "error"
+)
+
+// Sources a damaged or missing copy can be repaired from.
+const (
+	RepairNone        = "none"
+	RepairSource      = "source"
+	RepairDestination = "destination"
+	RepairAny         = "any"
+)
+
+// ScrubDestinations periodically re-hashes the copies at the destinations of a configuration and compares them with
+// the stored checksums. Every copy is scrubbed once per scrub interval, at the pace allowed by the scrub rate limit.
+//
+// Parameters:
+// - ctx: The context to control the scrubbing lifecycle.
+// - db: The database connection to track copied files.
+// - cfg: The configuration whose destinations are scrubbed.
+func ScrubDestinations(ctx context.Context, db *sql.DB, cfg Configuration) {
+	cycle, err := time.ParseDuration(cfg.Scrub.Interval)
+	if err != nil {
+		LogWithDatetime(fmt.Sprintf("Invalid scrub interval for %s: %v", cfg.Name, err), true)
+		sendSlackNotification(fmt.Sprintf("Invalid scrub interval for %s: %v", cfg.Name, err))
+		return
+	}
+	duration, err := time.ParseDuration(cfg.CheckInterval)
+	if err != nil {
+		return
+	}
+	ticker := time.NewTicker(duration)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			LogWithDatetime("Shutting down scrubbing", true)
+			return
+		case <-ticker.C:
+			scrubDue(ctx, db, cfg, cycle)
+		}
+	}
+}
+
+// scrubDue scrubs every copy of a configuration that has not been scrubbed within the scrub interval.
+//
+// Parameters:
+// - ctx: The context to control the scrubbing lifecycle.
+// - db: The database connection to track copied files.
+// - cfg: The configuration whose destinations are scrubbed.
+// - cycle: The scrub interval.
+func scrubDue(ctx context.Context, db *sql.DB, cfg Configuration, cycle time.Duration) {
+	records, err := GetScrubCandidates(db, cfg.Destinations, time.Now().Add(-cycle))
+	if err != nil {
+		LogWithDatetime(fmt.Sprintf("Error getting copies to scrub: %v", err), true)
+		sendSlackNotification(fmt.Sprintf("Error getting copies to scrub: %v", err))
+		return
+	}
+
+	for _, record := range records {
+		if ctx.Err() != nil {
+			return
+		}
+		destPath, ok := cfg.destinationPath(record.FilePath, record.Destination, record.IsFolder)
+		if !ok {
+			// The copy belongs to another configuration sharing the destination.
+			continue
+		}
+		status := scrubCopy(ctx, db, cfg, record, destPath)
+		if ctx.Err() != nil {
+			return
+		}
+		dbMutex.Lock()
+		UpdateScrubResult(db, record.FilePath, record.Destination, status, time.Now())
+		dbMutex.Unlock()
+	}
+}
+
+// scrubCopy re-hashes a single copy, alerts if it is missing or changed, and repairs it if configured.
+//
+// Parameters:
+// - ctx: The context to control the scrubbing lifecycle.
+// - db: The database connection to track copied files.
+// - cfg: The configuration the copy belongs to.
+// - record: The recorded copy.
+// - destPath: The path of the copy at the destination.
+//
+// Returns:
+// - string: The outcome of the scrub.
+func scrubCopy(ctx context.Context, db *sql.DB, cfg Configuration, record CopiedFileRecord, destPath string) string {
+	algorithm := cfg.checksumAlgorithm()
+	recordAlgorithm := digestAlgorithm(algorithm, record.IsFolder)
+
+	if _, err := os.Stat(destPath); os.IsNotExist(err) {
+		LogWithDatetime(fmt.Sprintf("Scrub found copy missing: %s", destPath), true)
+		sendSlackNotification(fmt.Sprintf("Scrub found copy missing: %s", destPath))
+		return repairCopy(ctx, db, cfg, record, destPath, ScrubMissing)
+	}
+
+	checksum, err := cfg.copyChecksum(ctx, record.Destination, destPath, record.IsFolder, scrubLimiters(cfg))
+	if errors.Is(err, errEncryptedCopy) {
+		return scrubStoredCopy(ctx, db, cfg, record, destPath)
+	}
+	if err != nil {
+		if ctx.Err() == nil {
+			LogWithDatetime(fmt.Sprintf("Error scrubbing %s: %v", destPath, err), true)
+			sendSlackNotification(fmt.Sprintf("Error scrubbing %s: %v", destPath, err))
+		}
+		return ScrubError
+	}
+
+	if record.Checksum == "" || normalizeChecksumAlgorithm(record.ChecksumAlgorithm) != recordAlgorithm {
+		// The copy may already be damaged, so the baseline comes from the source rather than from the copy.
+		reference, err := sourceChecksum(ctx, db, cfg, record)
+		if err != nil {
+			if ctx.Err() != nil {
+				return ScrubError
+			}
+			LogWithDatetime(fmt.Sprintf("Scrub cannot verify %s without a %s checksum of its source: %v", destPath, algorithm, err), true)
+			return ScrubUnverified
+		}
+		dbMutex.Lock()
+		UpdateCopiedFileChecksumWithAlgorithm(db, record.FilePath, record.Destination, reference, recordAlgorithm)
+		dbMutex.Unlock()
+		record.Checksum, record.ChecksumAlgorithm = reference, recordAlgorithm
+		if checksum == reference {
+			LogWithDatetime(fmt.Sprintf("Scrub recorded %s checksum for %s", algorithm, destPath), false)
+			return ScrubBaseline
+		}
+	} else if checksum == record.Checksum {
+		LogWithDatetime(fmt.Sprintf("Scrub verified %s", destPath), false)
+		return ScrubOK
+	}
+
+	LogWithDatetime(fmt.Sprintf("Scrub found copy changed: %s", destPath), true)
+	sendSlackNotification(fmt.Sprintf("Scrub found copy changed: %s", destPath))
+	if record.IsFolder {
+		reportManifestDifferences(db, cfg, record.FilePath, destPath, record.Destination)
+	}
+	return repairCopy(ctx, db, cfg, record, destPath, ScrubChanged)
+}
+
+// sourceChecksum returns the checksum a copy should have, taken from the checksum recorded for its source with the
+// configured algorithm, or from hashing the source if none was recorded.
+//
+// Parameters:
+// - ctx: The context to control the scrubbing lifecycle.
+// - db: The database connection to track copied files.
+// - cfg: The configuration the copy belongs to.
+// - record: The recorded copy.
+//
+// Returns:
+// - string: The checksum of the source.
+// - error: An error object if no checksum was recorded and the source could not be hashed.
+func sourceChecksum(ctx context.Context, db *sql.DB, cfg Configuration, record CopiedFileRecord) (string, error) {
+	algorithm := cfg.checksumAlgorithm()
+	checksum, err := GetOriginFileChecksumFor(db, record.FilePath, digestAlgorithm(algorithm, record.IsFolder))
+	if err != nil && err != sql.ErrNoRows {
+		return "", err
+	}
+	if checksum != "" {
+		return checksum, nil
+	}
+	checksum, _, err = calculateChecksums(ctx, record.FilePath, algorithm, "", scrubLimiters(cfg))
+	return checksum, err
+}
+
+// scrubStoredCopy re-hashes the stored bytes of an encrypted copy that cannot be decrypted at the destination and
+// compares them with the checksum recorded when the copy was written.
+//
+// Parameters:
+// - ctx: The context to control the scrubbing lifecycle.
+// - db: The database connection to track copied files.
+// - cfg: The configuration the copy belongs to.
+// - record: The recorded copy.
+// - destPath: The path of the copy at the destination.
+//
+// Returns:
+// - string: The outcome of the scrub.
+func scrubStoredCopy(ctx context.Context, db *sql.DB, cfg Configuration, record CopiedFileRecord, destPath string) string {
+	checksum, _, err := calculateChecksums(ctx, destPath, cfg.checksumAlgorithm(), "", scrubLimiters(cfg))
+	if err != nil {
+		if ctx.Err() == nil {
+			LogWithDatetime(fmt.Sprintf("Error scrubbing %s: %v", destPath, err), true)
+			sendSlackNotification(fmt.Sprintf("Error scrubbing %s: %v", destPath, err))
+		}
+		return ScrubError
+	}
+
+	if record.StoredChecksum == "" || normalizeChecksumAlgorithm(record.ChecksumAlgorithm) != cfg.checksumAlgorithm() {
+		dbMutex.Lock()
+		UpdateCopiedFileStoredChecksum(db, record.FilePath, record.Destination, checksum)
+		dbMutex.Unlock()
+		LogWithDatetime(fmt.Sprintf("Scrub recorded stored checksum for %s", destPath), false)
+		return ScrubBaseline
+	}
+	if checksum == record.StoredChecksum {
+		LogWithDatetime(fmt.Sprintf("Scrub verified %s", destPath), false)
+		return ScrubOK
+	}
+
+	LogWithDatetime(fmt.Sprintf("Scrub found copy changed: %s", destPath), true)
+	sendSlackNotification(fmt.Sprintf("Scrub found copy changed: %s", destPath))
+	return repairCopy(ctx, db, cfg, record, destPath, ScrubChanged)
+}
+
+// scrubLimiters returns the rate limiters that apply to scrubbing the destinations of a configuration.
+//
+// Parameters:
+// - cfg: The configuration being scrubbed.
+//
+// Returns:
+// - []*RateLimiter: The scrub rate limiter of the configuration.
+func scrubLimiters(cfg Configuration) []*RateLimiter {
+	return []*RateLimiter{getRateLimiter("scrub:"+cfg.Name, cfg.Scrub.RateLimit)}
+}
+
+// repairCopy restores a damaged or missing copy from the source or from another destination, as configured.
+// A candidate is only used if its content matches the checksum recorded for the copy.
+//
+// Parameters:
+// - ctx: The context to control the repair lifecycle.
+// - db: The database connection to track copied files.
+// - cfg: The configuration the copy belongs to.
+// - record: The recorded copy.
+// - destPath: The path of the copy at the destination.
+// - status: The outcome to report if the copy is not repaired.
+//
+// Returns:
+// - string: ScrubRepaired if the copy was restored, otherwise status.
+func repairCopy(ctx context.Context, db *sql.DB, cfg Configuration, record CopiedFileRecord, destPath, status string) string {
+	if record.Checksum == "" || normalizeChecksumAlgorithm(record.ChecksumAlgorithm) != digestAlgorithm(cfg.checksumAlgorithm(), record.IsFolder) {
+		return status
+	}
+
+	for _, candidate := range repairCandidates(db, cfg, record) {
+		err := restoreCopy(ctx, db, cfg, candidate, destPath, record)
+		if err == nil && cfg.destinationConfig(record.Destination).storedSuffix(record.IsFolder) != "" {
+			// Encrypted copies are never written the same way twice, so the new stored bytes are recorded.
+			var storedChecksum string
+			if storedChecksum, err = CalculateFileChecksum(destPath, cfg.checksumAlgorithm()); err == nil {
+				dbMutex.Lock()
+				UpdateCopiedFileStoredChecksum(db, record.FilePath, record.Destination, storedChecksum)
+				dbMutex.Unlock()
+			}
+		}
+		if err == nil {
+			LogWithDatetime(fmt.Sprintf("Repaired %s from %s", destPath, candidate), true)
+			sendSlackNotification(fmt.Sprintf("Repaired %s from %s", destPath, candidate))
+			return ScrubRepaired
+		}
+		LogWithDatetime(fmt.Sprintf("Could not repair %s from %s: %v", destPath, candidate, err), true)
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return status
+}
+
+// repairCandidates lists the paths a copy can be repaired from, following the repair setting of the configuration.
+// Other destinations are only listed if their recorded checksum matches the copy.
+//
+// Parameters:
+// - db: The database connection to track copied files.
+// - cfg: The configuration the copy belongs to.
+// - record: The recorded copy.
+//
+// Returns:
+// - []string: The candidate paths, the source first.
+func repairCandidates(db *sql.DB, cfg Configuration, record CopiedFileRecord) []string {
+	var candidates []string
+	repair := cfg.Scrub.Repair
+	if repair == RepairSource || repair == RepairAny {
+		if _, err := os.Stat(record.FilePath); err == nil {
+			candidates = append(candidates, record.FilePath)
+		}
+	}
+	if repair == RepairDestination || repair == RepairAny {
+		copies, err := GetCopiesOf(db, record.FilePath)
+		if err != nil {
+			LogWithDatetime(fmt.Sprintf("Error getting copies of %s: %v", record.FilePath, err), true)
+			return candidates
+		}
+		for _, other := range copies {
+			if other.Destination == record.Destination || other.Checksum != record.Checksum || other.ChecksumAlgorithm != record.ChecksumAlgorithm {
+				continue
+			}
+			if otherPath, ok := cfg.destinationPath(other.FilePath, other.Destination, other.IsFolder); ok {
+				candidates = append(candidates, otherPath)
+			}
+		}
+	}
+	return candidates
+}
+
+// restoreCopy copies a candidate over a damaged or missing copy. The candidate is written next to the copy first and
+// only replaces it if its checksum matches the one recorded for the copy.
+//
+// Parameters:
+// - ctx: The context to control the repair lifecycle.
+// - db: The database connection to track copied files.
+// - cfg: The configuration the copy belongs to.
+// - candidate: The path to restore from.
+// - destPath: The path of the copy at the destination.
+// - record: The recorded copy.
+//
+// Returns:
+// - error: An error object if the candidate could not be copied or does not match.
+func restoreCopy(ctx context.Context, db *sql.DB, cfg Configuration, candidate, destPath string, record CopiedFileRecord) error {
+	opts := CopyOptions{
+		Limiters: scrubLimiters(cfg),
+		Engine:   cfg.destinationConfig(record.Destination).IOEngine,
+		Sync:     cfg.destinationConfig(record.Destination).durable(),
+		Checksum: cfg.checksumAlgorithm(),
+	}
+	metadata := cfg.destinationConfig(record.Destination).Metadata
+
+	if cfg.destinationConfig(record.Destination).layout() == LayoutContentAddressed {
+		// The candidate is checked before it is stored, because storing it relinks every path sharing its content.
+		checksum, _, err := calculateChecksums(ctx, candidate, opts.Checksum, "", opts.Limiters)
+		if record.IsFolder {
+			var manifest Manifest
+			manifest, err = walkManifest(ctx, candidate, opts.Checksum, "", true, opts.Limiters)
+			checksum = manifest.Digest()
+		}
+		if err != nil {
+			return err
+		}
+		if checksum != record.Checksum {
+			return fmt.Errorf("checksum %s does not match the recorded checksum", checksum)
+		}
+		members, results, err := storeCopy(ctx, db, cfg, candidate, destPath, record.Destination, opts, record.IsFolder, true)
+		if err != nil {
+			return err
+		}
+		dbMutex.Lock()
+		err = ReplaceStoreLinks(db, record.Destination, record.FilePath, storeLinks(destPath, members, results))
+		dbMutex.Unlock()
+		return err
+	} else if format := cfg.destinationConfig(record.Destination).bundleArchive(record.IsFolder); format != "" {
+		if err := repairArchive(ctx, candidate, destPath, format, record, opts); err != nil {
+			return err
+		}
+	} else if !record.IsFolder {
+		// A compressed copy at another destination is copied as is and checked by decompressing it. Encrypted copies
+		// are only repaired from plain files, since a copy can be encrypted without the identity that decrypts it.
+		settings := cfg.destinationConfig(record.Destination)
+		compression := settings.compression(false)
+		encryption := settings.encryption(false)
+		if strings.HasSuffix(candidate, encryptedSuffix) || (encryption != "" && strings.HasSuffix(candidate, compressedSuffix)) {
+			return fmt.Errorf("encrypted copies are only repaired from plain files")
+		}
+		if !strings.HasSuffix(candidate, compressedSuffix) {
+			opts.Compression = compression
+			opts.Encryption = encryption
+			if encryption != "" {
+				recipients, err := settings.recipients()
+				if err != nil {
+					return err
+				}
+				opts.Recipients = recipients
+			}
+		}
+		result, err := CopyFileWithOptions(ctx, candidate, destPath, opts)
+		if err != nil {
+			return err
+		}
+		checksum := result.Checksum
+		if compression != "" && opts.Compression == "" {
+			checksum, _, err = decodeFile(ctx, destPath+".cat.part", compression, nil, opts.Checksum, opts.Limiters, nil)
+		}
+		if err != nil || checksum != record.Checksum {
+			os.Remove(destPath + ".cat.part")
+			if err != nil {
+				return err
+			}
+			return fmt.Errorf("checksum %s does not match the recorded checksum", checksum)
+		}
+		logMetadataError(destPath, PreserveMetadata(candidate, destPath+".cat.part", metadata))
+		if err := os.Rename(destPath+".cat.part", destPath); err != nil {
+			return err
+		}
+	} else {
+		stagingPath := destPath + ".cat.part"
+		if err := os.RemoveAll(stagingPath); err != nil {
+			return err
+		}
+		members, _, err := stageBundleDirectories(candidate, stagingPath)
+		if err != nil {
+			return err
+		}
+		results, err := copyBundleMembers(ctx, candidate, stagingPath, members, opts, VerifyFull, cfg.bundleWorkers())
+		if err != nil {
+			os.RemoveAll(stagingPath)
+			return err
+		}
+		entries := make([]ManifestEntry, len(results))
+		for i, result := range results {
+			entries[i] = ManifestEntry{Path: filepath.ToSlash(members[i]), Size: result.Size, Checksum: result.Checksum}
+		}
+		if digest := newManifest(opts.Checksum, "", entries).Digest(); digest != record.Checksum {
+			os.RemoveAll(stagingPath)
+			return fmt.Errorf("manifest digest %s does not match the recorded checksum", digest)
+		}
+		logMetadataError(destPath, preserveTreeMetadata(candidate, stagingPath, metadata))
+		if opts.Sync {
+			if err := syncTree(stagingPath); err != nil {
+				return err
+			}
+		}
+
+		// The damaged copy is moved aside rather than removed, so it is only lost once the repair is in place.
+		damagedPath := destPath + ".cat.damaged"
+		if err := os.RemoveAll(damagedPath); err != nil {
+			return err
+		}
+		if err := os.Rename(destPath, damagedPath); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if err := os.Rename(stagingPath, destPath); err != nil {
+			return err
+		}
+		os.RemoveAll(damagedPath)
+	}
+
+	if opts.Sync {
+		return syncDir(filepath.Dir(destPath))
+	}
+	return nil
+}
@@ -0,0 +1,153 @@
+package catapult
+
+import (
+	"context"
+	"database/sql"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// recordScrubTestCopy writes a file to a source directory and a destination and records the copy.
+func recordScrubTestCopy(t *testing.T, db *sql.DB, src, destination, name string, content []byte) string {
+	t.Helper()
+	file := filepath.Join(src, name)
+	if err := os.WriteFile(file, content, 0644); err != nil {
+		t.Fatalf("Failed to create test file: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(destination, name), content, 0644); err != nil {
+		t.Fatalf("Failed to create test copy: %v", err)
+	}
+	checksum, _ := CalculateFileHash(file)
+	MarkFileAsCopied(db, file, destination, false)
+	UpdateCopiedFileChecksumWithAlgorithm(db, file, destination, checksum, ChecksumSHA256)
+	return file
+}
+
+func scrubStatus(t *testing.T, db *sql.DB, file, destination string) string {
+	t.Helper()
+	var status sql.NullString
+	err := db.QueryRow(`SELECT scrub_status FROM copied_files WHERE file_path = ? AND destination = ?`, file, destination).Scan(&status)
+	if err != nil {
+		t.Fatalf("Failed to query scrub status: %v", err)
+	}
+	return status.String
+}
+
+func TestScrubDestinations(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+
+	tmpDir := t.TempDir()
+	src := filepath.Join(tmpDir, "scrub_src")
+	destination := filepath.Join(tmpDir, "scrub_dst")
+	os.MkdirAll(src, 0755)
+	os.MkdirAll(destination, 0755)
+
+	intact := recordScrubTestCopy(t, db, src, destination, "intact.raw", []byte("intact"))
+	changed := recordScrubTestCopy(t, db, src, destination, "changed.raw", []byte("original"))
+	missing := recordScrubTestCopy(t, db, src, destination, "missing.raw", []byte("missing"))
+	os.WriteFile(filepath.Join(destination, "changed.raw"), []byte("tampered"), 0644)
+	os.Remove(filepath.Join(destination, "missing.raw"))
+
+	cfg := Configuration{Name: "scrub", Directories: []string{src}, Destinations: []string{destination}}
+	scrubDue(context.Background(), db, cfg, time.Hour)
+
+	for file, want := range map[string]string{intact: ScrubOK, changed: ScrubChanged, missing: ScrubMissing} {
+		if got := scrubStatus(t, db, file, destination); got != want {
+			t.Errorf("scrub status of %s = %q, want %q", filepath.Base(file), got, want)
+		}
+	}
+
+	// Scrubbed copies are not due again until the interval has passed.
+	if records, _ := GetScrubCandidates(db, cfg.Destinations, time.Now().Add(-time.Hour)); len(records) != 0 {
+		t.Fatalf("Expected no copies due for scrubbing, got %d", len(records))
+	}
+
+	cfg.Scrub.Repair = RepairSource
+	db.Exec(`UPDATE copied_files SET last_scrubbed = NULL`)
+	scrubDue(context.Background(), db, cfg, time.Hour)
+	for _, name := range []string{"changed.raw", "missing.raw"} {
+		content, err := os.ReadFile(filepath.Join(destination, name))
+		want, _ := os.ReadFile(filepath.Join(src, name))
+		if err != nil || string(content) != string(want) {
+			t.Errorf("%s not repaired: %q, %v", name, content, err)
+		}
+	}
+	if got := scrubStatus(t, db, changed, destination); got != ScrubRepaired {
+		t.Errorf("scrub status after repair = %q, want %q", got, ScrubRepaired)
+	}
+}
+
+func TestScrubBaselineFromSource(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+
+	tmpDir := t.TempDir()
+	src := filepath.Join(tmpDir, "src")
+	destination := filepath.Join(tmpDir, "dst")
+	os.MkdirAll(src, 0755)
+	os.MkdirAll(destination, 0755)
+
+	// Copies recorded without a checksum: one intact, one damaged and one whose source is gone.
+	intact := recordScrubTestCopy(t, db, src, destination, "intact.raw", []byte("intact"))
+	damaged := recordScrubTestCopy(t, db, src, destination, "damaged.raw", []byte("original"))
+	orphan := recordScrubTestCopy(t, db, src, destination, "orphan.raw", []byte("orphan"))
+	db.Exec(`UPDATE copied_files SET checksum = NULL, checksum_algorithm = NULL`)
+	os.WriteFile(filepath.Join(destination, "damaged.raw"), []byte("damaged!"), 0644)
+	os.Remove(orphan)
+
+	cfg := Configuration{Name: "scrub", Directories: []string{src}, Destinations: []string{destination}}
+	scrubDue(context.Background(), db, cfg, time.Hour)
+
+	for file, want := range map[string]string{intact: ScrubBaseline, damaged: ScrubChanged, orphan: ScrubUnverified} {
+		if got := scrubStatus(t, db, file, destination); got != want {
+			t.Errorf("scrub status of %s = %q, want %q", filepath.Base(file), got, want)
+		}
+	}
+	expected, _ := CalculateFileHash(damaged)
+	if checksum, _ := GetCopiedFileChecksumFor(db, damaged, destination, ChecksumSHA256); checksum != expected {
+		t.Fatalf("Recorded checksum %q, want the checksum of the source %q", checksum, expected)
+	}
+}
+
+func TestScrubRepairsFolderFromDestination(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+
+	tmpDir := t.TempDir()
+	src := filepath.Join(tmpDir, "src")
+	folder := filepath.Join(src, "run.d")
+	good := filepath.Join(tmpDir, "good")
+	bad := filepath.Join(tmpDir, "bad")
+	os.MkdirAll(filepath.Join(folder, "sub"), 0755)
+	os.WriteFile(filepath.Join(folder, "a.bin"), []byte("alpha"), 0644)
+	os.WriteFile(filepath.Join(folder, "sub", "b.bin"), []byte("beta"), 0644)
+
+	cfg := Configuration{
+		Name:         "scrub_folder",
+		Directories:  []string{src},
+		Destinations: []string{good, bad},
+		Scrub:        ScrubConfig{Repair: RepairDestination},
+	}
+	for _, destination := range cfg.Destinations {
+		copyBundleWithVerification(context.Background(), db, cfg, folder, filepath.Join(destination, "run.d"), destination, CopyOptions{})
+	}
+	// The source is gone, so only the good destination can repair the bad one.
+	os.RemoveAll(folder)
+	os.WriteFile(filepath.Join(bad, "run.d", "sub", "b.bin"), []byte("BETA"), 0644)
+
+	scrubDue(context.Background(), db, cfg, time.Hour)
+
+	if got := scrubStatus(t, db, folder, bad); got != ScrubRepaired {
+		t.Fatalf("scrub status = %q, want %q", got, ScrubRepaired)
+	}
+	content, err := os.ReadFile(filepath.Join(bad, "run.d", "sub", "b.bin"))
+	if err != nil || string(content) != "beta" {
+		t.Fatalf("Folder member not repaired: %q, %v", content, err)
+	}
+	if _, err := os.Stat(filepath.Join(bad, "run.d.cat.damaged")); !os.IsNotExist(err) {
+		t.Fatalf("Expected damaged copy to be removed after repair")
+	}
+}
@@ -0,0 +1,229 @@
+package catapult
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// Checksum files that can be written at a destination. Both are compatible with `sha256sum -c`.
+const (
+	// ChecksumFileSidecar writes a <name>.sha256 file next to each copied file or bundle directory.
+	ChecksumFileSidecar = "sidecar"
+	// ChecksumFileSums keeps a SHA256SUMS file in each destination directory with a line per copied file.
+	ChecksumFileSums = "sha256sums"
+)
+
+// sha256SumsName is the name of the per-directory checksum list.
+const sha256SumsName = "SHA256SUMS"
+
+// checksumFileMutex serializes updates of SHA256SUMS files, which are shared by every file in a directory.
+var checksumFileMutex sync.Mutex
+
+// writeChecksumFiles writes the checksum files configured for a destination after a copy was renamed into place.
+// Files are written atomically, and existing lines for the copy are replaced so that an overwritten copy is listed
+// with its new checksum.
+//
+// Parameters:
+// - cfg: The configuration the copy belongs to.
+// - destination: The destination directory.
+// - destPath: The final path of the copied file or bundle directory.
+// - entries: The files of the copy with paths relative to destPath, or a single entry with an empty path for a file.
+// - algorithm: The checksum algorithm of the entries.
+// - secondary: The secondary checksum algorithm of the entries, or an empty string for none.
+func writeChecksumFiles(cfg Configuration, destination, destPath string, entries []ManifestEntry, algorithm, secondary string) {
+	mode := cfg.destinationConfig(destination).ChecksumFile
+	if mode == "" {
+		return
+	}
+
+	dir := filepath.Dir(destPath)
+	name := filepath.Base(destPath)
+	var lines []string
+	for _, entry := range entries {
+		path := name
+		if entry.Path != "" {
+			path = name + "/" + entry.Path
+		}
+		checksum, err := checksumOf(filepath.Join(dir, filepath.FromSlash(path)), entry, algorithm, secondary, ChecksumSHA256)
+		if err != nil {
+			logChecksumFileError(destPath, err)
+			return
+		}
+		lines = append(lines, sha256sumLine(checksum, path))
+	}
+
+	durable := cfg.destinationConfig(destination).durable()
+	var err error
+	switch mode {
+	case ChecksumFileSidecar:
+		err = writeFileAtomic(destPath+".sha256", []byte(strings.Join(lines, "")), durable)
+	case ChecksumFileSums:
+		err = updateSha256Sums(filepath.Join(dir, sha256SumsName), name, lines, durable)
+	default:
+		err = fmt.Errorf("unknown checksum file mode: %s", mode)
+	}
+	logChecksumFileError(destPath, err)
+}
+
+// checksumOf returns a checksum of a copied file, reusing the checksums computed during the copy if one of them uses
+// the wanted algorithm and hashing the copy otherwise.
+//
+// Parameters:
+// - path: The path of the copied file.
+// - entry: The checksums of the file.
+// - algorithm: The checksum algorithm of the entry.
+// - secondary: The secondary checksum algorithm of the entry.
+// - wanted: The checksum algorithm to return a checksum for.
+//
+// Returns:
+// - string: The checksum in hexadecimal format.
+// - error: An error object if the copy could not be hashed.
+func checksumOf(path string, entry ManifestEntry, algorithm, secondary, wanted string) (string, error) {
+	if normalizeChecksumAlgorithm(algorithm) == wanted && entry.Checksum != "" {
+		return entry.Checksum, nil
+	}
+	if secondary == wanted && entry.SecondaryChecksum != "" {
+		return entry.SecondaryChecksum, nil
+	}
+	return CalculateFileChecksum(path, wanted)
+}
+
+// sha256sumLine formats a line of a checksum file in the format read by `sha256sum -c`. Names containing a backslash
+// or a newline are escaped the same way sha256sum escapes them.
+//
+// Parameters:
+// - checksum: The SHA-256 checksum in hexadecimal format.
+// - path: The path of the file relative to the checksum file, with forward slashes.
+//
+// Returns:
+// - string: The line, including the trailing newline.
+func sha256sumLine(checksum, path string) string {
+	if strings.ContainsAny(path, "\\\n\r") {
+		escaped := strings.NewReplacer("\\", "\\\\", "\n", "\\n", "\r", "\\r").Replace(path)
+		return fmt.Sprintf("\\%s  %s\n", checksum, escaped)
+	}
+	return fmt.Sprintf("%s  %s\n", checksum, path)
+}
+
+// sha256sumPath returns the unescaped path of a line of a checksum file.
+//
+// Parameters:
+// - line: The line without its trailing newline.
+//
+// Returns:
+// - string: The path of the line, or an empty string if the line is malformed.
+func sha256sumPath(line string) string {
+	escaped := strings.HasPrefix(line, "\\")
+	if escaped {
+		line = line[1:]
+	}
+	parts := strings.SplitN(line, " ", 2)
+	if len(parts) != 2 {
+		return ""
+	}
+	// The path follows a space and either a second space (text mode) or an asterisk (binary mode).
+	path := strings.TrimPrefix(strings.TrimPrefix(parts[1], " "), "*")
+	if escaped {
+		path = strings.NewReplacer("\\\\", "\\", "\\n", "\n", "\\r", "\r").Replace(path)
+	}
+	return path
+}
+
+// updateSha256Sums replaces the lines of a copy in a SHA256SUMS file. Lines for the copy itself and, for a bundle
+// directory, for any of its members are removed before the new lines are appended.
+//
+// Parameters:
+// - listPath: The path of the SHA256SUMS file.
+// - name: The name of the copied file or bundle directory.
+// - lines: The new lines for the copy.
+// - durable: Boolean indicating if the file is flushed to stable storage.
+//
+// Returns:
+// - error: An error object if the file could not be read or written.
+func updateSha256Sums(listPath, name string, lines []string, durable bool) error {
+	checksumFileMutex.Lock()
+	defer checksumFileMutex.Unlock()
+
+	var kept []string
+	file, err := os.Open(listPath)
+	if err == nil {
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			line := scanner.Text()
+			path := sha256sumPath(line)
+			if path == name || strings.HasPrefix(path, name+"/") {
+				continue
+			}
+			kept = append(kept, line+"\n")
+		}
+		err = scanner.Err()
+		file.Close()
+		if err != nil {
+			return err
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	return writeFileAtomic(listPath, []byte(strings.Join(append(kept, lines...), "")), durable)
+}
+
+// writeFileAtomic writes a file through a temporary file that is renamed into place, so that readers never see a
+// partially written file.
+//
+// Parameters:
+// - path: The path of the file.
+// - content: The content of the file.
+// - durable: Boolean indicating if the file and its directory are flushed to stable storage.
+//
+// Returns:
+// - error: An error object if the file could not be written.
+func writeFileAtomic(path string, content []byte, durable bool) error {
+	tmpPath := path + ".cat.part"
+	file, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(content); err != nil {
+		file.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+	if durable {
+		if err := file.Sync(); err != nil {
+			file.Close()
+			os.Remove(tmpPath)
+			return err
+		}
+	}
+	if err := file.Close(); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	if durable {
+		return syncDir(filepath.Dir(path))
+	}
+	return nil
+}
+
+// logChecksumFileError logs and reports an error writing a checksum file. A missing checksum file does not fail
+// the copy it describes.
+//
+// Parameters:
+// - destPath: The path of the copy the checksum file describes.
+// - err: The error, or nil.
+func logChecksumFileError(destPath string, err error) {
+	if err == nil {
+		return
+	}
+	LogWithDatetime(fmt.Sprintf("Error writing checksum file for %s: %v", destPath, err), true)
+	sendSlackNotification(fmt.Sprintf("Error writing checksum file for %s: %v", destPath, err))
+}
@@ -0,0 +1,77 @@
+package catapult
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// checkSha256sum runs sha256sum -c on a checksum file if sha256sum is available.
+func checkSha256sum(t *testing.T, dir, listName string) {
+	t.Helper()
+	if _, err := exec.LookPath("sha256sum"); err != nil {
+		return
+	}
+	cmd := exec.Command("sha256sum", "-c", listName)
+	cmd.Dir = dir
+	if output, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("sha256sum -c %s failed: %v\n%s", listName, err, output)
+	}
+}
+
+func TestWriteChecksumFilesSidecar(t *testing.T) {
+	destination := t.TempDir()
+	destPath := filepath.Join(destination, "run.d")
+	os.MkdirAll(filepath.Join(destPath, "sub"), 0755)
+	os.WriteFile(filepath.Join(destPath, "a.bin"), []byte("alpha"), 0644)
+	os.WriteFile(filepath.Join(destPath, "sub", "b.bin"), []byte("beta"), 0644)
+
+	// The bundle was hashed with xxh3, so the SHA-256 checksums are computed from the copy.
+	manifest, err := BuildManifest(destPath, ChecksumXXH3, "")
+	if err != nil {
+		t.Fatalf("BuildManifest() error: %v", err)
+	}
+	cfg := Configuration{DestinationSettings: map[string]DestinationConfig{destination: {ChecksumFile: ChecksumFileSidecar}}}
+	writeChecksumFiles(cfg, destination, destPath, manifest.Entries, manifest.Algorithm, "")
+
+	content, err := os.ReadFile(destPath + ".sha256")
+	if err != nil {
+		t.Fatalf("Failed to read sidecar: %v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(content)), "\n")
+	if len(lines) != 2 || !strings.HasSuffix(lines[0], "  run.d/a.bin") || !strings.HasSuffix(lines[1], "  run.d/sub/b.bin") {
+		t.Fatalf("Unexpected sidecar content:\n%s", content)
+	}
+	checkSha256sum(t, destination, "run.d.sha256")
+}
+
+func TestWriteChecksumFilesSums(t *testing.T) {
+	destination := t.TempDir()
+	cfg := Configuration{DestinationSettings: map[string]DestinationConfig{destination: {ChecksumFile: ChecksumFileSums}}}
+
+	write := func(name, content string) {
+		destPath := filepath.Join(destination, name)
+		os.WriteFile(destPath, []byte(content), 0644)
+		checksum, _ := CalculateFileHash(destPath)
+		writeChecksumFiles(cfg, destination, destPath, []ManifestEntry{{Checksum: checksum}}, ChecksumSHA256, "")
+	}
+	write("first.raw", "first")
+	write("second.raw", "second")
+	write("with\\backslash.raw", "escaped")
+	// Overwriting a file replaces its line instead of adding another.
+	write("first.raw", "first, overwritten")
+
+	content, err := os.ReadFile(filepath.Join(destination, sha256SumsName))
+	if err != nil {
+		t.Fatalf("Failed to read SHA256SUMS: %v", err)
+	}
+	if count := strings.Count(string(content), "first.raw"); count != 1 {
+		t.Fatalf("first.raw listed %d times:\n%s", count, content)
+	}
+	if count := strings.Count(string(content), "\n"); count != 3 {
+		t.Fatalf("Expected 3 lines, got %d:\n%s", count, content)
+	}
+	checkSha256sum(t, destination, sha256SumsName)
+}
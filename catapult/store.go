@@ -0,0 +1,444 @@
+package catapult
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+
+	"github.com/schollz/progressbar/v3"
+)
+
+// storeDirName is the directory at the root of a content-addressed destination that holds its objects.
+const storeDirName = ".catapult-store"
+
+// EngineLinked is recorded as the I/O engine of a copy whose content was already stored, so that only a link was
+// created.
+const EngineLinked = "link"
+
+// storeIncoming numbers the copies staged in the store before their checksum is known.
+var storeIncoming atomic.Int64
+
+// storeLocks serializes the writers of each object, so that two files with the same content are not stored at once.
+var storeLocks sync.Map
+
+// StoreObject is an object in the store of a content-addressed destination.
+type StoreObject struct {
+	Checksum  string
+	Algorithm string
+	Size      int64
+}
+
+// StoreLink is a path of a content-addressed destination and the object it is linked to.
+type StoreLink struct {
+	Path string
+	StoreObject
+}
+
+// storeObjectPath returns the path of an object in the store of a destination. Objects are fanned out over two
+// directory levels named after the first four characters of their checksum.
+//
+// Parameters:
+// - destination: The destination directory.
+// - algorithm: The checksum algorithm.
+// - checksum: The checksum of the content in hexadecimal format.
+//
+// Returns:
+// - string: The path of the object.
+func storeObjectPath(destination, algorithm, checksum string) string {
+	dir := filepath.Join(destination, storeDirName, "objects", algorithm)
+	if len(checksum) >= 4 {
+		dir = filepath.Join(dir, checksum[:2], checksum[2:4])
+	}
+	return filepath.Join(dir, checksum)
+}
+
+// lockStoreObject locks an object for writing.
+//
+// Parameters:
+// - objectPath: The path of the object.
+//
+// Returns:
+// - func(): A function that unlocks the object.
+func lockStoreObject(objectPath string) func() {
+	lock, _ := storeLocks.LoadOrStore(objectPath, &sync.Mutex{})
+	lock.(*sync.Mutex).Lock()
+	return lock.(*sync.Mutex).Unlock
+}
+
+// storeObject stores a file in the object store of a destination and hardlinks linkPath to it. If an object of the
+// same size is stored, the file is hashed first and only copied if none of them has the same checksum, so duplicate
+// content costs neither space nor transfer. Otherwise the content cannot be stored yet, and the file is copied into
+// the store while it is hashed and then renamed to its checksum, so that it is read once. A damaged object that is
+// replaced is relinked at every path recorded for it.
+//
+// Parameters:
+// - ctx: The context to control the copying lifecycle.
+// - db: The database connection holding the catalog of the store.
+// - destination: The destination directory.
+// - src: The source file.
+// - linkPath: The path to link to the object.
+// - opts: The options for copying the file.
+// - verification: The verification mode applied to a newly stored object.
+// - metadata: The metadata applied to a newly stored object, which is shared by all of its links.
+// - recheck: Boolean indicating if a stored object is hashed before it is reused, rather than only compared by size.
+//
+// Returns:
+// - CopyResult: The size and checksums of the file, and EngineLinked as the engine if its content was stored already.
+// - error: An error object if the file could not be stored or linked.
+func storeObject(ctx context.Context, db *sql.DB, destination, src, linkPath string, opts CopyOptions, verification string, metadata MetadataConfig, recheck bool) (CopyResult, error) {
+	info, err := os.Stat(src)
+	if err != nil {
+		return CopyResult{}, err
+	}
+	algorithm := normalizeChecksumAlgorithm(opts.Checksum)
+	candidate, err := HasStoreObjectOfSize(db, destination, algorithm, info.Size())
+	if err != nil {
+		return CopyResult{}, err
+	}
+
+	var result CopyResult
+	var staged string
+	if candidate {
+		checksum, secondary, err := calculateChecksums(ctx, src, algorithm, opts.SecondaryChecksum, nil)
+		if err != nil {
+			return CopyResult{}, err
+		}
+		result = CopyResult{
+			Size:               info.Size(),
+			Checksum:           checksum,
+			Algorithm:          algorithm,
+			SecondaryChecksum:  secondary,
+			SecondaryAlgorithm: opts.SecondaryChecksum,
+		}
+	} else {
+		// A staged copy has a name of its own, so it is never resumed.
+		incoming := filepath.Join(destination, storeDirName, "incoming", fmt.Sprintf("%d.%d", os.Getpid(), storeIncoming.Add(1)))
+		stagedOptions := opts
+		stagedOptions.Resume = false
+		result, err = CopyFileWithOptions(ctx, src, incoming, stagedOptions)
+		staged = incoming + ".cat.part"
+		defer os.Remove(staged)
+		if err != nil {
+			return CopyResult{}, err
+		}
+	}
+
+	objectPath := storeObjectPath(destination, algorithm, result.Checksum)
+	unlock := lockStoreObject(objectPath)
+	defer unlock()
+
+	objectInfo, statErr := os.Stat(objectPath)
+	intact := statErr == nil && objectInfo.Size() == result.Size
+	if intact && recheck {
+		storedChecksum, err := CalculateFileChecksum(objectPath, algorithm)
+		if err != nil {
+			return CopyResult{}, err
+		}
+		intact = storedChecksum == result.Checksum
+	}
+	if intact {
+		result.Engine = EngineLinked
+	} else {
+		if err := os.MkdirAll(filepath.Dir(objectPath), os.ModePerm); err != nil {
+			return CopyResult{}, err
+		}
+		if staged == "" {
+			copied, err := CopyFileWithOptions(ctx, src, objectPath, opts)
+			staged = objectPath + ".cat.part"
+			if err == nil && copied.Checksum != result.Checksum {
+				err = fmt.Errorf("source file %s changed while copying", src)
+			}
+			if err != nil {
+				os.Remove(staged)
+				return CopyResult{}, err
+			}
+			result.Engine = copied.Engine
+		}
+		if err := VerifyCopy(verification, src, staged, result.Size, result.Checksum, algorithm); err != nil {
+			os.Remove(staged)
+			return CopyResult{}, err
+		}
+		logMetadataError(objectPath, PreserveMetadata(src, staged, metadata))
+		if err := os.Rename(staged, objectPath); err != nil {
+			return CopyResult{}, err
+		}
+		if opts.Sync {
+			if err := syncDir(filepath.Dir(objectPath)); err != nil {
+				return CopyResult{}, err
+			}
+		}
+
+		dbMutex.Lock()
+		SaveStoreObject(db, destination, algorithm, result.Checksum, result.Size)
+		dbMutex.Unlock()
+		if statErr == nil {
+			// The damaged object was replaced, so the paths still linked to it are moved to the new one.
+			relinkStoreObject(db, destination, algorithm, result.Checksum, objectPath)
+		}
+	}
+
+	if err := linkStoreObject(objectPath, linkPath); err != nil {
+		return CopyResult{}, err
+	}
+	return result, nil
+}
+
+// linkStoreObject hardlinks a path to an object. The link is created next to the path first and renamed over it, so
+// an existing file at the path is replaced atomically.
+//
+// Parameters:
+// - objectPath: The path of the object.
+// - linkPath: The path to link to the object.
+//
+// Returns:
+// - error: An error object if the link could not be created.
+func linkStoreObject(objectPath, linkPath string) error {
+	objectInfo, err := os.Stat(objectPath)
+	if err != nil {
+		return err
+	}
+	if linkInfo, err := os.Stat(linkPath); err == nil && os.SameFile(objectInfo, linkInfo) {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(linkPath), os.ModePerm); err != nil {
+		return err
+	}
+	partPath := linkPath + ".cat.part"
+	os.Remove(partPath)
+	if err := os.Link(objectPath, partPath); err != nil {
+		return err
+	}
+	if err := os.Rename(partPath, linkPath); err != nil {
+		os.Remove(partPath)
+		return err
+	}
+	return nil
+}
+
+// relinkStoreObject links every path recorded for an object to its current file.
+//
+// Parameters:
+// - db: The database connection holding the catalog of the store.
+// - destination: The destination directory.
+// - algorithm: The checksum algorithm of the object.
+// - checksum: The checksum of the object.
+// - objectPath: The path of the object.
+func relinkStoreObject(db *sql.DB, destination, algorithm, checksum, objectPath string) {
+	links, err := GetStoreObjectLinks(db, destination, algorithm, checksum)
+	if err != nil {
+		LogWithDatetime(fmt.Sprintf("Error getting links of %s: %v", objectPath, err), true)
+		return
+	}
+	for _, link := range links {
+		if err := linkStoreObject(objectPath, link); err != nil {
+			LogWithDatetime(fmt.Sprintf("Error relinking %s to %s: %v", link, objectPath, err), true)
+		}
+	}
+}
+
+// storeCopy stores a file or the members of a bundle directory in the object store of a destination and links their
+// mirrored paths to the objects. A bundle is linked in a staging directory that is renamed into place once every
+// member is stored. The caller records the links in the catalog.
+//
+// Parameters:
+// - ctx: The context to control the copying lifecycle.
+// - db: The database connection holding the catalog of the store.
+// - cfg: The configuration the copy belongs to.
+// - source: The source file or bundle directory.
+// - destPath: The mirrored path of the copy at the destination.
+// - destination: The destination directory.
+// - opts: The options for copying each file.
+// - isFolder: Boolean indicating if the source is a bundle directory.
+// - recheck: Boolean indicating if stored objects are hashed before they are reused.
+//
+// Returns:
+// - []string: The member paths relative to the bundle directory, or a single empty path for a file.
+// - []CopyResult: The result of each member, in the same order.
+// - error: An error object if the copy could not be stored.
+func storeCopy(ctx context.Context, db *sql.DB, cfg Configuration, source, destPath, destination string, opts CopyOptions, isFolder, recheck bool) ([]string, []CopyResult, error) {
+	verification := cfg.verificationMode(destination)
+	metadata := cfg.destinationConfig(destination).Metadata
+
+	if !isFolder {
+		result, err := storeObject(ctx, db, destination, source, destPath, opts, verification, metadata, recheck)
+		if err != nil {
+			return nil, nil, err
+		}
+		return []string{""}, []CopyResult{result}, nil
+	}
+
+	stagingPath := destPath + ".cat.part"
+	if err := os.RemoveAll(stagingPath); err != nil {
+		return nil, nil, err
+	}
+	members, _, err := stageBundleDirectories(source, stagingPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	results := make([]CopyResult, len(members))
+	for i, member := range members {
+		result, err := storeObject(ctx, db, destination, filepath.Join(source, member), filepath.Join(stagingPath, member), opts, verification, metadata, recheck)
+		if err != nil {
+			os.RemoveAll(stagingPath)
+			return nil, nil, err
+		}
+		results[i] = result
+	}
+
+	// An existing bundle is moved aside, so it is only lost once the new links are in place.
+	replacedPath := destPath + ".cat.replaced"
+	if err := os.RemoveAll(replacedPath); err != nil {
+		return nil, nil, err
+	}
+	if err := os.Rename(destPath, replacedPath); err != nil && !os.IsNotExist(err) {
+		return nil, nil, err
+	}
+	if err := os.Rename(stagingPath, destPath); err != nil {
+		return nil, nil, err
+	}
+	os.RemoveAll(replacedPath)
+	if opts.Sync {
+		if err := syncDir(filepath.Dir(destPath)); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	return members, results, nil
+}
+
+// storeLinks lists the links of a copy stored by storeCopy, for recording them in the catalog.
+//
+// Parameters:
+// - destPath: The mirrored path of the copy at the destination.
+// - members: The member paths relative to the bundle directory, or a single empty path for a file.
+// - results: The result of each member, in the same order.
+//
+// Returns:
+// - []StoreLink: The linked paths and their objects.
+func storeLinks(destPath string, members []string, results []CopyResult) []StoreLink {
+	links := make([]StoreLink, len(members))
+	for i, member := range members {
+		links[i] = StoreLink{
+			Path:        filepath.Join(destPath, member),
+			StoreObject: StoreObject{Checksum: results[i].Checksum, Algorithm: results[i].Algorithm, Size: results[i].Size},
+		}
+	}
+	return links
+}
+
+// copyStoredWithVerification copies a file or bundle directory to a content-addressed destination and records it
+// in the database.
+//
+// Parameters:
+// - ctx: The context to control the copying lifecycle.
+// - db: The database connection to track copied files.
+// - cfg: The configuration for the directory to monitor.
+// - source: The source file or bundle directory.
+// - destPath: The mirrored path of the copy at the destination.
+// - destination: The destination directory.
+// - copyOptions: The options for copying each file.
+// - isFolder: Boolean indicating if the source is a bundle directory.
+func copyStoredWithVerification(ctx context.Context, db *sql.DB, cfg Configuration, source, destPath, destination string, copyOptions CopyOptions, isFolder bool) {
+	LogWithDatetime(fmt.Sprintf("Starting to store: `%s` to destination: `%s`", source, destPath), true)
+	sendSlackNotification(fmt.Sprintf("Starting to store: `%s` to destination: `%s`", source, destPath))
+
+	if isFolder {
+		copyOptions.Bar = progressbar.NewOptions64(GetDirectorySize(source),
+			progressbar.OptionSetDescription(fmt.Sprintf("Storing folder %s to %s", source, destPath)),
+			progressbar.OptionShowBytes(true),
+		)
+	}
+	members, results, err := storeCopy(ctx, db, cfg, source, destPath, destination, copyOptions, isFolder, false)
+	if err != nil {
+		LogWithDatetime(fmt.Sprintf("Error storing %s: %v", source, err), true)
+		sendSlackNotification(fmt.Sprintf("Error storing %s: %v", source, err))
+		return
+	}
+
+	entries := make([]ManifestEntry, len(results))
+	var size, linked int64
+	for i, result := range results {
+		entries[i] = ManifestEntry{
+			Path:              filepath.ToSlash(members[i]),
+			Size:              result.Size,
+			Checksum:          result.Checksum,
+			SecondaryChecksum: result.SecondaryChecksum,
+		}
+		size += result.Size
+		if result.Engine == EngineLinked {
+			linked += result.Size
+		}
+	}
+	manifest := newManifest(copyOptions.Checksum, copyOptions.SecondaryChecksum, entries)
+	checksum, secondary := entries[0].Checksum, entries[0].SecondaryChecksum
+	if isFolder {
+		checksum, secondary = manifest.Digest(), manifest.SecondaryDigest()
+	}
+	algorithm := digestAlgorithm(copyOptions.Checksum, isFolder)
+	verification := cfg.verificationMode(destination)
+
+	LogWithDatetime(fmt.Sprintf("Finished storing: `%s` to destination: `%s` (%d of %d bytes already stored)", source, destPath, linked, size), true)
+	sendSlackNotification(fmt.Sprintf("Finished storing: `%s` to destination: `%s`", source, destPath))
+	writeChecksumFiles(cfg, destination, destPath, manifest.Entries, manifest.Algorithm, manifest.SecondaryAlgorithm)
+	dbMutex.Lock()
+	if err := ReplaceStoreLinks(db, destination, source, storeLinks(destPath, members, results)); err != nil {
+		LogWithDatetime(fmt.Sprintf("Error recording links of %s: %v", source, err), true)
+		sendSlackNotification(fmt.Sprintf("Error recording links of %s: %v", source, err))
+	}
+	MarkFileAsCopied(db, source, destination, isFolder)
+	UpdateCopiedFileChecksumWithAlgorithm(db, source, destination, checksum, algorithm)
+	SaveFileSize(db, source, size, isFolder)
+	UpdateFileChecksumWithAlgorithm(db, source, checksum, algorithm)
+	if copyOptions.SecondaryChecksum != "" {
+		UpdateFileSecondaryChecksum(db, source, secondary, digestAlgorithm(copyOptions.SecondaryChecksum, isFolder))
+	}
+	if isFolder {
+		SaveManifest(db, source, manifest)
+	}
+	UpdateCopiedFileSize(db, source, destination, size)
+	UpdateCopiedFileVerification(db, source, destination, verification)
+	UpdateCopiedFileEngine(db, source, destination, combinedEngine(results))
+	dbMutex.Unlock()
+}
+
+// PruneStore removes the objects of a content-addressed destination that no path is linked to any more. Objects
+// are only removed once the catalog holds no reference to them, and removing an object never affects a hardlink
+// that still points at its content.
+//
+// Parameters:
+// - db: The database connection holding the catalog of the store.
+// - destination: The destination directory.
+//
+// Returns:
+// - int: The number of objects removed.
+// - int64: The number of bytes freed.
+// - error: An error object if the catalog could not be read or an object could not be removed.
+func PruneStore(db *sql.DB, destination string) (int, int64, error) {
+	// Pruning holds the database lock, so copies staged in the store are left over from an interrupted run.
+	if err := os.RemoveAll(filepath.Join(destination, storeDirName, "incoming")); err != nil {
+		return 0, 0, err
+	}
+	objects, err := GetUnreferencedStoreObjects(db, destination)
+	if err != nil {
+		return 0, 0, err
+	}
+	var removed int
+	var freed int64
+	for _, object := range objects {
+		objectPath := storeObjectPath(destination, object.Algorithm, object.Checksum)
+		if err := os.Remove(objectPath); err != nil && !os.IsNotExist(err) {
+			return removed, freed, err
+		}
+		if err := DeleteStoreObject(db, destination, object.Algorithm, object.Checksum); err != nil {
+			return removed, freed, err
+		}
+		LogWithDatetime(fmt.Sprintf("Pruned %s", objectPath), false)
+		removed++
+		freed += object.Size
+	}
+	return removed, freed, nil
+}
@@ -0,0 +1,122 @@
+package catapult
+
+import (
+	"context"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestContentAddressedStore(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+
+	tmpDir := t.TempDir()
+	src := filepath.Join(tmpDir, "src")
+	destination := filepath.Join(tmpDir, "dst")
+	os.MkdirAll(filepath.Join(src, "run.d"), 0755)
+	os.MkdirAll(destination, 0755)
+	shared := []byte("QC standard")
+	files := map[string][]byte{
+		"a.raw":          shared,
+		"b.raw":          shared,
+		"c.raw":          []byte("unique"),
+		"run.d/qc.raw":   shared,
+		"run.d/data.raw": []byte("bundle data"),
+	}
+	for name, content := range files {
+		os.WriteFile(filepath.Join(src, name), content, 0644)
+	}
+
+	cfg := Configuration{
+		Name:                "cas",
+		Directories:         []string{src},
+		Destinations:        []string{destination},
+		OverrideIfDifferent: true,
+		DestinationSettings: map[string]DestinationConfig{destination: {Layout: LayoutContentAddressed}},
+	}
+	for _, name := range []string{"a.raw", "b.raw", "c.raw", "run.d"} {
+		copyFileWithVerification(context.Background(), db, filepath.Join(src, name), src, destination, cfg, math.MaxInt64)
+	}
+
+	sharedChecksum, _ := CalculateFileHash(filepath.Join(src, "a.raw"))
+	object := storeObjectPath(destination, ChecksumSHA256, sharedChecksum)
+	objectInfo, err := os.Stat(object)
+	if err != nil {
+		t.Fatalf("Expected object for shared content: %v", err)
+	}
+	for _, name := range []string{"a.raw", "b.raw", "run.d/qc.raw"} {
+		info, err := os.Stat(filepath.Join(destination, name))
+		if err != nil || !os.SameFile(info, objectInfo) {
+			t.Fatalf("Expected %s to be linked to the shared object: %v", name, err)
+		}
+	}
+	objects, _ := filepath.Glob(filepath.Join(destination, storeDirName, "objects", ChecksumSHA256, "*", "*", "*"))
+	if len(objects) != 3 {
+		t.Fatalf("Expected 3 objects, got %d", len(objects))
+	}
+	var refcount int
+	db.QueryRow(`SELECT refcount FROM store_objects WHERE destination = ? AND checksum = ?`, destination, sharedChecksum).Scan(&refcount)
+	if refcount != 3 {
+		t.Fatalf("refcount = %d, want 3", refcount)
+	}
+	var engine string
+	db.QueryRow(`SELECT engine FROM copied_files WHERE file_path = ?`, filepath.Join(src, "b.raw")).Scan(&engine)
+	if engine != EngineLinked {
+		t.Fatalf("engine = %q, want %q", engine, EngineLinked)
+	}
+
+	// New content is staged in the store while it is hashed, and nothing is left behind once it is named.
+	db.QueryRow(`SELECT engine FROM copied_files WHERE file_path = ?`, filepath.Join(src, "c.raw")).Scan(&engine)
+	if engine == EngineLinked || engine == "" {
+		t.Fatalf("engine of new content = %q, want a copy engine", engine)
+	}
+	if staged, _ := os.ReadDir(filepath.Join(destination, storeDirName, "incoming")); len(staged) != 0 {
+		t.Fatalf("Expected no staged copies to be left, got %d", len(staged))
+	}
+
+	scrubDue(context.Background(), db, cfg, time.Hour)
+	if got := scrubStatus(t, db, filepath.Join(src, "run.d"), destination); got != ScrubOK {
+		t.Fatalf("scrub status = %q, want %q", got, ScrubOK)
+	}
+
+	// Damaging the shared object damages every link, and repairing it relinks them all to the new object.
+	os.WriteFile(object, []byte("QC standarX"), 0644)
+	cfg.Scrub.Repair = RepairSource
+	db.Exec(`UPDATE copied_files SET last_scrubbed = NULL`)
+	scrubDue(context.Background(), db, cfg, time.Hour)
+	if got := scrubStatus(t, db, filepath.Join(src, "a.raw"), destination); got != ScrubRepaired {
+		t.Fatalf("scrub status = %q, want %q", got, ScrubRepaired)
+	}
+	objectInfo, _ = os.Stat(object)
+	for _, name := range []string{"a.raw", "b.raw", "run.d/qc.raw"} {
+		content, _ := os.ReadFile(filepath.Join(destination, name))
+		info, _ := os.Stat(filepath.Join(destination, name))
+		if string(content) != string(shared) || !os.SameFile(info, objectInfo) {
+			t.Fatalf("Expected %s to be relinked to the repaired object, got %q", name, content)
+		}
+	}
+
+	// Overriding a changed file releases its old object, which pruning then removes.
+	uniqueChecksum, _ := CalculateFileHash(filepath.Join(src, "c.raw"))
+	os.WriteFile(filepath.Join(src, "c.raw"), []byte("unique, revised"), 0644)
+	db.Exec(`UPDATE file_sizes SET checksum = NULL WHERE path = ?`, filepath.Join(src, "c.raw"))
+	db.Exec(`UPDATE copied_files SET checksum = NULL WHERE file_path = ?`, filepath.Join(src, "c.raw"))
+	copyFileWithVerification(context.Background(), db, filepath.Join(src, "c.raw"), src, destination, cfg, math.MaxInt64)
+
+	removed, freed, err := PruneStore(db, destination)
+	if err != nil || removed != 1 || freed != int64(len("unique")) {
+		t.Fatalf("PruneStore() = %d, %d, %v, want 1 object of %d bytes", removed, freed, err, len("unique"))
+	}
+	if _, err := os.Stat(storeObjectPath(destination, ChecksumSHA256, uniqueChecksum)); !os.IsNotExist(err) {
+		t.Fatalf("Expected the unreferenced object to be removed: %v", err)
+	}
+	if content, _ := os.ReadFile(filepath.Join(destination, "c.raw")); string(content) != "unique, revised" {
+		t.Fatalf("Unexpected content after override: %q", content)
+	}
+	if removed, _, _ := PruneStore(db, destination); removed != 0 {
+		t.Fatalf("Expected nothing left to prune, removed %d", removed)
+	}
+}
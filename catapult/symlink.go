@@ -0,0 +1,137 @@
+package catapult
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// Policies for symbolic links inside the monitored directories.
+const (
+	// SymlinkFollow copies what a link points to, descending into linked directories unless they contain the link.
+	SymlinkFollow = "follow"
+	// SymlinkCopy recreates each link at the destinations with the same target.
+	SymlinkCopy = "link"
+	// SymlinkSkip leaves links out.
+	SymlinkSkip = "skip"
+)
+
+// EngineSymlink is recorded as the engine of links recreated at a destination. Their targets are not copied, so
+// they are not scrubbed.
+const EngineSymlink = "symlink"
+
+// ValidateSymlinkPolicy checks that a symlink policy is known.
+//
+// Parameters:
+// - policy: The policy, or an empty string for the default.
+//
+// Returns:
+// - error: An error object if the policy is not supported.
+func ValidateSymlinkPolicy(policy string) error {
+	switch policy {
+	case "", SymlinkFollow, SymlinkCopy, SymlinkSkip:
+		return nil
+	}
+	return fmt.Errorf("unknown symlink policy: %s", policy)
+}
+
+// isSymlink checks whether a path listed for a configuration is a link to recreate rather than to copy.
+//
+// Parameters:
+// - cfg: The configuration the path was listed for.
+// - path: The listed path.
+//
+// Returns:
+// - bool: True if the configuration copies links as links and the path is one.
+func isSymlink(cfg Configuration, path string) bool {
+	if cfg.Symlinks != SymlinkCopy {
+		return false
+	}
+	info, err := os.Lstat(path)
+	return err == nil && info.Mode()&os.ModeSymlink != 0
+}
+
+// logListingSkips reports the paths left out of the listing of a directory.
+//
+// Parameters:
+// - dir: The directory that was listed.
+// - skips: The counts of skipped paths.
+func logListingSkips(dir string, skips ListingSkips) {
+	if skips.SpecialFiles > 0 {
+		LogWithDatetime(fmt.Sprintf("Skipped %d special files (FIFOs, sockets or devices) in %s", skips.SpecialFiles, dir), true)
+	}
+	if skips.Cycles > 0 {
+		LogWithDatetime(fmt.Sprintf("Skipped %d symbolic links to directories containing them in %s", skips.Cycles, dir), true)
+	}
+	if skips.SymbolicLinks > 0 {
+		LogWithDatetime(fmt.Sprintf("Skipped %d symbolic links in %s", skips.SymbolicLinks, dir), false)
+	}
+}
+
+// copySymlink recreates a link at a destination with the same target, so that relative links keep pointing into
+// the mirrored tree. A link with the same target is only marked as copied, and a different link is replaced.
+//
+// Parameters:
+// - db: The database connection to track copied files.
+// - link: The link in the monitored directory.
+// - dir: The monitored directory.
+// - destination: The destination directory.
+// - cfg: The configuration the link belongs to.
+func copySymlink(db *sql.DB, link, dir, destination string, cfg Configuration) {
+	target, err := os.Readlink(link)
+	if err != nil {
+		LogWithDatetime(fmt.Sprintf("Error reading symbolic link: %v", err), true)
+		sendSlackNotification(fmt.Sprintf("Error reading symbolic link: %v", err))
+		return
+	}
+	relPath, err := filepath.Rel(dir, link)
+	if err != nil {
+		LogWithDatetime(fmt.Sprintf("Error getting relative path: %v", err), true)
+		return
+	}
+	destPath, ok := prepareDestinationName(db, cfg, link, relPath, destination, false)
+	if !ok {
+		return
+	}
+
+	if existing, err := os.Readlink(destPath); err != nil || existing != target {
+		if info, err := os.Lstat(destPath); err == nil && info.Mode()&os.ModeSymlink == 0 {
+			LogWithDatetime(fmt.Sprintf("File already exists but is not a symbolic link: %s", destPath), true)
+			sendSlackNotification(fmt.Sprintf("File already exists but is not a symbolic link: %s", destPath))
+			return
+		}
+		tempPath := destPath + ".cat.part"
+		os.Remove(tempPath)
+		err := os.MkdirAll(filepath.Dir(destPath), os.ModePerm)
+		if err == nil {
+			err = os.Symlink(target, tempPath)
+		}
+		if err == nil {
+			err = os.Rename(tempPath, destPath)
+		}
+		if err == nil && cfg.destinationConfig(destination).durable() {
+			err = syncDir(filepath.Dir(destPath))
+		}
+		if err != nil {
+			os.Remove(tempPath)
+			LogWithDatetime(fmt.Sprintf("Error copying symbolic link %s: %v", link, err), true)
+			sendSlackNotification(fmt.Sprintf("Error copying symbolic link %s: %v", link, err))
+			return
+		}
+		LogWithDatetime(fmt.Sprintf("Copied symbolic link: %s to %s -> %s", link, destPath, target), false)
+	}
+
+	dbMutex.Lock()
+	defer dbMutex.Unlock()
+	copied, err := IsFileCopied(db, link, destination, false)
+	if err == nil && !copied {
+		err = MarkFileAsCopied(db, link, destination, false)
+	}
+	if err == nil {
+		err = UpdateCopiedFileEngine(db, link, destination, EngineSymlink)
+	}
+	if err != nil {
+		LogWithDatetime(fmt.Sprintf("Error recording symbolic link %s: %v", link, err), true)
+	}
+}
@@ -0,0 +1,126 @@
+package catapult
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+)
+
+// createLinkedTree creates a source tree with a file link, a directory link, a link back to the root and a socket.
+func createLinkedTree(t *testing.T) string {
+	t.Helper()
+	root := filepath.Join(t.TempDir(), "src")
+	os.MkdirAll(filepath.Join(root, "data"), 0755)
+	os.WriteFile(filepath.Join(root, "data", "sample.raw"), []byte("sample"), 0644)
+	for link, target := range map[string]string{
+		"sample-link.raw": filepath.Join("data", "sample.raw"),
+		"linked":          "data",
+		"data/loop":       "..",
+	} {
+		if err := os.Symlink(target, filepath.Join(root, link)); err != nil {
+			t.Skipf("Symbolic links are not supported: %v", err)
+		}
+	}
+	return root
+}
+
+func relPaths(root string, paths []string) []string {
+	var rel []string
+	for _, path := range paths {
+		r, _ := filepath.Rel(root, path)
+		rel = append(rel, filepath.ToSlash(r))
+	}
+	sort.Strings(rel)
+	return rel
+}
+
+func TestListFilesSymlinkPolicies(t *testing.T) {
+	root := createLinkedTree(t)
+	listener, err := net.Listen("unix", filepath.Join(root, "data", "daemon.sock"))
+	if err == nil {
+		defer listener.Close()
+	}
+
+	tests := []struct {
+		policy string
+		want   []string
+		skips  ListingSkips
+	}{
+		{SymlinkFollow, []string{".", "data", "data/sample.raw", "linked", "linked/sample.raw", "sample-link.raw"}, ListingSkips{Cycles: 2}},
+		{SymlinkCopy, []string{".", "data", "data/loop", "data/sample.raw", "linked", "sample-link.raw"}, ListingSkips{}},
+		{SymlinkSkip, []string{".", "data", "data/sample.raw"}, ListingSkips{SymbolicLinks: 3}},
+	}
+	for _, tt := range tests {
+		if err == nil {
+			// The socket is listed under data, and again under linked when links are followed.
+			tt.skips.SpecialFiles = 1
+			if tt.policy == SymlinkFollow {
+				tt.skips.SpecialFiles = 2
+			}
+		}
+		paths, skips, listErr := ListFiles(root, tt.policy)
+		if listErr != nil {
+			t.Fatalf("%s: ListFiles() error: %v", tt.policy, listErr)
+		}
+		if got := relPaths(root, paths); !equalStrings(got, tt.want) {
+			t.Fatalf("%s: ListFiles() = %v, want %v", tt.policy, got, tt.want)
+		}
+		if skips != tt.skips {
+			t.Fatalf("%s: skips = %+v, want %+v", tt.policy, skips, tt.skips)
+		}
+	}
+	if err := ValidateSymlinkPolicy("copy"); err == nil {
+		t.Fatalf("Expected ValidateSymlinkPolicy() to reject an unknown policy")
+	}
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestCopySymlinks(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+	root := createLinkedTree(t)
+	destination := filepath.Join(t.TempDir(), "dst")
+	os.MkdirAll(destination, 0755)
+
+	cfg := Configuration{Name: "links", Directories: []string{root}, Destinations: []string{destination}, Symlinks: SymlinkCopy}
+	for i := 0; i < 2; i++ {
+		processFiles(context.Background(), db, root, cfg, destination, 1<<40, 0)
+	}
+	for link, want := range map[string]string{"sample-link.raw": filepath.Join("data", "sample.raw"), "linked": "data", "data/loop": ".."} {
+		target, err := os.Readlink(filepath.Join(destination, link))
+		if err != nil || target != want {
+			t.Fatalf("Readlink(%s) = %q, %v, want %q", link, target, err, want)
+		}
+		copied, _ := IsFileCopied(db, filepath.Join(root, link), destination, false)
+		if !copied {
+			t.Fatalf("Expected %s to be marked as copied", link)
+		}
+	}
+
+	// A changed link is replaced, and links are not scrubbed.
+	os.Remove(filepath.Join(root, "linked"))
+	os.Symlink(filepath.Join("data", "sample.raw"), filepath.Join(root, "linked"))
+	copySymlink(db, filepath.Join(root, "linked"), root, destination, cfg)
+	if target, _ := os.Readlink(filepath.Join(destination, "linked")); target != filepath.Join("data", "sample.raw") {
+		t.Fatalf("Expected the changed link to be replaced, got %q", target)
+	}
+	candidates, _ := GetScrubCandidates(db, []string{destination}, time.Now().Add(time.Hour))
+	if len(candidates) != 1 || candidates[0].FilePath != filepath.Join(root, "data", "sample.raw") {
+		t.Fatalf("Expected only the copied file to be scrubbed, got %+v", candidates)
+	}
+}
@@ -0,0 +1,42 @@
+package catapult
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDestinationDurable(t *testing.T) {
+	enabled, disabled := true, false
+	cases := []struct {
+		config DestinationConfig
+		want   bool
+	}{
+		{DestinationConfig{}, false},
+		{DestinationConfig{Archive: true}, true},
+		{DestinationConfig{Archive: true, Durable: &disabled}, false},
+		{DestinationConfig{Durable: &enabled}, true},
+	}
+	for _, c := range cases {
+		if got := c.config.durable(); got != c.want {
+			t.Errorf("durable() for %+v = %v, want %v", c.config, got, c.want)
+		}
+	}
+}
+
+func TestSyncedCopy(t *testing.T) {
+	tmpDir := t.TempDir()
+	src := filepath.Join(tmpDir, "source.raw")
+	dst := filepath.Join(tmpDir, "out", "sub", "source.raw")
+	os.WriteFile(src, []byte("durable content"), 0644)
+
+	for _, engine := range []string{EngineAuto, EngineBuffered} {
+		if _, err := CopyFileWithOptions(context.Background(), src, dst, CopyOptions{Engine: engine, Sync: true}); err != nil {
+			t.Fatalf("CopyFileWithOptions(%s) error: %v", engine, err)
+		}
+	}
+	if err := syncTree(filepath.Join(tmpDir, "out")); err != nil {
+		t.Fatalf("syncTree() error: %v", err)
+	}
+}
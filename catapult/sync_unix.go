@@ -0,0 +1,49 @@
+//go:build !windows
+// +build !windows
+
+package catapult
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// syncDir flushes a directory to stable storage on Unix-based systems, so that renames and newly created
+// entries inside it survive a power loss.
+//
+// Parameters:
+// - dir: The directory to flush.
+//
+// Returns:
+// - error: An error object if the directory could not be opened or flushed.
+func syncDir(dir string) error {
+	file, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return file.Sync()
+}
+
+// syncTree flushes a directory, every directory below it and its parent to stable storage.
+//
+// Parameters:
+// - root: The directory tree to flush.
+//
+// Returns:
+// - error: An error object if a directory could not be flushed.
+func syncTree(root string) error {
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return syncDir(path)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(root))
+}
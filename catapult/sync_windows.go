@@ -0,0 +1,27 @@
+//go:build windows
+// +build windows
+
+package catapult
+
+// syncDir is a no-op on Windows systems, where directories cannot be flushed and NTFS journals
+// directory changes itself.
+//
+// Parameters:
+// - dir: The directory to flush.
+//
+// Returns:
+// - error: Always nil.
+func syncDir(dir string) error {
+	return nil
+}
+
+// syncTree is a no-op on Windows systems, see syncDir.
+//
+// Parameters:
+// - root: The directory tree to flush.
+//
+// Returns:
+// - error: Always nil.
+func syncTree(root string) error {
+	return nil
+}
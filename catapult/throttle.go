@@ -0,0 +1,194 @@
+package catapult
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// RateLimiter limits the throughput of the copies sharing it to a number of bytes per second.
+// Each chunk reserves its own slot in arrival order, so concurrent copies share the bandwidth fairly.
+type RateLimiter struct {
+	mu   sync.Mutex
+	rate int64
+	next time.Time
+}
+
+var (
+	rateLimitersMutex sync.Mutex
+	rateLimiters      = make(map[string]*RateLimiter)
+)
+
+// NewRateLimiter creates a rate limiter. A rate of zero or less means unlimited.
+//
+// Parameters:
+// - bytesPerSecond: The maximum throughput in bytes per second.
+//
+// Returns:
+// - *RateLimiter: The new rate limiter.
+func NewRateLimiter(bytesPerSecond int64) *RateLimiter {
+	return &RateLimiter{rate: bytesPerSecond}
+}
+
+// SetRate changes the limit of the rate limiter. It takes effect for the next chunk of every copy.
+//
+// Parameters:
+// - bytesPerSecond: The maximum throughput in bytes per second, or zero for unlimited.
+func (r *RateLimiter) SetRate(bytesPerSecond int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.rate = bytesPerSecond
+	r.next = time.Time{}
+}
+
+// Rate returns the current limit of the rate limiter in bytes per second.
+func (r *RateLimiter) Rate() int64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.rate
+}
+
+// WaitN blocks until n bytes may be transferred or the context is cancelled.
+//
+// Parameters:
+// - ctx: The context to control the wait.
+// - n: The number of bytes about to be transferred.
+//
+// Returns:
+// - error: The context error if the context was cancelled while waiting.
+func (r *RateLimiter) WaitN(ctx context.Context, n int) error {
+	if r == nil {
+		return nil
+	}
+	r.mu.Lock()
+	if r.rate <= 0 {
+		r.mu.Unlock()
+		return nil
+	}
+	now := time.Now()
+	start := r.next
+	if start.Before(now) {
+		start = now
+	}
+	r.next = start.Add(time.Duration(float64(n) / float64(r.rate) * float64(time.Second)))
+	r.mu.Unlock()
+
+	delay := time.Until(start)
+	if delay <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// getRateLimiter returns the shared rate limiter registered under the given key, creating it with the given
+// rate if it does not exist yet. The rate of an existing limiter is left untouched.
+func getRateLimiter(key string, bytesPerSecond int64) *RateLimiter {
+	rateLimitersMutex.Lock()
+	defer rateLimitersMutex.Unlock()
+	limiter, ok := rateLimiters[key]
+	if !ok {
+		limiter = NewRateLimiter(bytesPerSecond)
+		rateLimiters[key] = limiter
+	}
+	return limiter
+}
+
+// ApplyRateLimits updates the shared global, per configuration, per destination and scrub rate limiters from the
+// given configurations. Copies in progress pick up the new limits with their next chunk.
+//
+// Parameters:
+// - config: The configurations containing the rate limits.
+func ApplyRateLimits(config Configurations) {
+	getRateLimiter("global", config.RateLimit).SetRate(config.RateLimit)
+	for _, cfg := range config.Configs {
+		getRateLimiter("config:"+cfg.Name, cfg.RateLimit).SetRate(cfg.RateLimit)
+		getRateLimiter("scrub:"+cfg.Name, cfg.Scrub.RateLimit).SetRate(cfg.Scrub.RateLimit)
+		for _, destination := range cfg.Destinations {
+			rate := cfg.destinationConfig(destination).RateLimit
+			getRateLimiter("destination:"+destination, rate).SetRate(rate)
+		}
+	}
+}
+
+// copyLimiters returns the rate limiters that apply to copies from a configuration to a destination.
+//
+// Parameters:
+// - cfg: The configuration the copy belongs to.
+// - destination: The destination of the copy.
+//
+// Returns:
+// - []*RateLimiter: The global, configuration and destination rate limiters.
+func copyLimiters(cfg Configuration, destination string) []*RateLimiter {
+	return []*RateLimiter{
+		getRateLimiter("global", 0),
+		getRateLimiter("config:"+cfg.Name, cfg.RateLimit),
+		getRateLimiter("destination:"+destination, cfg.destinationConfig(destination).RateLimit),
+	}
+}
+
+// WatchRateLimits re-reads the configuration file whenever it changes and applies its rate limits,
+// so that limits can be changed without restarting.
+//
+// Parameters:
+// - ctx: The context to control the watching lifecycle.
+// - filePath: The path of the configuration file.
+// - interval: How often to check the file for changes.
+func WatchRateLimits(ctx context.Context, filePath string, interval time.Duration) {
+	var lastModified time.Time
+	if info, err := os.Stat(filePath); err == nil {
+		lastModified = info.ModTime()
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			info, err := os.Stat(filePath)
+			if err != nil || !info.ModTime().After(lastModified) {
+				continue
+			}
+			lastModified = info.ModTime()
+			configs, err := ReadConfigsFromFile(filePath)
+			if err != nil {
+				LogWithDatetime(fmt.Sprintf("Error reloading rate limits: %v", err), true)
+				continue
+			}
+			ApplyRateLimits(configs)
+			LogWithDatetime("Reloaded rate limits from configuration file", true)
+		}
+	}
+}
+
+// formatThroughput formats a transfer rate in a human readable form.
+//
+// Parameters:
+// - bytes: The number of bytes transferred.
+// - elapsed: The time taken to transfer them.
+//
+// Returns:
+// - string: The throughput, e.g. "12.3 MB/s".
+func formatThroughput(bytes int64, elapsed time.Duration) string {
+	if elapsed <= 0 {
+		return "n/a"
+	}
+	rate := float64(bytes) / elapsed.Seconds()
+	units := []string{"B/s", "kB/s", "MB/s", "GB/s"}
+	unit := 0
+	for rate >= 1000 && unit < len(units)-1 {
+		rate /= 1000
+		unit++
+	}
+	return fmt.Sprintf("%.1f %s", rate, units[unit])
+}
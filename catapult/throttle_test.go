@@ -0,0 +1,70 @@
+package catapult
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestRateLimiterWaitN(t *testing.T) {
+	limiter := NewRateLimiter(1000)
+	ctx := context.Background()
+
+	started := time.Now()
+	for i := 0; i < 3; i++ {
+		if err := limiter.WaitN(ctx, 100); err != nil {
+			t.Fatalf("WaitN() error: %v", err)
+		}
+	}
+	// The third chunk starts after the first two have used their 200 ms.
+	if elapsed := time.Since(started); elapsed < 150*time.Millisecond {
+		t.Fatalf("WaitN() did not throttle: elapsed %v", elapsed)
+	}
+
+	limiter.SetRate(0)
+	started = time.Now()
+	for i := 0; i < 100; i++ {
+		limiter.WaitN(ctx, 1000)
+	}
+	if elapsed := time.Since(started); elapsed > 100*time.Millisecond {
+		t.Fatalf("Unlimited rate limiter throttled: elapsed %v", elapsed)
+	}
+}
+
+func TestRateLimiterCancel(t *testing.T) {
+	limiter := NewRateLimiter(1)
+	ctx, cancel := context.WithCancel(context.Background())
+
+	limiter.WaitN(ctx, 1000)
+	cancel()
+	if err := limiter.WaitN(ctx, 1000); err == nil {
+		t.Fatalf("Expected WaitN() to return the context error")
+	}
+}
+
+func TestApplyRateLimits(t *testing.T) {
+	cfg := Configuration{
+		Name:         "throttled",
+		Destinations: []string{"dst"},
+		RateLimit:    500,
+		DestinationSettings: map[string]DestinationConfig{
+			"dst": {RateLimit: 100},
+		},
+	}
+	ApplyRateLimits(Configurations{Configs: []Configuration{cfg}, RateLimit: 1000})
+
+	limiters := copyLimiters(cfg, "dst")
+	want := []int64{1000, 500, 100}
+	for i, limiter := range limiters {
+		if limiter.Rate() != want[i] {
+			t.Errorf("limiter %d rate = %d, want %d", i, limiter.Rate(), want[i])
+		}
+	}
+
+	cfg.DestinationSettings["dst"] = DestinationConfig{RateLimit: 200}
+	ApplyRateLimits(Configurations{Configs: []Configuration{cfg}})
+	if rate := copyLimiters(cfg, "dst")[2].Rate(); rate != 200 {
+		t.Fatalf("destination rate after reload = %d, want 200", rate)
+	}
+	ApplyRateLimits(Configurations{})
+}
@@ -0,0 +1,131 @@
+package catapult
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+)
+
+// Verification modes for a written copy.
+const (
+	// VerifyNone trusts the copy without checking it.
+	VerifyNone = "none"
+	// VerifySize checks that the copy has the same size as the source.
+	VerifySize = "size"
+	// VerifyFull re-reads the whole copy and compares its hash with the source checksum.
+	VerifyFull = "full"
+	// VerifySampled re-reads evenly spaced blocks of the copy and compares them with the source.
+	VerifySampled = "sampled"
+)
+
+// verifySampleCount and verifySampleSize control how much of a file a sampled verification re-reads.
+const (
+	verifySampleCount = 16
+	verifySampleSize  = 1024 * 1024
+)
+
+// verificationMode returns the verification mode for a destination, falling back to the configuration default
+// and then to a full re-read.
+//
+// Parameters:
+// - destination: The destination directory as listed in Destinations.
+//
+// Returns:
+// - string: The verification mode.
+func (cfg Configuration) verificationMode(destination string) string {
+	if mode := cfg.destinationConfig(destination).Verification; mode != "" {
+		return mode
+	}
+	if cfg.Verification != "" {
+		return cfg.Verification
+	}
+	return VerifyFull
+}
+
+// VerifyCopy checks a written copy against its source using the given verification mode.
+//
+// Parameters:
+// - mode: The verification mode.
+// - src: The source file path.
+// - copyPath: The path of the written copy.
+// - size: The size of the source file.
+// - checksum: The checksum of the source computed while copying.
+// - algorithm: The checksum algorithm of checksum.
+//
+// Returns:
+// - error: An error object describing the mismatch, or nil if the copy passed verification.
+func VerifyCopy(mode, src, copyPath string, size int64, checksum, algorithm string) error {
+	switch mode {
+	case VerifyNone:
+		return nil
+	case VerifySize:
+		if copiedSize := GetFileSize(copyPath); copiedSize != size {
+			return fmt.Errorf("size mismatch for %s: %d, want %d", copyPath, copiedSize, size)
+		}
+		return nil
+	case VerifySampled:
+		if copiedSize := GetFileSize(copyPath); copiedSize != size {
+			return fmt.Errorf("size mismatch for %s: %d, want %d", copyPath, copiedSize, size)
+		}
+		return compareSamples(src, copyPath, size)
+	case VerifyFull, "":
+		copiedHash, err := CalculateFileChecksum(copyPath, algorithm)
+		if err != nil {
+			return err
+		}
+		if copiedHash != checksum {
+			return fmt.Errorf("file hash mismatch for: %s", copyPath)
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown verification mode: %s", mode)
+	}
+}
+
+// compareSamples compares evenly spaced blocks of two files, including the first and last block.
+//
+// Parameters:
+// - src: The source file path.
+// - copyPath: The path of the written copy.
+// - size: The size of both files.
+//
+// Returns:
+// - error: An error object if a block differs or could not be read.
+func compareSamples(src, copyPath string, size int64) error {
+	sourceFile, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer sourceFile.Close()
+	copyFile, err := os.Open(copyPath)
+	if err != nil {
+		return err
+	}
+	defer copyFile.Close()
+
+	sourceBlock := make([]byte, verifySampleSize)
+	copyBlock := make([]byte, verifySampleSize)
+	span := size - verifySampleSize
+	for i := int64(0); i < verifySampleCount; i++ {
+		var offset int64
+		if span > 0 {
+			offset = span * i / (verifySampleCount - 1)
+		}
+		n, err := sourceFile.ReadAt(sourceBlock, offset)
+		if err != nil && err != io.EOF {
+			return err
+		}
+		m, err := copyFile.ReadAt(copyBlock, offset)
+		if err != nil && err != io.EOF {
+			return err
+		}
+		if n != m || !bytes.Equal(sourceBlock[:n], copyBlock[:m]) {
+			return fmt.Errorf("sampled block at offset %d differs for: %s", offset, copyPath)
+		}
+		if span <= 0 {
+			break
+		}
+	}
+	return nil
+}
@@ -0,0 +1,52 @@
+package catapult
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestVerifyCopy(t *testing.T) {
+	tmpDir := t.TempDir()
+	src := filepath.Join(tmpDir, "source.raw")
+	dst := filepath.Join(tmpDir, "out", "source.raw")
+	content := make([]byte, 5*1024*1024)
+	for i := range content {
+		content[i] = byte(i % 251)
+	}
+	if err := os.WriteFile(src, content, 0644); err != nil {
+		t.Fatalf("Failed to create test file: %v", err)
+	}
+
+	result, err := CopyFileWithOptions(context.Background(), src, dst, CopyOptions{})
+	if err != nil {
+		t.Fatalf("CopyFileWithOptions() error: %v", err)
+	}
+	expectedHash, _ := CalculateFileHash(src)
+	if result.Checksum != expectedHash {
+		t.Fatalf("inline checksum = %s, want %s", result.Checksum, expectedHash)
+	}
+
+	part := dst + ".cat.part"
+	for _, mode := range []string{VerifyNone, VerifySize, VerifyFull, VerifySampled} {
+		if err := VerifyCopy(mode, src, part, result.Size, result.Checksum, result.Algorithm); err != nil {
+			t.Fatalf("VerifyCopy(%s) error on intact copy: %v", mode, err)
+		}
+	}
+
+	// Corrupt the last byte, which every mode but none and size must detect.
+	file, err := os.OpenFile(part, os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatalf("Failed to open copy: %v", err)
+	}
+	file.WriteAt([]byte{content[len(content)-1] + 1}, int64(len(content)-1))
+	file.Close()
+
+	for mode, wantErr := range map[string]bool{VerifyNone: false, VerifySize: false, VerifyFull: true, VerifySampled: true} {
+		err := VerifyCopy(mode, src, part, result.Size, result.Checksum, result.Algorithm)
+		if (err != nil) != wantErr {
+			t.Errorf("VerifyCopy(%s) error = %v, want error %v", mode, err, wantErr)
+		}
+	}
+}
@@ -0,0 +1,244 @@
+package catapult
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// defaultVersionsDirectory is where versions are kept at a destination unless another directory is configured.
+const defaultVersionsDirectory = ".catapult-versions"
+
+// versionTimeFormat is the timestamp appended to the name of a version. It sorts in time order and contains no
+// characters that Windows forbids in file names.
+const versionTimeFormat = "20060102T150405.000Z"
+
+// Version is a previous copy kept at a destination when it was overridden.
+type Version struct {
+	FilePath          string
+	Destination       string
+	Path              string
+	VersionPath       string
+	IsFolder          bool
+	Checksum          string
+	ChecksumAlgorithm string
+	Size              int64
+	Created           time.Time
+}
+
+// directory returns the directory versions are kept in, relative to the destination.
+//
+// Returns:
+// - string: The configured directory, or defaultVersionsDirectory.
+func (v VersioningConfig) directory() string {
+	if v.Directory == "" {
+		return defaultVersionsDirectory
+	}
+	return v.Directory
+}
+
+// keepVersion moves an overridden copy into the versions area of its destination under a timestamped name, records
+// it and removes the oldest versions of the copy beyond the configured number.
+//
+// Parameters:
+// - db: The database connection to record the version in.
+// - cfg: The configuration the copy belongs to.
+// - file: The source of the copy.
+// - copyPath: The path of the overridden copy at the destination.
+// - destination: The destination directory.
+// - isFolder: Boolean indicating if the copy is a bundle directory.
+// - checksum: The checksum recorded for the overridden copy.
+// - algorithm: The checksum algorithm of checksum.
+//
+// Returns:
+// - error: An error object if the copy could not be moved.
+func keepVersion(db *sql.DB, cfg Configuration, file, copyPath, destination string, isFolder bool, checksum, algorithm string) error {
+	relPath, err := filepath.Rel(destination, copyPath)
+	if err != nil {
+		return err
+	}
+	created := time.Now().UTC()
+	versionPath := timestampedPath(filepath.Join(destination, cfg.Versioning.directory(), relPath), created)
+
+	info, err := os.Stat(copyPath)
+	if err != nil {
+		return err
+	}
+	size := info.Size()
+	if info.IsDir() {
+		size = GetDirectorySize(copyPath)
+	}
+	if err := os.MkdirAll(filepath.Dir(versionPath), os.ModePerm); err != nil {
+		return err
+	}
+	if err := os.Rename(copyPath, versionPath); err != nil {
+		return err
+	}
+	if cfg.destinationConfig(destination).durable() {
+		if err := syncDir(filepath.Dir(versionPath)); err != nil {
+			return err
+		}
+		if err := syncDir(filepath.Dir(copyPath)); err != nil {
+			return err
+		}
+	}
+
+	dbMutex.Lock()
+	defer dbMutex.Unlock()
+	err = SaveVersion(db, Version{
+		FilePath:          file,
+		Destination:       destination,
+		Path:              copyPath,
+		VersionPath:       versionPath,
+		IsFolder:          isFolder,
+		Checksum:          checksum,
+		ChecksumAlgorithm: algorithm,
+		Size:              size,
+		Created:           created,
+	})
+	if err != nil {
+		return err
+	}
+	LogWithDatetime(fmt.Sprintf("Kept previous version of %s as %s", copyPath, versionPath), true)
+	pruneVersions(db, copyPath, cfg.Versioning.Keep)
+	return nil
+}
+
+// timestampedPath appends a timestamp to a path, and a counter if a path with the same timestamp already exists.
+//
+// Parameters:
+// - path: The path to append the timestamp to.
+// - t: The timestamp.
+//
+// Returns:
+// - string: A path that does not exist yet.
+func timestampedPath(path string, t time.Time) string {
+	base := path + "." + t.UTC().Format(versionTimeFormat)
+	candidate := base
+	for n := 1; ; n++ {
+		if _, err := os.Lstat(candidate); os.IsNotExist(err) {
+			return candidate
+		}
+		candidate = fmt.Sprintf("%s-%d", base, n)
+	}
+}
+
+// pruneVersions removes the oldest versions of a copy beyond the given number.
+//
+// Parameters:
+// - db: The database connection holding the versions.
+// - copyPath: The path of the copy at the destination.
+// - keep: The number of versions to keep.
+func pruneVersions(db *sql.DB, copyPath string, keep int) {
+	versions, err := GetVersions(db, copyPath)
+	if err != nil {
+		LogWithDatetime(fmt.Sprintf("Error getting versions of %s: %v", copyPath, err), true)
+		return
+	}
+	for i := keep; i < len(versions); i++ {
+		if err := os.RemoveAll(versions[i].VersionPath); err != nil {
+			LogWithDatetime(fmt.Sprintf("Error removing version %s: %v", versions[i].VersionPath, err), true)
+			continue
+		}
+		DeleteVersion(db, versions[i].Destination, versions[i].VersionPath)
+		LogWithDatetime(fmt.Sprintf("Removed version %s", versions[i].VersionPath), false)
+	}
+}
+
+// PrintVersions prints the versions of a copy to the console, newest first.
+//
+// Parameters:
+// - versions: The versions to print.
+func PrintVersions(versions []Version) {
+	for _, version := range versions {
+		fmt.Printf("%s %12d %s %s\n", version.Created.Format(time.RFC3339), version.Size, version.Checksum, version.VersionPath)
+	}
+	LogWithDatetime(fmt.Sprintf("%d versions", len(versions)), false)
+}
+
+// RestoreVersion copies a version into a directory under the name of the copy it was kept for and verifies it against
+// the checksum recorded when it was overridden. Versions of bags are validated as bags instead, and versions of
+// archives, compressed or encrypted copies are restored as stored, so that -restore can decode them.
+//
+// Parameters:
+// - db: The database connection holding the versions.
+// - versionPath: The path of the version.
+// - target: The directory to restore the version into.
+//
+// Returns:
+// - error: An error object if the version is unknown, could not be copied or does not match its checksum.
+func RestoreVersion(db *sql.DB, versionPath, target string) error {
+	version, found, err := GetVersion(db, versionPath)
+	if err != nil {
+		return err
+	}
+	if !found {
+		return fmt.Errorf("no version recorded for %s", versionPath)
+	}
+	restorePath := filepath.Join(target, filepath.Base(version.Path))
+	if _, err := os.Lstat(restorePath); err == nil {
+		return fmt.Errorf("%s already exists", restorePath)
+	}
+	if err := os.MkdirAll(target, os.ModePerm); err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	algorithm := strings.TrimSuffix(version.ChecksumAlgorithm, manifestAlgorithmSuffix)
+	_, isArchive := archiveFormatOf(version.Path)
+	stored := isArchive || strings.HasSuffix(version.Path, compressedSuffix) || strings.HasSuffix(version.Path, encryptedSuffix)
+	isBag := strings.HasSuffix(version.Path, bagSuffix)
+	stagingPath := restorePath + ".cat.part"
+
+	var checksum string
+	info, err := os.Stat(versionPath)
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		if err := os.RemoveAll(stagingPath); err != nil {
+			return err
+		}
+		members, _, err := stageBundleDirectories(versionPath, stagingPath)
+		if err == nil {
+			_, err = copyBundleMembers(ctx, versionPath, stagingPath, members, CopyOptions{Checksum: algorithm}, VerifyFull, 1)
+		}
+		if err == nil && isBag {
+			err = ValidateBag(stagingPath)
+		} else if err == nil {
+			var manifest Manifest
+			manifest, err = walkManifest(ctx, stagingPath, algorithm, "", true, nil)
+			checksum = manifest.Digest()
+		}
+		if err == nil {
+			err = preserveTreeMetadata(versionPath, stagingPath, MetadataConfig{})
+		}
+		if err != nil {
+			os.RemoveAll(stagingPath)
+			return err
+		}
+	} else {
+		result, err := CopyFileWithOptions(ctx, versionPath, restorePath, CopyOptions{Checksum: algorithm})
+		if err != nil {
+			return err
+		}
+		checksum = result.Checksum
+		if err := PreserveMetadata(versionPath, stagingPath, MetadataConfig{}); err != nil {
+			os.Remove(stagingPath)
+			return err
+		}
+	}
+
+	if !isBag && !stored && version.Checksum != "" && checksum != version.Checksum {
+		os.RemoveAll(stagingPath)
+		return fmt.Errorf("restored version %s does not match the checksum recorded for %s", restorePath, version.Path)
+	}
+	if stored {
+		LogWithDatetime(fmt.Sprintf("Restored %s as stored; restore it with -restore to decode it", restorePath), false)
+	}
+	return os.Rename(stagingPath, restorePath)
+}
@@ -0,0 +1,124 @@
+package catapult
+
+import (
+	"context"
+	"database/sql"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// reviseSource rewrites a source file and forgets its recorded checksums, so that its copy is seen as different.
+func reviseSource(t *testing.T, db *sql.DB, file, content string) {
+	t.Helper()
+	if err := os.WriteFile(file, []byte(content), 0644); err != nil {
+		t.Fatalf("Failed to revise source: %v", err)
+	}
+	db.Exec(`UPDATE file_sizes SET checksum = NULL WHERE path = ?`, file)
+	db.Exec(`UPDATE copied_files SET checksum = NULL WHERE file_path = ?`, file)
+}
+
+func TestOverrideKeepsVersions(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+
+	tmpDir := t.TempDir()
+	src := filepath.Join(tmpDir, "src")
+	destination := filepath.Join(tmpDir, "dst")
+	os.MkdirAll(src, 0755)
+	os.MkdirAll(destination, 0755)
+	file := filepath.Join(src, "sample.raw")
+	os.WriteFile(file, []byte("v1"), 0644)
+
+	cfg := Configuration{
+		Name:                "versions",
+		Directories:         []string{src},
+		Destinations:        []string{destination},
+		OverrideIfDifferent: true,
+		Versioning:          VersioningConfig{Keep: 2},
+	}
+	copyFileWithVerification(context.Background(), db, file, src, destination, cfg, math.MaxInt64)
+	for _, content := range []string{"v2", "v3", "v4"} {
+		reviseSource(t, db, file, content)
+		copyFileWithVerification(context.Background(), db, file, src, destination, cfg, math.MaxInt64)
+	}
+
+	copyPath := filepath.Join(destination, "sample.raw")
+	if content, _ := os.ReadFile(copyPath); string(content) != "v4" {
+		t.Fatalf("Copy = %q, want %q", content, "v4")
+	}
+	versions, err := ListVersions(db, file)
+	if err != nil || len(versions) != 2 {
+		t.Fatalf("ListVersions() = %d versions, %v, want 2", len(versions), err)
+	}
+	for i, want := range []string{"v3", "v2"} {
+		content, err := os.ReadFile(versions[i].VersionPath)
+		if err != nil || string(content) != want {
+			t.Fatalf("Version %d = %q, %v, want %q", i, content, err, want)
+		}
+		if !strings.HasPrefix(versions[i].VersionPath, filepath.Join(destination, defaultVersionsDirectory, "sample.raw.")) {
+			t.Fatalf("Unexpected version path %s", versions[i].VersionPath)
+		}
+	}
+	if entries, _ := os.ReadDir(filepath.Join(destination, defaultVersionsDirectory)); len(entries) != 2 {
+		t.Fatalf("Expected the oldest version to be removed, found %d versions", len(entries))
+	}
+
+	restoreDir := filepath.Join(tmpDir, "restore")
+	if err := RestoreVersion(db, versions[0].VersionPath, restoreDir); err != nil {
+		t.Fatalf("RestoreVersion() error: %v", err)
+	}
+	if content, _ := os.ReadFile(filepath.Join(restoreDir, "sample.raw")); string(content) != "v3" {
+		t.Fatalf("Restored %q, want %q", content, "v3")
+	}
+
+	os.WriteFile(versions[1].VersionPath, []byte("v9"), 0644)
+	if err := RestoreVersion(db, versions[1].VersionPath, filepath.Join(tmpDir, "tampered")); err == nil {
+		t.Fatalf("Expected RestoreVersion() to fail for a tampered version")
+	}
+}
+
+func TestOverrideKeepsFolderVersion(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+
+	tmpDir := t.TempDir()
+	src := filepath.Join(tmpDir, "src")
+	folder := filepath.Join(src, "run.d")
+	destination := filepath.Join(tmpDir, "dst")
+	createTestBundle(t, folder)
+	os.MkdirAll(destination, 0755)
+	expected, _ := BuildManifest(folder, ChecksumSHA256, "")
+
+	cfg := Configuration{
+		Name:                "versions",
+		Directories:         []string{src},
+		Destinations:        []string{destination},
+		OverrideIfDifferent: true,
+		Versioning:          VersioningConfig{Keep: 1, Directory: "old"},
+	}
+	copyFileWithVerification(context.Background(), db, folder, src, destination, cfg, math.MaxInt64)
+	reviseSource(t, db, filepath.Join(folder, "a.bin"), "revised")
+	db.Exec(`UPDATE file_sizes SET checksum = NULL WHERE path = ?`, folder)
+	db.Exec(`UPDATE copied_files SET checksum = NULL WHERE file_path = ?`, folder)
+	copyFileWithVerification(context.Background(), db, folder, src, destination, cfg, math.MaxInt64)
+
+	versions, err := ListVersions(db, filepath.Join(destination, "run.d"))
+	if err != nil || len(versions) != 1 || !versions[0].IsFolder {
+		t.Fatalf("ListVersions() = %+v, %v, want one folder version", versions, err)
+	}
+	if !strings.HasPrefix(versions[0].VersionPath, filepath.Join(destination, "old", "run.d.")) {
+		t.Fatalf("Unexpected version path %s", versions[0].VersionPath)
+	}
+
+	restoreDir := filepath.Join(tmpDir, "restore")
+	if err := RestoreVersion(db, versions[0].VersionPath, restoreDir); err != nil {
+		t.Fatalf("RestoreVersion() error: %v", err)
+	}
+	restored, _ := BuildManifest(filepath.Join(restoreDir, "run.d"), ChecksumSHA256, "")
+	if differences := DiffManifests(expected, restored); len(differences) != 0 {
+		t.Fatalf("Restored version differs: %v", differences)
+	}
+}
@@ -5,9 +5,14 @@ go 1.23.0
 require modernc.org/sqlite v1.32.0
 
 require (
+	filippo.io/age v1.2.1
+	github.com/klauspost/compress v1.18.0
 	github.com/schollz/progressbar/v3 v3.14.6
 	github.com/slack-go/slack v0.10.0
-	golang.org/x/sys v0.22.0
+	github.com/zeebo/xxh3 v1.1.0
+	golang.org/x/sys v0.30.0
+	golang.org/x/text v0.22.0
+	lukechampine.com/blake3 v1.4.1
 )
 
 require (
@@ -15,12 +20,14 @@ require (
 	github.com/google/uuid v1.6.0 // indirect
 	github.com/gorilla/websocket v1.4.2 // indirect
 	github.com/hashicorp/golang-lru/v2 v2.0.7 // indirect
+	github.com/klauspost/cpuid/v2 v2.2.10 // indirect
 	github.com/mattn/go-isatty v0.0.20 // indirect
 	github.com/mitchellh/colorstring v0.0.0-20190213212951-d06e56a500db // indirect
 	github.com/ncruces/go-strftime v0.1.9 // indirect
 	github.com/pkg/errors v0.8.0 // indirect
 	github.com/remyoudompheng/bigfft v0.0.0-20230129092748-24d4a6f8daec // indirect
 	github.com/rivo/uniseg v0.4.7 // indirect
+	golang.org/x/crypto v0.24.0 // indirect
 	golang.org/x/term v0.22.0 // indirect
 	modernc.org/gc/v3 v3.0.0-20240107210532-573471604cb6 // indirect
 	modernc.org/libc v1.55.3 // indirect
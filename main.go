@@ -6,7 +6,7 @@ import (
 	"flag"
 	"fmt"
 	"os"
-	"sync"
+	"time"
 
 	"github.com/noatgnu/catapultMirror/catapult"
 )
@@ -15,6 +15,18 @@ func main() {
 	configFile := flag.String("config", "", "Path to the JSON configuration file")
 	dbPath := flag.String("db", "file_sizes.db", "Path to the SQLite database file")
 	logFilePath := flag.String("log", "transfer.log", "Path to the log file")
+	dryRun := flag.Bool("dry-run", false, "Report planned actions without writing to destinations or the database")
+	dryRunOutput := flag.String("dry-run-output", "", "Path to export the dry run plan (.json or .csv)")
+	restore := flag.String("restore", "", "Path of a bundle archive or compressed or encrypted copy to restore and verify against the database")
+	restoreTo := flag.String("restore-to", ".", "Directory to restore a bundle archive, compressed or encrypted copy or version into")
+	identity := flag.String("identity", "", "Path of an age identity file to decrypt encrypted copies with when restoring")
+	versions := flag.String("versions", "", "Path of a copy at a destination, or of its source, to list the kept versions of")
+	restoreVersion := flag.String("restore-version", "", "Path of a kept version to restore and verify against the database")
+	conflicts := flag.Bool("conflicts", false, "List conflicts that are open or have a pending resolution")
+	resolveConflict := flag.Int64("resolve-conflict", 0, "ID of a conflict to resolve with -resolution")
+	resolution := flag.String("resolution", "", "Conflict policy to resolve a conflict with: skip, overwrite, keep_both, newer, larger or quarantine")
+	pruneStore := flag.String("prune-store", "", "Content-addressed destination to remove unreferenced objects from")
+	leaseTimeout := flag.Duration("lease-timeout", catapult.DefaultLeaseTimeout, "How long a destination lease held by another host is honoured without renewal")
 	flag.Parse()
 
 	err := catapult.StartLogger(*logFilePath)
@@ -24,6 +36,109 @@ func main() {
 	}
 	defer catapult.CloseLogger()
 
+	if *restore != "" {
+		readOnlyDB, err := catapult.OpenDBReadOnly(*dbPath)
+		if err != nil {
+			catapult.LogWithDatetime(fmt.Sprintf("Error opening database: %v", err), false)
+			return
+		}
+		if readOnlyDB != nil {
+			defer readOnlyDB.Close()
+		}
+		if err := catapult.Restore(readOnlyDB, *restore, *restoreTo, *identity); err != nil {
+			catapult.LogWithDatetime(fmt.Sprintf("Error restoring %s: %v", *restore, err), false)
+			return
+		}
+		catapult.LogWithDatetime(fmt.Sprintf("Restored %s to %s", *restore, *restoreTo), false)
+		return
+	}
+
+	if *versions != "" || *restoreVersion != "" {
+		readOnlyDB, err := catapult.OpenDBReadOnly(*dbPath)
+		if err != nil {
+			catapult.LogWithDatetime(fmt.Sprintf("Error opening database: %v", err), false)
+			return
+		}
+		if readOnlyDB == nil {
+			catapult.LogWithDatetime(fmt.Sprintf("Database %s does not exist", *dbPath), false)
+			return
+		}
+		defer readOnlyDB.Close()
+		if *versions != "" {
+			kept, err := catapult.ListVersions(readOnlyDB, *versions)
+			if err != nil {
+				catapult.LogWithDatetime(fmt.Sprintf("Error listing versions of %s: %v", *versions, err), false)
+				return
+			}
+			catapult.PrintVersions(kept)
+			return
+		}
+		if err := catapult.RestoreVersion(readOnlyDB, *restoreVersion, *restoreTo); err != nil {
+			catapult.LogWithDatetime(fmt.Sprintf("Error restoring %s: %v", *restoreVersion, err), false)
+			return
+		}
+		catapult.LogWithDatetime(fmt.Sprintf("Restored %s to %s", *restoreVersion, *restoreTo), false)
+		return
+	}
+
+	if *conflicts {
+		readOnlyDB, err := catapult.OpenDBReadOnly(*dbPath)
+		if err != nil {
+			catapult.LogWithDatetime(fmt.Sprintf("Error opening database: %v", err), false)
+			return
+		}
+		if readOnlyDB == nil {
+			catapult.LogWithDatetime(fmt.Sprintf("Database %s does not exist", *dbPath), false)
+			return
+		}
+		defer readOnlyDB.Close()
+		unresolved, err := catapult.ListConflicts(readOnlyDB)
+		if err != nil {
+			catapult.LogWithDatetime(fmt.Sprintf("Error listing conflicts: %v", err), false)
+			return
+		}
+		catapult.PrintConflicts(unresolved)
+		return
+	}
+
+	if *resolveConflict != 0 {
+		db, err := catapult.InitDB(*dbPath)
+		if err != nil {
+			catapult.LogWithDatetime(fmt.Sprintf("Error initializing database: %v", err), false)
+			return
+		}
+		defer db.Close()
+		if err := catapult.ResolveConflict(db, *resolveConflict, *resolution); err != nil {
+			catapult.LogWithDatetime(fmt.Sprintf("Error resolving conflict %d: %v", *resolveConflict, err), false)
+			return
+		}
+		catapult.LogWithDatetime(fmt.Sprintf("Resolved conflict %d with %s", *resolveConflict, *resolution), false)
+		return
+	}
+
+	if *pruneStore != "" {
+		// Pruning holds the database lock, so no copy can link to an object while it is removed.
+		dbLock, err := catapult.AcquireLock(*dbPath+".lock", 0)
+		if err != nil {
+			catapult.LogWithDatetime(fmt.Sprintf("Error locking database: %v", err), false)
+			return
+		}
+		defer dbLock.Release()
+		db, err := catapult.InitDB(*dbPath)
+		if err != nil {
+			catapult.LogWithDatetime(fmt.Sprintf("Error initializing database: %v", err), false)
+			return
+		}
+		defer db.Close()
+		removed, freed, err := catapult.PruneStore(db, *pruneStore)
+		if err != nil {
+			catapult.LogWithDatetime(fmt.Sprintf("Error pruning %s: %v", *pruneStore, err), false)
+			return
+		}
+		catapult.LogWithDatetime(fmt.Sprintf("Pruned %d objects (%d bytes) from %s", removed, freed, *pruneStore), false)
+		return
+	}
+
 	if *configFile == "" {
 		catapult.LogWithDatetime("Usage: catapultMirror -config=<config_file> -db=<db_file> -log=<log_file>", false)
 		return
@@ -45,6 +160,55 @@ func main() {
 		return
 	}
 
+	if *dryRun {
+		readOnlyDB, err := catapult.OpenDBReadOnly(*dbPath)
+		if err != nil {
+			catapult.LogWithDatetime(fmt.Sprintf("Error opening database: %v", err), false)
+			return
+		}
+		if readOnlyDB != nil {
+			defer readOnlyDB.Close()
+		}
+
+		plan, err := catapult.PlanMirror(readOnlyDB, configs)
+		if err != nil {
+			catapult.LogWithDatetime(fmt.Sprintf("Error planning dry run: %v", err), false)
+			return
+		}
+		catapult.PrintPlan(plan)
+		if *dryRunOutput != "" {
+			if err := catapult.ExportPlan(plan, *dryRunOutput); err != nil {
+				catapult.LogWithDatetime(fmt.Sprintf("Error exporting dry run plan: %v", err), false)
+				return
+			}
+			catapult.LogWithDatetime(fmt.Sprintf("Dry run plan exported to %s", *dryRunOutput), false)
+		}
+		return
+	}
+
+	dbLock, err := catapult.AcquireLock(*dbPath+".lock", 0)
+	if err != nil {
+		catapult.LogWithDatetime(fmt.Sprintf("Error locking database: %v", err), false)
+		return
+	}
+	defer dbLock.Release()
+
+	leases, err := catapult.AcquireDestinationLeases(configs, *leaseTimeout)
+	if err != nil {
+		catapult.LogWithDatetime(fmt.Sprintf("Error acquiring destination lease: %v", err), false)
+		return
+	}
+	defer catapult.ReleaseLocks(leases)
+
+	backgroundCtx, stopBackground := context.WithCancel(context.Background())
+	defer stopBackground()
+	go func() {
+		if err := catapult.RenewLocks(backgroundCtx, leases, *leaseTimeout/3); err != nil {
+			catapult.LogWithDatetime(fmt.Sprintf("Destination leases were given up: %v", err), false)
+		}
+	}()
+	go catapult.WatchRateLimits(backgroundCtx, *configFile, 10*time.Second)
+
 	db, err := catapult.InitDB(*dbPath)
 	if err != nil {
 		catapult.LogWithDatetime(fmt.Sprintf("Error initializing database: %v", err), false)
@@ -55,19 +219,8 @@ func main() {
 	// Initialize Slack with the configurations
 	catapult.InitSlack(configs)
 
-	var wg sync.WaitGroup
-
-	for _, config := range configs.Configs {
-		wg.Add(1)
-		go func(config catapult.Configuration) {
-			defer wg.Done()
-
-			ctx, cancel := context.WithCancel(context.Background())
-			defer cancel()
-
-			catapult.MonitorAndMirror(ctx, db, configs)
-		}(config)
-	}
-
-	wg.Wait()
+	// MonitorAndMirror starts the monitor and the scrubber of every configuration, so it runs once.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	catapult.MonitorAndMirror(ctx, db, configs)
 }